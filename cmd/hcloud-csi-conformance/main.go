@@ -0,0 +1,192 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The hcloud-csi-conformance command runs the csi-sanity suite against a
+// deployed plugin, to validate an installation after upgrades. The suite
+// creates, attaches, mounts and deletes real volumes in the project of the
+// plugin.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/kubernetes-csi/csi-test/pkg/sanity"
+	"github.com/kubernetes-csi/csi-test/utils"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/reporters"
+	"github.com/onsi/gomega"
+
+	"github.com/apricote/hcloud-csi-driver/driver"
+)
+
+// driverName is the name the plugin reports, the suite must not be run
+// against the plugin of another driver
+const driverName = "de.apricote.hcloud.csi.volumes"
+
+// pluginDir is the directory of the plugin on the nodes, it's mounted with
+// bidirectional propagation, which the node plugin expects for its mounts
+const pluginDir = "/var/lib/kubelet/plugins/" + driverName
+
+var (
+	// controllerCapabilities must be reported by every plugin, the suite
+	// skips the tests of missing capabilities instead of failing
+	controllerCapabilities = []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+	}
+
+	// snapshotCapabilities are reported if a backup store is configured
+	snapshotCapabilities = []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+	}
+
+	nodeCapabilities = []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+	}
+)
+
+func main() {
+	var (
+		endpoint    = flag.String("endpoint", "unix://"+pluginDir+"/csi.sock", "CSI endpoint of the plugin, it must serve the controller and node services")
+		stagingPath = flag.String("staging-path", pluginDir+"/conformance/staging", "Staging target path of the test volumes, must be on a shared mount")
+		targetPath  = flag.String("target-path", pluginDir+"/conformance/target", "Target path of the test volumes, must be on a shared mount")
+		secretsFile = flag.String("secrets-file", "", "YAML file with the secrets passed to the calls, the plugin doesn't use any")
+		volumeSize  = flag.Int64("volume-size", 10, "Size of the test volumes in GB, at least 10")
+		snapshots   = flag.Bool("snapshots", false, "Expect snapshot support, i.e. the plugin is run with --backup-url")
+		junitReport = flag.String("junit-report", "", "Write a JUnit report of the suite to this file")
+	)
+	flag.Parse()
+
+	if *volumeSize < 10 {
+		log.Fatalln("--volume-size must be at least 10")
+	}
+
+	if err := checkPlugin(*endpoint, *snapshots); err != nil {
+		log.Fatalln(err)
+	}
+
+	sanity.GinkgoTest(&sanity.Config{
+		Address:        *endpoint,
+		StagingPath:    *stagingPath,
+		TargetPath:     *targetPath,
+		SecretsFile:    *secretsFile,
+		TestVolumeSize: *volumeSize * driver.GB,
+	})
+	gomega.RegisterFailHandler(ginkgo.Fail)
+
+	var specReporters []ginkgo.Reporter
+	if *junitReport != "" {
+		specReporters = append(specReporters, reporters.NewJUnitReporter(*junitReport))
+	}
+
+	if !ginkgo.RunSpecsWithDefaultAndCustomReporters(suite{}, "hcloud-csi-driver conformance", specReporters) {
+		os.Exit(1)
+	}
+}
+
+// suite stands in for the testing.T of the suite, whether it passed is
+// returned by ginkgo as well
+type suite struct{}
+
+func (suite) Fail() {}
+
+// checkPlugin verifies that the plugin at endpoint is this driver and reports
+// the expected capabilities. The suite only tests the advertised
+// capabilities, so it would pass for a plugin with some of them missing.
+func checkPlugin(endpoint string, snapshots bool) error {
+	conn, err := utils.Connect(endpoint)
+	if err != nil {
+		return fmt.Errorf("connecting to %s failed: %s", endpoint, err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	identity := csi.NewIdentityClient(conn)
+	info, err := identity.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	if err != nil {
+		return fmt.Errorf("getting the plugin info failed: %s", err)
+	}
+	if info.Name != driverName {
+		return fmt.Errorf("%s serves the plugin %q, expected %q", endpoint, info.Name, driverName)
+	}
+	log.Printf("validating %s %s at %s", info.Name, info.VendorVersion, endpoint)
+
+	var problems []string
+
+	pluginCaps, err := identity.GetPluginCapabilities(ctx, &csi.GetPluginCapabilitiesRequest{})
+	if err != nil {
+		return fmt.Errorf("getting the plugin capabilities failed: %s", err)
+	}
+	servesController := false
+	for _, c := range pluginCaps.Capabilities {
+		if c.GetService().GetType() == csi.PluginCapability_Service_CONTROLLER_SERVICE {
+			servesController = true
+		}
+	}
+	if !servesController {
+		return fmt.Errorf("%s doesn't serve the controller service, run the suite against a plugin in --mode=all", endpoint)
+	}
+
+	controllerCaps, err := csi.NewControllerClient(conn).ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{})
+	if err != nil {
+		return fmt.Errorf("getting the controller capabilities failed: %s", err)
+	}
+	reported := map[csi.ControllerServiceCapability_RPC_Type]bool{}
+	for _, c := range controllerCaps.Capabilities {
+		reported[c.GetRpc().GetType()] = true
+	}
+	expected := controllerCapabilities
+	if snapshots {
+		expected = append(expected, snapshotCapabilities...)
+	}
+	for _, c := range expected {
+		if !reported[c] {
+			problems = append(problems, fmt.Sprintf("controller capability %s is missing", c))
+		}
+	}
+
+	nodeCaps, err := csi.NewNodeClient(conn).NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
+	if err != nil {
+		return fmt.Errorf("getting the node capabilities failed: %s", err)
+	}
+	for _, expected := range nodeCapabilities {
+		found := false
+		for _, c := range nodeCaps.Capabilities {
+			if c.GetRpc().GetType() == expected {
+				found = true
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("node capability %s is missing", expected))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("unexpected capabilities of %s: %s", endpoint, strings.Join(problems, ", "))
+	}
+	return nil
+}
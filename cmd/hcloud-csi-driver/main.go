@@ -21,17 +21,106 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
 
 	"github.com/apricote/hcloud-csi-driver/driver"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			runMigrate(os.Args[2:])
+			return
+		case "move-project":
+			runMoveProject(os.Args[2:])
+			return
+		case "adopt":
+			runAdopt(os.Args[2:])
+			return
+		case "restore":
+			runRestore(os.Args[2:])
+			return
+		case "bench":
+			runBench(os.Args[2:])
+			return
+		case "modify":
+			runModify(os.Args[2:])
+			return
+		case "repair":
+			runRepair(os.Args[2:])
+			return
+		case "diag":
+			runDiag(os.Args[2:])
+			return
+		}
+	}
+
 	var (
 		endpoint = flag.String("endpoint", "unix:///var/lib/kubelet/plugins/de.apricote.hcloud.csi.volumes/csi.sock", "CSI endpoint")
 		token    = flag.String("token", "", "Hetzner Cloud access token")
 		url      = flag.String("url", "https://api.hetzner.cloud/v1", "Hetzner Cloud API URL")
-		hostname = flag.String("hostname", "", "Name of the current node")
+		hostname = flag.String("hostname", "", "Name of the current node, defaults to the hostname of the machine")
+		metadata = flag.Bool("metadata", false, "Look up the server of the node in the metadata service instead of by hostname, falls back to the hostname if it fails")
+		mode     = flag.String("mode", driver.ModeAll, "CSI services to serve: all, controller or node")
 		version  = flag.Bool("version", false, "Print the version and exit.")
+
+		logFormat    = flag.String("log-format", "text", "Format of the log entries: text or json")
+		adminAddress = flag.String("admin-address", "", "TCP address of the admin endpoint serving the state and metrics of the plugin, i.e: :9189. Disabled if empty")
+		costMetrics  = flag.Bool("cost-metrics", false, "Serve the size of the provisioned volumes by StorageClass and PVC namespace on the admin endpoint")
+
+		topologyGranularity = flag.String("topology-granularity", driver.TopologyGranularityLocation, "Granularity of the topology reported for nodes and volumes: location or datacenter")
+		grpcGzip            = flag.Bool("grpc-gzip", false, "Compress the gRPC responses with gzip, the clients must accept gzip encoded responses")
+
+		stagingDirMode = flag.String("staging-dir-mode", "0750", "Permissions of the staging target directories created by the node plugin")
+		publishDirMode = flag.String("publish-dir-mode", "0750", "Permissions of the publish target directories created by the node plugin")
+		nodeJournalDir = flag.String("node-journal-dir", "", "Directory the node plugin records its operations in, to clean up after a crash. Disabled if empty")
+		maxFormats     = flag.Int("max-concurrent-formats", 2, "Number of volumes formatted at the same time, unlimited if negative")
+
+		backupURL             = flag.String("backup-url", "", "Object store for snapshot backups, i.e: s3://endpoint/bucket/prefix or webdav://host/path. Snapshots are disabled if empty")
+		backupAccessKeyID     = flag.String("backup-access-key-id", os.Getenv("BACKUP_ACCESS_KEY_ID"), "Access key id (or WebDAV username) for the backup store, defaults to $BACKUP_ACCESS_KEY_ID")
+		backupSecretAccessKey = flag.String("backup-secret-access-key", os.Getenv("BACKUP_SECRET_ACCESS_KEY"), "Secret access key (or WebDAV password) for the backup store, defaults to $BACKUP_SECRET_ACCESS_KEY")
+		backupEncryptionKey   = flag.String("backup-encryption-key", os.Getenv("BACKUP_ENCRYPTION_KEY"), "Base64 encoded 256 bit key the backup data is encrypted with, defaults to $BACKUP_ENCRYPTION_KEY")
+		backupRegion          = flag.String("backup-region", "", "Region of the S3 compatible backup store")
+		backupSchedule        = flag.Bool("backup-schedule", false, "Create backups of PVCs annotated with a backup schedule")
+		backupConcurrency     = flag.Int("backup-schedule-concurrency", 1, "Maximum number of scheduled backups uploaded at the same time")
+		kubeconfig            = flag.String("kubeconfig", "", "Path to a kubeconfig file, the in-cluster configuration is used if empty")
+
+		dataMover          = flag.String("data-mover", driver.DataMoverLocal, "How backup data is copied: local (on the controller's server) or pod (in helper pods)")
+		dataMoverImage     = flag.String("data-mover-image", "", "Image of the data mover helper pods, must contain this driver")
+		dataMoverNamespace = flag.String("data-mover-namespace", "kube-system", "Namespace of the data mover helper pods")
+		dataMoverSecret    = flag.String("data-mover-secret", "", "Secret with the backup store credentials for the data mover helper pods")
+
+		volumePool       = flag.String("volume-pool", "", "Unattached volumes to keep ready for fast provisioning as size:count pairs in GB, i.e: 10:5,50:2")
+		volumePoolFsType = flag.String("volume-pool-fs-type", "", "Filesystem the pool volumes are formatted with in advance, unformatted if empty")
+		volumePopulator  = flag.Bool("volume-populator", false, "Populate new volumes from the image set in the annotation of their PVC")
+		volumeAutoscale  = flag.Bool("volume-autoscale", false, "Grow the volumes attached to the node once they fill up, as configured by their autoscale labels")
+		clusterID        = flag.String("cluster-id", "", "ID of the cluster added as label to its volumes, required if several clusters share the project")
+		nodeRecovery     = flag.Bool("node-recovery", false, "Detach the volumes of the cluster left attached to replaced or rebuilt nodes, requires --cluster-id")
+		lostVolumeCheck  = flag.Bool("lost-volume-check", false, "Mark the persistent volumes whose volume was deleted outside of the plugin")
+		syncLabels       = flag.Bool("sync-volume-labels", false, "Mirror the labels of the volumes to annotations of their persistent volumes")
+		detachStale      = flag.Bool("detach-stale", false, "Detach volumes from servers that don't need them anymore when they're attached to another node")
+		asyncDetach      = flag.Bool("async-detach", false, "Return from ControllerUnpublishVolume once the detach is accepted, not only once the volume is detached")
+		maxQueuedAttach  = flag.Int("max-queued-attaches", 20, "Number of attaches that may wait for the other operations of a server, unlimited if zero")
+
+		maintenance     = flag.Bool("maintenance", false, "Don't provision or grow volumes, the existing volumes keep working")
+		maintenanceFile = flag.String("maintenance-file", "", "Enable the maintenance mode while this file exists")
+
+		nfsServerImage = flag.String("nfs-server-image", "", "Image of the NFS servers exporting ReadWriteMany volumes, ReadWriteMany is disabled if empty")
+		nfsNamespace   = flag.String("nfs-namespace", "kube-system", "Namespace of the NFS servers")
+
+		mover         = flag.String("mover", "", "Run as data mover helper instead of the plugin: backup, restore, populate, wipe, bench or probe")
+		moverBackupID = flag.String("mover-backup-id", "", "Backup copied by the data mover helper")
+		moverDevice   = flag.String("mover-device", "", "Block device copied by the data mover helper")
+		moverSource   = flag.String("mover-source", "", "Image URL the data mover helper populates the device from")
+
+		moverBenchFsType   = flag.String("mover-bench-fs-type", "ext4", "Filesystem the benchmark of the data mover helper runs on")
+		moverBenchFileSize = flag.Int64("mover-bench-file-size", 1<<30, "Size of the file the benchmark of the data mover helper runs on in bytes")
+		moverBenchDuration = flag.Duration("mover-bench-duration", 30*time.Second, "Runtime of every IO pattern of the benchmark of the data mover helper")
 	)
 	flag.Parse()
 
@@ -40,7 +129,108 @@ func main() {
 		os.Exit(0)
 	}
 
-	drv, err := driver.NewDriver(*endpoint, *token, *url, *hostname)
+	if *mover != "" {
+		err := driver.RunMover(driver.MoverParams{
+			Direction: *mover,
+			BackupID:  *moverBackupID,
+			Device:    *moverDevice,
+			Source:    *moverSource,
+
+			BenchFsType:   *moverBenchFsType,
+			BenchFileSize: *moverBenchFileSize,
+			BenchDuration: *moverBenchDuration,
+
+			BackupURL:             *backupURL,
+			BackupAccessKeyID:     *backupAccessKeyID,
+			BackupSecretAccessKey: *backupSecretAccessKey,
+			BackupRegion:          *backupRegion,
+			BackupEncryptionKey:   *backupEncryptionKey,
+		})
+		if err != nil {
+			log.Fatalln(err)
+		}
+		os.Exit(0)
+	}
+
+	stagingMode, err := parseFileMode(*stagingDirMode)
+	if err != nil {
+		log.Fatalf("invalid --staging-dir-mode: %s", err)
+	}
+
+	publishMode, err := parseFileMode(*publishDirMode)
+	if err != nil {
+		log.Fatalf("invalid --publish-dir-mode: %s", err)
+	}
+
+	pool, err := parseVolumePool(*volumePool)
+	if err != nil {
+		log.Fatalf("invalid --volume-pool: %s", err)
+	}
+
+	logger := logrus.New()
+	switch *logFormat {
+	case "text":
+	case "json":
+		logger.Formatter = &logrus.JSONFormatter{}
+	default:
+		log.Fatalf("invalid --log-format %q, must be text or json", *logFormat)
+	}
+
+	var metadataClient driver.MetadataClient
+	if *metadata {
+		metadataClient = driver.NewMetadataClient(driver.DefaultMetadataURL)
+	}
+
+	drv, err := driver.NewDriver(driver.WithParams(driver.NewDriverParams{
+		Endpoint:            *endpoint,
+		Token:               *token,
+		URL:                 *url,
+		Hostname:            *hostname,
+		Metadata:            metadataClient,
+		Mode:                *mode,
+		TopologyGranularity: *topologyGranularity,
+		GRPCGzip:            *grpcGzip,
+		StagingDirMode:      stagingMode,
+		PublishDirMode:      publishMode,
+		NodeJournalDir:      *nodeJournalDir,
+		AdminAddress:        *adminAddress,
+		CostMetrics:         *costMetrics,
+
+		MaxConcurrentFormats: *maxFormats,
+		MaxQueuedAttaches:    *maxQueuedAttach,
+
+		BackupURL:             *backupURL,
+		BackupAccessKeyID:     *backupAccessKeyID,
+		BackupSecretAccessKey: *backupSecretAccessKey,
+		BackupRegion:          *backupRegion,
+		BackupEncryptionKey:   *backupEncryptionKey,
+
+		BackupSchedule:            *backupSchedule,
+		BackupScheduleConcurrency: *backupConcurrency,
+		Kubeconfig:                *kubeconfig,
+
+		DataMover:          *dataMover,
+		DataMoverImage:     *dataMoverImage,
+		DataMoverNamespace: *dataMoverNamespace,
+		DataMoverSecret:    *dataMoverSecret,
+
+		VolumePool:       pool,
+		VolumePoolFsType: *volumePoolFsType,
+		VolumePopulator:  *volumePopulator,
+		VolumeAutoscale:  *volumeAutoscale,
+		ClusterID:        *clusterID,
+		NodeRecovery:     *nodeRecovery,
+		LostVolumeCheck:  *lostVolumeCheck,
+		SyncVolumeLabels: *syncLabels,
+		DetachStale:      *detachStale,
+		AsyncDetach:      *asyncDetach,
+
+		Maintenance:     *maintenance,
+		MaintenanceFile: *maintenanceFile,
+
+		NFSServerImage: *nfsServerImage,
+		NFSNamespace:   *nfsNamespace,
+	}), driver.WithLogger(logrus.NewEntry(logger)))
 
 	if err != nil {
 		log.Fatalln(err)
@@ -50,3 +240,46 @@ func main() {
 		log.Fatalln(err)
 	}
 }
+
+// parseFileMode parses an octal permission string such as "0750"
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	if mode&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("%q is not a valid permission", s)
+	}
+
+	return os.FileMode(mode), nil
+}
+
+// parseVolumePool parses a list of size:count pairs
+func parseVolumePool(s string) (map[int]int, error) {
+	pool := map[int]int{}
+	if s == "" {
+		return pool, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q must be size:count", pair)
+		}
+
+		size, err := strconv.Atoi(parts[0])
+		if err != nil || size < 10 {
+			return nil, fmt.Errorf("invalid size %q, must be at least 10", parts[0])
+		}
+
+		count, err := strconv.Atoi(parts[1])
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("invalid count %q", parts[1])
+		}
+
+		pool[size] = count
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,328 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apricote/hcloud-csi-driver/driver"
+)
+
+// toolFlags registers the flags shared by all subcommands on fs. The returned
+// function returns their values once fs is parsed.
+func toolFlags(fs *flag.FlagSet) func() driver.ToolParams {
+	var (
+		token      = fs.String("token", os.Getenv("HCLOUD_TOKEN"), "Hetzner Cloud access token, defaults to $HCLOUD_TOKEN")
+		url        = fs.String("url", "https://api.hetzner.cloud/v1", "Hetzner Cloud API URL")
+		kubeconfig = fs.String("kubeconfig", os.Getenv("KUBECONFIG"), "Path to a kubeconfig file, defaults to $KUBECONFIG")
+
+		backupURL             = fs.String("backup-url", "", "Object store for the temporary backups, i.e: s3://endpoint/bucket/prefix or webdav://host/path")
+		backupAccessKeyID     = fs.String("backup-access-key-id", os.Getenv("BACKUP_ACCESS_KEY_ID"), "Access key id (or WebDAV username) for the backup store, defaults to $BACKUP_ACCESS_KEY_ID")
+		backupSecretAccessKey = fs.String("backup-secret-access-key", os.Getenv("BACKUP_SECRET_ACCESS_KEY"), "Secret access key (or WebDAV password) for the backup store, defaults to $BACKUP_SECRET_ACCESS_KEY")
+		backupEncryptionKey   = fs.String("backup-encryption-key", os.Getenv("BACKUP_ENCRYPTION_KEY"), "Base64 encoded 256 bit key the backup data is encrypted with, defaults to $BACKUP_ENCRYPTION_KEY")
+		backupRegion          = fs.String("backup-region", "", "Region of the S3 compatible backup store")
+
+		dataMoverImage     = fs.String("data-mover-image", "", "Image of the data mover helper pods, must contain this driver")
+		dataMoverNamespace = fs.String("data-mover-namespace", "kube-system", "Namespace of the data mover helper pods")
+		dataMoverSecret    = fs.String("data-mover-secret", "", "Secret with the backup store credentials for the data mover helper pods")
+	)
+
+	return func() driver.ToolParams {
+		return driver.ToolParams{
+			Token:      *token,
+			URL:        *url,
+			Kubeconfig: *kubeconfig,
+
+			BackupURL:             *backupURL,
+			BackupAccessKeyID:     *backupAccessKeyID,
+			BackupSecretAccessKey: *backupSecretAccessKey,
+			BackupRegion:          *backupRegion,
+			BackupEncryptionKey:   *backupEncryptionKey,
+
+			DataMoverImage:     *dataMoverImage,
+			DataMoverNamespace: *dataMoverNamespace,
+			DataMoverSecret:    *dataMoverSecret,
+		}
+	}
+}
+
+// runMigrate implements the migrate subcommand
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	params := toolFlags(fs)
+	pv := fs.String("pv", "", "Name of the persistent volume to migrate")
+	location := fs.String("location", "", "Name of the target location, i.e: nbg1")
+	fs.Parse(args)
+
+	if *pv == "" || *location == "" {
+		log.Fatalln("--pv and --location must be provided")
+	}
+
+	err := driver.MigrateVolume(driver.MigrateParams{
+		ToolParams:       params(),
+		PersistentVolume: *pv,
+		Location:         *location,
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// runMoveProject implements the move-project subcommand
+func runMoveProject(args []string) {
+	fs := flag.NewFlagSet("move-project", flag.ExitOnError)
+	params := toolFlags(fs)
+	pv := fs.String("pv", "", "Name of the persistent volume to move")
+	targetToken := fs.String("target-token", os.Getenv("HCLOUD_TARGET_TOKEN"), "Access token of the target project, defaults to $HCLOUD_TARGET_TOKEN")
+	backupID := fs.String("backup-id", "", "Existing backup of the volume to restore instead of creating a new one")
+	fs.Parse(args)
+
+	if *pv == "" || *targetToken == "" {
+		log.Fatalln("--pv and --target-token must be provided")
+	}
+
+	err := driver.MoveVolumeToProject(driver.MoveProjectParams{
+		ToolParams:       params(),
+		PersistentVolume: *pv,
+		TargetToken:      *targetToken,
+		BackupID:         *backupID,
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// runAdopt implements the adopt subcommand
+func runAdopt(args []string) {
+	fs := flag.NewFlagSet("adopt", flag.ExitOnError)
+	params := toolFlags(fs)
+	pv := fs.String("pv", "", "Name of the persistent volume to adopt")
+	dryRun := fs.Bool("dry-run", false, "Only validate that the volume can be adopted")
+	fs.Parse(args)
+
+	if *pv == "" {
+		log.Fatalln("--pv must be provided")
+	}
+
+	err := driver.AdoptVolume(driver.AdoptParams{
+		ToolParams:       params(),
+		PersistentVolume: *pv,
+		DryRun:           *dryRun,
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// runRepair implements the repair subcommand
+func runRepair(args []string) {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	params := toolFlags(fs)
+	pv := fs.String("pv", "", "Name of the persistent volume whose volume was recreated")
+	volume := fs.String("volume", "", "ID or name of the recreated volume, looked up by its labels if empty")
+	checkFilesystem := fs.Bool("check-filesystem", false, "Check in a data mover pod that the volume contains the filesystem of the persistent volume")
+	dryRun := fs.Bool("dry-run", false, "Only validate that the persistent volume can be repaired")
+	fs.Parse(args)
+
+	if *pv == "" {
+		log.Fatalln("--pv must be provided")
+	}
+
+	err := driver.RepairVolume(driver.RepairParams{
+		ToolParams:       params(),
+		PersistentVolume: *pv,
+		Volume:           *volume,
+		CheckFilesystem:  *checkFilesystem,
+		DryRun:           *dryRun,
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// runRestore implements the restore subcommand
+func runRestore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	params := toolFlags(fs)
+	backupID := fs.String("backup-id", "", "Backup (or snapshot) to restore")
+	name := fs.String("name", "", "Name of the new volume and persistent volume, defaults to restore-<backup id>")
+	location := fs.String("location", "", "Name of the location of the new volume, defaults to the location of the source volume")
+	size := fs.Int("size", 0, "Size of the new volume in GB, defaults to the size of the backup")
+	fsType := fs.String("fs-type", "ext4", "Filesystem of the backup")
+	storageClass := fs.String("storage-class", "", "Storage class of the persistent volume")
+	claim := fs.String("claim", "", "PVC the persistent volume is bound to, i.e: default/data")
+	fs.Parse(args)
+
+	if *backupID == "" {
+		log.Fatalln("--backup-id must be provided")
+	}
+
+	var claimNamespace, claimName string
+	if *claim != "" {
+		parts := strings.SplitN(*claim, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			log.Fatalln("--claim must be given as namespace/name")
+		}
+		claimNamespace, claimName = parts[0], parts[1]
+	}
+
+	err := driver.RestoreVolume(driver.RestoreParams{
+		ToolParams:     params(),
+		BackupID:       *backupID,
+		Name:           *name,
+		Location:       *location,
+		Size:           *size,
+		FsType:         *fsType,
+		StorageClass:   *storageClass,
+		ClaimNamespace: claimNamespace,
+		ClaimName:      claimName,
+		Output:         os.Stdout,
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// runBench implements the bench subcommand
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	params := toolFlags(fs)
+	location := fs.String("location", "", "Name of the location the scratch volume is created in, i.e: nbg1")
+	size := fs.Int("size", 10, "Size of the scratch volume in GB")
+	volumeID := fs.Int("volume-id", 0, "Existing detached volume to benchmark instead of a scratch volume, it must not be used by a persistent volume")
+	fsType := fs.String("fs-type", "ext4", "Filesystem the volume is formatted with, if it's not formatted yet")
+	fileSize := fs.Int("file-size", 1024, "Size of the file the benchmark runs on in MB")
+	duration := fs.Duration("duration", 30*time.Second, "Runtime of every IO pattern")
+	fs.Parse(args)
+
+	if *location == "" && *volumeID == 0 {
+		log.Fatalln("--location or --volume-id must be provided")
+	}
+
+	err := driver.BenchVolume(driver.BenchParams{
+		ToolParams: params(),
+		Location:   *location,
+		Size:       *size,
+		VolumeID:   *volumeID,
+		FsType:     *fsType,
+		FileSize:   int64(*fileSize) << 20,
+		Duration:   *duration,
+		Output:     os.Stdout,
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// runModify implements the modify subcommand
+func runModify(args []string) {
+	fs := flag.NewFlagSet("modify", flag.ExitOnError)
+	params := toolFlags(fs)
+	pv := fs.String("pv", "", "Name of the persistent volume to modify")
+	labels := fs.String("labels", "", "Labels to set on the volume, i.e: autoscaleMax=100,team=data")
+	removeLabels := fs.String("remove-labels", "", "Labels to remove from the volume, i.e: autoscaleMax,team")
+	deleteProtection := fs.String("delete-protection", "", "Enable (true) or disable (false) the delete protection of the volume, unchanged if empty")
+	fs.Parse(args)
+
+	if *pv == "" {
+		log.Fatalln("--pv must be provided")
+	}
+
+	set := map[string]string{}
+	if *labels != "" {
+		for _, pair := range strings.Split(*labels, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				log.Fatalf("invalid label %q, must be given as key=value", pair)
+			}
+			set[parts[0]] = parts[1]
+		}
+	}
+
+	var remove []string
+	if *removeLabels != "" {
+		remove = strings.Split(*removeLabels, ",")
+	}
+
+	var protection *bool
+	if *deleteProtection != "" {
+		v, err := strconv.ParseBool(*deleteProtection)
+		if err != nil {
+			log.Fatalf("invalid --delete-protection %q, must be true or false", *deleteProtection)
+		}
+		protection = &v
+	}
+
+	err := driver.ModifyVolume(driver.ModifyParams{
+		ToolParams:       params(),
+		PersistentVolume: *pv,
+		Labels:           set,
+		RemoveLabels:     remove,
+		DeleteProtection: protection,
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// runDiag implements the diag subcommand
+func runDiag(args []string) {
+	fs := flag.NewFlagSet("diag", flag.ExitOnError)
+	params := toolFlags(fs)
+	namespace := fs.String("namespace", "kube-system", "Namespace of the plugin pods")
+	selector := fs.String("selector", driver.DefaultDiagSelector, "Label selector of the plugin pods")
+	logLines := fs.Int64("log-lines", 1000, "Number of log lines added per container")
+	journalDir := fs.String("node-journal-dir", "", "Node operation journal to add, when run on a node")
+	output := fs.String("output", "", "File the bundle is written to, defaults to hcloud-csi-diag-<time>.tar.gz, - for stdout")
+	fs.Parse(args)
+
+	out := os.Stdout
+	name := *output
+	if name == "" {
+		name = fmt.Sprintf("hcloud-csi-diag-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+	}
+	if name != "-" {
+		f, err := os.Create(name)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	err := driver.CollectDiagnostics(driver.DiagParams{
+		ToolParams: params(),
+		Namespace:  *namespace,
+		Selector:   *selector,
+		LogLines:   *logLines,
+		JournalDir: *journalDir,
+		Output:     out,
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if name != "-" {
+		fmt.Fprintf(os.Stderr, "diagnostics bundle written to %s\n", name)
+	}
+}
@@ -0,0 +1,269 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	drivererrors "github.com/apricote/hcloud-csi-driver/driver/errors"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// actionPollInterval defines how often the running actions are checked
+	actionPollInterval = time.Second
+
+	// actionsPerRequest is the number of actions fetched with one request
+	actionsPerRequest = 25
+
+	// actionTimeout is how long waitAction waits for an action
+	actionTimeout = time.Minute
+)
+
+// actionWatcher polls the actions waited for by waitAction. All running
+// actions are fetched with as few requests as possible, so many concurrent
+// operations (i.e. when a StatefulSet is scaled up) share the API rate limit
+// instead of each polling its own action. The zero value is usable, the
+// polling goroutine runs while there are actions to wait for.
+type actionWatcher struct {
+	mu      sync.Mutex
+	waiters map[int][]chan error
+	polling bool
+}
+
+// add registers a waiter for the action. The returned channel receives nil
+// once the action succeeded, or its error.
+func (w *actionWatcher) add(d *Driver, actionID int) chan error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.waiters == nil {
+		w.waiters = map[int][]chan error{}
+	}
+
+	done := make(chan error, 1)
+	w.waiters[actionID] = append(w.waiters[actionID], done)
+
+	if !w.polling {
+		w.polling = true
+		go d.pollActions()
+	}
+	return done
+}
+
+// remove unregisters the waiter, i.e. after it timed out
+func (w *actionWatcher) remove(actionID int, done chan error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	waiters := w.waiters[actionID]
+	for i, ch := range waiters {
+		if ch == done {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+
+	if len(waiters) == 0 {
+		delete(w.waiters, actionID)
+	} else {
+		w.waiters[actionID] = waiters
+	}
+}
+
+// pending returns the IDs of the actions waited for. If there are none, the
+// polling stops.
+func (w *actionWatcher) pending() []int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.waiters) == 0 {
+		w.polling = false
+		return nil
+	}
+
+	ids := make([]int, 0, len(w.waiters))
+	for id := range w.waiters {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// finish notifies the waiters of the action
+func (w *actionWatcher) finish(actionID int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, done := range w.waiters[actionID] {
+		done <- err
+	}
+	delete(w.waiters, actionID)
+}
+
+// pollActions checks the actions waited for until there are none left
+func (d *Driver) pollActions() {
+	ll := d.log.WithField("component", "action_watcher")
+
+	ticker := time.NewTicker(actionPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ids := d.actionWatcher.pending()
+		if len(ids) == 0 {
+			return
+		}
+
+		for len(ids) > 0 {
+			n := len(ids)
+			if n > actionsPerRequest {
+				n = actionsPerRequest
+			}
+
+			actions, err := d.actionsByID(ids[:n])
+			if err != nil {
+				ll.WithError(err).Info("waiting for actions errored")
+			}
+			for _, action := range actions {
+				ll.WithFields(logrus.Fields{
+					"action_id":     action.ID,
+					"action_status": action.Status,
+				}).Info("action received")
+
+				switch action.Status {
+				case hcloud.ActionStatusSuccess:
+					d.actionWatcher.finish(action.ID, nil)
+				case hcloud.ActionStatusError:
+					err := action.Error()
+					if err == nil {
+						err = fmt.Errorf("action %d failed", action.ID)
+					}
+					d.actionWatcher.finish(action.ID, err)
+				}
+			}
+
+			ids = ids[n:]
+		}
+	}
+}
+
+// actionsByID returns the actions with the given IDs
+func (d *Driver) actionsByID(ids []int) ([]*hcloud.Action, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	actions, _, err := d.actions.ListByID(ctx, ids)
+	return actions, err
+}
+
+// runningVolumeActions returns the actions of the volume that are still
+// running
+func (d *Driver) runningVolumeActions(ctx context.Context, volumeID int) ([]*hcloud.Action, error) {
+	actions, _, err := d.actions.ListForVolume(ctx, volumeID, hcloud.ActionStatusRunning)
+	if err != nil {
+		return nil, err
+	}
+
+	var running []*hcloud.Action
+	for _, a := range actions {
+		if a.Status == hcloud.ActionStatusRunning {
+			running = append(running, a)
+		}
+	}
+	return running, nil
+}
+
+// actionClient implements ActionService with plain requests, the API client
+// we use doesn't support filtering actions yet
+type actionClient struct {
+	client *hcloud.Client
+}
+
+// ListByID returns the actions with the given IDs
+func (c *actionClient) ListByID(ctx context.Context, ids []int) ([]*hcloud.Action, *hcloud.Response, error) {
+	query := url.Values{}
+	for _, id := range ids {
+		query.Add("id", strconv.Itoa(id))
+	}
+	return c.list(ctx, "/actions?"+query.Encode())
+}
+
+// ListForVolume returns the actions of the volume with the given status
+func (c *actionClient) ListForVolume(ctx context.Context, volumeID int, status hcloud.ActionStatus) ([]*hcloud.Action, *hcloud.Response, error) {
+	return c.list(ctx, fmt.Sprintf("/volumes/%d/actions?status=%s", volumeID, status))
+}
+
+func (c *actionClient) list(ctx context.Context, path string) ([]*hcloud.Action, *hcloud.Response, error) {
+	req, err := c.client.NewRequest(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var body schema.ActionListResponse
+	resp, err := c.client.Do(req, &body)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	actions := make([]*hcloud.Action, 0, len(body.Actions))
+	for _, a := range body.Actions {
+		actions = append(actions, hcloud.ActionFromSchema(a))
+	}
+	return actions, resp, nil
+}
+
+// settleVolume waits for the actions of the volume that are still running,
+// i.e. an attach started before the controller restarted, and returns the
+// volume in its current state. Starting another action instead would fail
+// while the volume is locked. The volume is returned as is if nothing is
+// running or the actions can't be listed.
+func (d *Driver) settleVolume(ctx context.Context, vol *hcloud.Volume, ll *logrus.Entry) (*hcloud.Volume, error) {
+	actions, err := d.runningVolumeActions(ctx, vol.ID)
+	if err != nil {
+		ll.WithError(err).Warn("could not list the running actions of the volume")
+		return vol, nil
+	}
+
+	if len(actions) == 0 {
+		return vol, nil
+	}
+
+	for _, action := range actions {
+		ll.WithFields(logrus.Fields{
+			"action_id":      action.ID,
+			"action_command": action.Command,
+		}).Info("waiting for running action of the volume")
+		if err := d.waitAction(ctx, vol.ID, action.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	settled, _, err := d.volumes.GetByID(ctx, vol.ID)
+	if err != nil {
+		return nil, err
+	}
+	if settled == nil {
+		return nil, drivererrors.Errorf(drivererrors.ErrVolumeNotFound, "volume %d not found, it was deleted", vol.ID)
+	}
+	return settled, nil
+}
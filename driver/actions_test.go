@@ -0,0 +1,153 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	"github.com/sirupsen/logrus"
+)
+
+func TestWaitActionBatched(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		resp := &schema.ActionListResponse{}
+		for _, v := range r.URL.Query()["id"] {
+			id, _ := strconv.Atoi(v)
+			status := hcloud.ActionStatusSuccess
+			if id == 0 {
+				status = hcloud.ActionStatusError
+			}
+			resp.Actions = append(resp.Actions, schema.Action{ID: id, Status: string(status)})
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer ts.Close()
+
+	d := &Driver{
+		actions: &actionClient{client: hcloud.NewClient(hcloud.WithEndpoint(ts.URL))},
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2*actionsPerRequest)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = d.waitAction(context.Background(), i, i)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if i == 0 && err == nil {
+			t.Error("waitAction() returned no error for a failed action")
+		}
+		if i > 0 && err != nil {
+			t.Errorf("waitAction() for action %d: %s", i, err)
+		}
+	}
+
+	// usually two requests, more if the waiters were added across polls
+	if n := atomic.LoadInt32(&requests); n > 6 {
+		t.Errorf("expected the actions to be fetched together, got %d requests", n)
+	}
+}
+
+// fakeActions reports the actions in running as running until they're
+// fetched by ID
+type fakeActions struct {
+	mu      sync.Mutex
+	running map[int][]int // action IDs by volume ID
+	fetched []int
+}
+
+func (f *fakeActions) ListByID(ctx context.Context, ids []int) ([]*hcloud.Action, *hcloud.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var actions []*hcloud.Action
+	for _, id := range ids {
+		f.fetched = append(f.fetched, id)
+		actions = append(actions, &hcloud.Action{ID: id, Status: hcloud.ActionStatusSuccess})
+	}
+	return actions, nil, nil
+}
+
+func (f *fakeActions) ListForVolume(ctx context.Context, volumeID int, status hcloud.ActionStatus) ([]*hcloud.Action, *hcloud.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var actions []*hcloud.Action
+	for _, id := range f.running[volumeID] {
+		actions = append(actions, &hcloud.Action{ID: id, Status: hcloud.ActionStatusRunning, Command: "attach_volume"})
+	}
+	return actions, nil, nil
+}
+
+func TestSettleVolume(t *testing.T) {
+	api := &fakeAPI{
+		t: t,
+		volumes: map[int]*schema.Volume{
+			1: {ID: 1, Name: "pvc-1", Size: 10},
+			2: {ID: 2, Name: "pvc-2", Size: 10},
+		},
+		servers: map[int]*schema.Server{},
+	}
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	client := hcloud.NewClient(hcloud.WithEndpoint(ts.URL))
+	actions := &fakeActions{running: map[int][]int{1: {101, 102}}}
+	d := &Driver{
+		volumes: &client.Volume,
+		actions: actions,
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+
+	for _, id := range []int{1, 2} {
+		vol, err := d.settleVolume(context.Background(), &hcloud.Volume{ID: id}, d.log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vol.ID != id {
+			t.Errorf("expected volume %d, got %d", id, vol.ID)
+		}
+	}
+
+	actions.mu.Lock()
+	defer actions.mu.Unlock()
+	fetched := map[int]bool{}
+	for _, id := range actions.fetched {
+		fetched[id] = true
+	}
+	if len(fetched) != 2 || !fetched[101] || !fetched[102] {
+		t.Errorf("expected the running actions 101 and 102 to be waited for, got %v", actions.fetched)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// adminState is the state of the plugin served at /state
+type adminState struct {
+	Version     string              `json:"version"`
+	Commit      string              `json:"commit"`
+	Mode        string              `json:"mode"`
+	Ready       bool                `json:"ready"`
+	Maintenance bool                `json:"maintenance"`
+	Problems    []string            `json:"problems"`
+	Operations  []operationProgress `json:"operations"`
+}
+
+// serveAdmin serves the admin endpoint on the admin address until the driver
+// is stopped
+func (d *Driver) serveAdmin() error {
+	listener, err := net.Listen("tcp", d.adminAddress)
+	if err != nil {
+		return fmt.Errorf("failed to listen on admin address: %v", err)
+	}
+
+	d.adminSrv = &http.Server{Handler: d.adminHandler()}
+	go func() {
+		if err := d.adminSrv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			d.log.WithError(err).Error("admin endpoint failed")
+		}
+	}()
+
+	d.log.WithField("admin_addr", listener.Addr().String()).Info("admin endpoint started")
+	return nil
+}
+
+// adminHandler returns the handler of the admin endpoint: /state returns the
+// state of the plugin and its long-running operations as JSON, /metrics
+// returns metrics in the Prometheus text format
+func (d *Driver) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(d.adminState()); err != nil {
+			d.log.WithError(err).Warn("could not write admin state")
+		}
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, m := range d.metrics() {
+			m.write(w)
+		}
+	})
+	return mux
+}
+
+func (d *Driver) adminState() adminState {
+	d.readyMu.Lock()
+	ready := d.ready
+	d.readyMu.Unlock()
+
+	return adminState{
+		Version:     version,
+		Commit:      commit,
+		Mode:        d.mode,
+		Ready:       ready,
+		Maintenance: d.inMaintenance(),
+		Problems:    d.prober.degraded(),
+		Operations:  d.progress.operations(),
+	}
+}
+
+// metrics returns the metrics served at /metrics
+func (d *Driver) metrics() []*metricFamily {
+	ratio := newMetricFamily("hcloud_csi_operation_progress_ratio", "gauge", "Copied part of the bytes of the current phase of a long-running operation")
+	done := newMetricFamily("hcloud_csi_operation_done_bytes", "gauge", "Copied bytes of the current phase of a long-running operation")
+	total := newMetricFamily("hcloud_csi_operation_total_bytes", "gauge", "Bytes to copy in the current phase of a long-running operation, 0 if it has no byte progress")
+	updated := newMetricFamily("hcloud_csi_operation_last_progress_timestamp_seconds", "gauge", "Time of the last progress of a long-running operation")
+	stalled := newMetricFamily("hcloud_csi_operation_stalled", "gauge", "Whether a long-running operation made no progress for 10 minutes")
+
+	for _, op := range d.progress.operations() {
+		labels := []string{"kind", op.Kind, "id", op.ID, "phase", op.Phase}
+		ratio.add(op.Ratio(), labels...)
+		done.add(float64(op.Done), labels...)
+		total.add(float64(op.Total), labels...)
+		updated.add(float64(op.Updated.Unix()), labels...)
+
+		s := 0.0
+		if op.Stalled {
+			s = 1
+		}
+		stalled.add(s, labels...)
+	}
+
+	metrics := append([]*metricFamily{ratio, done, total, updated, stalled}, d.detachMetrics()...)
+	return append(metrics, d.costCollector.metrics()...)
+}
+
+// labelValueEscaper escapes the label values of the Prometheus text format
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricFamily is a metric in the Prometheus text format
+type metricFamily struct {
+	name, typ, help string
+	samples         []metricSample
+}
+
+type metricSample struct {
+	// labels are pairs of label names and values
+	labels []string
+	value  float64
+}
+
+func newMetricFamily(name, typ, help string) *metricFamily {
+	return &metricFamily{name: name, typ: typ, help: help}
+}
+
+// add adds a sample with the given label names and values
+func (m *metricFamily) add(value float64, labels ...string) {
+	m.samples = append(m.samples, metricSample{labels: labels, value: value})
+}
+
+// write writes the metric with its samples sorted by labels
+func (m *metricFamily) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.typ)
+
+	lines := make([]string, 0, len(m.samples))
+	for _, s := range m.samples {
+		var labels []string
+		for i := 0; i+1 < len(s.labels); i += 2 {
+			labels = append(labels, fmt.Sprintf(`%s="%s"`, s.labels[i], labelValueEscaper.Replace(s.labels[i+1])))
+		}
+
+		line := m.name
+		if len(labels) > 0 {
+			line += "{" + strings.Join(labels, ",") + "}"
+		}
+		lines = append(lines, line+" "+strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+	sort.Strings(lines)
+
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestAdminHandler(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	d := &Driver{mode: ModeController, log: log.WithField("test", t.Name()), ready: true}
+	r := d.progress.start(operationBackup, "b1", d.log)
+	r.phase("uploading", 1000)
+	r.update(250)
+
+	ts := httptest.NewServer(d.adminHandler())
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL + "/state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var state adminState
+	if err := json.NewDecoder(res.Body).Decode(&state); err != nil {
+		t.Fatal(err)
+	}
+	if !state.Ready || state.Mode != ModeController || len(state.Operations) != 1 || state.Operations[0].Done != 250 {
+		t.Errorf("unexpected state %+v", state)
+	}
+
+	res, err = ts.Client().Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE hcloud_csi_operation_progress_ratio gauge",
+		`hcloud_csi_operation_progress_ratio{kind="backup",id="b1",phase="uploading"} 0.25`,
+		`hcloud_csi_operation_total_bytes{kind="backup",id="b1",phase="uploading"} 1000`,
+		`hcloud_csi_operation_stalled{kind="backup",id="b1",phase="uploading"} 0`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("expected %q in the metrics, got:\n%s", line, body)
+		}
+	}
+}
+
+// TestRunAdminAddressInUse checks Run doesn't leave the background
+// controllers and the CSI socket behind if the admin endpoint can't be
+// started
+func TestRunAdminAddressInUse(t *testing.T) {
+	used, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer used.Close()
+
+	dir, err := ioutil.TempDir("", "hcloud-csi-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	d := &Driver{
+		endpoint:     "unix://" + filepath.Join(dir, "csi.sock"),
+		mode:         ModeController,
+		adminAddress: used.Addr().String(),
+		log:          log.WithField("test", t.Name()),
+	}
+	d.prober = newHealthProber(d)
+
+	if err := d.Run(); err == nil {
+		t.Fatal("expected Run to fail with the admin address in use")
+	}
+
+	if d.stopCh != nil || d.srv != nil {
+		t.Error("expected the background controllers and the server not to be started")
+	}
+	if conn, err := net.Dial("unix", filepath.Join(dir, "csi.sock")); err == nil {
+		conn.Close()
+		t.Error("expected the CSI socket to be closed")
+	}
+}
+
+func TestMetricFamilyEscaping(t *testing.T) {
+	m := newMetricFamily("test_metric", "gauge", "Test")
+	m.add(1, "name", "a \"quoted\"\\value\n")
+
+	var out strings.Builder
+	m.write(&out)
+
+	want := "# HELP test_metric Test\n# TYPE test_metric gauge\n" + `test_metric{name="a \"quoted\"\\value\n"} 1` + "\n"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
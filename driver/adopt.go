@@ -0,0 +1,178 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// labelAdoptedFrom is added to adopted volumes and contains the name of the
+// CSI driver that provisioned them
+const labelAdoptedFrom = "adoptedFrom"
+
+// AdoptParams defines the parameters of AdoptVolume
+type AdoptParams struct {
+	ToolParams
+
+	// PersistentVolume is the name of the PV to adopt
+	PersistentVolume string
+	// DryRun only validates that the volume can be adopted
+	DryRun bool
+}
+
+// AdoptVolume hands the volume of a PV provisioned by another hcloud CSI
+// driver over to this driver. The volume is labeled like the volumes created
+// by this driver, the PV is replaced by one referencing the volume with this
+// driver and the PVC is recreated. The data isn't copied, the original PV is
+// retained and can be deleted afterwards.
+//
+// All pods using the PVC must be stopped before, so the volume is detached.
+// At least one ready node running this driver must be in the location of the
+// volume, so it can be attached again.
+func AdoptVolume(p AdoptParams) error {
+	d, err := newAPIToolDriver(p.ToolParams)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	ll := d.log.WithFields(logrus.Fields{
+		"pv_name": p.PersistentVolume,
+		"dry_run": p.DryRun,
+		"method":  "adopt_volume",
+	})
+
+	pv, err := d.kubeClient.CoreV1().PersistentVolumes().Get(p.PersistentVolume, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("could not get persistent volume %q: %s", p.PersistentVolume, err)
+	}
+
+	if pv.Spec.CSI == nil {
+		return fmt.Errorf("persistent volume %q is not provisioned by a CSI driver", pv.Name)
+	}
+	if pv.Spec.CSI.Driver == driverName {
+		return fmt.Errorf("persistent volume %q is provisioned by %s already", pv.Name, driverName)
+	}
+
+	ref := pv.Spec.ClaimRef
+	if ref == nil || pv.Status.Phase != corev1.VolumeBound {
+		return fmt.Errorf("persistent volume %q is not bound", pv.Name)
+	}
+
+	pvc, err := d.kubeClient.CoreV1().PersistentVolumeClaims(ref.Namespace).Get(ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("could not get persistent volume claim %s/%s: %s", ref.Namespace, ref.Name, err)
+	}
+
+	vol, err := d.adoptableVolume(ctx, pv.Spec.CSI.VolumeHandle)
+	if err != nil {
+		return err
+	}
+
+	ll = ll.WithFields(logrus.Fields{
+		"volume_id":   vol.ID,
+		"from_driver": pv.Spec.CSI.Driver,
+	})
+
+	if p.DryRun {
+		ll.Info("volume can be adopted")
+		return nil
+	}
+
+	labels := map[string]string{}
+	for k, v := range vol.Labels {
+		labels[k] = v
+	}
+	labels["createdBy"] = createdByHCloud
+	labels[labelPVCName] = pvc.Name
+	labels[labelPVCNamespace] = pvc.Namespace
+	labels[labelAdoptedFrom] = pv.Spec.CSI.Driver
+
+	ll.Info("labeling volume")
+	if _, _, err := d.volumes.Update(ctx, vol, hcloud.VolumeUpdateOpts{Labels: labels}); err != nil {
+		return fmt.Errorf("could not label volume %d: %s", vol.ID, err)
+	}
+
+	ll.Info("replacing persistent volume")
+	newPV, err := d.replaceVolume(pv, pvc, fmt.Sprintf("%s-adopted", pv.Name), func(pv *corev1.PersistentVolume) {
+		pv.Spec.CSI.Driver = driverName
+		pv.Spec.CSI.VolumeHandle = strconv.Itoa(vol.ID)
+		pv.Spec.CSI.VolumeAttributes = nil
+		pv.Spec.NodeAffinity = locationAffinity(vol.Location.Name)
+	})
+	if err != nil {
+		return err
+	}
+
+	ll.WithField("new_pv_name", newPV.Name).Info("volume adopted, the original persistent volume is retained")
+	return nil
+}
+
+// adoptableVolume returns the volume with the given handle of another driver
+// if it can be attached by this driver. Handles are either volume ids or
+// names.
+func (d *Driver) adoptableVolume(ctx context.Context, handle string) (*hcloud.Volume, error) {
+	var vol *hcloud.Volume
+	var err error
+	if id, convErr := strconv.Atoi(handle); convErr == nil {
+		vol, _, err = d.volumes.GetByID(ctx, id)
+	} else {
+		vol, _, err = d.volumes.GetByName(ctx, handle)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if vol == nil {
+		return nil, fmt.Errorf("volume %q not found, it might belong to another project", handle)
+	}
+
+	if vol.Server != nil {
+		return nil, fmt.Errorf("volume %d is attached to server %d, stop all pods using it first", vol.ID, vol.Server.ID)
+	}
+
+	if _, err := d.nodeInLocation(ctx, vol.Location); err != nil {
+		return nil, fmt.Errorf("volume %d can't be attached: %s", vol.ID, err)
+	}
+
+	return vol, nil
+}
+
+// locationAffinity returns the node affinity of a PV in the given location
+func locationAffinity(location string) *corev1.VolumeNodeAffinity {
+	return &corev1.VolumeNodeAffinity{
+		Required: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{
+				{
+					MatchExpressions: []corev1.NodeSelectorRequirement{
+						{
+							Key:      topologyLocation,
+							Operator: corev1.NodeSelectorOpIn,
+							Values:   []string{location},
+						},
+					},
+				},
+			},
+		},
+	}
+}
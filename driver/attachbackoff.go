@@ -0,0 +1,104 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// attachBackoffBase is the delay after the first failed attach of a
+	// volume. It's doubled with every further failure up to
+	// attachBackoffMax.
+	attachBackoffBase = 10 * time.Second
+	attachBackoffMax  = 10 * time.Minute
+
+	// attachCircuitFailures is the number of failed attaches in a row after
+	// which the volume is considered broken. Further attaches are rejected
+	// for attachCircuitOpen, then a single attempt is let through again.
+	attachCircuitFailures = 5
+	attachCircuitOpen     = time.Hour
+)
+
+// attachBackoff tracks the failed attaches of the volumes the plugin attaches
+// itself to copy their data. A volume that can't be attached is retried with
+// increasing delays, so a broken volume doesn't keep the data mover busy.
+// The zero value is usable.
+type attachBackoff struct {
+	mu       sync.Mutex
+	failures map[int]attachFailures
+}
+
+type attachFailures struct {
+	count   int
+	retryAt time.Time
+}
+
+// allow returns whether the volume may be attached. If not, it returns the
+// time of the next attempt.
+func (b *attachBackoff) allow(volumeID int, now time.Time) (bool, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	f, ok := b.failures[volumeID]
+	if !ok || !now.Before(f.retryAt) {
+		return true, time.Time{}
+	}
+	return false, f.retryAt
+}
+
+// failed records a failed attach of the volume and returns the number of
+// failures in a row
+func (b *attachBackoff) failed(volumeID int, now time.Time) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures == nil {
+		b.failures = map[int]attachFailures{}
+	}
+
+	f := b.failures[volumeID]
+	f.count++
+	f.retryAt = now.Add(attachDelay(f.count))
+	b.failures[volumeID] = f
+	return f.count
+}
+
+// succeeded resets the failures of the volume
+func (b *attachBackoff) succeeded(volumeID int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.failures, volumeID)
+}
+
+// attachDelay returns the delay after the given number of failures in a row.
+// Up to a fifth is added as jitter, so the jobs of volumes that failed
+// together don't retry together.
+func attachDelay(failures int) time.Duration {
+	if failures >= attachCircuitFailures {
+		return attachCircuitOpen
+	}
+
+	delay := attachBackoffBase << uint(failures-1)
+	if delay > attachBackoffMax {
+		delay = attachBackoffMax
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay/5)+1))
+}
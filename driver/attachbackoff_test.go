@@ -0,0 +1,71 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAttachBackoff(t *testing.T) {
+	var b attachBackoff
+	now := time.Now()
+
+	if ok, _ := b.allow(1, now); !ok {
+		t.Fatal("allow() rejected a volume without failures")
+	}
+
+	b.failed(1, now)
+	if ok, _ := b.allow(1, now.Add(attachBackoffBase/2)); ok {
+		t.Error("allow() accepted an attach during the backoff")
+	}
+	if ok, _ := b.allow(1, now.Add(2*attachBackoffBase)); !ok {
+		t.Error("allow() rejected an attach after the backoff")
+	}
+	if ok, _ := b.allow(2, now); !ok {
+		t.Error("allow() rejected another volume")
+	}
+
+	for i := 1; i < attachCircuitFailures; i++ {
+		b.failed(1, now)
+	}
+	if ok, _ := b.allow(1, now.Add(attachBackoffMax+attachBackoffMax/5+time.Second)); ok {
+		t.Error("allow() accepted an attach while the circuit is open")
+	}
+	if ok, _ := b.allow(1, now.Add(attachCircuitOpen)); !ok {
+		t.Error("allow() rejected an attach after the circuit was open")
+	}
+
+	b.succeeded(1)
+	if ok, _ := b.allow(1, now); !ok {
+		t.Error("allow() rejected a volume after a successful attach")
+	}
+}
+
+func TestAttachDelay(t *testing.T) {
+	for failures := 1; failures < attachCircuitFailures; failures++ {
+		min := attachBackoffBase << uint(failures-1)
+		if min > attachBackoffMax {
+			min = attachBackoffMax
+		}
+
+		delay := attachDelay(failures)
+		if delay < min || delay > min+min/5 {
+			t.Errorf("attachDelay(%d) = %s, want between %s and %s", failures, delay, min, min+min/5)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// attachCacheTTL is how long an attachment is remembered. Volumes can be
+	// detached outside of the plugin, so it's kept short.
+	attachCacheTTL = 30 * time.Second
+
+	// publishDevicePath is the key of the device path of the volume in the
+	// publish info returned by ControllerPublishVolume
+	publishDevicePath = "devicePath"
+)
+
+// attachCache remembers the volumes ControllerPublishVolume found attached,
+// so the retries of the attacher are answered without calling the API. All
+// detaches done by the plugin forget the volume. The zero value is usable.
+type attachCache struct {
+	mu      sync.Mutex
+	entries map[int]attachCacheEntry
+}
+
+type attachCacheEntry struct {
+	serverID int
+	device   string
+	added    time.Time
+}
+
+// add remembers that the volume is attached to the server
+func (c *attachCache) add(volumeID, serverID int, device string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = map[int]attachCacheEntry{}
+	}
+	c.entries[volumeID] = attachCacheEntry{serverID: serverID, device: device, added: now}
+}
+
+// get returns the device path of the volume if it's known to be attached to
+// the server
+func (c *attachCache) get(volumeID, serverID int, now time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[volumeID]
+	if !ok || e.serverID != serverID {
+		return "", false
+	}
+	if now.Sub(e.added) > attachCacheTTL {
+		delete(c.entries, volumeID)
+		return "", false
+	}
+	return e.device, true
+}
+
+// forget removes the volume from the cache
+func (c *attachCache) forget(volumeID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, volumeID)
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAttachCache(t *testing.T) {
+	var c attachCache
+	now := time.Now()
+
+	if _, ok := c.get(1, 10, now); ok {
+		t.Fatal("empty cache returned an attachment")
+	}
+
+	c.add(1, 10, "/dev/disk/by-id/scsi-0HC_Volume_1", now)
+
+	device, ok := c.get(1, 10, now.Add(attachCacheTTL/2))
+	if !ok || device != "/dev/disk/by-id/scsi-0HC_Volume_1" {
+		t.Errorf("get() = %q, %t, want the device of the attachment", device, ok)
+	}
+
+	if _, ok := c.get(1, 11, now); ok {
+		t.Error("get() returned the attachment for another server")
+	}
+
+	if _, ok := c.get(1, 10, now.Add(2*attachCacheTTL)); ok {
+		t.Error("get() returned an expired attachment")
+	}
+
+	c.add(1, 10, "/dev/disk/by-id/scsi-0HC_Volume_1", now)
+	c.forget(1)
+	if _, ok := c.get(1, 10, now); ok {
+		t.Error("get() returned a forgotten attachment")
+	}
+}
@@ -0,0 +1,308 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// labelAutoscaleMax enables growing the volume once its filesystem fills
+	// up, up to the given size in GB. Like the other autoscale labels, it's
+	// copied from the StorageClass parameter of the same name.
+	labelAutoscaleMax = "autoscaleMax"
+
+	// labelAutoscaleThreshold is the fill level in percent at which the
+	// volume is grown, defaultAutoscaleThreshold if not set
+	labelAutoscaleThreshold = "autoscaleThreshold"
+
+	// labelAutoscaleStep is the number of GB the volume is grown by,
+	// defaultAutoscaleStep if not set
+	labelAutoscaleStep = "autoscaleStep"
+
+	defaultAutoscaleThreshold = 90
+	defaultAutoscaleStep      = 10
+
+	// maxVolumeSizeInGB is the maximum size of a Hetzner Cloud Volume
+	maxVolumeSizeInGB = 10240
+
+	// volumeAutoscaleInterval defines how often the fill level of the
+	// volumes is checked
+	volumeAutoscaleInterval = time.Minute
+)
+
+// autoscaleLabels are the labels copied from the StorageClass parameters
+var autoscaleLabels = []string{labelAutoscaleMax, labelAutoscaleThreshold, labelAutoscaleStep}
+
+// autoscaleConfig defines when and how far a volume is grown
+type autoscaleConfig struct {
+	max       int // GB
+	threshold int // percent
+	step      int // GB
+}
+
+// parseAutoscaleConfig parses the autoscale labels or parameters. It returns
+// nil if autoscaling is not enabled.
+func parseAutoscaleConfig(values map[string]string) (*autoscaleConfig, error) {
+	if values[labelAutoscaleMax] == "" {
+		return nil, nil
+	}
+
+	c := &autoscaleConfig{
+		threshold: defaultAutoscaleThreshold,
+		step:      defaultAutoscaleStep,
+	}
+
+	fields := []struct {
+		key      string
+		value    *int
+		min, max int
+	}{
+		{labelAutoscaleMax, &c.max, 1, maxVolumeSizeInGB},
+		{labelAutoscaleThreshold, &c.threshold, 1, 99},
+		{labelAutoscaleStep, &c.step, 1, maxVolumeSizeInGB},
+	}
+
+	for _, f := range fields {
+		v, ok := values[f.key]
+		if !ok {
+			continue
+		}
+
+		n, err := strconv.Atoi(v)
+		if err != nil || n < f.min || n > f.max {
+			return nil, fmt.Errorf("%s must be a number between %d and %d, got %q", f.key, f.min, f.max, v)
+		}
+		*f.value = n
+	}
+
+	return c, nil
+}
+
+// validateAutoscaleParams checks the autoscale parameters of a StorageClass
+func validateAutoscaleParams(params map[string]string) error {
+	if _, err := parseAutoscaleConfig(params); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return nil
+}
+
+// volumeAutoscaler grows the volumes attached to the node once their
+// filesystem crosses the configured fill level. It replaces volume expansion
+// via the CO, which requires a newer CSI spec version than the plugin
+// implements (v0.3).
+type volumeAutoscaler struct {
+	d   *Driver
+	log *logrus.Entry
+}
+
+// newVolumeAutoscaler returns a new volumeAutoscaler for the given driver
+func newVolumeAutoscaler(d *Driver) *volumeAutoscaler {
+	return &volumeAutoscaler{
+		d:   d,
+		log: d.log.WithField("component", "volume_autoscaler"),
+	}
+}
+
+// run checks the volumes until stopCh is closed
+func (a *volumeAutoscaler) run(stopCh <-chan struct{}) {
+	a.log.Info("volume autoscaler started")
+
+	ticker := time.NewTicker(volumeAutoscaleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			a.log.Info("volume autoscaler stopped")
+			return
+		case <-ticker.C:
+			a.check(context.Background())
+		}
+	}
+}
+
+// check grows all volumes of the node that need more space
+func (a *volumeAutoscaler) check(ctx context.Context) {
+	if a.d.inMaintenance() {
+		a.log.Info("skipping check in maintenance mode")
+		return
+	}
+
+	serverID, err := strconv.Atoi(a.d.nodeID)
+	if err != nil {
+		a.log.WithError(err).Error("invalid node id")
+		return
+	}
+
+	// only the volumes attached to the server are fetched, instead of all
+	// autoscaled volumes of the project on every node
+	server, _, err := a.d.servers.GetByID(ctx, serverID)
+	if err != nil || server == nil {
+		a.log.WithError(err).Error("could not get the server of the node")
+		return
+	}
+
+	for _, attached := range server.Volumes {
+		vol, _, err := a.d.volumes.GetByID(ctx, attached.ID)
+		if err != nil {
+			a.log.WithError(err).WithField("volume_id", attached.ID).Error("could not get attached volume")
+			continue
+		}
+		if vol == nil || vol.Labels[labelAutoscaleMax] == "" || vol.Server == nil || vol.Server.ID != serverID {
+			continue
+		}
+
+		ll := a.log.WithField("volume_id", vol.ID)
+
+		c, err := parseAutoscaleConfig(vol.Labels)
+		if err != nil {
+			ll.WithError(err).Warn("invalid autoscale labels")
+			continue
+		}
+
+		if err := a.checkVolume(ctx, vol, c); err != nil {
+			ll.WithError(err).Error("could not autoscale volume")
+		}
+	}
+}
+
+// checkVolume grows the volume if its filesystem is filled above the
+// threshold
+func (a *volumeAutoscaler) checkVolume(ctx context.Context, vol *hcloud.Volume, c *autoscaleConfig) error {
+	target, fsType, ok := a.d.nodeVolumes.mount(vol.LinuxDevice)
+	if !ok {
+		var err error
+		target, fsType, err = deviceMount(vol.LinuxDevice)
+		if err != nil {
+			return err
+		}
+	}
+	if target == "" {
+		return nil // not staged yet
+	}
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(target, &st); err != nil {
+		return fmt.Errorf("could not get filesystem usage of %q: %s", target, err)
+	}
+	if st.Blocks == 0 {
+		return nil
+	}
+
+	used := int((st.Blocks - st.Bfree) * 100 / st.Blocks)
+	ll := a.log.WithFields(logrus.Fields{
+		"volume_id":         vol.ID,
+		"used_percent":      used,
+		"threshold_percent": c.threshold,
+		"size_giga_bytes":   vol.Size,
+	})
+
+	if used < c.threshold {
+		return nil
+	}
+
+	// a resize started before a restart might still be running, grow the
+	// filesystem once it's done instead of resizing again
+	settled, err := a.d.settleVolume(ctx, vol, ll)
+	if err != nil {
+		return err
+	}
+	if settled.Size != vol.Size {
+		ll.WithField("new_size_giga_bytes", settled.Size).Info("volume was grown already")
+		a.d.formatCache.forget(vol.LinuxDevice)
+		return resizeFilesystem(vol.LinuxDevice, target, fsType)
+	}
+
+	if vol.Size >= c.max {
+		ll.Warn("volume is filled above the threshold, but has reached its maximum size")
+		return nil
+	}
+
+	size := vol.Size + c.step
+	if size > c.max {
+		size = c.max
+	}
+
+	ll.WithField("new_size_giga_bytes", size).Info("growing volume")
+	action, _, err := a.d.volumes.Resize(ctx, vol, size)
+	if err != nil {
+		return fmt.Errorf("could not resize volume to %d GB: %s", size, err)
+	}
+
+	if action != nil {
+		if err := a.d.waitAction(ctx, vol.ID, action.ID); err != nil {
+			return err
+		}
+	}
+
+	a.d.formatCache.forget(vol.LinuxDevice)
+	return resizeFilesystem(vol.LinuxDevice, target, fsType)
+}
+
+// deviceMount returns a mount point and the filesystem of the given device.
+// The target is empty if the device isn't mounted.
+func deviceMount(device string) (string, string, error) {
+	out, err := exec.Command("findmnt", "-o", "TARGET,FSTYPE", "-S", device, "-J").CombinedOutput()
+	if err != nil {
+		// findmnt exits with non zero exit status if it couldn't find anything
+		if strings.TrimSpace(string(out)) == "" {
+			return "", "", nil
+		}
+		return "", "", fmt.Errorf("could not find mounts of %q: %v output: %q", device, err, string(out))
+	}
+
+	var resp findmntResponse
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return "", "", fmt.Errorf("couldn't unmarshal data: %q: %s", string(out), err)
+	}
+
+	if len(resp.FileSystems) == 0 {
+		return "", "", nil
+	}
+	return resp.FileSystems[0].Target, resp.FileSystems[0].FsType, nil
+}
+
+// resizeFilesystem grows the mounted filesystem to the size of its device
+func resizeFilesystem(device, target, fsType string) error {
+	var cmd *exec.Cmd
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		cmd = exec.Command("resize2fs", device)
+	case "xfs":
+		cmd = exec.Command("xfs_growfs", target)
+	default:
+		return fmt.Errorf("growing %s filesystems is not supported", fsType)
+	}
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("resizing the filesystem failed: %v output: %q", err, string(out))
+	}
+	return nil
+}
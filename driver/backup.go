@@ -0,0 +1,515 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	drivererrors "github.com/apricote/hcloud-csi-driver/driver/errors"
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Hetzner Cloud Volumes don't support snapshots natively. Snapshots are
+// therefore implemented as backups: the content of the volume's block device
+// is compressed and streamed to an object storage. Every backup is stored as
+//
+//   <id>/manifest.json       metadata of the backup, see backupManifest
+//   <id>/data/000000.gz      gzip compressed chunks of the block device
+//   <id>/data/000001.gz
+//   ...
+//
+// The manifest is updated after every chunk, so an interrupted backup
+// continues with the first missing chunk. The data is copied by a dataMover.
+
+const (
+	backupManifestKey = "manifest.json"
+	backupDataPrefix  = "data/"
+
+	// backupFormatChunkedGzip is the format of the backup data, a copy of
+	// the whole block device split into gzip compressed chunks
+	backupFormatChunkedGzip = "raw+gzip-chunked"
+
+	// backupChunkSize is the uncompressed size of a chunk
+	backupChunkSize = 256 * MB
+
+	backupStatusUploading = "uploading"
+	backupStatusReady     = "ready"
+	backupStatusFailed    = "failed"
+
+	// deviceWaitTimeout defines how long to wait for the device of an
+	// attached volume to appear
+	deviceWaitTimeout = time.Minute
+)
+
+var (
+	// errObjectNotFound is returned by an objectStore if an object doesn't
+	// exist
+	errObjectNotFound = errors.New("object not found")
+
+	// backupIDRegexp defines the valid backup ids. They're used as part of
+	// the object keys.
+	backupIDRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,127}$`)
+)
+
+// objectStore stores backups
+type objectStore interface {
+	// Put stores the content of r under the given key
+	Put(ctx context.Context, key string, r io.Reader) error
+
+	// Get returns the content stored under the given key. It returns
+	// errObjectNotFound if it doesn't exist.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// Delete deletes the given key. It's not an error if it doesn't exist.
+	Delete(ctx context.Context, key string) error
+
+	// List returns the names of the "directories" directly below prefix
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// newObjectStore returns the objectStore for the given backup URL. Supported
+// are S3 compatible object storages (s3://endpoint/bucket/prefix) and WebDAV
+// servers such as Hetzner Storage Boxes (webdav://host/path). Append "+http"
+// to the scheme to use plain HTTP.
+func newObjectStore(rawurl, accessKey, secretKey, region string) (objectStore, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup url: %s", err)
+	}
+
+	scheme := "https"
+	kind := u.Scheme
+	if strings.HasSuffix(kind, "+http") {
+		scheme = "http"
+		kind = strings.TrimSuffix(kind, "+http")
+	}
+
+	endpoint := &url.URL{Scheme: scheme, Host: u.Host}
+
+	switch kind {
+	case "s3":
+		parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("backup url %q doesn't contain a bucket", rawurl)
+		}
+
+		prefix := ""
+		if len(parts) == 2 && parts[1] != "" {
+			prefix = parts[1] + "/"
+		}
+
+		return newS3Store(endpoint, parts[0], prefix, region, accessKey, secretKey), nil
+	case "webdav":
+		endpoint.Path = u.Path
+		return newWebDAVStore(endpoint, accessKey, secretKey), nil
+	default:
+		return nil, fmt.Errorf("unsupported backup url scheme %q, must be one of s3, s3+http, webdav, webdav+http", u.Scheme)
+	}
+}
+
+// backupManifest contains the metadata of a backup
+type backupManifest struct {
+	ID               string    `json:"id"`
+	SourceVolumeID   string    `json:"sourceVolumeId"`
+	SourceVolumeName string    `json:"sourceVolumeName"`
+	SizeBytes        int64     `json:"sizeBytes"`
+	CreatedAt        time.Time `json:"createdAt"`
+	Format           string    `json:"format"`
+	Status           string    `json:"status"`
+	Error            string    `json:"error,omitempty"`
+	StoredBytes      int64     `json:"storedBytes,omitempty"`
+	// Group identifies the backups created together by createBackupGroup
+	Group string `json:"group,omitempty"`
+	// Retention defines when the backup is pruned, it's kept forever if nil
+	Retention *backupRetention `json:"retention,omitempty"`
+	// Encryption is the cipher the data is encrypted with, empty if it's not
+	// encrypted. KeyID identifies the key.
+	Encryption string `json:"encryption,omitempty"`
+	KeyID      string `json:"keyId,omitempty"`
+
+	// ChunkSize is the uncompressed size of every chunk but the last one,
+	// Chunks is the number of chunks that are stored already
+	ChunkSize int64 `json:"chunkSize"`
+	Chunks    int   `json:"chunks"`
+}
+
+// copy returns a copy of the manifest that can be changed independently
+func (m *backupManifest) copy() *backupManifest {
+	c := *m
+	if m.Retention != nil {
+		retention := *m.Retention
+		c.Retention = &retention
+	}
+	return &c
+}
+
+// totalChunks returns the number of chunks of the complete backup
+func (m *backupManifest) totalChunks() int {
+	return int((m.SizeBytes + m.ChunkSize - 1) / m.ChunkSize)
+}
+
+// copiedBytes returns the uncompressed size of the first n chunks
+func (m *backupManifest) copiedBytes(n int) int64 {
+	copied := int64(n) * m.ChunkSize
+	if copied > m.SizeBytes {
+		return m.SizeBytes
+	}
+	return copied
+}
+
+// chunkKey returns the object key of the chunk with the given index
+func (m *backupManifest) chunkKey(i int) string {
+	return fmt.Sprintf("%s/%s%06d.gz", m.ID, backupDataPrefix, i)
+}
+
+// snapshot returns the CSI representation of the backup
+func (m *backupManifest) snapshot() *csi.Snapshot {
+	st := &csi.SnapshotStatus{}
+	switch m.Status {
+	case backupStatusReady:
+		st.Type = csi.SnapshotStatus_READY
+	case backupStatusUploading:
+		st.Type = csi.SnapshotStatus_UPLOADING
+	case backupStatusFailed:
+		st.Type = csi.SnapshotStatus_ERROR_UPLOADING
+		st.Details = m.Error
+	}
+
+	return &csi.Snapshot{
+		Id:             m.ID,
+		SourceVolumeId: m.SourceVolumeID,
+		SizeBytes:      m.SizeBytes,
+		CreatedAt:      m.CreatedAt.UnixNano(),
+		Status:         st,
+	}
+}
+
+// createBackup starts the backup of the given volume. It's idempotent, if the
+// backup exists already the existing manifest is returned. Errors are gRPC
+// status errors.
+func (d *Driver) createBackup(ctx context.Context, id, sourceVolumeID string, retention *backupRetention) (*backupManifest, error) {
+	manifest, vol, err := d.lookupBackup(ctx, id, sourceVolumeID)
+	if err != nil {
+		return nil, err
+	}
+
+	if vol == nil {
+		return manifest, nil
+	}
+
+	// the manifest of an interrupted upload is kept, so the upload resumes
+	// with the first missing chunk
+	if manifest == nil {
+		manifest = newBackupManifest(id, vol, "", time.Now().UTC(), retention)
+		setEncryption(manifest, d.backups)
+		if err := d.putBackup(ctx, manifest); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	d.startBackup(vol, manifest)
+	return manifest, nil
+}
+
+// createBackupGroup starts the backups of a group of volumes, given as backup
+// id to source volume id. All volumes are checked before any backup is
+// started, and all backups share the same creation time. It's idempotent
+// like createBackup.
+//
+// The backups are consistent with each other if the volumes are detached.
+// Otherwise they're only started at about the same time, they're not
+// crash-consistent across the volumes.
+func (d *Driver) createBackupGroup(ctx context.Context, group string, backups map[string]string, retention *backupRetention) error {
+	type member struct {
+		id       string
+		manifest *backupManifest
+		vol      *hcloud.Volume
+	}
+
+	var members []member
+	for id, sourceVolumeID := range backups {
+		manifest, vol, err := d.lookupBackup(ctx, id, sourceVolumeID)
+		if err != nil {
+			return err
+		}
+
+		if vol != nil {
+			members = append(members, member{id: id, manifest: manifest, vol: vol})
+		}
+	}
+
+	now := time.Now().UTC()
+	for i, m := range members {
+		if m.manifest != nil {
+			continue
+		}
+
+		members[i].manifest = newBackupManifest(m.id, m.vol, group, now, retention)
+		setEncryption(members[i].manifest, d.backups)
+		if err := d.putBackup(ctx, members[i].manifest); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	for _, m := range members {
+		d.startBackup(m.vol, m.manifest)
+	}
+	return nil
+}
+
+// lookupBackup returns the manifest of an existing backup and the volume to
+// back up. The volume is nil if the backup is finished or running already.
+// Errors are gRPC status errors.
+func (d *Driver) lookupBackup(ctx context.Context, id, sourceVolumeID string) (*backupManifest, *hcloud.Volume, error) {
+	manifest, err := d.getBackup(ctx, id)
+	if err != nil {
+		return nil, nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if manifest != nil {
+		if manifest.SourceVolumeID != sourceVolumeID {
+			return nil, nil, status.Errorf(codes.AlreadyExists,
+				"snapshot %q exists already for a different source volume %q", id, manifest.SourceVolumeID)
+		}
+
+		// an interrupted upload (i.e: the plugin was restarted) is started
+		// again
+		if manifest.Status != backupStatusUploading || d.backupRunning(manifest.ID) {
+			d.log.WithFields(logrus.Fields{
+				"backup_id": id,
+				"status":    manifest.Status,
+			}).Info("backup already created")
+			return manifest, nil, nil
+		}
+	}
+
+	volumeID, err := strconv.Atoi(sourceVolumeID)
+	if err != nil {
+		return nil, nil, drivererrors.Errorf(drivererrors.ErrVolumeNotFound, "volume %q not found", sourceVolumeID)
+	}
+
+	vol, _, err := d.volumes.GetByID(ctx, volumeID)
+	if err != nil {
+		return nil, nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if vol == nil {
+		return nil, nil, drivererrors.Errorf(drivererrors.ErrVolumeNotFound, "volume %q not found", sourceVolumeID)
+	}
+
+	if err := d.mover.Check(vol); err != nil {
+		return nil, nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	return manifest, vol, nil
+}
+
+// newBackupManifest returns the manifest of a new backup of the volume
+func newBackupManifest(id string, vol *hcloud.Volume, group string, createdAt time.Time, retention *backupRetention) *backupManifest {
+	return &backupManifest{
+		ID:               id,
+		SourceVolumeID:   strconv.Itoa(vol.ID),
+		SourceVolumeName: vol.Name,
+		SizeBytes:        int64(vol.Size * GB),
+		CreatedAt:        createdAt,
+		Format:           backupFormatChunkedGzip,
+		Status:           backupStatusUploading,
+		ChunkSize:        backupChunkSize,
+		Group:            group,
+		Retention:        retention,
+	}
+}
+
+// getBackup returns the manifest of the backup with the given id. It returns
+// nil if the backup doesn't exist.
+func (d *Driver) getBackup(ctx context.Context, id string) (*backupManifest, error) {
+	return getManifest(ctx, d.backups, id)
+}
+
+// putBackup stores the given manifest
+func (d *Driver) putBackup(ctx context.Context, m *backupManifest) error {
+	return putManifest(ctx, d.backups, m)
+}
+
+// getManifest reads the manifest of the backup with the given id from the
+// store. It returns nil if the backup doesn't exist.
+func getManifest(ctx context.Context, store objectStore, id string) (*backupManifest, error) {
+	r, err := store.Get(ctx, id+"/"+backupManifestKey)
+	if err == errObjectNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var m backupManifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("couldn't decode manifest of backup %q: %s", id, err)
+	}
+
+	return &m, nil
+}
+
+// putManifest writes the given manifest to the store
+func putManifest(ctx context.Context, store objectStore, m *backupManifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return store.Put(ctx, m.ID+"/"+backupManifestKey, bytes.NewReader(data))
+}
+
+// listBackups returns the manifests of all backups
+func (d *Driver) listBackups(ctx context.Context) ([]*backupManifest, error) {
+	ids, err := d.backups.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var manifests []*backupManifest
+	for _, id := range ids {
+		m, err := d.getBackup(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		// directory without a manifest, i.e: a backup that was deleted
+		// partially
+		if m == nil {
+			continue
+		}
+
+		manifests = append(manifests, m)
+	}
+
+	return manifests, nil
+}
+
+// deleteBackup deletes the data and manifest of the given backup
+func (d *Driver) deleteBackup(ctx context.Context, id string) error {
+	m, err := d.getBackup(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	if m != nil {
+		for i := 0; i < m.totalChunks(); i++ {
+			keys = append(keys, m.chunkKey(i))
+		}
+	}
+	keys = append(keys, id+"/"+backupDataPrefix, id+"/"+backupManifestKey, id+"/")
+
+	for _, key := range keys {
+		if err := d.backups.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupRunning returns true if a backup with the given id is currently
+// being uploaded by this driver instance
+func (d *Driver) backupRunning(id string) bool {
+	d.backupsMu.Lock()
+	defer d.backupsMu.Unlock()
+	_, ok := d.backupJobs[id]
+	return ok
+}
+
+// volumeBackupRunning returns true if any backup of the given volume is
+// currently being uploaded by this driver instance
+func (d *Driver) volumeBackupRunning(volumeID string) bool {
+	d.backupsMu.Lock()
+	defer d.backupsMu.Unlock()
+	for _, v := range d.backupJobs {
+		if v == volumeID {
+			return true
+		}
+	}
+	return false
+}
+
+// runningBackups returns the number of backups currently being uploaded by
+// this driver instance
+func (d *Driver) runningBackups() int {
+	d.backupsMu.Lock()
+	defer d.backupsMu.Unlock()
+	return len(d.backupJobs)
+}
+
+// startBackup starts uploading the content of the volume in the background.
+// The stored manifest is updated once the backup finished or failed. The
+// backup works on a copy of the given manifest, which the caller keeps
+// reading (i.e. CreateSnapshot returns it), so its state is only published
+// through the store.
+func (d *Driver) startBackup(vol *hcloud.Volume, manifest *backupManifest) {
+	d.backupsMu.Lock()
+	if _, ok := d.backupJobs[manifest.ID]; ok {
+		d.backupsMu.Unlock()
+		return
+	}
+	d.backupJobs[manifest.ID] = manifest.SourceVolumeID
+	d.backupsMu.Unlock()
+
+	m := manifest.copy()
+	go func() {
+		defer func() {
+			d.backupsMu.Lock()
+			delete(d.backupJobs, m.ID)
+			d.backupsMu.Unlock()
+		}()
+
+		ll := d.log.WithFields(logrus.Fields{
+			"backup_id": m.ID,
+			"volume_id": vol.ID,
+			"method":    "backup",
+		})
+
+		ctx := context.Background()
+
+		ll.WithField("chunks", m.Chunks).Info("backup started")
+		if err := d.mover.Backup(ctx, vol, m); err != nil {
+			ll.WithError(err).Error("backup failed")
+			m.Status = backupStatusFailed
+			m.Error = err.Error()
+		} else {
+			ll.WithField("stored_bytes", m.StoredBytes).Info("backup finished")
+			m.Status = backupStatusReady
+		}
+
+		if err := d.putBackup(ctx, m); err != nil {
+			ll.WithError(err).Error("storing backup manifest failed")
+		}
+	}()
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	"github.com/sirupsen/logrus"
+)
+
+// runningMover updates the manifest like a backup. It finishes with err
+// once release is closed, right away if it's nil.
+type runningMover struct {
+	fakeMover
+	err     error
+	release chan struct{}
+}
+
+func (r *runningMover) Backup(ctx context.Context, vol *hcloud.Volume, m *backupManifest) error {
+	m.Chunks++
+	m.StoredBytes += 1024
+	if r.release != nil {
+		<-r.release
+	}
+	return r.err
+}
+
+// TestCreateSnapshotWhileRunning checks CreateSnapshot doesn't share the
+// manifest with the running backup, run it with -race
+func TestCreateSnapshotWhileRunning(t *testing.T) {
+	cases := []struct {
+		name    string
+		err     error
+		release chan struct{}
+		want    string
+	}{
+		{"running", nil, make(chan struct{}), backupStatusReady},
+		{"failing right away", errors.New("device not found"), nil, backupStatusFailed},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			api := &fakeAPI{
+				t:       t,
+				volumes: map[int]*schema.Volume{1: {ID: 1, Name: "pvc-1", Size: 10}},
+				servers: map[int]*schema.Server{},
+			}
+			ts := httptest.NewServer(api)
+			defer ts.Close()
+
+			// the logger would order the accesses of the backup and the
+			// calls, hiding the race from the detector
+			log := logrus.New()
+			log.Out = ioutil.Discard
+			log.SetLevel(logrus.PanicLevel)
+			log.SetNoLock()
+			client := hcloud.NewClient(hcloud.WithEndpoint(ts.URL))
+			d := &Driver{
+				hcloudClient: client,
+				volumes:      &client.Volume,
+				servers:      &client.Server,
+				actions:      &actionClient{client: client},
+				backups:      newMemStore(),
+				backupJobs:   map[string]string{},
+				mover:        &runningMover{err: c.err, release: c.release},
+				log:          log.WithField("test_enabled", true),
+			}
+
+			// retries read the snapshot while the backup runs
+			req := &csi.CreateSnapshotRequest{Name: "snap-1", SourceVolumeId: "1"}
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					resp, err := d.CreateSnapshot(context.Background(), req)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if resp.Snapshot.Id != req.Name {
+						t.Errorf("expected snapshot %q, got %q", req.Name, resp.Snapshot.Id)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if c.release != nil {
+				close(c.release)
+			}
+			deadline := time.Now().Add(10 * time.Second)
+			for d.backupRunning(req.Name) {
+				if time.Now().After(deadline) {
+					t.Fatal("backup did not finish")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			m, err := d.getBackup(context.Background(), req.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Status != c.want || m.Chunks != 1 {
+				t.Errorf("expected the stored manifest to be %s with 1 chunk, got %s with %d chunks", c.want, m.Status, m.Chunks)
+			}
+		})
+	}
+}
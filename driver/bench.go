@@ -0,0 +1,426 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unsafe"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// labelBench marks the scratch volumes created by BenchVolume
+	labelBench = "bench"
+
+	// benchFileName is the name of the file the benchmark runs on, in the
+	// root of the filesystem of the volume
+	benchFileName = ".hcloud-csi-bench"
+
+	// benchAlignment is the alignment of the buffers and offsets required
+	// for direct IO
+	benchAlignment = 4 * KB
+)
+
+// BenchParams defines the parameters of BenchVolume
+type BenchParams struct {
+	ToolParams
+
+	// Location is the name of the location the scratch volume is created in
+	Location string
+	// Size is the size of the scratch volume in GB
+	Size int
+	// VolumeID optionally selects an existing detached volume that's not
+	// bound to a PV, instead of creating a scratch volume. Its filesystem is
+	// kept, the benchmark runs on a temporary file.
+	VolumeID int
+	// FsType is the filesystem the volume is formatted with, if it's not
+	// formatted yet, and mounted with
+	FsType string
+	// FileSize is the size of the file the benchmark runs on in bytes
+	FileSize int64
+	// Duration is the runtime of every IO pattern
+	Duration time.Duration
+
+	// Output receives the results
+	Output io.Writer
+}
+
+// benchConfig defines how the IO patterns of a benchmark are run
+type benchConfig struct {
+	FileSize int64
+	Duration time.Duration
+}
+
+// benchPattern is an IO pattern of the benchmark, modeled after the common fio
+// jobs: one request at a time with the given block size
+type benchPattern struct {
+	Name      string
+	BlockSize int64
+	Random    bool
+	Write     bool
+}
+
+var benchPatterns = []benchPattern{
+	{Name: "seq-write", BlockSize: MB, Write: true},
+	{Name: "seq-read", BlockSize: MB},
+	{Name: "rand-write", BlockSize: 4 * KB, Random: true, Write: true},
+	{Name: "rand-read", BlockSize: 4 * KB, Random: true},
+}
+
+// benchResult is the result of running a benchPattern
+type benchResult struct {
+	Pattern    string        `json:"pattern"`
+	BlockSize  int64         `json:"blockSize"`
+	Ops        int           `json:"ops"`
+	Duration   time.Duration `json:"duration"`
+	AvgLatency time.Duration `json:"avgLatency"`
+	P99Latency time.Duration `json:"p99Latency"`
+}
+
+// IOPS returns the number of operations per second
+func (r *benchResult) IOPS() float64 {
+	return float64(r.Ops) / r.Duration.Seconds()
+}
+
+// Throughput returns the number of bytes transferred per second
+func (r *benchResult) Throughput() float64 {
+	return float64(int64(r.Ops)*r.BlockSize) / r.Duration.Seconds()
+}
+
+// BenchVolume measures the performance of a volume. It runs common IO
+// patterns in a data mover helper pod, on a filesystem formatted and mounted
+// like the node plugin stages volumes, and writes the IOPS, throughput and
+// latencies to p.Output.
+//
+// Unless an existing volume is selected, a scratch volume is created in the
+// given location and deleted afterwards. The helper pod runs on a ready node
+// in the location of the volume.
+func BenchVolume(p BenchParams) error {
+	if p.DataMoverImage == "" {
+		return fmt.Errorf("a data mover image is required to run the benchmark")
+	}
+
+	d, err := newAPIToolDriver(p.ToolParams)
+	if err != nil {
+		return err
+	}
+	mover := newToolPodMover(d, p.ToolParams)
+	d.mover = mover
+
+	ctx := context.Background()
+	ll := d.log.WithFields(logrus.Fields{
+		"method": "bench_volume",
+	})
+
+	var vol *hcloud.Volume
+	if p.VolumeID != 0 {
+		vol, err = d.unboundVolume(ctx, p.VolumeID)
+		if err != nil {
+			return err
+		}
+	} else {
+		vol, err = d.createBenchVolume(ctx, p.Location, p.Size)
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			if _, err := d.volumes.Delete(context.Background(), vol); err != nil {
+				ll.WithError(err).WithField("volume_id", vol.ID).Error("could not delete scratch volume")
+			}
+		}()
+	}
+
+	ll = ll.WithFields(logrus.Fields{
+		"volume_id":       vol.ID,
+		"volume_location": vol.Location.Name,
+	})
+
+	fsType := p.FsType
+	if fsType == "" {
+		fsType = "ext4"
+	}
+
+	fileSize := p.FileSize
+	if fileSize == 0 {
+		fileSize = GB
+	}
+	if fileSize > int64(vol.Size)*GB/2 {
+		return fmt.Errorf("file size %d must be at most half the size of volume %d", fileSize, vol.ID)
+	}
+
+	duration := p.Duration
+	if duration == 0 {
+		duration = 30 * time.Second
+	}
+
+	ll.Info("running benchmark")
+	out, err := mover.run(ctx, vol, MoverBench,
+		"--mover-bench-fs-type="+fsType,
+		"--mover-bench-file-size="+strconv.FormatInt(fileSize, 10),
+		"--mover-bench-duration="+duration.String())
+	if err != nil {
+		return err
+	}
+
+	var results []benchResult
+	if err := json.Unmarshal([]byte(out), &results); err != nil {
+		return fmt.Errorf("invalid benchmark result %q: %s", out, err)
+	}
+
+	fmt.Fprintf(p.Output, "volume %d in %s, %d GB\n\n", vol.ID, vol.Location.Name, vol.Size)
+	writeBenchResults(p.Output, results)
+	return nil
+}
+
+// unboundVolume returns the detached volume with the given id, if it's not
+// referenced by a PV
+func (d *Driver) unboundVolume(ctx context.Context, id int) (*hcloud.Volume, error) {
+	vol, _, err := d.volumes.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if vol == nil {
+		return nil, fmt.Errorf("volume %d not found", id)
+	}
+	if vol.Server != nil {
+		return nil, fmt.Errorf("volume %d is attached to server %d", vol.ID, vol.Server.ID)
+	}
+
+	pvs, err := d.kubeClient.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list persistent volumes: %s", err)
+	}
+
+	handle := strconv.Itoa(vol.ID)
+	for _, pv := range pvs.Items {
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == driverName && pv.Spec.CSI.VolumeHandle == handle &&
+			pv.Status.Phase != corev1.VolumeReleased {
+			return nil, fmt.Errorf("volume %d is used by persistent volume %q", vol.ID, pv.Name)
+		}
+	}
+
+	return vol, nil
+}
+
+// createBenchVolume creates a scratch volume with the given size in GB
+func (d *Driver) createBenchVolume(ctx context.Context, name string, size int) (*hcloud.Volume, error) {
+	if name == "" {
+		return nil, fmt.Errorf("a location is required to create a scratch volume")
+	}
+
+	location, _, err := d.hcloudClient.Location.GetByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if location == nil {
+		return nil, fmt.Errorf("location %q not found", name)
+	}
+
+	if size == 0 {
+		size = minVolumeSizeInGB / GB
+	}
+
+	return d.createToolVolume(ctx, hcloud.VolumeCreateOpts{
+		Name:     fmt.Sprintf("bench-%s-%s", name, time.Now().UTC().Format("20060102150405")),
+		Size:     size,
+		Location: location,
+		Labels: map[string]string{
+			"createdBy": createdByHCloud,
+			labelBench:  "true",
+		},
+	})
+}
+
+// writeBenchResults writes the results as a table to w
+func writeBenchResults(w io.Writer, results []benchResult) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATTERN\tBLOCK SIZE\tIOPS\tTHROUGHPUT\tAVG LATENCY\tP99 LATENCY")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%dK\t%.0f\t%.1f MB/s\t%s\t%s\n", r.Pattern, r.BlockSize/KB,
+			r.IOPS(), r.Throughput()/MB, r.AvgLatency, r.P99Latency)
+	}
+	tw.Flush()
+}
+
+// benchDevice formats and mounts device like NodeStageVolume, runs the
+// benchmark on a file in its filesystem and unmounts it again
+func benchDevice(ctx context.Context, device, fsType string, cfg benchConfig, ll *logrus.Entry) ([]benchResult, error) {
+	m := newMounter(ll)
+
+	formatted, err := m.IsFormatted(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+	if !formatted {
+		ll.Info("formatting the device")
+		if err := m.Format(ctx, device, fsType); err != nil {
+			return nil, err
+		}
+	}
+
+	target, err := ioutil.TempDir("", "hcloud-csi-bench")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(target)
+
+	if err := m.Mount(ctx, device, target, fsType); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := m.Unmount(context.Background(), target); err != nil {
+			ll.WithError(err).Error("unmounting the device failed")
+		}
+	}()
+
+	path := filepath.Join(target, benchFileName)
+	defer os.Remove(path)
+
+	return benchFile(ctx, path, cfg, true, ll)
+}
+
+// benchFile runs the benchmark patterns on the file at path. It's created
+// with the configured size first. With direct, the page cache is bypassed.
+func benchFile(ctx context.Context, path string, cfg benchConfig, direct bool, ll *logrus.Entry) ([]benchResult, error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if direct {
+		flags |= syscall.O_DIRECT
+	}
+
+	f, err := os.OpenFile(path, flags, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf := alignedBuffer(MB)
+
+	// lay out the file, so reads don't hit holes
+	ll.WithField("bytes", cfg.FileSize).Info("laying out the benchmark file")
+	for off := int64(0); off < cfg.FileSize; off += int64(len(buf)) {
+		if _, err := f.WriteAt(buf, off); err != nil {
+			return nil, fmt.Errorf("laying out the benchmark file failed: %s", err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+
+	var results []benchResult
+	for _, pattern := range benchPatterns {
+		ll.WithField("pattern", pattern.Name).Info("running pattern")
+		r, err := runBenchPattern(ctx, f, pattern, cfg, buf)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %s failed: %s", pattern.Name, err)
+		}
+		results = append(results, *r)
+	}
+
+	return results, nil
+}
+
+// runBenchPattern runs the pattern on f until the configured duration is
+// over. buf must be at least as large as the block size.
+func runBenchPattern(ctx context.Context, f *os.File, pattern benchPattern, cfg benchConfig, buf []byte) (*benchResult, error) {
+	buf = buf[:pattern.BlockSize]
+	blocks := cfg.FileSize / pattern.BlockSize
+	if blocks == 0 {
+		return nil, fmt.Errorf("file size %d is smaller than the block size %d", cfg.FileSize, pattern.BlockSize)
+	}
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var latencies []time.Duration
+
+	start := time.Now()
+	for i := int64(0); time.Since(start) < cfg.Duration; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		block := i % blocks
+		if pattern.Random {
+			block = rnd.Int63n(blocks)
+		}
+		off := block * pattern.BlockSize
+
+		opStart := time.Now()
+		var err error
+		if pattern.Write {
+			_, err = f.WriteAt(buf, off)
+		} else {
+			_, err = f.ReadAt(buf, off)
+		}
+		if err != nil {
+			return nil, err
+		}
+		latencies = append(latencies, time.Since(opStart))
+	}
+
+	r := summarizeBench(pattern, latencies)
+	r.Duration = time.Since(start)
+	return r, nil
+}
+
+// summarizeBench returns the result of a pattern with the given latencies
+func summarizeBench(pattern benchPattern, latencies []time.Duration) *benchResult {
+	r := &benchResult{
+		Pattern:   pattern.Name,
+		BlockSize: pattern.BlockSize,
+		Ops:       len(latencies),
+	}
+	if len(latencies) == 0 {
+		return r
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	var total time.Duration
+	for _, l := range latencies {
+		total += l
+	}
+	r.AvgLatency = total / time.Duration(len(latencies))
+	r.P99Latency = latencies[(len(latencies)*99+99)/100-1]
+	return r
+}
+
+// alignedBuffer returns a buffer of the given size that's aligned for direct
+// IO
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+benchAlignment)
+	off := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & (benchAlignment - 1)); rem != 0 {
+		off = benchAlignment - rem
+	}
+	return buf[off : off+size]
+}
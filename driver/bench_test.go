@@ -0,0 +1,87 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestBenchFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := benchConfig{FileSize: 2 * MB, Duration: 20 * time.Millisecond}
+	ll := logrus.New().WithField("test", t.Name())
+
+	// the page cache can't be bypassed on every filesystem tests run on
+	results, err := benchFile(context.Background(), filepath.Join(dir, benchFileName), cfg, false, ll)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != len(benchPatterns) {
+		t.Fatalf("got %d results, want %d", len(results), len(benchPatterns))
+	}
+
+	for i, r := range results {
+		if r.Pattern != benchPatterns[i].Name || r.BlockSize != benchPatterns[i].BlockSize {
+			t.Errorf("result %d is of pattern %s with block size %d, want %s", i, r.Pattern, r.BlockSize, benchPatterns[i].Name)
+		}
+		if r.Ops == 0 || r.Duration < cfg.Duration {
+			t.Errorf("pattern %s ran %d ops in %s", r.Pattern, r.Ops, r.Duration)
+		}
+		if r.AvgLatency <= 0 || r.P99Latency < r.AvgLatency/2 {
+			t.Errorf("pattern %s has invalid latencies avg %s p99 %s", r.Pattern, r.AvgLatency, r.P99Latency)
+		}
+	}
+}
+
+func TestSummarizeBench(t *testing.T) {
+	var latencies []time.Duration
+	for i := 200; i > 0; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+
+	r := summarizeBench(benchPatterns[2], latencies)
+	if r.Ops != 200 {
+		t.Errorf("got %d ops, want 200", r.Ops)
+	}
+	if want := 100500 * time.Microsecond; r.AvgLatency != want {
+		t.Errorf("got average latency %s, want %s", r.AvgLatency, want)
+	}
+	if want := 198 * time.Millisecond; r.P99Latency != want {
+		t.Errorf("got p99 latency %s, want %s", r.P99Latency, want)
+	}
+
+	r.Duration = 2 * time.Second
+	if r.IOPS() != 100 {
+		t.Errorf("got %f IOPS, want 100", r.IOPS())
+	}
+	if want := float64(100 * 4 * KB); r.Throughput() != want {
+		t.Errorf("got throughput %f, want %f", r.Throughput(), want)
+	}
+}
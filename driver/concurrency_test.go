@@ -0,0 +1,399 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The tests in this file fire overlapping calls at the controller, run them
+// with -race to catch unsynchronized state as well.
+
+// concurrentVolumes fails the test if attaches and detaches of the same
+// volume or server overlap. Every call takes a moment, so calls that aren't
+// kept apart by the driver do overlap.
+type concurrentVolumes struct {
+	VolumeService
+	t *testing.T
+
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+func (c *concurrentVolumes) enter(keys ...string) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.active == nil {
+		c.active = map[string]bool{}
+	}
+	for _, key := range keys {
+		if c.active[key] {
+			c.t.Errorf("overlapping attaches or detaches of %s", key)
+		}
+		c.active[key] = true
+	}
+
+	return func() {
+		time.Sleep(time.Millisecond)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, key := range keys {
+			delete(c.active, key)
+		}
+	}
+}
+
+func (c *concurrentVolumes) Attach(ctx context.Context, volume *hcloud.Volume, server *hcloud.Server) (*hcloud.Action, *hcloud.Response, error) {
+	defer c.enter(fmt.Sprintf("volume %d", volume.ID), fmt.Sprintf("server %d", server.ID))()
+	return c.VolumeService.Attach(ctx, volume, server)
+}
+
+func (c *concurrentVolumes) Detach(ctx context.Context, volume *hcloud.Volume) (*hcloud.Action, *hcloud.Response, error) {
+	keys := []string{fmt.Sprintf("volume %d", volume.ID)}
+	if volume.Server != nil {
+		keys = append(keys, fmt.Sprintf("server %d", volume.Server.ID))
+	}
+	defer c.enter(keys...)()
+	return c.VolumeService.Detach(ctx, volume)
+}
+
+// newConcurrencyDriver returns a controller for a fake API with the servers
+// 1, 2 and 3
+func newConcurrencyDriver(t *testing.T) (*Driver, *fakeAPI, func()) {
+	api := &fakeAPI{
+		t:       t,
+		volumes: map[int]*schema.Volume{},
+		servers: map[int]*schema.Server{},
+	}
+	for id := 1; id <= 3; id++ {
+		api.servers[id] = &schema.Server{ID: id}
+	}
+	ts := httptest.NewServer(api)
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	client := hcloud.NewClient(hcloud.WithEndpoint(ts.URL))
+	d := &Driver{
+		location:     "fsn1",
+		hcloudClient: client,
+		volumes:      &concurrentVolumes{VolumeService: &client.Volume, t: t},
+		servers:      &client.Server,
+		actions:      &actionClient{client: client},
+		log:          log.WithField("test_enabled", true),
+	}
+	return d, api, ts.Close
+}
+
+// parallel runs fn n times at the same time and returns the errors
+func parallel(n int, fn func(i int) error) []error {
+	errs := make([]error, n)
+	start := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			errs[i] = fn(i)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	return errs
+}
+
+func createVolume(d *Driver, name string) (string, error) {
+	resp, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               name,
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessMode: supportedAccessMode}},
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.Volume.Id, nil
+}
+
+func publishVolume(d *Driver, volumeID string, serverID int) error {
+	_, err := d.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           strconv.Itoa(serverID),
+		VolumeCapability: &csi.VolumeCapability{AccessMode: supportedAccessMode},
+	})
+	return err
+}
+
+func unpublishVolume(d *Driver, volumeID string, serverID int) error {
+	_, err := d.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: volumeID,
+		NodeId:   strconv.Itoa(serverID),
+	})
+	return err
+}
+
+// attachedServer returns the server the volume is attached to, 0 if it's
+// detached
+func attachedServer(api *fakeAPI, volumeID string) int {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	id, _ := strconv.Atoi(volumeID)
+	if vol := api.volumes[id]; vol != nil && vol.Server != nil {
+		return *vol.Server
+	}
+	return 0
+}
+
+func TestConcurrentCreateVolume(t *testing.T) {
+	d, api, stop := newConcurrencyDriver(t)
+	defer stop()
+
+	ids := make([]string, 20)
+	errs := parallel(len(ids), func(i int) error {
+		var err error
+		// two volumes, created by ten calls each
+		ids[i], err = createVolume(d, fmt.Sprintf("pvc-%d", i%2))
+		return err
+	})
+
+	created := map[string]string{}
+	for i, err := range errs {
+		name := fmt.Sprintf("pvc-%d", i%2)
+		switch {
+		case status.Code(err) == codes.Aborted:
+		case err != nil:
+			t.Errorf("creating %s: %s", name, err)
+		case created[name] != "" && created[name] != ids[i]:
+			t.Errorf("%s was created as volume %s and %s", name, created[name], ids[i])
+		default:
+			created[name] = ids[i]
+		}
+	}
+
+	// the retries of the aborted calls find the volumes
+	for i := 0; i < 2; i++ {
+		name := fmt.Sprintf("pvc-%d", i)
+		id, err := createVolume(d, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created[name] != "" && created[name] != id {
+			t.Errorf("retry of %s returned volume %s, expected %s", name, id, created[name])
+		}
+	}
+
+	if len(api.volumes) != 2 {
+		t.Errorf("expected 2 volumes, got %d", len(api.volumes))
+	}
+}
+
+func TestConcurrentPublishVolume(t *testing.T) {
+	d, api, stop := newConcurrencyDriver(t)
+	defer stop()
+
+	var volumeIDs []string
+	for i := 0; i < 6; i++ {
+		id, err := createVolume(d, fmt.Sprintf("pvc-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		volumeIDs = append(volumeIDs, id)
+	}
+
+	// the attaches of a server are queued, servers don't wait for each other
+	errs := parallel(len(volumeIDs), func(i int) error {
+		return publishVolume(d, volumeIDs[i], 1+i%3)
+	})
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("attaching volume %s: %s", volumeIDs[i], err)
+		}
+	}
+
+	// retries are answered without attaching again
+	errs = parallel(len(volumeIDs)*2, func(i int) error {
+		i = i % len(volumeIDs)
+		return publishVolume(d, volumeIDs[i], 1+i%3)
+	})
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("retrying the attach of volume %s: %s", volumeIDs[i%len(volumeIDs)], err)
+		}
+	}
+
+	errs = parallel(len(volumeIDs), func(i int) error {
+		return unpublishVolume(d, volumeIDs[i], 1+i%3)
+	})
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("detaching volume %s: %s", volumeIDs[i], err)
+		}
+	}
+
+	for _, id := range volumeIDs {
+		if server := attachedServer(api, id); server != 0 {
+			t.Errorf("volume %s is still attached to server %d", id, server)
+		}
+	}
+}
+
+func TestConcurrentPublishUnpublishVolume(t *testing.T) {
+	d, api, stop := newConcurrencyDriver(t)
+	defer stop()
+
+	volumeID, err := createVolume(d, "pvc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// attaches and detaches of the same volume are either run one after
+	// another or rejected with ABORTED, so the CO retries them
+	errs := parallel(20, func(i int) error {
+		if i%2 == 0 {
+			return publishVolume(d, volumeID, 1)
+		}
+		return unpublishVolume(d, volumeID, 1)
+	})
+	for _, err := range errs {
+		if err != nil && status.Code(err) != codes.Aborted {
+			t.Errorf("expected success or ABORTED, got %v", err)
+		}
+	}
+
+	if err := publishVolume(d, volumeID, 1); err != nil {
+		t.Fatal(err)
+	}
+	if server := attachedServer(api, volumeID); server != 1 {
+		t.Fatalf("expected the volume to be attached to server 1, got %d", server)
+	}
+
+	// a volume attached to one server can't be attached to the others
+	errs = parallel(6, func(i int) error {
+		return publishVolume(d, volumeID, 1+i%3)
+	})
+	for i, err := range errs {
+		if i%3 == 0 && err != nil {
+			t.Errorf("retrying the attach to server 1: %s", err)
+		}
+		if i%3 != 0 && err == nil {
+			t.Errorf("volume was attached to server %d as well", 1+i%3)
+		}
+	}
+	if server := attachedServer(api, volumeID); server != 1 {
+		t.Fatalf("expected the volume to stay attached to server 1, got %d", server)
+	}
+
+	if err := unpublishVolume(d, volumeID, 1); err != nil {
+		t.Fatal(err)
+	}
+	if server := attachedServer(api, volumeID); server != 0 {
+		t.Fatalf("expected the volume to be detached, got server %d", server)
+	}
+}
+
+func TestConcurrentMoverAttach(t *testing.T) {
+	d, api, stop := newConcurrencyDriver(t)
+	defer stop()
+
+	var volumeIDs []string
+	for i := 0; i < 6; i++ {
+		id, err := createVolume(d, fmt.Sprintf("pvc-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		volumeIDs = append(volumeIDs, id)
+	}
+
+	// the data mover shares the queue of the server with the CO
+	errs := parallel(len(volumeIDs), func(i int) error {
+		if i%2 == 0 {
+			return publishVolume(d, volumeIDs[i], 1)
+		}
+
+		id, _ := strconv.Atoi(volumeIDs[i])
+		release, err := d.attachVolume(context.Background(), &hcloud.Volume{ID: id}, 1)
+		if err != nil {
+			return err
+		}
+		release()
+		return nil
+	})
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("attaching volume %s: %s", volumeIDs[i], err)
+		}
+	}
+
+	for i, id := range volumeIDs {
+		want := 0
+		if i%2 == 0 {
+			want = 1
+		}
+		if server := attachedServer(api, id); server != want {
+			t.Errorf("expected volume %s to be attached to server %d, got %d", id, want, server)
+		}
+	}
+}
+
+func TestConcurrentDeleteVolume(t *testing.T) {
+	d, api, stop := newConcurrencyDriver(t)
+	defer stop()
+
+	var volumeIDs []string
+	for i := 0; i < 2; i++ {
+		id, err := createVolume(d, fmt.Sprintf("pvc-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		volumeIDs = append(volumeIDs, id)
+	}
+
+	// deleting is idempotent, all calls succeed
+	errs := parallel(20, func(i int) error {
+		_, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{
+			VolumeId: volumeIDs[i%2],
+		})
+		return err
+	})
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("deleting volume %s: %s", volumeIDs[i%2], err)
+		}
+	}
+
+	if len(api.volumes) != 0 {
+		t.Errorf("expected all volumes to be deleted, got %d", len(api.volumes))
+	}
+}
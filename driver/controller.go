@@ -24,6 +24,7 @@ import (
 	"strconv"
 	"time"
 
+	drivererrors "github.com/apricote/hcloud-csi-driver/driver/errors"
 	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
 	"github.com/hetznercloud/hcloud-go/hcloud"
 	"github.com/sirupsen/logrus"
@@ -44,12 +45,22 @@ const (
 	minVolumeSizeInGB     = 10 * GB
 
 	createdByHCloud = "hcloud-csi-driver"
+
+	// errorCodeVolumeLimitExceeded is the code of the API error returned if
+	// no more volumes can be attached to the server. The API client we use
+	// doesn't define it yet.
+	errorCodeVolumeLimitExceeded = hcloud.ErrorCode("volume_limit_exceeded")
 )
 
 var (
 	// hcloud currently only support a single node to be attached to a single node
 	// in read/write mode. This corresponds to `accessModes.ReadWriteOnce` in a
-	// PVC resource on Kubernets
+	// PVC resource on Kubernets. Several pods on the same node can use the
+	// volume at the same time, every pod gets its own bind mount of the
+	// staging path (see NodePublishVolume).
+	//
+	// TODO: advertise SINGLE_NODE_MULTI_WRITER (and SINGLE_NODE_SINGLE_WRITER)
+	// once the CSI spec is updated, the modes don't exist in v0.3.
 	supportedAccessMode = &csi.VolumeCapability_AccessMode{
 		Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
 	}
@@ -66,23 +77,19 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		return nil, status.Error(codes.InvalidArgument, "CreateVolume Volume capabilities must be provided")
 	}
 
-	if req.AccessibilityRequirements != nil {
-		for _, t := range req.AccessibilityRequirements.Requisite {
-			location, ok := t.Segments["location"]
-			if !ok {
-				continue // nothing to do
-			}
-
-			if location != d.location {
-				return nil, status.Errorf(codes.ResourceExhausted, "volume can be only created in location: %q, got: %q", d.location, location)
+	if !d.creating.start(req.Name) {
+		return nil, drivererrors.Errorf(drivererrors.ErrInProgress, "volume %q is being created already", req.Name)
+	}
+	defer d.creating.finish(req.Name)
 
-			}
-		}
+	location, err := d.volumeLocation(ctx, req.Parameters, req.AccessibilityRequirements)
+	if err != nil {
+		return nil, err
 	}
 
 	size, err := extractStorage(req.CapacityRange)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, status.Error(codes.OutOfRange, err.Error())
 	}
 
 	volumeName := req.Name
@@ -92,11 +99,12 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		"storage_size_giga_bytes": size / GB,
 		"method":                  "create_volume",
 		"volume_capabilities":     req.VolumeCapabilities,
+		"volume_location":         location,
 	})
 	ll.Info("create volume called")
 
 	// get volume first, if it's created do nothing
-	volume, _, err := d.hcloudClient.Volume.GetByName(ctx, volumeName)
+	volume, _, err := d.volumes.GetByName(ctx, volumeName)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
@@ -110,44 +118,162 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("invalid option requested size: %d", size))
 		}
 
+		source, err := d.populateSource(ctx, req, size)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := d.checkPopulated(volume, source); err != nil {
+			return nil, err
+		}
+
+		// the volume must satisfy the request like a new one
+		existingLocation := volumeLocationName(volume, location)
+		if l := req.Parameters[paramLocation]; l != "" && l != existingLocation {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %q exists already in location %q, requested %q", volumeName, existingLocation, l)
+		}
+		if reqs := req.AccessibilityRequirements; reqs != nil {
+			ok, err := d.topologyMatchesAny(ctx, reqs.Requisite, existingLocation)
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			if !ok {
+				return nil, status.Errorf(codes.AlreadyExists, "volume %q exists already in location %q, requisite topology: %v", volumeName, existingLocation, reqs.Requisite)
+			}
+		}
+
+		attributes, err := d.volumeAttributes(ctx, volume, req.Parameters)
+		if err != nil {
+			return nil, err
+		}
+
+		topologies, err := d.accessibleTopology(ctx, volume, existingLocation)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
 		volumeID := strconv.Itoa(volume.ID)
 
-		ll.Info("volume already created")
-		return &csi.CreateVolumeResponse{
+		resp := &csi.CreateVolumeResponse{
 			Volume: &csi.Volume{
-				Id:            volumeID,
-				CapacityBytes: volumeCapacityGigaBytes,
+				Id:                 volumeID,
+				CapacityBytes:      volumeCapacityGigaBytes,
+				Attributes:         attributes,
+				ContentSource:      req.VolumeContentSource,
+				AccessibleTopology: topologies,
 			},
-		}, nil
+		}
+
+		ll.WithField("response", resp).Info("volume already created")
+		return resp, nil
+	}
+
+	// retries for existing volumes are answered above, only new volumes
+	// are rejected
+	if err := d.checkMaintenance(); err != nil {
+		return nil, err
+	}
+
+	labels, err := volumeLabels(req.Parameters, d.clusterID)
+	if err != nil {
+		return nil, err
 	}
 
 	volumeReq := &hcloud.VolumeCreateOpts{
 		Name: volumeName,
 		Size: int(size / GB),
 		Location: &hcloud.Location{
-			Name: d.location,
-		},
-		Labels: map[string]string{
-			"createdBy": createdByHCloud,
+			Name: location,
 		},
+		Labels: labels,
 	}
 
-	if !validateCapabilities(req.VolumeCapabilities) {
+	// multi node volumes are exported via NFS
+	nfs := d.nfs != nil && nfsCapabilities(req.VolumeCapabilities)
+	if !nfs && !validateCapabilities(req.VolumeCapabilities) {
 		return nil, status.Error(codes.AlreadyExists, "invalid volume capabilities requested. Only SINGLE_NODE_WRITER is supported ('accessModes.ReadWriteOnce' on Kubernetes)")
 	}
 
+	if nfs {
+		volumeReq.Labels[labelNFSExport] = "true"
+	}
+
 	ll.Info("verify volume size is allowed")
 	if size < minVolumeSizeInGB {
 		return nil, status.Errorf(codes.OutOfRange, "requested volume size %d GB is lower than supported minimum of %d GB", size/GB, minVolumeSizeInGB/GB)
 	}
 
+	if err := validateAutoscaleParams(req.Parameters); err != nil {
+		return nil, err
+	}
+
+	if err := validateWipeParams(req.Parameters); err != nil {
+		return nil, err
+	}
+
+	if err := validateFsTuningParams(req.Parameters, req.VolumeCapabilities); err != nil {
+		return nil, err
+	}
+
+	ll.Info("checking namespace policy")
+	if err := checkNamespacePolicy(req.Parameters); err != nil {
+		return nil, err
+	}
+
 	ll.Info("checking volume limit")
 	if err := d.checkLimit(ctx); err != nil {
 		return nil, err
 	}
 
+	ll.Info("checking volume quota")
+	if err := d.checkQuota(ctx, req.Parameters); err != nil {
+		return nil, err
+	}
+
+	ll.Info("checking provisioning rate")
+	if err := d.checkProvisionRate(req.Parameters); err != nil {
+		return nil, err
+	}
+
+	source, err := d.populateSource(ctx, req, size)
+	if err != nil {
+		return nil, err
+	}
+
+	if source != "" {
+		volumeReq.Labels[labelPopulated] = "false"
+	}
+
+	// the pool only holds volumes in the location of the driver. Volumes
+	// formatted in advance aren't tuned.
+	if d.volumePool != nil && source == "" && !nfs && location == d.location && (d.volumePool.fsType == "" || fsTuningAttributes(req.Parameters) == nil) {
+		vol, err := d.volumePool.claim(ctx, volumeName, int(size/GB), req.VolumeCapabilities, volumeReq.Labels)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		if vol != nil {
+			topologies, err := d.accessibleTopology(ctx, vol, location)
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+
+			resp := &csi.CreateVolumeResponse{
+				Volume: &csi.Volume{
+					Id:                 strconv.Itoa(vol.ID),
+					CapacityBytes:      size,
+					Attributes:         fsTuningAttributes(req.Parameters),
+					AccessibleTopology: topologies,
+				},
+			}
+
+			ll.WithField("response", resp).Info("volume claimed from pool")
+			return resp, nil
+		}
+	}
+
 	ll.WithField("volume_req", volumeReq).Info("creating volume")
-	hcloudResp, _, err := d.hcloudClient.Volume.Create(ctx, *volumeReq)
+	hcloudResp, _, err := d.volumes.Create(ctx, *volumeReq)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
@@ -155,17 +281,36 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 
 	volumeID := strconv.Itoa(hcloudResp.Volume.ID)
 
+	// the volume can only be attached once it's created
+	if (source != "" || nfs) && hcloudResp.Action != nil {
+		if err := d.waitAction(ctx, hcloudResp.Volume.ID, hcloudResp.Action.ID); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if source != "" {
+		if err := d.checkPopulated(hcloudResp.Volume, source); err != nil {
+			return nil, err
+		}
+	}
+
+	attributes, err := d.volumeAttributes(ctx, hcloudResp.Volume, req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	topologies, err := d.accessibleTopology(ctx, hcloudResp.Volume, location)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
 	resp := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			Id:            volumeID,
-			CapacityBytes: size,
-			AccessibleTopology: []*csi.Topology{
-				{
-					Segments: map[string]string{
-						"location": d.location,
-					},
-				},
-			},
+			Id:                 volumeID,
+			CapacityBytes:      size,
+			Attributes:         attributes,
+			ContentSource:      req.VolumeContentSource,
+			AccessibleTopology: topologies,
 		},
 	}
 
@@ -193,7 +338,18 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 		return &csi.DeleteVolumeResponse{}, nil
 	}
 
-	resp, err := d.hcloudClient.Volume.Delete(ctx, &hcloud.Volume{
+	if d.nfs != nil {
+		// the export has to be stopped, so its volume is detached
+		if err := d.nfs.unexport(volumeID); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if err := d.checkWiped(ctx, volumeID); err != nil {
+		return nil, err
+	}
+
+	resp, err := d.volumes.Delete(ctx, &hcloud.Volume{
 		ID: volumeID,
 	})
 	if err != nil {
@@ -205,6 +361,12 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 			}).Warn("assuming volume is deleted already")
 			return &csi.DeleteVolumeResponse{}, nil
 		}
+		if hcloud.IsError(err, hcloud.ErrorCode("protected")) {
+			return nil, drivererrors.Errorf(drivererrors.ErrProtected, "volume %d is protected against deletion", volumeID)
+		}
+		if hcloud.IsError(err, hcloud.ErrorCode("locked")) {
+			return nil, drivererrors.Errorf(drivererrors.ErrLocked, "volume %d is locked by another action", volumeID)
+		}
 		return nil, err
 	}
 
@@ -226,6 +388,12 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Volume capability must be provided")
 	}
 
+	if req.VolumeAttributes[attrNFSServer] != "" {
+		// the nodes mount the NFS export, the volume stays attached to the
+		// NFS server
+		return &csi.ControllerPublishVolumeResponse{}, nil
+	}
+
 	volumeID, err := strconv.Atoi(req.VolumeId)
 	if err != nil {
 		// don't return because the CSI tests passes ID's in non-integer format.
@@ -257,27 +425,55 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 	})
 	ll.Info("controller publish volume called")
 
+	// the attacher retries until it sees the call succeed, answer the
+	// retries from the cache
+	if device, ok := d.attachCache.get(volumeID, serverID, time.Now()); ok {
+		ll.Info("volume is already attached")
+		return publishResponse(device), nil
+	}
+
 	// check if volume exist before trying to attach it
-	vol, resp, err := d.hcloudClient.Volume.GetByID(ctx, volumeID)
+	vol, resp, err := d.volumes.GetByID(ctx, volumeID)
 	if err != nil {
 		if resp != nil && resp.StatusCode == http.StatusNotFound {
-			return nil, status.Errorf(codes.NotFound, "volume %q not found", req.VolumeId)
+			return nil, drivererrors.Errorf(drivererrors.ErrVolumeNotFound, "volume %q not found", req.VolumeId)
 		}
 		// TODO: replace with actual error handling
-		return nil, status.Errorf(codes.NotFound, "volume %q not found", req.VolumeId)
+		return nil, drivererrors.Errorf(drivererrors.ErrVolumeNotFound, "volume %q not found", req.VolumeId)
 		// return nil, err
 	}
+	if vol == nil {
+		// deleted outside of the plugin, fail right away instead of
+		// retrying the attachment until it times out
+		return nil, drivererrors.Errorf(drivererrors.ErrVolumeNotFound, "volume %q not found, it was deleted", req.VolumeId)
+	}
+
+	if vol.Server != nil && vol.Server.ID == serverID {
+		ll.Info("volume is already attached")
+		d.attachCache.add(vol.ID, serverID, vol.LinuxDevice, time.Now())
+		return publishResponse(vol.LinuxDevice), nil
+	}
+
+	// an attach started before a restart of the controller might still be
+	// running, wait for it instead of attaching again
+	vol, err = d.settleVolume(ctx, vol, ll)
+	if err != nil {
+		return nil, err
+	}
 
 	// check if server exist before trying to attach the volume to the server
-	server, resp, err := d.hcloudClient.Server.GetByID(ctx, serverID)
+	server, resp, err := d.servers.GetByID(ctx, serverID)
 	if err != nil {
 		if resp != nil && resp.StatusCode == http.StatusNotFound {
-			return nil, status.Errorf(codes.NotFound, "server %q not found", serverID)
+			return nil, drivererrors.Errorf(drivererrors.ErrServerNotFound, "server %d not found", serverID)
 		}
 		// TODO: replace with actual error handling
-		return nil, status.Errorf(codes.NotFound, "server %q not found", serverID)
+		return nil, drivererrors.Errorf(drivererrors.ErrServerNotFound, "server %d not found", serverID)
 		// return nil, err
 	}
+	if server == nil {
+		return nil, drivererrors.Errorf(drivererrors.ErrServerNotFound, "server %d not found", serverID)
+	}
 
 	attachedServer := vol.Server
 	var attachedID int
@@ -285,20 +481,42 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 		attachedID = attachedServer.ID
 		if attachedID == serverID {
 			ll.Info("volume is already attached")
-			return &csi.ControllerPublishVolumeResponse{}, nil
+			d.attachCache.add(vol.ID, serverID, vol.LinuxDevice, time.Now())
+			return publishResponse(vol.LinuxDevice), nil
 		}
 	}
 
-	// volume is attached to a different server, return an error
+	// volume is attached to a different server, return an error unless the
+	// attachment is stale and can be removed
 	if attachedID != 0 {
-		return nil, status.Errorf(codes.FailedPrecondition,
-			"volume is attached to the wrong server(%q), dettach the volume to fix it", attachedID)
+		if !d.detachStale {
+			return nil, drivererrors.Errorf(drivererrors.ErrAttached,
+				"volume is attached to the wrong server(%d), dettach the volume to fix it", attachedID)
+		}
+
+		if err := d.detachStaleAttachment(ctx, vol); err != nil {
+			return nil, err
+		}
 	}
 
+	// the attaches and detaches of a server run one after another
+	release, err := d.serverQueue.acquire(ctx, server.ID, false)
+	if err != nil {
+		return nil, serverQueueError(ctx, server.ID, err)
+	}
+	defer release()
+
 	// attach the volume to the correct node
-	action, resp, err := d.hcloudClient.Volume.Attach(ctx, vol, server)
+	action, resp, err := d.volumes.Attach(ctx, vol, server)
 	if err != nil {
-		return nil, status.Errorf(codes.Aborted, "volume %q could not be attached to server %q: %s", vol.ID, server.ID, err)
+		if hcloud.IsError(err, errorCodeVolumeLimitExceeded) {
+			return nil, drivererrors.Errorf(drivererrors.ErrAttachLimit,
+				"volume %d could not be attached to server %d, it has %d volumes attached already: %s", vol.ID, server.ID, len(server.Volumes), err)
+		}
+		if hcloud.IsError(err, hcloud.ErrorCode("locked")) {
+			return nil, drivererrors.Errorf(drivererrors.ErrLocked, "volume %d could not be attached to server %d: %s", vol.ID, server.ID, err)
+		}
+		return nil, status.Errorf(codes.Aborted, "volume %d could not be attached to server %d: %s", vol.ID, server.ID, err)
 	}
 
 	if action != nil {
@@ -309,7 +527,18 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 	}
 
 	ll.Info("volume is attached")
-	return &csi.ControllerPublishVolumeResponse{}, nil
+	d.attachCache.add(vol.ID, serverID, vol.LinuxDevice, time.Now())
+	return publishResponse(vol.LinuxDevice), nil
+}
+
+// publishResponse returns the response of ControllerPublishVolume for a
+// volume attached as the given device
+func publishResponse(device string) *csi.ControllerPublishVolumeResponse {
+	return &csi.ControllerPublishVolumeResponse{
+		PublishInfo: map[string]string{
+			publishDevicePath: device,
+		},
+	}
 }
 
 // ControllerUnpublishVolume deattaches the given volume from the node
@@ -341,8 +570,10 @@ func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.Control
 	})
 	ll.Info("controller unpublish volume called")
 
+	d.attachCache.forget(volumeID)
+
 	// check if volume exist before trying to detach it
-	vol, resp, err := d.hcloudClient.Volume.GetByID(ctx, volumeID)
+	vol, resp, err := d.volumes.GetByID(ctx, volumeID)
 	if err != nil {
 		if resp != nil && resp.StatusCode == http.StatusNotFound {
 			// assume it's detached
@@ -350,26 +581,65 @@ func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.Control
 		}
 		return nil, err
 	}
+	if vol == nil {
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+
+	vol, err = d.settleVolume(ctx, vol, ll)
+	if err != nil {
+		return nil, err
+	}
 
 	// check if server exist before trying to attach the volume to the server
-	_, resp, err = d.hcloudClient.Server.GetByID(ctx, serverID)
+	server, resp, err := d.servers.GetByID(ctx, serverID)
 	if err != nil {
 		if resp != nil && resp.StatusCode == http.StatusNotFound {
-			return nil, status.Errorf(codes.NotFound, "server %q not found", serverID)
+			return nil, drivererrors.Errorf(drivererrors.ErrServerNotFound, "server %d not found", serverID)
 		}
 		return nil, err
 	}
+	if server == nil {
+		return nil, drivererrors.Errorf(drivererrors.ErrServerNotFound, "server %d not found", serverID)
+	}
+
+	// NFS exports are never attached to the nodes mounting them, their
+	// volume must stay attached to the NFS server
+	if vol.Server == nil || vol.Server.ID != serverID {
+		ll.Info("volume is not attached to the server")
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+
+	// detaches are started before the attaches waiting for the server
+	release, err := d.serverQueue.acquire(ctx, serverID, true)
+	if err != nil {
+		return nil, serverQueueError(ctx, serverID, err)
+	}
 
-	action, resp, err := d.hcloudClient.Volume.Detach(ctx, vol)
+	action, resp, err := d.volumes.Detach(ctx, vol)
 	if err != nil {
-		return nil, status.Errorf(codes.Aborted, "volume %q could not be deattached from server %q: %s", vol.ID, serverID, err)
+		release()
+		if hcloud.IsError(err, hcloud.ErrorCode("locked")) {
+			return nil, drivererrors.Errorf(drivererrors.ErrLocked, "volume %d could not be deattached from server %d: %s", vol.ID, serverID, err)
+		}
+		return nil, status.Errorf(codes.Aborted, "volume %d could not be deattached from server %d: %s", vol.ID, serverID, err)
 	}
 
 	if action != nil {
+		if d.asyncDetach {
+			// the server is released once the detach is finished
+			ll.Info("detach accepted, tracking it in the background")
+			d.trackDetach(vol, server, action.ID, release, ll)
+			return &csi.ControllerUnpublishVolumeResponse{}, nil
+		}
+
 		ll.Info("waiting until volume is detached")
-		if err := d.waitAction(ctx, vol.ID, action.ID); err != nil {
+		err := d.waitAction(ctx, vol.ID, action.ID)
+		release()
+		if err != nil {
 			return nil, err
 		}
+	} else {
+		release()
 	}
 
 	ll.Info("volume is detached")
@@ -405,24 +675,32 @@ func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 	ll.Info("validate volume capabilities called")
 
 	// check if volume exist before trying to validate it it
-	_, volResp, err := d.hcloudClient.Volume.GetByID(ctx, volumeID)
+	vol, volResp, err := d.volumes.GetByID(ctx, volumeID)
 	if err != nil {
 		if volResp != nil && volResp.StatusCode == http.StatusNotFound {
-			return nil, status.Errorf(codes.NotFound, "volume %q not found", req.VolumeId)
+			return nil, drivererrors.Errorf(drivererrors.ErrVolumeNotFound, "volume %q not found", req.VolumeId)
 		}
 		// TODO: replace with actual error handling
-		return nil, status.Errorf(codes.NotFound, "volume %q not found", req.VolumeId)
+		return nil, drivererrors.Errorf(drivererrors.ErrVolumeNotFound, "volume %q not found", req.VolumeId)
 		// return nil, err
 	}
 
+	if vol == nil {
+		return nil, drivererrors.Errorf(drivererrors.ErrVolumeNotFound, "volume %q not found", req.VolumeId)
+	}
+
+	location := d.location
+	if vol.Location != nil {
+		location = vol.Location.Name
+	}
+
 	if req.AccessibleTopology != nil {
 		for _, t := range req.AccessibleTopology {
-			location, ok := t.Segments["location"]
-			if !ok {
-				continue // nothing to do
+			ok, err := d.topologyMatches(ctx, t, location)
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
 			}
-
-			if location != d.location {
+			if !ok {
 				// return early if a different location is expected
 				ll.WithField("supported", false).Info("supported capabilities")
 				return &csi.ValidateVolumeCapabilitiesResponse{
@@ -433,8 +711,13 @@ func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 	}
 
 	// if it's not supported (i.e: wrong location), we shouldn't override it
+	supported := validateCapabilities(req.VolumeCapabilities)
+	if vol.Labels[labelNFSExport] != "" {
+		supported = d.nfs != nil && nfsCapabilities(req.VolumeCapabilities)
+	}
+
 	resp := &csi.ValidateVolumeCapabilitiesResponse{
-		Supported: validateCapabilities(req.VolumeCapabilities),
+		Supported: supported,
 	}
 
 	ll.WithField("supported", resp.Supported).Info("supported capabilities")
@@ -469,7 +752,7 @@ func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (
 	var volumes []*hcloud.Volume
 	lastPage := 0
 	for {
-		vols, resp, err := d.hcloudClient.Volume.List(ctx, listOpts)
+		vols, resp, err := d.volumes.List(ctx, listOpts)
 		if err != nil {
 			return nil, err
 		}
@@ -536,14 +819,18 @@ func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.Control
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
-
-		// TODO(arslan): enable once snapshotting is supported
-		// csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
-		// csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
 	} {
 		caps = append(caps, newCap(cap))
 	}
 
+	// snapshots are implemented as backups and require a backup store
+	if d.backups != nil {
+		caps = append(caps,
+			newCap(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT),
+			newCap(csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS),
+		)
+	}
+
 	resp := &csi.ControllerGetCapabilitiesResponse{
 		Capabilities: caps,
 	}
@@ -555,23 +842,89 @@ func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.Control
 	return resp, nil
 }
 
+// TODO: implement volume group snapshots once the CSI spec has RPCs for them,
+// they don't exist in v0.3. The backup groups of the scheduler (see
+// annBackupGroup) only start the backups at about the same time, they're
+// not crash-consistent across the volumes.
+
 // CreateSnapshot will be called by the CO to create a new snapshot from a
-// source volume on behalf of a user.
+// source volume on behalf of a user. Snapshots are backups of the volume's
+// content to the configured object store. The backup is uploaded in the
+// background, the snapshot is in the UPLOADING state until it's finished.
 func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	d.log.WithFields(logrus.Fields{
-		"req":    req,
-		"method": "create_snapshot",
-	}).Warn("create snapshot is not implemented")
-	return nil, status.Error(codes.Unimplemented, "")
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot Name must be provided")
+	}
+
+	if req.SourceVolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot Source Volume ID must be provided")
+	}
+
+	if d.backups == nil {
+		return nil, status.Error(codes.Unimplemented, "snapshots are not supported, no backup store is configured")
+	}
+
+	if !backupIDRegexp.MatchString(req.Name) {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateSnapshot Name %q contains invalid characters", req.Name)
+	}
+
+	ll := d.log.WithFields(logrus.Fields{
+		"snapshot_name":    req.Name,
+		"source_volume_id": req.SourceVolumeId,
+		"params":           req.Parameters,
+		"method":           "create_snapshot",
+	})
+	ll.Info("create snapshot called")
+
+	retention, err := parseRetention(req.Parameters[paramRetainCount], req.Parameters[paramRetainAge])
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := d.createBackup(ctx, req.Name, req.SourceVolumeId, retention)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &csi.CreateSnapshotResponse{
+		Snapshot: manifest.snapshot(),
+	}
+
+	ll.WithField("response", resp).Info("snapshot is uploading")
+	return resp, nil
 }
 
 // DeleteSnapshot will be called by the CO to delete a snapshot.
 func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	d.log.WithFields(logrus.Fields{
-		"req":    req,
-		"method": "delete_snapshot",
-	}).Warn("delete snapshot is not implemented")
-	return nil, status.Error(codes.Unimplemented, "")
+	if req.SnapshotId == "" {
+		return nil, status.Error(codes.InvalidArgument, "DeleteSnapshot Snapshot ID must be provided")
+	}
+
+	if d.backups == nil {
+		return nil, status.Error(codes.Unimplemented, "snapshots are not supported, no backup store is configured")
+	}
+
+	ll := d.log.WithFields(logrus.Fields{
+		"snapshot_id": req.SnapshotId,
+		"method":      "delete_snapshot",
+	})
+	ll.Info("delete snapshot called")
+
+	if !backupIDRegexp.MatchString(req.SnapshotId) {
+		// can't be created by us, so it doesn't exist
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	if d.backupRunning(req.SnapshotId) {
+		return nil, status.Errorf(codes.FailedPrecondition, "snapshot %q is still uploading", req.SnapshotId)
+	}
+
+	if err := d.deleteBackup(ctx, req.SnapshotId); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	ll.Info("snapshot is deleted")
+	return &csi.DeleteSnapshotResponse{}, nil
 }
 
 // ListSnapshots returns the information about all snapshots on the storage
@@ -579,21 +932,87 @@ func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequ
 // ListSnapshots shold not list a snapshot that is being created but has not
 // been cut successfully yet.
 func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	d.log.WithFields(logrus.Fields{
-		"req":    req,
-		"method": "list_snapshots",
-	}).Warn("list snapshots is not implemented")
-	return nil, status.Error(codes.Unimplemented, "")
+	if d.backups == nil {
+		return nil, status.Error(codes.Unimplemented, "snapshots are not supported, no backup store is configured")
+	}
+
+	ll := d.log.WithFields(logrus.Fields{
+		"req_starting_token": req.StartingToken,
+		"snapshot_id":        req.SnapshotId,
+		"source_volume_id":   req.SourceVolumeId,
+		"method":             "list_snapshots",
+	})
+	ll.Info("list snapshots called")
+
+	var manifests []*backupManifest
+	if req.SnapshotId != "" {
+		if backupIDRegexp.MatchString(req.SnapshotId) {
+			m, err := d.getBackup(ctx, req.SnapshotId)
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+
+			if m != nil {
+				manifests = append(manifests, m)
+			}
+		}
+	} else {
+		var err error
+		manifests, err = d.listBackups(ctx)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	var entries []*csi.ListSnapshotsResponse_Entry
+	for _, m := range manifests {
+		if req.SourceVolumeId != "" && m.SourceVolumeID != req.SourceVolumeId {
+			continue
+		}
+
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{
+			Snapshot: m.snapshot(),
+		})
+	}
+
+	start := 0
+	if req.StartingToken != "" {
+		var err error
+		start, err = strconv.Atoi(req.StartingToken)
+		if err != nil || start < 0 || start > len(entries) {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q", req.StartingToken)
+		}
+	}
+
+	end := len(entries)
+	if req.MaxEntries > 0 && start+int(req.MaxEntries) < end {
+		end = start + int(req.MaxEntries)
+	}
+
+	resp := &csi.ListSnapshotsResponse{
+		Entries: entries[start:end],
+	}
+
+	if end < len(entries) {
+		resp.NextToken = strconv.Itoa(end)
+	}
+
+	ll.WithField("response", resp).Info("snapshots listed")
+	return resp, nil
 }
 
 // extractStorage extracts the storage size in GB from the given capacity
 // range. If the capacity range is not satisfied it returns the default volume
-// size.
+// size. Volumes are sized in whole GB, so the required bytes are rounded up.
 func extractStorage(capRange *csi.CapacityRange) (int64, error) {
 	if capRange == nil {
 		return defaultVolumeSizeInGB, nil
 	}
 
+	if capRange.RequiredBytes < 0 || capRange.LimitBytes < 0 {
+		return 0, errors.New("requiredBytes and limitBytes must not be negative")
+	}
+
 	if capRange.RequiredBytes == 0 && capRange.LimitBytes == 0 {
 		return defaultVolumeSizeInGB, nil
 	}
@@ -606,47 +1025,54 @@ func extractStorage(capRange *csi.CapacityRange) (int64, error) {
 		maxSize = minSize
 	}
 
-	if minSize == maxSize {
-		return minSize, nil
+	if minSize != maxSize {
+		return 0, errors.New("requiredBytes and LimitBytes are not the same")
+	}
+
+	// also keeps the rounding below from overflowing
+	if minSize > maxVolumeSizeInGB*GB {
+		return 0, fmt.Errorf("requiredBytes exceeds the maximum volume size of %d GB", maxVolumeSizeInGB)
 	}
 
-	return 0, errors.New("requiredBytes and LimitBytes are not the same")
+	// the limit is checked against the rounded size, a volume must never be
+	// smaller than the required bytes
+	size := (minSize + GB - 1) / GB * GB
+	if capRange.LimitBytes != 0 && size > capRange.LimitBytes {
+		return 0, fmt.Errorf("limitBytes %d is not a multiple of 1 GB", capRange.LimitBytes)
+	}
+
+	return size, nil
 }
 
-// waitAction waits until the given action for the volume is completed
+// waitAction waits until the given action for the volume is completed, at
+// most for actionTimeout. The actions of all callers are polled together, see
+// pollActions.
 func (d *Driver) waitAction(ctx context.Context, volumeID int, actionID int) error {
+	return d.waitActionTimeout(ctx, volumeID, actionID, actionTimeout)
+}
+
+// waitActionTimeout waits like waitAction, but at most for the given timeout
+func (d *Driver) waitActionTimeout(ctx context.Context, volumeID int, actionID int, timeout time.Duration) error {
 	ll := d.log.WithFields(logrus.Fields{
 		"volume_id": volumeID,
 		"action_id": actionID,
 	})
 
-	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	// TODO(arslan): use backoff in the future
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ticker.C:
-			action, _, err := d.hcloudClient.Action.GetByID(ctx, actionID)
-			if err != nil {
-				ll.WithError(err).Info("waiting for volume errored")
-				continue
-			}
-			ll.WithField("action_status", action.Status).Info("action received")
+	done := d.actionWatcher.add(d, actionID)
+	defer d.actionWatcher.remove(actionID, done)
 
-			if action.Status == hcloud.ActionStatusSuccess {
-				ll.Info("action completed")
-				return nil
-			}
-
-			if action.Status == hcloud.ActionStatusRunning {
-				continue
-			}
-		case <-ctx.Done():
-			return fmt.Errorf("timeout occured waiting for storage action of volume: %q", volumeID)
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("storage action of volume %d failed: %s", volumeID, err)
 		}
+		ll.Info("action completed")
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timeout occured waiting for storage action of volume: %d", volumeID)
 	}
 }
 
@@ -672,7 +1098,9 @@ func validateCapabilities(caps []*csi.VolumeCapability) bool {
 
 	supported := false
 	for _, cap := range caps {
-		if hasSupport(cap.AccessMode.Mode) {
+		// the getters return the zero values for capabilities without an
+		// access mode, which isn't supported
+		if hasSupport(cap.GetAccessMode().GetMode()) {
 			supported = true
 		} else {
 			// we need to make sure all capabilities are supported. Revert back
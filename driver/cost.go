@@ -0,0 +1,139 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// costMetricsInterval defines how often the provisioned volumes are
+	// counted for the cost metrics
+	costMetricsInterval = 5 * time.Minute
+)
+
+// volumeOwner is the StorageClass and the namespace of the PVC a volume was
+// provisioned for, as labeled by CreateVolume. They're empty for volumes
+// created without the PVC metadata, i.e. pool volumes.
+type volumeOwner struct {
+	storageClass string
+	namespace    string
+}
+
+// volumeUsage is the size and number of the volumes of an owner
+type volumeUsage struct {
+	sizeGB  int
+	volumes int
+}
+
+// costCollector counts the provisioned volumes by their StorageClass and
+// namespace, so their spend can be attributed to tenants. The volumes are
+// listed in the background, scraping the metrics doesn't call the API.
+type costCollector struct {
+	d   *Driver
+	log *logrus.Entry
+
+	mu      sync.Mutex // protects usage and updated
+	usage   map[volumeOwner]volumeUsage
+	updated time.Time
+}
+
+// newCostCollector returns a new costCollector for the given driver
+func newCostCollector(d *Driver) *costCollector {
+	return &costCollector{
+		d:   d,
+		log: d.log.WithField("component", "cost_collector"),
+	}
+}
+
+// run counts the volumes until stopCh is closed
+func (c *costCollector) run(stopCh <-chan struct{}) {
+	c.log.Info("cost collector started")
+
+	for {
+		if err := c.collect(context.Background()); err != nil {
+			c.log.WithError(err).Error("could not count provisioned volumes")
+		}
+
+		timer := time.NewTimer(jittered(costMetricsInterval))
+		select {
+		case <-stopCh:
+			timer.Stop()
+			c.log.Info("cost collector stopped")
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// collect counts the volumes provisioned by the driver
+func (c *costCollector) collect(ctx context.Context) error {
+	usage := map[volumeOwner]volumeUsage{}
+	err := c.d.eachVolume(ctx, "createdBy="+createdByHCloud, func(vol *hcloud.Volume) bool {
+		owner := volumeOwner{
+			storageClass: vol.Labels[labelStorageClass],
+			namespace:    vol.Labels[labelPVCNamespace],
+		}
+
+		u := usage[owner]
+		u.sizeGB += vol.Size
+		u.volumes++
+		usage[owner] = u
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.usage = usage
+	c.updated = time.Now()
+	return nil
+}
+
+// metrics returns the cost metrics, none before the volumes were counted
+// once. A nil collector returns no metrics.
+func (c *costCollector) metrics() []*metricFamily {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.updated.IsZero() {
+		return nil
+	}
+
+	size := newMetricFamily("hcloud_csi_provisioned_gigabytes", "gauge", "Size of the volumes provisioned by the plugin by StorageClass and PVC namespace")
+	count := newMetricFamily("hcloud_csi_provisioned_volumes", "gauge", "Number of the volumes provisioned by the plugin by StorageClass and PVC namespace")
+	updated := newMetricFamily("hcloud_csi_provisioned_last_update_timestamp_seconds", "gauge", "Time the provisioned volumes were last counted")
+
+	for owner, u := range c.usage {
+		labels := []string{"storage_class", owner.storageClass, "namespace", owner.namespace}
+		size.add(float64(u.sizeGB), labels...)
+		count.add(float64(u.volumes), labels...)
+	}
+	updated.add(float64(c.updated.Unix()))
+
+	return []*metricFamily{size, count, updated}
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCostMetrics(t *testing.T) {
+	ts := httptest.NewServer(&fakeAPI{
+		t: t,
+		volumes: map[int]*schema.Volume{
+			1: {ID: 1, Size: 10, Labels: map[string]string{"createdBy": createdByHCloud, labelStorageClass: "fast", labelPVCNamespace: "team-a"}},
+			2: {ID: 2, Size: 50, Labels: map[string]string{"createdBy": createdByHCloud, labelStorageClass: "fast", labelPVCNamespace: "team-a"}},
+			3: {ID: 3, Size: 20, Labels: map[string]string{"createdBy": createdByHCloud, labelStorageClass: "fast", labelPVCNamespace: "team-b"}},
+			// a pool volume, it's not claimed yet
+			4: {ID: 4, Size: 10, Labels: map[string]string{"createdBy": createdByHCloud}},
+		},
+	})
+	defer ts.Close()
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	client := hcloud.NewClient(hcloud.WithEndpoint(ts.URL))
+	d := &Driver{volumes: &client.Volume, log: log.WithField("test", t.Name())}
+	d.costCollector = newCostCollector(d)
+
+	if m := d.costCollector.metrics(); m != nil {
+		t.Errorf("expected no metrics before the volumes are counted, got %d", len(m))
+	}
+
+	if err := d.costCollector.collect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	for _, m := range d.metrics() {
+		m.write(&out)
+	}
+
+	for _, line := range []string{
+		`hcloud_csi_provisioned_gigabytes{storage_class="fast",namespace="team-a"} 60`,
+		`hcloud_csi_provisioned_gigabytes{storage_class="fast",namespace="team-b"} 20`,
+		`hcloud_csi_provisioned_gigabytes{storage_class="",namespace=""} 10`,
+		`hcloud_csi_provisioned_volumes{storage_class="fast",namespace="team-a"} 2`,
+		"# TYPE hcloud_csi_provisioned_last_update_timestamp_seconds gauge",
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("expected %q in the metrics, got:\n%s", line, out.String())
+		}
+	}
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronMatches(t *testing.T) {
+	// 2018-10-01 was a Monday
+	monday := time.Date(2018, 10, 1, 3, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		expr string
+		t    time.Time
+		want bool
+	}{
+		{"0 3 * * *", monday, true},
+		{"0 3 * * *", monday.Add(time.Minute), false},
+		{"*/15 * * * *", monday.Add(45 * time.Minute), true},
+		{"*/15 * * * *", monday.Add(50 * time.Minute), false},
+		{"0 1-5 * * 1", monday, true},
+		{"0 3 * * 2,3", monday, false},
+		{"0 3 15 * 1", monday, true}, // day of month or day of week
+		{"0 3 15 * 2", monday, false},
+		{"@daily", monday.Add(-3 * time.Hour), true},
+		{"@monthly", monday.Add(-3 * time.Hour), true},
+	}
+
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %s", tt.expr, err)
+		}
+
+		if got := c.matches(tt.t); got != tt.want {
+			t.Errorf("%q matches %s = %v, want %v", tt.expr, tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want error", expr)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// detachTimeout is how long a detach is tracked after
+	// ControllerUnpublishVolume returned
+	detachTimeout = 5 * time.Minute
+
+	// eventReasonDetachFailed is the reason of the events emitted for nodes
+	// a volume couldn't be detached from
+	eventReasonDetachFailed = "VolumeDetachFailed"
+)
+
+// trackDetach waits for the detach action of the volume in the background.
+// With async detaches, ControllerUnpublishVolume returns once the detach is
+// accepted, so draining a node with many volumes doesn't wait for each detach
+// in turn. A volume that's still attached when it's published again is
+// waited for by settleVolume. If the detach fails, it's counted in the
+// hcloud_csi_detach_failures_total metric and a warning event is emitted for
+// the node. release is called once the detach is finished, done is closed
+// afterwards.
+func (d *Driver) trackDetach(vol *hcloud.Volume, server *hcloud.Server, actionID int, release func(), ll *logrus.Entry) (done <-chan struct{}) {
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		defer release()
+
+		err := d.waitActionTimeout(context.Background(), vol.ID, actionID, detachTimeout)
+		if err != nil {
+			ll.WithError(err).Error("detaching volume failed")
+			atomic.AddInt32(&d.detachFailures, 1)
+			d.detachFailed(vol, server, err, ll)
+			return
+		}
+		ll.Info("volume is detached")
+	}()
+	return finished
+}
+
+// detachFailed emits the warning event for a failed detach if the driver has
+// access to the Kubernetes API. The node is expected to have the name of its
+// server.
+func (d *Driver) detachFailed(vol *hcloud.Volume, server *hcloud.Server, err error, ll *logrus.Entry) {
+	if d.kubeClient == nil || server == nil {
+		return
+	}
+
+	// events of cluster scoped objects are stored in the default namespace
+	ref := corev1.ObjectReference{
+		Kind:       "Node",
+		APIVersion: "v1",
+		Namespace:  metav1.NamespaceDefault,
+		Name:       server.Name,
+	}
+
+	message := fmt.Sprintf("volume %d could not be detached from server %d: %s", vol.ID, server.ID, err)
+	if err := d.warningEvent(ref, eventReasonDetachFailed, message); err != nil {
+		ll.WithError(err).Warn("could not create event")
+	}
+}
+
+// detachMetrics returns the metrics of the background detaches
+func (d *Driver) detachMetrics() []*metricFamily {
+	failures := newMetricFamily("hcloud_csi_detach_failures_total", "counter", "Number of the detaches tracked in the background that failed")
+	failures.add(float64(atomic.LoadInt32(&d.detachFailures)))
+	return []*metricFamily{failures}
+}
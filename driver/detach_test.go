@@ -0,0 +1,90 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	"github.com/sirupsen/logrus"
+)
+
+func TestTrackDetach(t *testing.T) {
+	cases := []struct {
+		name     string
+		status   hcloud.ActionStatus
+		failures int32
+	}{
+		{"success", hcloud.ActionStatusSuccess, 0},
+		{"failure", hcloud.ActionStatusError, 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				resp := &schema.ActionListResponse{}
+				for _, v := range r.URL.Query()["id"] {
+					id, _ := strconv.Atoi(v)
+					resp.Actions = append(resp.Actions, schema.Action{ID: id, Status: string(c.status)})
+				}
+				json.NewEncoder(w).Encode(resp)
+			}))
+			defer ts.Close()
+
+			d := &Driver{
+				actions: &actionClient{client: hcloud.NewClient(hcloud.WithEndpoint(ts.URL))},
+				log:     logrus.New().WithField("test_enabled", true),
+			}
+
+			var released int32
+			done := d.trackDetach(&hcloud.Volume{ID: 1}, &hcloud.Server{ID: 2, Name: "node"}, 3, func() {
+				atomic.AddInt32(&released, 1)
+			}, d.log)
+
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("detach was not finished")
+			}
+
+			if n := atomic.LoadInt32(&released); n != 1 {
+				t.Errorf("expected the server to be released once, got %d", n)
+			}
+			if n := atomic.LoadInt32(&d.detachFailures); n != c.failures {
+				t.Errorf("expected %d failed detaches, got %d", c.failures, n)
+			}
+
+			var buf bytes.Buffer
+			for _, m := range d.detachMetrics() {
+				m.write(&buf)
+			}
+			want := "hcloud_csi_detach_failures_total " + strconv.Itoa(int(c.failures)) + "\n"
+			if !strings.Contains(buf.String(), want) {
+				t.Errorf("expected the metrics to contain %q, got:\n%s", want, buf.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// devicePollInterval defines how often the device is checked if it can't be
+// watched with inotify
+const devicePollInterval = 500 * time.Millisecond
+
+// waitForDevice waits until the given device exists. udev creates the device
+// links (i.e. /dev/disk/by-id/scsi-0HC_Volume_1234) shortly after the volume
+// is attached, so their directory is watched with inotify to return as soon
+// as the link appears. It falls back to polling if the directory can't be
+// watched, i.e. if it doesn't exist yet.
+func waitForDevice(ctx context.Context, device string) error {
+	ctx, cancel := context.WithTimeout(ctx, deviceWaitTimeout)
+	defer cancel()
+
+	if _, err := os.Stat(device); err == nil {
+		return nil
+	}
+
+	watch, err := watchDir(filepath.Dir(device))
+	if err != nil {
+		return pollForDevice(ctx, device)
+	}
+	defer watch.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		watch.SetReadDeadline(deadline)
+	}
+
+	// the device might have appeared before the watch was added
+	buf := make([]byte, 4096)
+	for {
+		if _, err := os.Stat(device); err == nil {
+			return nil
+		}
+
+		// the events aren't parsed, every change of the directory is a
+		// reason to check again
+		if _, err := watch.Read(buf); err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("timeout occured waiting for device %q", device)
+			}
+			return pollForDevice(ctx, device)
+		}
+	}
+}
+
+// watchDir returns a file the inotify events of the directory can be read
+// from. Creating and moving entries into the directory is watched.
+func watchDir(dir string) (*os.File, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := syscall.InotifyAddWatch(fd, dir, syscall.IN_CREATE|syscall.IN_MOVED_TO); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	// the descriptor is non-blocking, so reads honor the deadline
+	return os.NewFile(uintptr(fd), "inotify"), nil
+}
+
+// pollForDevice checks whether the device exists until it does or ctx is
+// done
+func pollForDevice(ctx context.Context, device string) error {
+	ticker := time.NewTicker(devicePollInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := os.Stat(device); err == nil {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("timeout occured waiting for device %q", device)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWaitForDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hcloud-csi-device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	device := filepath.Join(dir, "scsi-0HC_Volume_1")
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		os.Symlink(os.DevNull, device)
+	}()
+
+	start := time.Now()
+	if err := waitForDevice(context.Background(), device); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("waitForDevice() took %s", took)
+	}
+
+	// the directory doesn't exist, it's polled
+	missing := filepath.Join(dir, "by-id", "scsi-0HC_Volume_2")
+	ctx, cancel := context.WithTimeout(context.Background(), 2*devicePollInterval)
+	defer cancel()
+	if err := waitForDevice(ctx, missing); err == nil {
+		t.Error("waitForDevice() returned no error for a missing device")
+	}
+}
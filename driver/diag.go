@@ -0,0 +1,572 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// DefaultDiagSelector selects the pods of the controller and the node
+	// plugin of the release manifests
+	DefaultDiagSelector = "app in (csi-hcloud-controller,csi-hcloud-node)"
+
+	// redacted replaces the secrets in the diagnostics bundle
+	redacted = "REDACTED"
+)
+
+// DiagParams defines the parameters of CollectDiagnostics
+type DiagParams struct {
+	ToolParams
+
+	// Namespace and Selector select the pods of the plugin, their config and
+	// logs are added to the bundle
+	Namespace string
+	Selector  string
+	// LogLines is the number of log lines added per container
+	LogLines int64
+
+	// JournalDir is the node operation journal, its entries are the
+	// operations in progress on the node. It's skipped if empty.
+	JournalDir string
+	// MountInfo is the mount table of the node, /proc/self/mountinfo if
+	// empty
+	MountInfo string
+
+	// Output receives the bundle, a gzipped tar archive
+	Output io.Writer
+}
+
+// CollectDiagnostics writes a bundle for support issues to p.Output. It
+// contains the version of the driver, the redacted config and the recent
+// logs of the plugin pods, the operations in progress, the mount table of
+// the node and the volumes of the driver and their servers.
+//
+// Every part is collected on its own, the parts that can't be collected are
+// listed in errors.txt of the bundle. Run it in the node plugin container to
+// add the journal and the mounts of the node.
+func CollectDiagnostics(p DiagParams) error {
+	if p.Output == nil {
+		return fmt.Errorf("an output is required for the diagnostics bundle")
+	}
+
+	namespace := p.Namespace
+	if namespace == "" {
+		namespace = "kube-system"
+	}
+	selector := p.Selector
+	if selector == "" {
+		selector = DefaultDiagSelector
+	}
+	logLines := p.LogLines
+	if logLines == 0 {
+		logLines = 1000
+	}
+	mountInfo := p.MountInfo
+	if mountInfo == "" {
+		mountInfo = "/proc/self/mountinfo"
+	}
+
+	ctx := context.Background()
+	d := &Driver{
+		log: logrus.New().WithFields(logrus.Fields{
+			"version": version,
+			"method":  "collect_diagnostics",
+		}),
+	}
+
+	gz := gzip.NewWriter(p.Output)
+	a := &diagArchive{tw: tar.NewWriter(gz), now: time.Now().UTC()}
+
+	a.addJSON("version.json", diagVersion{
+		Version:   version,
+		Commit:    commit,
+		TreeState: gitTreeState,
+		GoVersion: runtime.Version(),
+		Collected: a.now,
+	})
+
+	var nodes []string
+	if kubeClient, err := newKubeClient(p.Kubeconfig); err != nil {
+		a.failed("kubernetes", err)
+	} else {
+		d.kubeClient = kubeClient
+		nodes = a.collectPods(d, namespace, selector, logLines)
+		a.collectAttachments(d)
+	}
+
+	if p.Token == "" {
+		a.failed("hcloud", fmt.Errorf("no Hetzner Cloud access token is given"))
+	} else {
+		hcloudClient := newHCloudClient(p.Token, p.URL)
+		d.hcloudClient = hcloudClient
+		d.volumes = &hcloudClient.Volume
+		d.servers = &hcloudClient.Server
+		d.actions = &actionClient{client: hcloudClient}
+		a.collectHCloud(ctx, d, nodes)
+	}
+
+	if p.JournalDir != "" {
+		a.collectJournal(d, p.JournalDir)
+	}
+	a.collectMounts(mountInfo)
+
+	if len(a.errs) > 0 {
+		a.add("errors.txt", []byte(strings.Join(a.errs, "\n")+"\n"))
+	}
+
+	if a.err != nil {
+		return a.err
+	}
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	d.log.WithField("failed_parts", len(a.errs)).Info("diagnostics bundle is written")
+	return nil
+}
+
+// diagArchive writes the files of the diagnostics bundle. Writing stops at
+// the first error, it's returned by CollectDiagnostics.
+type diagArchive struct {
+	tw  *tar.Writer
+	now time.Time
+	err error
+
+	// errs are the parts of the bundle that couldn't be collected
+	errs []string
+}
+
+func (a *diagArchive) add(name string, data []byte) {
+	if a.err != nil {
+		return
+	}
+
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: a.now,
+	}
+	if a.err = a.tw.WriteHeader(hdr); a.err != nil {
+		return
+	}
+	_, a.err = a.tw.Write(data)
+}
+
+func (a *diagArchive) addJSON(name string, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		a.failed(name, err)
+		return
+	}
+	a.add(name, append(data, '\n'))
+}
+
+func (a *diagArchive) failed(part string, err error) {
+	a.errs = append(a.errs, fmt.Sprintf("%s: %s", part, err))
+}
+
+type diagVersion struct {
+	Version   string    `json:"version"`
+	Commit    string    `json:"commit"`
+	TreeState string    `json:"treeState"`
+	GoVersion string    `json:"goVersion"`
+	Collected time.Time `json:"collected"`
+}
+
+type diagPod struct {
+	Name       string          `json:"name"`
+	Node       string          `json:"node"`
+	Phase      string          `json:"phase"`
+	Started    *time.Time      `json:"started,omitempty"`
+	Containers []diagContainer `json:"containers"`
+}
+
+type diagContainer struct {
+	Name     string            `json:"name"`
+	Image    string            `json:"image"`
+	Args     []string          `json:"args,omitempty"`
+	Env      map[string]string `json:"env,omitempty"`
+	Ready    bool              `json:"ready"`
+	Restarts int32             `json:"restarts"`
+}
+
+// collectPods adds the redacted config of the plugin pods to pods.json and
+// their recent logs to logs/. It returns the nodes the pods run on.
+func (a *diagArchive) collectPods(d *Driver, namespace, selector string, logLines int64) []string {
+	pods, err := d.kubeClient.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		a.failed("pods", err)
+		return nil
+	}
+
+	var nodes []string
+	var summaries []diagPod
+	for _, pod := range pods.Items {
+		summary := diagPod{
+			Name:  pod.Name,
+			Node:  pod.Spec.NodeName,
+			Phase: string(pod.Status.Phase),
+		}
+		if pod.Status.StartTime != nil {
+			started := pod.Status.StartTime.Time
+			summary.Started = &started
+		}
+		if pod.Spec.NodeName != "" {
+			nodes = append(nodes, pod.Spec.NodeName)
+		}
+
+		statuses := map[string]corev1.ContainerStatus{}
+		for _, s := range pod.Status.ContainerStatuses {
+			statuses[s.Name] = s
+		}
+
+		for _, c := range pod.Spec.Containers {
+			container := diagContainer{
+				Name:     c.Name,
+				Image:    c.Image,
+				Ready:    statuses[c.Name].Ready,
+				Restarts: statuses[c.Name].RestartCount,
+			}
+			for _, arg := range c.Args {
+				container.Args = append(container.Args, redactArg(arg))
+			}
+			for _, env := range c.Env {
+				if container.Env == nil {
+					container.Env = map[string]string{}
+				}
+				container.Env[env.Name] = redactEnv(env)
+			}
+			summary.Containers = append(summary.Containers, container)
+
+			a.collectLogs(d, pod, c.Name, logLines, false)
+			if statuses[c.Name].RestartCount > 0 {
+				a.collectLogs(d, pod, c.Name, logLines, true)
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+
+	a.addJSON("pods.json", summaries)
+	return nodes
+}
+
+// collectLogs adds the last lines of the log of the container, of its
+// previous run if previous is set
+func (a *diagArchive) collectLogs(d *Driver, pod corev1.Pod, container string, lines int64, previous bool) {
+	name := path.Join("logs", pod.Name, container+".log")
+	if previous {
+		name = path.Join("logs", pod.Name, container+".previous.log")
+	}
+
+	logs, err := d.kubeClient.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container: container,
+		TailLines: &lines,
+		Previous:  previous,
+	}).DoRaw()
+	if err != nil {
+		a.failed(name, err)
+		return
+	}
+	a.add(name, logs)
+}
+
+type diagAttachment struct {
+	Name             string     `json:"name"`
+	Node             string     `json:"node"`
+	PersistentVolume string     `json:"persistentVolume"`
+	Attached         bool       `json:"attached"`
+	AttachError      string     `json:"attachError,omitempty"`
+	DetachError      string     `json:"detachError,omitempty"`
+	Deleted          *time.Time `json:"deleted,omitempty"`
+}
+
+// collectAttachments adds the VolumeAttachments of the driver, the attaches
+// and detaches the CO waits for, to volumeattachments.json
+func (a *diagArchive) collectAttachments(d *Driver) {
+	vas, _, _, err := d.volumeAttachments()
+	if err != nil {
+		a.failed("volumeattachments", err)
+		return
+	}
+
+	var attachments []diagAttachment
+	for _, va := range vas {
+		attachment := diagAttachment{
+			Name:     va.Name,
+			Node:     va.Spec.NodeName,
+			Attached: va.Status.Attached,
+		}
+		if va.Spec.Source.PersistentVolumeName != nil {
+			attachment.PersistentVolume = *va.Spec.Source.PersistentVolumeName
+		}
+		if va.Status.AttachError != nil {
+			attachment.AttachError = va.Status.AttachError.Message
+		}
+		if va.Status.DetachError != nil {
+			attachment.DetachError = va.Status.DetachError.Message
+		}
+		if va.DeletionTimestamp != nil {
+			deleted := va.DeletionTimestamp.Time
+			attachment.Deleted = &deleted
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	a.addJSON("volumeattachments.json", attachments)
+}
+
+type diagVolume struct {
+	ID          int               `json:"id"`
+	Name        string            `json:"name"`
+	Size        int               `json:"size"`
+	Location    string            `json:"location"`
+	Server      int               `json:"server,omitempty"`
+	LinuxDevice string            `json:"linuxDevice"`
+	Protected   bool              `json:"protected"`
+	Labels      map[string]string `json:"labels"`
+	Created     time.Time         `json:"created"`
+
+	// RunningActions are the commands of the actions in progress, i.e. an
+	// attach or a resize
+	RunningActions []string `json:"runningActions,omitempty"`
+}
+
+type diagServer struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	Datacenter string `json:"datacenter"`
+	Locked     bool   `json:"locked"`
+	Volumes    []int  `json:"volumes"`
+}
+
+// collectHCloud adds the volumes of the driver to hcloud/volumes.json and
+// the servers they're attached to and the servers of the nodes to
+// hcloud/servers.json
+func (a *diagArchive) collectHCloud(ctx context.Context, d *Driver, nodes []string) {
+	var volumes []diagVolume
+	serverIDs := map[int]bool{}
+	err := d.eachVolume(ctx, "createdBy="+createdByHCloud, func(vol *hcloud.Volume) bool {
+		v := diagVolume{
+			ID:          vol.ID,
+			Name:        vol.Name,
+			Size:        vol.Size,
+			LinuxDevice: vol.LinuxDevice,
+			Protected:   vol.Protection.Delete,
+			Labels:      vol.Labels,
+			Created:     vol.Created,
+		}
+		if vol.Location != nil {
+			v.Location = vol.Location.Name
+		}
+		if vol.Server != nil {
+			v.Server = vol.Server.ID
+			serverIDs[vol.Server.ID] = true
+		}
+
+		actions, err := d.runningVolumeActions(ctx, vol.ID)
+		if err != nil {
+			a.failed(fmt.Sprintf("actions of volume %d", vol.ID), err)
+		}
+		for _, action := range actions {
+			v.RunningActions = append(v.RunningActions, action.Command)
+		}
+
+		volumes = append(volumes, v)
+		return true
+	})
+	if err != nil {
+		a.failed("hcloud volumes", err)
+	} else {
+		a.addJSON("hcloud/volumes.json", volumes)
+	}
+
+	var servers []*hcloud.Server
+	for _, name := range nodes {
+		server, _, err := d.servers.GetByName(ctx, name)
+		if err != nil {
+			a.failed(fmt.Sprintf("server %q", name), err)
+			continue
+		}
+		if server != nil && !serverIDs[server.ID] {
+			serverIDs[server.ID] = true
+			servers = append(servers, server)
+		}
+	}
+	for id := range serverIDs {
+		if containsServer(servers, id) {
+			continue
+		}
+		server, _, err := d.servers.GetByID(ctx, id)
+		if err != nil {
+			a.failed(fmt.Sprintf("server %d", id), err)
+			continue
+		}
+		if server != nil {
+			servers = append(servers, server)
+		}
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].ID < servers[j].ID })
+
+	var summaries []diagServer
+	for _, server := range servers {
+		summary := diagServer{
+			ID:     server.ID,
+			Name:   server.Name,
+			Status: string(server.Status),
+			Locked: server.Locked,
+		}
+		if server.Datacenter != nil {
+			summary.Datacenter = server.Datacenter.Name
+		}
+		for _, vol := range server.Volumes {
+			summary.Volumes = append(summary.Volumes, vol.ID)
+		}
+		summaries = append(summaries, summary)
+	}
+	a.addJSON("hcloud/servers.json", summaries)
+}
+
+func containsServer(servers []*hcloud.Server, id int) bool {
+	for _, server := range servers {
+		if server.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// collectJournal adds the entries of the node journal, the node operations
+// in progress or interrupted by a crash, to journal.json
+func (a *diagArchive) collectJournal(d *Driver, dir string) {
+	if _, err := os.Stat(dir); err != nil {
+		a.failed("journal", err)
+		return
+	}
+
+	journal := &nodeJournal{dir: dir, log: d.log}
+	entries, err := journal.entries()
+	if err != nil {
+		a.failed("journal", err)
+		return
+	}
+	a.addJSON("journal.json", entries)
+}
+
+// collectMounts adds the mounts of the kubelet and the volumes from the
+// mount table to mounts.txt
+func (a *diagArchive) collectMounts(mountInfo string) {
+	data, err := ioutil.ReadFile(mountInfo)
+	if err != nil {
+		a.failed("mounts", err)
+		return
+	}
+
+	var mounts bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, "kubelet") || strings.Contains(line, "HC_Volume") {
+			fmt.Fprintln(&mounts, line)
+		}
+	}
+	a.add("mounts.txt", mounts.Bytes())
+}
+
+// sensitive returns true if the flag or environment variable holds a secret
+func sensitive(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"token", "secret", "key", "password"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactArg returns the argument with its secrets replaced. The values of
+// secret flags are replaced, unless they reference an environment variable,
+// and the credentials of URLs are removed.
+func redactArg(arg string) string {
+	if !strings.HasPrefix(arg, "-") || !strings.Contains(arg, "=") {
+		return arg
+	}
+
+	parts := strings.SplitN(arg, "=", 2)
+	name, value := parts[0], parts[1]
+	if strings.HasPrefix(value, "$(") || value == "" {
+		return arg
+	}
+	if sensitive(name) {
+		return name + "=" + redacted
+	}
+	return name + "=" + redactValue(value)
+}
+
+// redactEnv returns the value of the environment variable, or where it's
+// taken from, with secrets replaced
+func redactEnv(env corev1.EnvVar) string {
+	if from := env.ValueFrom; from != nil {
+		switch {
+		case from.SecretKeyRef != nil:
+			return fmt.Sprintf("secret %s/%s", from.SecretKeyRef.Name, from.SecretKeyRef.Key)
+		case from.ConfigMapKeyRef != nil:
+			return fmt.Sprintf("config map %s/%s", from.ConfigMapKeyRef.Name, from.ConfigMapKeyRef.Key)
+		case from.FieldRef != nil:
+			return "field " + from.FieldRef.FieldPath
+		}
+		return "reference"
+	}
+
+	if sensitive(env.Name) && env.Value != "" {
+		return redacted
+	}
+	return redactValue(env.Value)
+}
+
+// redactValue removes the credentials and the query of URLs, other values
+// are returned as they are
+func redactValue(value string) string {
+	if !strings.Contains(value, "://") {
+		return value
+	}
+	return redactURL(value)
+}
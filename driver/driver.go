@@ -21,6 +21,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
@@ -28,14 +29,32 @@ import (
 	"strconv"
 	"sync"
 
+	drivererrors "github.com/apricote/hcloud-csi-driver/driver/errors"
 	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
 	"github.com/hetznercloud/hcloud-go/hcloud"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 const (
 	driverName = "de.apricote.hcloud.csi.volumes"
+
+	// listenFdsStart is the first file descriptor passed by systemd socket
+	// activation
+	listenFdsStart = 3
+
+	// defaultDirMode is the default permission of the staging and publish
+	// target directories created by the driver
+	defaultDirMode os.FileMode = 0750
+
+	// ModeAll, ModeController and ModeNode define which CSI services the
+	// plugin serves. COs such as Nomad run the controller and node plugins
+	// as separate jobs.
+	ModeAll        = "all"
+	ModeController = "controller"
+	ModeNode       = "node"
 )
 
 var (
@@ -52,61 +71,735 @@ var (
 //
 type Driver struct {
 	endpoint string
+	mode     string
 	nodeID   string
 	hostname string
 	location string
 
+	// datacenter and topologyGranularity are used to report the datacenter
+	// in the topology of the node, see TopologyGranularityDatacenter
+	datacenter          string
+	topologyGranularity string
+
+	datacentersMu sync.Mutex          // protects datacenters
+	datacenters   map[string][]string // datacenter names by location, see locationDatacenters
+
+	networkZonesMu sync.Mutex        // protects networkZones
+	networkZones   map[string]string // network zones by location, see locationNetworkZones
+
+	// clusterID is added as label to the volumes created by the driver, see
+	// NewDriverParams.ClusterID
+	clusterID string
+
+	// dedicated is set if the driver doesn't run on a Hetzner Cloud server,
+	// e.g. on a dedicated server in a hybrid cluster
+	dedicated bool
+
+	stagingDirMode os.FileMode
+	publishDirMode os.FileMode
+
 	srv          *grpc.Server
 	hcloudClient *hcloud.Client
+	volumes      VolumeService
+	servers      ServerService
+	actions      ActionService
 	mounter      Mounter
 	log          *logrus.Entry
 
+	// interceptors are additional unary interceptors registered via
+	// AddUnaryInterceptor
+	interceptors []grpc.UnaryServerInterceptor
+
+	// grpcGzip enables compressing the responses with gzip
+	grpcGzip bool
+
+	// backups stores the backups that implement snapshots. It's nil if no
+	// backup store is configured.
+	backups    objectStore
+	backupsMu  sync.Mutex        // protects backupJobs
+	backupJobs map[string]string // backups currently uploading, id to source volume id
+
+	// mover copies the data of backups and populated volumes
+	mover dataMover
+
+	// progress tracks the copies of the mover and the other long-running
+	// operations for the admin endpoint
+	progress progressTracker
+
+	// populator enables populating volumes from the PVC annotation
+	populator    bool
+	populateMu   sync.Mutex   // protects populateJobs
+	populateJobs map[int]bool // ids of the volumes currently populated
+
+	wipeMu   sync.Mutex   // protects wipeJobs
+	wipeJobs map[int]bool // ids of the volumes currently wiped before they're deleted
+
+	// kubeClient is used by the background controllers that need access to
+	// the Kubernetes API. It's nil if none of them is enabled.
+	kubeClient kubernetes.Interface
+
+	// provisionLimiter enforces the provisioning rate limits of the
+	// storage classes
+	provisionLimiter provisionLimiter
+
+	// attachCache remembers the volumes found attached in
+	// ControllerPublishVolume
+	attachCache attachCache
+
+	// attachBackoff delays the attaches of volumes that failed to attach to
+	// copy their data
+	attachBackoff attachBackoff
+
+	// serverQueue orders the attaches and detaches of each server
+	serverQueue serverQueue
+
+	// actionWatcher polls the actions waitAction waits for
+	actionWatcher actionWatcher
+
+	// creating tracks the CreateVolume calls in progress by volume name
+	creating inFlight
+
+	// backupScheduler creates backups of annotated PVCs, nil if disabled
+	backupScheduler *backupScheduler
+
+	// volumePool keeps volumes ready to be claimed by CreateVolume, nil if
+	// disabled
+	volumePool *volumePool
+
+	// nfs exports ReadWriteMany volumes via NFS, nil if disabled
+	nfs *nfsExporter
+
+	// volumeAutoscaler grows the volumes of the node that fill up, nil if
+	// disabled
+	volumeAutoscaler *volumeAutoscaler
+
+	// nodeRecovery cleans up the attachments of replaced nodes, nil if
+	// disabled
+	nodeRecovery *nodeRecovery
+
+	// detachStale enables detaching stale attachments in
+	// ControllerPublishVolume, see detachStaleAttachment
+	detachStale bool
+
+	// asyncDetach makes ControllerUnpublishVolume track the detach in the
+	// background instead of waiting for it, see trackDetach
+	asyncDetach bool
+
+	// detachFailures counts the failed background detaches, accessed
+	// atomically
+	detachFailures int32
+
+	// lostVolumeDetector marks the PVs of deleted volumes, nil if disabled
+	lostVolumeDetector *lostVolumeDetector
+
+	// costCollector counts the provisioned volumes for the cost metrics,
+	// nil if disabled
+	costCollector *costCollector
+
+	// labelSyncer mirrors the labels of the volumes to their PVs, nil if
+	// disabled
+	labelSyncer *labelSyncer
+
+	// nodeVolumes remembers the volumes staged and published by the node
+	// plugin
+	nodeVolumes nodeVolumes
+
+	// formatCache remembers the devices found formatted by the node plugin
+	formatCache formatCache
+
+	// formatLimiter bounds the number of volumes formatted at the same time
+	formatLimiter formatLimiter
+
+	// journal records the operations of the node plugin, nil if disabled
+	journal *nodeJournal
+
+	// prober checks the dependencies of the plugin for Probe
+	prober *healthProber
+
+	// maintenance and maintenanceFile enable the maintenance mode, see
+	// inMaintenance
+	maintenance     bool
+	maintenanceFile string
+
+	// adminAddress is the address of the admin endpoint, adminSrv serves it
+	// while the driver runs
+	adminAddress string
+	adminSrv     *http.Server
+
+	// stopCh is closed once the driver is stopped to stop all background
+	// controllers
+	stopCh chan struct{}
+
 	// ready defines whether the driver is ready to function. This value will
 	// be used by the `Identity` service via the `Probe()` method.
 	readyMu sync.Mutex // protects ready
 	ready   bool
 }
 
+// NewDriverParams defines the parameters that can be passed to NewDriver with
+// WithParams.
+type NewDriverParams struct {
+	Endpoint string
+	Token    string
+	URL      string
+	// Hostname is the name of the server the plugin runs on. The hostname of
+	// the machine is used if it's empty.
+	Hostname string
+
+	// Metadata is the metadata service the node plugin looks up its server
+	// in. If it's nil or fails, the server is looked up by Hostname.
+	Metadata MetadataClient
+
+	// Mode defines which CSI services are served, ModeAll if empty
+	Mode string
+
+	// GRPCGzip enables compressing the gRPC responses with gzip, so the
+	// responses of ListVolumes and ListSnapshots in projects with thousands
+	// of volumes stay below the message size limits of the sidecars. The
+	// clients must accept gzip encoded responses.
+	GRPCGzip bool
+
+	// TopologyGranularity defines the topology segments of the nodes and
+	// volumes, TopologyGranularityLocation if empty
+	TopologyGranularity string
+
+	// StagingDirMode and PublishDirMode define the permissions of the
+	// staging and publish target directories created by the node plugin. If
+	// not set, defaultDirMode is used.
+	StagingDirMode os.FileMode
+	PublishDirMode os.FileMode
+
+	// BackupURL is the location of the object store the snapshots are
+	// backed up to, i.e: s3://endpoint/bucket/prefix or
+	// webdav://storagebox/path. Snapshots are disabled if it's empty.
+	BackupURL string
+	// BackupAccessKeyID and BackupSecretAccessKey are the credentials for
+	// the backup store (username and password for WebDAV).
+	BackupAccessKeyID     string
+	BackupSecretAccessKey string
+	// BackupRegion is the region of S3 compatible backup stores
+	BackupRegion string
+	// BackupEncryptionKey is the base64 encoded 256 bit key the backup data
+	// is encrypted with. Backups are not encrypted if it's empty.
+	BackupEncryptionKey string
+
+	// BackupSchedule enables creating backups of PVCs annotated with a
+	// schedule. At most BackupScheduleConcurrency scheduled backups are
+	// uploaded at the same time.
+	BackupSchedule            bool
+	BackupScheduleConcurrency int
+
+	// DataMover selects how the data of backups is copied, either
+	// DataMoverLocal (the default) or DataMoverPod. The helper pods of
+	// DataMoverPod run DataMoverImage in DataMoverNamespace and read the
+	// backup store credentials from DataMoverSecret.
+	DataMover          string
+	DataMoverImage     string
+	DataMoverNamespace string
+	DataMoverSecret    string
+
+	// VolumePool defines the number of unattached volumes to keep ready per
+	// size in GB. If VolumePoolFsType is set, they're formatted in advance.
+	VolumePool       map[int]int
+	VolumePoolFsType string
+
+	// VolumePopulator enables populating new volumes from the image set in
+	// the annotation of their PVC
+	VolumePopulator bool
+
+	// NFSServerImage enables ReadWriteMany volumes. They're exported by NFS
+	// server deployments running NFSServerImage in NFSNamespace.
+	NFSServerImage string
+	NFSNamespace   string
+
+	// VolumeAutoscale enables growing the volumes attached to the node once
+	// their filesystem crosses the fill level set in their labels
+	VolumeAutoscale bool
+
+	// ClusterID identifies the volumes of the cluster in a project shared by
+	// several clusters. It's added as the clusterID label to the new volumes.
+	ClusterID string
+
+	// NodeRecovery enables detaching the volumes left attached to replaced
+	// or rebuilt nodes. It requires a ClusterID, only the volumes labeled
+	// with it are recovered.
+	NodeRecovery bool
+
+	// LostVolumeCheck enables marking the PVs whose volume was deleted
+	// outside of the plugin
+	LostVolumeCheck bool
+
+	// SyncVolumeLabels enables mirroring the labels of the volumes, i.e. set
+	// by tooling outside of Kubernetes, to annotations of their PVs
+	SyncVolumeLabels bool
+
+	// DetachStale enables detaching volumes from servers that don't need
+	// them anymore when they're attached to another node
+	DetachStale bool
+
+	// AsyncDetach makes ControllerUnpublishVolume return once the detach is
+	// accepted. By default it returns only once the volume is detached.
+	AsyncDetach bool
+
+	// NodeJournalDir is the directory the node plugin records its staging
+	// and publishing operations in, so operations interrupted by a crash are
+	// cleaned up on the next start. The journal is disabled if it's empty.
+	NodeJournalDir string
+
+	// MaxQueuedAttaches is the number of attaches that may wait for the
+	// other operations of a server. Further attaches fail with UNAVAILABLE.
+	// It's unlimited if zero.
+	MaxQueuedAttaches int
+
+	// MaxConcurrentFormats is the number of volumes formatted at the same
+	// time, defaultMaxConcurrentFormats if zero and unlimited if negative
+	MaxConcurrentFormats int
+
+	// Maintenance enables the maintenance mode: no new volumes are
+	// provisioned or grown, the existing ones keep working. It's enabled as
+	// well while MaintenanceFile exists, so it can be toggled at runtime.
+	Maintenance     bool
+	MaintenanceFile string
+
+	// Kubeconfig is the path to the kubeconfig file used by the background
+	// controllers. The in-cluster configuration is used if it's empty.
+	Kubeconfig string
+
+	// AdminAddress is the TCP address the admin endpoint serves the state
+	// of the plugin and its metrics on, i.e: :9189. It's disabled if empty.
+	AdminAddress string
+
+	// CostMetrics enables the metrics of the provisioned volumes by
+	// StorageClass and PVC namespace on the admin endpoint. The namespaces
+	// require the external-provisioner to pass the PVC metadata
+	// (--extra-create-metadata).
+	CostMetrics bool
+}
+
 // NewDriver returns a CSI plugin that contains the necessary gRPC
 // interfaces to interact with Kubernetes over unix domain sockets for
 // managaing Hetzner Cloud Volumes
-func NewDriver(ep, token, url, hostname string) (*Driver, error) {
+func NewDriver(opts ...Option) (*Driver, error) {
+	var o driverOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	p := o.params
+	for _, set := range o.fields {
+		set(&p)
+	}
 
-	hcloudClient := hcloud.NewClient(
-		hcloud.WithToken(token),
-		hcloud.WithApplication("hcloud-csi-driver", version),
-		hcloud.WithEndpoint(url))
+	hcloudClient := o.hcloudClient
+	if hcloudClient == nil {
+		hcloudClient = newHCloudClient(p.Token, p.URL)
+	}
 
-	server, _, err := hcloudClient.Server.GetByName(context.TODO(), hostname)
-	if err != nil {
-		return nil, fmt.Errorf("could not get hcloud server by hostname: %s", err)
+	switch p.Mode {
+	case "":
+		p.Mode = ModeAll
+	case ModeAll, ModeController, ModeNode:
+	default:
+		return nil, fmt.Errorf("unknown mode %q, must be one of %q, %q or %q", p.Mode, ModeAll, ModeController, ModeNode)
+	}
+
+	switch p.TopologyGranularity {
+	case "":
+		p.TopologyGranularity = TopologyGranularityLocation
+	case TopologyGranularityLocation, TopologyGranularityDatacenter:
+	default:
+		return nil, fmt.Errorf("unknown topology granularity %q, must be %q or %q",
+			p.TopologyGranularity, TopologyGranularityLocation, TopologyGranularityDatacenter)
+	}
+
+	if p.Hostname == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("could not get hostname: %s", err)
+		}
+		p.Hostname = hostname
+	}
+
+	// the server is looked up while the rest of the plugin is set up, the
+	// request takes most of the startup time. The lookup is canceled if the
+	// setup fails, the buffered channel lets it finish without a receiver.
+	type lookupResult struct {
+		server      *nodeServer
+		metadataErr error
+		err         error
+	}
+	lookupCtx, cancelLookup := context.WithCancel(context.Background())
+	defer cancelLookup()
+	lookupDone := make(chan lookupResult, 1)
+	go func() {
+		var r lookupResult
+		r.server, r.metadataErr, r.err = lookupNodeServer(lookupCtx, p.Metadata, &hcloudClient.Server, p.Hostname)
+		lookupDone <- r
+	}()
+
+	stagingDirMode := p.StagingDirMode
+	if stagingDirMode == 0 {
+		stagingDirMode = defaultDirMode
+	}
+
+	publishDirMode := p.PublishDirMode
+	if publishDirMode == 0 {
+		publishDirMode = defaultDirMode
+	}
+
+	var err error
+	var backups objectStore
+	if p.BackupURL != "" {
+		backups, err = newObjectStore(p.BackupURL, p.BackupAccessKeyID, p.BackupSecretAccessKey, p.BackupRegion)
+		if err != nil {
+			return nil, err
+		}
+
+		backups, err = encryptStore(backups, p.BackupEncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.BackupSchedule && backups == nil {
+		return nil, fmt.Errorf("scheduled backups require a backup store")
+	}
+
+	if p.ClusterID != "" {
+		if err := validateLabel(labelClusterID, p.ClusterID); err != nil {
+			return nil, fmt.Errorf("invalid cluster id: %s", err)
+		}
+	}
+
+	if p.NodeRecovery && p.ClusterID == "" {
+		return nil, fmt.Errorf("node recovery requires a cluster id")
+	}
+
+	if p.CostMetrics && p.AdminAddress == "" {
+		return nil, fmt.Errorf("cost metrics require an admin address")
 	}
 
-	location := server.Datacenter.Location.Name
-	nodeID := strconv.Itoa(server.ID)
+	switch p.DataMover {
+	case "", DataMoverLocal:
+	case DataMoverPod:
+		if p.DataMoverImage == "" {
+			return nil, fmt.Errorf("the %q data mover requires an image", DataMoverPod)
+		}
+	default:
+		return nil, fmt.Errorf("unknown data mover %q, must be %q or %q", p.DataMover, DataMoverLocal, DataMoverPod)
+	}
+
+	kubeClient := o.kubeClient
+	if kubeClient == nil && (p.BackupSchedule || p.DataMover == DataMoverPod || p.VolumePopulator || p.NFSServerImage != "" || p.NodeRecovery || p.LostVolumeCheck || p.SyncVolumeLabels || p.DetachStale || p.AsyncDetach) {
+		kubeClient, err = newKubeClient(p.Kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	lookup := <-lookupDone
+	if lookup.err != nil {
+		return nil, fmt.Errorf("could not get hcloud server by hostname: %s", lookup.err)
+	}
+	server, metadataErr := lookup.server, lookup.metadataErr
 
-	log := logrus.New().WithFields(logrus.Fields{
+	var location, datacenter, nodeID string
+	var dedicated bool
+	switch {
+	case server != nil:
+		location = server.location
+		datacenter = server.datacenter
+		nodeID = strconv.Itoa(server.id)
+	case p.Mode != ModeController:
+		// hybrid clusters run the node plugin on dedicated (Robot) servers as
+		// well. Volumes can't be attached to them, but the plugin must not
+		// fail to start.
+		dedicated = true
+		nodeID = p.Hostname
+	default:
+		return nil, fmt.Errorf("could not find hcloud server %q", p.Hostname)
+	}
+
+	log := o.log
+	if log == nil {
+		log = logrus.NewEntry(logrus.New())
+	}
+	log = log.WithFields(logrus.Fields{
 		"location": location,
-		"hostname": hostname,
+		"hostname": p.Hostname,
 		"version":  version,
 	})
 
-	return &Driver{
-		endpoint:     ep,
-		hostname:     hostname,
-		nodeID:       nodeID,
-		location:     location,
-		hcloudClient: hcloudClient,
-		mounter:      newMounter(log),
-		log:          log,
-	}, nil
+	mounter := o.mounter
+	if mounter == nil {
+		mounter = newMounter(log)
+	}
+
+	if metadataErr != nil {
+		log.WithError(metadataErr).Warn("metadata service failed, the server was looked up by hostname")
+	}
+	if dedicated {
+		log.Warn("no hcloud server found for the hostname, volumes can't be attached to this node")
+	}
+
+	d := &Driver{
+		endpoint:            p.Endpoint,
+		mode:                p.Mode,
+		hostname:            p.Hostname,
+		nodeID:              nodeID,
+		dedicated:           dedicated,
+		location:            location,
+		datacenter:          datacenter,
+		clusterID:           p.ClusterID,
+		topologyGranularity: p.TopologyGranularity,
+		stagingDirMode:      stagingDirMode,
+		publishDirMode:      publishDirMode,
+		hcloudClient:        hcloudClient,
+		volumes:             &hcloudClient.Volume,
+		servers:             &hcloudClient.Server,
+		actions:             &actionClient{client: hcloudClient},
+		mounter:             mounter,
+		log:                 log,
+		backups:             backups,
+		backupJobs:          map[string]string{},
+		kubeClient:          kubeClient,
+		populator:           p.VolumePopulator,
+		populateJobs:        map[int]bool{},
+		wipeJobs:            map[int]bool{},
+		detachStale:         p.DetachStale,
+		asyncDetach:         p.AsyncDetach,
+		grpcGzip:            p.GRPCGzip,
+		formatLimiter:       newFormatLimiter(p.MaxConcurrentFormats),
+		maintenance:         p.Maintenance,
+		maintenanceFile:     p.MaintenanceFile,
+		adminAddress:        p.AdminAddress,
+	}
+
+	d.mover = &localMover{d: d}
+	if p.DataMover == DataMoverPod {
+		namespace := p.DataMoverNamespace
+		if namespace == "" {
+			namespace = "kube-system"
+		}
+
+		d.mover = &podMover{
+			d:            d,
+			image:        p.DataMoverImage,
+			namespace:    namespace,
+			secret:       p.DataMoverSecret,
+			backupURL:    p.BackupURL,
+			backupRegion: p.BackupRegion,
+		}
+	}
+
+	if p.BackupSchedule {
+		d.backupScheduler = newBackupScheduler(d, p.BackupScheduleConcurrency)
+	}
+
+	if len(p.VolumePool) > 0 {
+		d.volumePool = newVolumePool(d, p.VolumePool, p.VolumePoolFsType)
+	}
+
+	if p.NodeRecovery && p.Mode != ModeNode {
+		d.nodeRecovery = newNodeRecovery(d)
+	}
+
+	if p.LostVolumeCheck && p.Mode != ModeNode {
+		d.lostVolumeDetector = newLostVolumeDetector(d)
+	}
+
+	if p.CostMetrics && p.Mode != ModeNode {
+		d.costCollector = newCostCollector(d)
+	}
+
+	if p.SyncVolumeLabels && p.Mode != ModeNode {
+		d.labelSyncer = newLabelSyncer(d)
+	}
+
+	d.prober = newHealthProber(d)
+	d.serverQueue.maxAttaches = p.MaxQueuedAttaches
+
+	if p.NodeJournalDir != "" && p.Mode != ModeController {
+		d.journal, err = newNodeJournal(d, p.NodeJournalDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.VolumeAutoscale && p.Mode != ModeController && !dedicated {
+		d.volumeAutoscaler = newVolumeAutoscaler(d)
+	}
+
+	if p.NFSServerImage != "" {
+		namespace := p.NFSNamespace
+		if namespace == "" {
+			namespace = "kube-system"
+		}
+
+		d.nfs = &nfsExporter{
+			d:         d,
+			image:     p.NFSServerImage,
+			namespace: namespace,
+		}
+	}
+
+	return d, nil
+}
+
+// newKubeClient returns a client for the Kubernetes API. If kubeconfig is
+// empty, the in-cluster configuration is used.
+func newKubeClient(kubeconfig string) (kubernetes.Interface, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("could not load kubernetes config: %s", err)
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("could not create kubernetes client: %s", err)
+	}
+
+	return client, nil
 }
 
 // Run starts the CSI plugin by communication over the given endpoint
 func (d *Driver) Run() error {
+	listener, addr, err := d.listen()
+	if err != nil {
+		return err
+	}
+
+	// log response errors for better observability. Errors wrapping the
+	// errors of the driver, e.g. by the interceptors of embedders, are sent
+	// with their code.
+	errHandler := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		if err != nil {
+			d.log.WithError(err).WithField("method", info.FullMethod).Error("method failed")
+		}
+		return resp, drivererrors.Status(err)
+	}
+
+	// warn the user, it'll not propagate to the user but at least we see if
+	// something is wrong in the logs. It's checked in the background, so the
+	// node plugin serves the mounts of existing volumes right away after a
+	// restart.
+	go func() {
+		if err := d.checkLimit(context.Background()); err != nil {
+			d.log.WithError(err).Warn("CSI plugin will not function correctly, please resolve volume limit")
+		}
+	}()
+
+	// clean up before serving, so the CO's retries see the rolled back state
+	if d.journal != nil {
+		if err := d.recoverJournal(context.Background()); err != nil {
+			d.log.WithError(err).Error("could not recover interrupted node operations")
+		}
+	}
+
+	// the admin endpoint is started before the background controllers, so
+	// nothing has to be stopped if its address is in use
+	if d.adminAddress != "" {
+		if err := d.serveAdmin(); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	interceptors := append([]grpc.UnaryServerInterceptor{errHandler}, d.interceptors...)
+
+	opts := []grpc.ServerOption{grpc.UnaryInterceptor(chainUnaryInterceptors(interceptors...))}
+
+	// the vendored gRPC can't choose the compression per method, so all
+	// responses are compressed, not just the large ones of ListVolumes and
+	// ListSnapshots
+	if d.grpcGzip {
+		opts = append(opts,
+			grpc.RPCCompressor(grpc.NewGZIPCompressor()),
+			grpc.RPCDecompressor(grpc.NewGZIPDecompressor()))
+	}
+
+	d.srv = grpc.NewServer(opts...)
+	csi.RegisterIdentityServer(d.srv, d)
+	if d.servesController() {
+		csi.RegisterControllerServer(d.srv, d)
+	}
+	if d.servesNode() {
+		csi.RegisterNodeServer(d.srv, d)
+	}
+	registerHealthServer(d.srv, d)
+
+	d.readyMu.Lock()
+	d.stopCh = make(chan struct{})
+	d.readyMu.Unlock()
+
+	if d.backupScheduler != nil {
+		go d.backupScheduler.run(d.stopCh)
+	}
+
+	if d.volumePool != nil {
+		go d.volumePool.run(d.stopCh)
+	}
+
+	if d.volumeAutoscaler != nil {
+		go d.volumeAutoscaler.run(d.stopCh)
+	}
+
+	if d.prober != nil {
+		go d.prober.run(d.stopCh)
+	}
+
+	if d.nodeRecovery != nil {
+		go d.nodeRecovery.run(d.stopCh)
+	}
+
+	if d.lostVolumeDetector != nil {
+		go d.lostVolumeDetector.run(d.stopCh)
+	}
+
+	if d.costCollector != nil {
+		go d.costCollector.run(d.stopCh)
+	}
+
+	if d.labelSyncer != nil {
+		go d.labelSyncer.run(d.stopCh)
+	}
+
+	if d.backups != nil && d.servesController() {
+		go d.runBackupPruner(d.stopCh)
+	}
+
+	d.readyMu.Lock()
+	d.ready = true // we're now ready to go!
+	d.readyMu.Unlock()
+	d.log.WithField("addr", addr).Info("server started")
+	return d.srv.Serve(listener)
+}
+
+// listen returns the listener the gRPC server should be served on. If the
+// process was started via systemd socket activation (LISTEN_FDS), the already
+// open socket is used, otherwise a new unix domain socket is created at the
+// endpoint.
+func (d *Driver) listen() (net.Listener, string, error) {
+	listener, err := activatedListener(os.Getenv, listenFdsStart)
+
+	// don't pass the sockets down to any child processes we execute
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if listener != nil {
+		addr := listener.Addr().String()
+		d.log.WithField("socket", addr).Info("using socket passed by systemd socket activation")
+		return listener, addr, nil
+	}
+
 	u, err := url.Parse(d.endpoint)
 	if err != nil {
-		return fmt.Errorf("unable to parse address: %q", err)
+		return nil, "", fmt.Errorf("unable to parse address: %q", err)
 	}
 
 	addr := path.Join(u.Host, filepath.FromSlash(u.Path))
@@ -116,53 +809,103 @@ func (d *Driver) Run() error {
 
 	// CSI plugins talk only over UNIX sockets currently
 	if u.Scheme != "unix" {
-		return fmt.Errorf("currently only unix domain sockets are supported, have: %s", u.Scheme)
+		return nil, "", fmt.Errorf("currently only unix domain sockets are supported, have: %s", u.Scheme)
 	} else {
 		// remove the socket if it's already there. This can happen if we
 		// deploy a new version and the socket was created from the old running
 		// plugin.
 		d.log.WithField("socket", addr).Info("removing socket")
 		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
-			return fmt.Errorf("failed to remove unix domain socket file %s, error: %s", addr, err)
+			return nil, "", fmt.Errorf("failed to remove unix domain socket file %s, error: %s", addr, err)
 		}
 	}
 
-	listener, err := net.Listen(u.Scheme, addr)
+	listener, err = net.Listen(u.Scheme, addr)
 	if err != nil {
-		return fmt.Errorf("failed to listen: %v", err)
+		return nil, "", fmt.Errorf("failed to listen: %v", err)
 	}
 
-	// log response errors for better observability
-	errHandler := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-		resp, err := handler(ctx, req)
-		if err != nil {
-			d.log.WithError(err).WithField("method", info.FullMethod).Error("method failed")
-		}
-		return resp, err
+	return listener, addr, nil
+}
+
+// activatedListener returns the socket passed to the process via the systemd
+// socket activation protocol as file descriptor fd, which is listenFdsStart
+// outside of tests. The LISTEN_* variables are read with getenv. It returns
+// nil if the process was not socket activated. See sd_listen_fds(3) for
+// details.
+func activatedListener(getenv func(string) string, fd int) (net.Listener, error) {
+	pid, err := strconv.Atoi(getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
 	}
 
-	// warn the user, it'll not propagate to the user but at least we see if
-	// something is wrong in the logs
-	if err := d.checkLimit(context.Background()); err != nil {
-		d.log.WithError(err).Warn("CSI plugin will not function correctly, please resolve volume limit")
+	fds, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
 	}
 
-	d.srv = grpc.NewServer(grpc.UnaryInterceptor(errHandler))
-	csi.RegisterIdentityServer(d.srv, d)
-	csi.RegisterControllerServer(d.srv, d)
-	csi.RegisterNodeServer(d.srv, d)
+	if fds > 1 {
+		return nil, fmt.Errorf("socket activation passed %d sockets, only a single socket is supported", fds)
+	}
 
-	d.ready = true // we're now ready to go!
-	d.log.WithField("addr", addr).Info("server started")
-	return d.srv.Serve(listener)
+	f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+	defer f.Close()
+
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use socket passed by systemd: %v", err)
+	}
+
+	return listener, nil
+}
+
+// AddUnaryInterceptor registers an additional unary interceptor for all
+// gRPC methods served by the driver. Interceptors are invoked in the order
+// they are added. It must be called before Run.
+func (d *Driver) AddUnaryInterceptor(interceptor grpc.UnaryServerInterceptor) {
+	d.interceptors = append(d.interceptors, interceptor)
+}
+
+// chainUnaryInterceptors combines the given interceptors into a single one.
+// The first interceptor is the outermost one, i.e: it's invoked first and
+// sees the final response and error of the handler.
+func chainUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		chained := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], chained
+			chained = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, next)
+			}
+		}
+		return chained(ctx, req)
+	}
+}
+
+// servesController returns true if the controller service is served
+func (d *Driver) servesController() bool {
+	return d.mode != ModeNode
+}
+
+// servesNode returns true if the node service is served
+func (d *Driver) servesNode() bool {
+	return d.mode != ModeController
 }
 
 // Stop stops the plugin
 func (d *Driver) Stop() {
 	d.readyMu.Lock()
 	d.ready = false
+	if d.stopCh != nil {
+		close(d.stopCh)
+		d.stopCh = nil
+	}
 	d.readyMu.Unlock()
 
+	if d.adminSrv != nil {
+		d.adminSrv.Close()
+	}
+
 	d.log.Info("server stopped")
 	d.srv.Stop()
 }
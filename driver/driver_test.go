@@ -17,27 +17,51 @@ limitations under the License.
 package driver
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
+	"fmt"
 	"github.com/hetznercloud/hcloud-go/hcloud"
 	"github.com/hetznercloud/hcloud-go/hcloud/schema"
 	"strconv"
+	"sync"
 
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/kubernetes-csi/csi-test/pkg/sanity"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-func init() {
-	rand.Seed(time.Now().UnixNano())
+var seed = flag.Int64("seed", 0, "Seed of the random numbers used by the driver, e.g. for jitter. Random if 0")
+
+// TestMain seeds the random numbers, the seed is printed if a test fails to
+// reproduce the run with -seed
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	rand.Seed(*seed)
+
+	code := m.Run()
+	if code != 0 {
+		fmt.Printf("random numbers were seeded with -seed=%d\n", *seed)
+	}
+	os.Exit(code)
 }
 
 func TestDriverSuite(t *testing.T) {
@@ -63,12 +87,19 @@ func TestDriverSuite(t *testing.T) {
 
 	hcloudClient := hcloud.NewClient(hcloud.WithEndpoint(tsHCloud.URL))
 
+	// the backup store enables the snapshot tests
 	driver := &Driver{
 		endpoint:     endpoint,
 		nodeID:       strconv.Itoa(serverID),
 		location:     "fsn1",
 		hcloudClient: hcloudClient,
+		volumes:      &hcloudClient.Volume,
+		servers:      &hcloudClient.Server,
+		actions:      &actionClient{client: hcloudClient},
 		mounter:      &fakeMounter{},
+		backups:      newMemStore(),
+		backupJobs:   map[string]string{},
+		mover:        &fakeMover{},
 		log:          logrus.New().WithField("test_enabled", true),
 	}
 	defer driver.Stop()
@@ -96,14 +127,164 @@ func TestDriverSuite(t *testing.T) {
 	sanity.Test(t, cfg)
 }
 
+func TestActivatedListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hcloud-csi-listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "csi.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	pid := strconv.Itoa(os.Getpid())
+	cases := []struct {
+		name      string
+		env       map[string]string
+		activated bool
+		err       bool
+	}{
+		{"not activated", map[string]string{}, false, false},
+		{"pid mismatch", map[string]string{"LISTEN_PID": strconv.Itoa(os.Getpid() + 1), "LISTEN_FDS": "1"}, false, false},
+		{"no sockets", map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": "0"}, false, false},
+		{"several sockets", map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": "2"}, false, true},
+		{"unix socket", map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": "1"}, true, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// pass a copy, the listener takes over the descriptor
+			fd, err := syscall.Dup(int(f.Fd()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			getenv := func(key string) string { return c.env[key] }
+
+			listener, err := activatedListener(getenv, fd)
+			if listener == nil {
+				syscall.Close(fd)
+			}
+			if c.err != (err != nil) {
+				t.Fatalf("expected error to be %t, got %v", c.err, err)
+			}
+			if !c.activated {
+				if listener != nil {
+					listener.Close()
+					t.Fatal("expected no listener")
+				}
+				return
+			}
+			if listener == nil {
+				t.Fatal("expected the passed socket to be used")
+			}
+			defer listener.Close()
+
+			if addr := listener.Addr().String(); addr != socket {
+				t.Errorf("expected listener on %s, got %s", socket, addr)
+			}
+			conn, err := net.Dial("unix", socket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			accepted, err := listener.Accept()
+			if err != nil {
+				t.Fatalf("expected to accept connections on the passed socket, got %s", err)
+			}
+			accepted.Close()
+		})
+	}
+}
+
+func TestUnaryInterceptors(t *testing.T) {
+	var calls []string
+	record := func(name string, shortCircuit bool) grpc.UnaryServerInterceptor {
+		return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			calls = append(calls, name)
+			if shortCircuit {
+				return nil, status.Error(codes.PermissionDenied, name)
+			}
+			resp, err := handler(ctx, req)
+			calls = append(calls, name+" done")
+			return resp, err
+		}
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls = append(calls, "handler")
+		return "response", nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v0.Controller/CreateVolume"}
+
+	cases := []struct {
+		name         string
+		shortCircuit bool
+		calls        []string
+		resp         interface{}
+		code         codes.Code
+	}{
+		{"in order", false, []string{"first", "second", "handler", "second done", "first done"}, "response", codes.OK},
+		{"short circuit", true, []string{"first", "second", "first done"}, nil, codes.PermissionDenied},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			calls = nil
+			d := &Driver{}
+			d.AddUnaryInterceptor(record("first", false))
+			d.AddUnaryInterceptor(record("second", c.shortCircuit))
+
+			resp, err := chainUnaryInterceptors(d.interceptors...)(context.Background(), "request", info, handler)
+			if status.Code(err) != c.code {
+				t.Errorf("expected code %s, got %v", c.code, err)
+			}
+			if resp != c.resp {
+				t.Errorf("expected response %v, got %v", c.resp, resp)
+			}
+			if !reflect.DeepEqual(calls, c.calls) {
+				t.Errorf("expected calls %v, got %v", c.calls, calls)
+			}
+		})
+	}
+}
+
 // fakeAPI implements a fake, cached Hetzner Cloud API
 type fakeAPI struct {
 	t       *testing.T
 	volumes map[int]*schema.Volume
 	servers map[int]*schema.Server
+
+	// lastID is the last ID given to a volume or action, the IDs count up
+	// so runs are reproducible
+	lastID int
+
+	// mu guards the maps, the driver calls the API concurrently
+	mu sync.Mutex
+}
+
+// nextID returns the ID for a new volume or action. The IDs of volumes
+// added to the map by the tests are skipped.
+func (f *fakeAPI) nextID() int {
+	for {
+		f.lastID++
+		if _, ok := f.volumes[f.lastID]; !ok {
+			return f.lastID
+		}
+	}
 }
 
 func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
 	if strings.HasPrefix(r.URL.Path, "/servers/") {
 		// for now we only do a GET, so we assume it's a GET and don't check
 		// for the method
@@ -111,18 +292,7 @@ func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		id, _ := strconv.Atoi(filepath.Base(r.URL.Path))
 		server, ok := f.servers[id]
 		if !ok {
-			w.WriteHeader(http.StatusNotFound)
-
-			errResp := &schema.ErrorResponse{
-				Error: schema.Error{
-					Code: string(hcloud.ErrorCodeNotFound),
-				},
-			}
-
-			err := json.NewEncoder(w).Encode(&errResp)
-			if err != nil {
-				f.t.Fatalf("error: %s", err)
-			}
+			f.notFound(w)
 			return
 		}
 		resp.Server = *server
@@ -153,6 +323,43 @@ func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Path == "/locations" {
+		fakeLocations(w)
+		return
+	}
+
+	if r.URL.Path == "/actions" {
+		resp := &schema.ActionListResponse{}
+		for _, v := range r.URL.Query()["id"] {
+			id, _ := strconv.Atoi(v)
+			resp.Actions = append(resp.Actions, schema.Action{
+				ID:     id,
+				Status: string(hcloud.ActionStatusSuccess),
+			})
+		}
+
+		err := json.NewEncoder(w).Encode(&resp)
+		if err != nil {
+			f.t.Fatalf("error: %s", err)
+		}
+		return
+	}
+
+	// attach, detach and resize are applied instantly
+	if r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/volumes/") && strings.Contains(r.URL.Path, "/actions/") {
+		f.volumeAction(w, r)
+		return
+	}
+
+	// no actions are ever running
+	if strings.HasSuffix(r.URL.Path, "/actions") {
+		err := json.NewEncoder(w).Encode(&schema.ActionListResponse{})
+		if err != nil {
+			f.t.Fatalf("error: %s", err)
+		}
+		return
+	}
+
 	// rest is /volumes related
 	switch r.Method {
 	case "GET":
@@ -166,8 +373,11 @@ func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					}
 				}
 			} else {
+				selector := r.URL.Query().Get("label_selector")
 				for _, vol := range f.volumes {
-					volumes = append(volumes, *vol)
+					if matchLabels(vol.Labels, selector) {
+						volumes = append(volumes, *vol)
+					}
 				}
 			}
 
@@ -186,10 +396,10 @@ func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			id, _ := strconv.Atoi(filepath.Base(r.URL.Path))
 			vol, ok := f.volumes[id]
 			if !ok {
-				w.WriteHeader(http.StatusNotFound)
-			} else {
-				resp.Volume = *vol
+				f.notFound(w)
+				return
 			}
+			resp.Volume = *vol
 
 			_ = json.NewEncoder(w).Encode(&resp)
 			return
@@ -202,12 +412,20 @@ func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			f.t.Fatal(err)
 		}
 
-		id := rand.Int()
+		id := f.nextID()
 		vol := &schema.Volume{
 			ID:      id,
 			Name:    v.Name,
 			Size:    v.Size,
 			Created: time.Now().UTC(),
+			// the device has to exist for NodeStageVolume
+			LinuxDevice: os.DevNull,
+		}
+		if location, ok := v.Location.(string); ok {
+			vol.Location.Name = location
+		}
+		if v.Labels != nil {
+			vol.Labels = *v.Labels
 		}
 
 		f.volumes[id] = vol
@@ -222,27 +440,268 @@ func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	case "DELETE":
 		id, _ := strconv.Atoi(filepath.Base(r.URL.Path))
+		if _, ok := f.volumes[id]; !ok {
+			f.notFound(w)
+			return
+		}
 		delete(f.volumes, id)
 	}
 }
 
-type fakeMounter struct{}
+// volumeAction handles POST /volumes/{id}/actions/{action}
+func (f *fakeAPI) volumeAction(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	id, _ := strconv.Atoi(parts[1])
+	action := parts[len(parts)-1]
+
+	vol, ok := f.volumes[id]
+	if !ok {
+		f.notFound(w)
+		return
+	}
+
+	switch action {
+	case "attach":
+		req := new(schema.VolumeActionAttachVolumeRequest)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			f.t.Fatal(err)
+		}
+		if _, ok := f.servers[req.Server]; !ok {
+			f.notFound(w)
+			return
+		}
+		// like the real API, attached volumes have to be detached first
+		if vol.Server != nil {
+			f.error(w, http.StatusUnprocessableEntity, hcloud.ErrorCodeInvalidInput)
+			return
+		}
+		server := req.Server
+		vol.Server = &server
+	case "detach":
+		vol.Server = nil
+	case "resize":
+		req := new(schema.VolumeActionResizeVolumeRequest)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			f.t.Fatal(err)
+		}
+		vol.Size = req.Size
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	resp := &schema.ActionGetResponse{
+		Action: schema.Action{
+			ID:      f.nextID(),
+			Command: action + "_volume",
+			Status:  string(hcloud.ActionStatusSuccess),
+		},
+	}
+
+	err := json.NewEncoder(w).Encode(&resp)
+	if err != nil {
+		f.t.Fatalf("error: %s", err)
+	}
+}
+
+// fakeNetworkZones are the locations of the fake API by network zone
+var fakeNetworkZones = map[string]string{
+	"fsn1": "eu-central",
+	"nbg1": "eu-central",
+	"hel1": "eu-central",
+	"ash":  "us-east",
+	"hil":  "us-west",
+	"sin":  "ap-southeast",
+}
+
+// fakeLocations writes the locations of fakeNetworkZones. The schema of the
+// API client we use doesn't contain the network zone yet.
+func fakeLocations(w http.ResponseWriter) {
+	type location struct {
+		Name        string `json:"name"`
+		NetworkZone string `json:"network_zone"`
+	}
+
+	var resp struct {
+		Locations []location `json:"locations"`
+	}
+	for name, zone := range fakeNetworkZones {
+		resp.Locations = append(resp.Locations, location{Name: name, NetworkZone: zone})
+	}
+	json.NewEncoder(w).Encode(&resp)
+}
+
+// matchLabels returns true if the labels match the selector. Only the
+// key=value and !key terms the driver uses are supported.
+func matchLabels(labels map[string]string, selector string) bool {
+	if selector == "" {
+		return true
+	}
+
+	for _, term := range strings.Split(selector, ",") {
+		if strings.HasPrefix(term, "!") {
+			if _, ok := labels[term[1:]]; ok {
+				return false
+			}
+			continue
+		}
+
+		kv := strings.SplitN(term, "=", 2)
+		if len(kv) != 2 || labels[kv[0]] != kv[1] {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fakeAPI) notFound(w http.ResponseWriter) {
+	f.error(w, http.StatusNotFound, hcloud.ErrorCodeNotFound)
+}
+
+func (f *fakeAPI) error(w http.ResponseWriter, statusCode int, code hcloud.ErrorCode) {
+	// the client only reads the error code of JSON responses
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+
+	errResp := &schema.ErrorResponse{
+		Error: schema.Error{
+			Code:    string(code),
+			Message: "fake API error",
+		},
+	}
+
+	err := json.NewEncoder(w).Encode(&errResp)
+	if err != nil {
+		f.t.Fatalf("error: %s", err)
+	}
+}
+
+// fakeMover finishes backups and restores instantly without copying data
+type fakeMover struct{}
+
+func (f *fakeMover) Check(vol *hcloud.Volume) error {
+	return nil
+}
+
+func (f *fakeMover) Backup(ctx context.Context, vol *hcloud.Volume, m *backupManifest) error {
+	return nil
+}
 
-func (f *fakeMounter) Format(source string, fsType string) error {
+func (f *fakeMover) Restore(ctx context.Context, vol *hcloud.Volume, m *backupManifest) error {
 	return nil
 }
 
-func (f *fakeMounter) Mount(source string, target string, fsType string, options ...string) error {
+func (f *fakeMover) Populate(ctx context.Context, vol *hcloud.Volume, source string) error {
 	return nil
 }
 
-func (f *fakeMounter) Unmount(target string) error {
+func (f *fakeMover) Wipe(ctx context.Context, vol *hcloud.Volume) error {
 	return nil
 }
 
-func (f *fakeMounter) IsFormatted(source string) (bool, error) {
-	return true, nil
+// fakeMounter tracks formatted devices and mounted targets like the kernel
+// would: devices have to be formatted before they're mounted, bind mounts
+// need a mounted source, and targets can't be unmounted while they're the
+// source of a bind mount. Errors in errors are returned by the method with
+// the same name instead. The zero value is ready to use.
+type fakeMounter struct {
+	mu        sync.Mutex
+	formatted map[string]string   // device to filesystem type
+	options   map[string][]string // device to mkfs options
+	mounts    map[string]string   // target to source
+	errors    map[string]error
+}
+
+func (f *fakeMounter) init(method string) error {
+	if f.formatted == nil {
+		f.formatted = map[string]string{}
+		f.options = map[string][]string{}
+		f.mounts = map[string]string{}
+	}
+	return f.errors[method]
 }
-func (f *fakeMounter) IsMounted(target string) (bool, error) {
-	return true, nil
+
+func (f *fakeMounter) Format(ctx context.Context, source string, fsType string, options ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.init("Format"); err != nil {
+		return err
+	}
+
+	f.formatted[source] = fsType
+	f.options[source] = options
+	return nil
+}
+
+func (f *fakeMounter) Mount(ctx context.Context, source string, target string, fsType string, options ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.init("Mount"); err != nil {
+		return err
+	}
+
+	if _, ok := f.mounts[target]; ok {
+		return fmt.Errorf("%s is already mounted", target)
+	}
+
+	bind := false
+	for _, o := range options {
+		bind = bind || o == "bind"
+	}
+
+	switch {
+	case bind:
+		if _, ok := f.mounts[source]; !ok {
+			return fmt.Errorf("source %s of bind mount isn't mounted", source)
+		}
+	case fsType == "nfs4":
+	default:
+		if f.formatted[source] != fsType {
+			return fmt.Errorf("%s isn't formatted with %s", source, fsType)
+		}
+	}
+
+	f.mounts[target] = source
+	return nil
+}
+
+func (f *fakeMounter) Unmount(ctx context.Context, target string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.init("Unmount"); err != nil {
+		return err
+	}
+
+	if _, ok := f.mounts[target]; !ok {
+		return fmt.Errorf("%s isn't mounted", target)
+	}
+	for t, source := range f.mounts {
+		if source == target {
+			return fmt.Errorf("%s is busy, it's bind mounted to %s", target, t)
+		}
+	}
+
+	delete(f.mounts, target)
+	return nil
+}
+
+func (f *fakeMounter) IsFormatted(ctx context.Context, source string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.init("IsFormatted"); err != nil {
+		return false, err
+	}
+
+	return f.formatted[source] != "", nil
+}
+
+func (f *fakeMounter) IsMounted(ctx context.Context, target string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.init("IsMounted"); err != nil {
+		return false, err
+	}
+
+	_, ok := f.mounts[target]
+	return ok, nil
 }
@@ -0,0 +1,261 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Backups can be encrypted client-side with a key supplied by the user. The
+// manifests stay readable, so backups can be listed without the key, only
+// the data chunks are encrypted. Chunks are split into segments which are
+// sealed with AES-256-GCM, each one stored as
+//
+//   flag (1 byte, 1 for the last segment) | nonce (12 bytes) |
+//   ciphertext length (4 bytes, big endian) | ciphertext
+//
+// The object key, the index of the segment and the flag are authenticated as
+// additional data, so segments can't be reordered, truncated or moved to
+// another chunk unnoticed.
+//
+// TODO: support fetching the key from a KMS instead of a secret
+
+const (
+	// backupEncryptionAES256GCM is the backupManifest.Encryption of encrypted
+	// backups
+	backupEncryptionAES256GCM = "aes-256-gcm"
+
+	// encryptionSegmentSize is the plaintext size of a segment
+	encryptionSegmentSize = 1 * MB
+)
+
+// encryptedStore encrypts the data chunks stored in the underlying store
+type encryptedStore struct {
+	objectStore
+
+	aead  cipher.AEAD
+	keyID string
+}
+
+// encryptStore returns a store encrypting the backup data with the given
+// base64 encoded 256 bit key. The store is returned unchanged if the key is
+// empty.
+func encryptStore(store objectStore, key string) (objectStore, error) {
+	if key == "" {
+		return store, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil || len(raw) != 32 {
+		return nil, errors.New("the backup encryption key must be 32 bytes, base64 encoded")
+	}
+
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(raw)
+	return &encryptedStore{
+		objectStore: store,
+		aead:        aead,
+		keyID:       hex.EncodeToString(sum[:8]),
+	}, nil
+}
+
+// storeKeyID returns the id of the key the store encrypts the backup data
+// with, or an empty string if it doesn't encrypt
+func storeKeyID(store objectStore) string {
+	if e, ok := store.(*encryptedStore); ok {
+		return e.keyID
+	}
+	return ""
+}
+
+// setEncryption records the encryption of the store in the manifest of a new
+// backup
+func setEncryption(m *backupManifest, store objectStore) {
+	if keyID := storeKeyID(store); keyID != "" {
+		m.Encryption = backupEncryptionAES256GCM
+		m.KeyID = keyID
+	}
+}
+
+// checkEncryption returns an error if the data of the backup can't be read
+// from the store, because it's encrypted with a different or no key
+func checkEncryption(m *backupManifest, store objectStore) error {
+	keyID := storeKeyID(store)
+	switch {
+	case m.KeyID == keyID:
+		return nil
+	case m.KeyID == "":
+		return fmt.Errorf("backup %q is not encrypted, but a backup encryption key is configured", m.ID)
+	case keyID == "":
+		return fmt.Errorf("backup %q is encrypted, but no backup encryption key is configured", m.ID)
+	default:
+		return fmt.Errorf("backup %q is encrypted with key %q, the configured key is %q", m.ID, m.KeyID, keyID)
+	}
+}
+
+// encrypted returns true if the object with the given key is encrypted
+func (e *encryptedStore) encrypted(key string) bool {
+	return strings.Contains(key, "/"+backupDataPrefix) && !strings.HasSuffix(key, "/")
+}
+
+func (e *encryptedStore) Put(ctx context.Context, key string, r io.Reader) error {
+	if !e.encrypted(key) {
+		return e.objectStore.Put(ctx, key, r)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(e.seal(pw, r, key))
+	}()
+
+	err := e.objectStore.Put(ctx, key, pr)
+	// unblock the writer in case uploading failed
+	pr.CloseWithError(err)
+	return err
+}
+
+func (e *encryptedStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	rc, err := e.objectStore.Get(ctx, key)
+	if err != nil || !e.encrypted(key) {
+		return rc, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer rc.Close()
+		pw.CloseWithError(e.open(pw, rc, key))
+	}()
+
+	return pr, nil
+}
+
+// seal encrypts r segment by segment to w
+func (e *encryptedStore) seal(w io.Writer, r io.Reader, key string) error {
+	br := bufio.NewReader(r)
+	buf := make([]byte, encryptionSegmentSize)
+	header := make([]byte, 1+e.aead.NonceSize()+4)
+	nonce := header[1 : 1+e.aead.NonceSize()]
+
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		last := err != nil
+		if !last {
+			// look ahead, so the last segment can be flagged
+			if _, err := br.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+
+		header[0] = 0
+		if last {
+			header[0] = 1
+		}
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+
+		ciphertext := e.aead.Seal(nil, nonce, buf[:n], segmentAAD(key, index, last))
+		binary.BigEndian.PutUint32(header[1+e.aead.NonceSize():], uint32(len(ciphertext)))
+
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		if _, err := w.Write(ciphertext); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+	}
+}
+
+// open decrypts the segments read from r to w
+func (e *encryptedStore) open(w io.Writer, r io.Reader, key string) error {
+	header := make([]byte, 1+e.aead.NonceSize()+4)
+	for index := uint64(0); ; index++ {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return fmt.Errorf("encrypted object %q is truncated: %s", key, err)
+		}
+
+		last := header[0] == 1
+		nonce := header[1 : 1+e.aead.NonceSize()]
+		size := binary.BigEndian.Uint32(header[1+e.aead.NonceSize():])
+		if size > encryptionSegmentSize+uint32(e.aead.Overhead()) {
+			return fmt.Errorf("encrypted object %q is corrupt", key)
+		}
+
+		ciphertext := make([]byte, size)
+		if _, err := io.ReadFull(r, ciphertext); err != nil {
+			return fmt.Errorf("encrypted object %q is truncated: %s", key, err)
+		}
+
+		plaintext, err := e.aead.Open(nil, nonce, ciphertext, segmentAAD(key, index, last))
+		if err != nil {
+			return fmt.Errorf("decrypting %q failed: %s", key, err)
+		}
+
+		if _, err := w.Write(plaintext); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+	}
+}
+
+// segmentAAD returns the additional data authenticated with a segment
+func segmentAAD(key string, index uint64, last bool) []byte {
+	var b bytes.Buffer
+	b.WriteString(key)
+	binary.Write(&b, binary.BigEndian, index)
+	if last {
+		b.WriteByte(1)
+	} else {
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestEncryptedStore(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+
+	mem := newMemStore()
+	store, err := encryptStore(mem, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, size := range []int{0, 100, encryptionSegmentSize, 2*encryptionSegmentSize + 10} {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(data)
+
+		if err := store.Put(ctx, "b/data/000000.gz", bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.Contains(mem.objects["b/data/000000.gz"], data) && size > 0 {
+			t.Errorf("size %d: data is stored in plaintext", size)
+		}
+
+		r, err := store.Get(ctx, "b/data/000000.gz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %d: %s", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("size %d: decrypted data differs", size)
+		}
+	}
+
+	// chunks can't be moved to another key
+	mem.objects["b/data/000001.gz"] = mem.objects["b/data/000000.gz"]
+	r, err := store.Get(ctx, "b/data/000001.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("reading a moved chunk succeeded, want error")
+	}
+
+	// truncated chunks are detected
+	stored := mem.objects["b/data/000000.gz"]
+	mem.objects["b/data/000000.gz"] = stored[:len(stored)-100]
+	r, err = store.Get(ctx, "b/data/000000.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("reading a truncated chunk succeeded, want error")
+	}
+
+	m := &backupManifest{ID: "b"}
+	setEncryption(m, store)
+	if err := checkEncryption(m, store); err != nil {
+		t.Error(err)
+	}
+	if err := checkEncryption(m, mem); err == nil {
+		t.Error("checkEncryption without a key succeeded, want error")
+	}
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package errors defines the errors the calls of the driver fail with. The
+// errors returned by the driver match them with Is, so callers and embedders
+// don't have to compare messages or gRPC codes:
+//
+//	_, err := d.ControllerPublishVolume(ctx, req)
+//	if drivererrors.Is(err, drivererrors.ErrAttachLimit) {
+//		// pick another node
+//	}
+//
+// On Go 1.13 and newer errors.Is matches them as well.
+//
+// The errors are gRPC status errors as well, the CO receives the code of
+// the matching error.
+package errors
+
+import (
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Error is an error the calls of the driver fail with
+type Error struct {
+	code codes.Code
+	msg  string
+}
+
+func newError(code codes.Code, msg string) *Error {
+	return &Error{code: code, msg: msg}
+}
+
+func (e *Error) Error() string {
+	return e.msg
+}
+
+// Code returns the gRPC code of the calls failing with the error
+func (e *Error) Code() codes.Code {
+	return e.code
+}
+
+// GRPCStatus returns the status of the error, the gRPC server sends it to
+// the CO
+func (e *Error) GRPCStatus() *status.Status {
+	return status.New(e.code, e.msg)
+}
+
+var (
+	// ErrVolumeNotFound is returned if the volume doesn't exist, e.g. it was
+	// deleted outside of the driver
+	ErrVolumeNotFound = newError(codes.NotFound, "volume not found")
+
+	// ErrServerNotFound is returned if the server of a node doesn't exist
+	ErrServerNotFound = newError(codes.NotFound, "server not found")
+
+	// ErrSnapshotNotFound is returned if the snapshot doesn't exist
+	ErrSnapshotNotFound = newError(codes.NotFound, "snapshot not found")
+
+	// ErrAttachLimit is returned if no more volumes can be attached to the
+	// server
+	ErrAttachLimit = newError(codes.ResourceExhausted, "attach limit of the server is reached")
+
+	// ErrAttached is returned if the volume is attached to another server
+	ErrAttached = newError(codes.FailedPrecondition, "volume is attached to another server")
+
+	// ErrProtected is returned if the volume is protected against deletion
+	ErrProtected = newError(codes.FailedPrecondition, "volume is protected")
+
+	// ErrLocked is returned if the volume or the server is locked by another
+	// action, the call succeeds once the action is finished
+	ErrLocked = newError(codes.Aborted, "resource is locked by another action")
+
+	// ErrInProgress is returned if the operation is running in the
+	// background already, e.g. the volume is being created or populated.
+	// The call succeeds once it's finished.
+	ErrInProgress = newError(codes.Aborted, "operation is in progress")
+
+	// ErrQuotaExceeded is returned if the volume would exceed the volume
+	// limits of its StorageClass or the provisioning rate
+	ErrQuotaExceeded = newError(codes.ResourceExhausted, "volume quota is exceeded")
+
+	// ErrMaintenance is returned while the plugin is in maintenance mode
+	ErrMaintenance = newError(codes.Unavailable, "plugin is in maintenance mode")
+)
+
+// Errorf returns an error with the formatted message that matches kind and
+// has its code. Causes are formatted into the message with %s, the Go
+// versions the driver supports can't wrap them with %w.
+func Errorf(kind *Error, format string, args ...interface{}) error {
+	return &kindError{kind: kind, msg: fmt.Sprintf(format, args...)}
+}
+
+// kindError is an error of a kind with a message of the call
+type kindError struct {
+	kind *Error
+	msg  string
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *kindError) GRPCStatus() *status.Status {
+	return status.New(e.kind.code, e.msg)
+}
+
+// Is returns true if err is an error of the given kind or wraps one. Errors
+// are unwrapped with their Unwrap method, like errors.Is of Go 1.13 does.
+func Is(err error, kind *Error) bool {
+	return errorKind(err) == kind
+}
+
+// Status returns the gRPC status error of err. Errors wrapping an error of
+// this package, i.e. with an Unwrap method, get its code and keep their
+// message. Other errors are returned as they are.
+func Status(err error) error {
+	if _, ok := err.(interface{ GRPCStatus() *status.Status }); ok || err == nil {
+		return err
+	}
+
+	if kind := errorKind(err); kind != nil {
+		return status.Error(kind.code, err.Error())
+	}
+	return err
+}
+
+// errorKind returns the error of this package err is or wraps, nil if it
+// wraps none
+func errorKind(err error) *Error {
+	for err != nil {
+		switch e := err.(type) {
+		case *Error:
+			return e
+		case *kindError:
+			return e.kind
+		}
+
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return nil
+		}
+		err = u.Unwrap()
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package errors
+
+import (
+	"io"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// wrapped wraps an error like fmt.Errorf with %w does on Go 1.13 and newer
+type wrapped struct {
+	msg string
+	err error
+}
+
+func (w *wrapped) Error() string { return w.msg + ": " + w.err.Error() }
+func (w *wrapped) Unwrap() error { return w.err }
+
+func TestErrorf(t *testing.T) {
+	err := Errorf(ErrLocked, "volume %d is locked: %s", 1, io.EOF)
+
+	if err.Error() != "volume 1 is locked: EOF" {
+		t.Errorf("unexpected message %q", err)
+	}
+	if !Is(err, ErrLocked) {
+		t.Error("expected the error to match ErrLocked")
+	}
+	if Is(err, ErrProtected) {
+		t.Error("expected the error not to match ErrProtected")
+	}
+	if !Is(&wrapped{"wrapped", err}, ErrLocked) {
+		t.Error("expected the wrapped error to match ErrLocked")
+	}
+	if Is(io.EOF, ErrLocked) || Is(nil, ErrLocked) {
+		t.Error("expected other errors not to match ErrLocked")
+	}
+
+	s, ok := status.FromError(err)
+	if !ok {
+		t.Fatal("expected a status error")
+	}
+	if s.Code() != codes.Aborted || s.Message() != err.Error() {
+		t.Errorf("expected Aborted: %s, got %s: %s", err, s.Code(), s.Message())
+	}
+}
+
+func TestStatus(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		code codes.Code
+	}{
+		{"nil", nil, codes.OK},
+		{"status", status.Error(codes.Internal, "internal"), codes.Internal},
+		{"error", ErrVolumeNotFound, codes.NotFound},
+		{"wrapped error", &wrapped{"wrapped", ErrAttachLimit}, codes.ResourceExhausted},
+		{"wrapped kind", &wrapped{"wrapped", Errorf(ErrInProgress, "volume 1 is being wiped")}, codes.Aborted},
+		{"other", io.EOF, codes.Unknown},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := Status(c.err)
+			if code := status.Code(err); code != c.code {
+				t.Errorf("expected code %s, got %s", c.code, code)
+			}
+			if got, want := status.Convert(err).Message(), status.Convert(c.err).Message(); got != want {
+				t.Errorf("expected the message %q, got %q", want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,423 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	drivererrors "github.com/apricote/hcloud-csi-driver/driver/errors"
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var updateGolden = flag.Bool("update", false, "Update the golden files of the tests")
+
+// apiErrors are the errors of the API the driver tells apart. Rate limit
+// errors are missing, the client retries them until they succeed.
+var apiErrors = []struct {
+	status int
+	code   hcloud.ErrorCode // empty for responses that aren't JSON
+}{
+	{http.StatusNotFound, hcloud.ErrorCodeNotFound},
+	{http.StatusNotFound, ""},
+	{http.StatusUnauthorized, hcloud.ErrorCode("unauthorized")},
+	{http.StatusForbidden, hcloud.ErrorCode("protected")},
+	{http.StatusLocked, hcloud.ErrorCode("locked")},
+	{http.StatusUnprocessableEntity, hcloud.ErrorCodeInvalidInput},
+	{http.StatusInternalServerError, hcloud.ErrorCodeServiceError},
+	{http.StatusServiceUnavailable, ""},
+}
+
+// failingAPI answers one request with an error, the others are answered by
+// the fake API
+type failingAPI struct {
+	*fakeAPI
+	method, path string
+	status       int
+	code         hcloud.ErrorCode
+}
+
+func (f *failingAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != f.method || r.URL.Path != f.path {
+		f.fakeAPI.ServeHTTP(w, r)
+		return
+	}
+
+	if f.code == "" {
+		w.WriteHeader(f.status)
+		fmt.Fprintln(w, "upstream unavailable")
+		return
+	}
+	f.error(w, f.status, f.code)
+}
+
+// TestAPIErrors checks the gRPC errors every failing API request of the
+// calls results in against testdata/api_errors.golden. Run the test with
+// -update to update the file after changing the mapping.
+func TestAPIErrors(t *testing.T) {
+	attached := 1
+	capability := &csi.VolumeCapability{AccessMode: supportedAccessMode}
+
+	calls := []struct {
+		name     string
+		requests []string
+		call     func(d *Driver) error
+	}{
+		{
+			"CreateVolume",
+			[]string{"GET /volumes", "POST /volumes"},
+			func(d *Driver) error {
+				_, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+					Name:               "pvc-new",
+					VolumeCapabilities: []*csi.VolumeCapability{capability},
+				})
+				return err
+			},
+		},
+		{
+			"DeleteVolume",
+			[]string{"GET /volumes/1", "DELETE /volumes/1"},
+			func(d *Driver) error {
+				_, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "1"})
+				return err
+			},
+		},
+		{
+			"ControllerPublishVolume",
+			[]string{"GET /volumes/1", "GET /volumes/1/actions", "GET /servers/1", "POST /volumes/1/actions/attach"},
+			func(d *Driver) error {
+				_, err := d.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+					VolumeId:         "1",
+					NodeId:           "1",
+					VolumeCapability: capability,
+				})
+				return err
+			},
+		},
+		{
+			"ControllerUnpublishVolume",
+			[]string{"GET /volumes/2", "GET /volumes/2/actions", "GET /servers/1", "POST /volumes/2/actions/detach"},
+			func(d *Driver) error {
+				_, err := d.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+					VolumeId: "2",
+					NodeId:   "1",
+				})
+				return err
+			},
+		},
+		{
+			"ValidateVolumeCapabilities",
+			[]string{"GET /volumes/1"},
+			func(d *Driver) error {
+				_, err := d.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+					VolumeId:           "1",
+					VolumeCapabilities: []*csi.VolumeCapability{capability},
+				})
+				return err
+			},
+		},
+	}
+
+	type apiErrorCase struct {
+		name   string
+		api    *failingAPI
+		call   func(d *Driver) error
+		result string
+	}
+
+	var cases []*apiErrorCase
+	for _, c := range calls {
+		for _, request := range c.requests {
+			var method, path string
+			fmt.Sscan(request, &method, &path)
+
+			for _, apiErr := range apiErrors {
+				code := string(apiErr.code)
+				if code == "" {
+					code = "no JSON"
+				}
+
+				cases = append(cases, &apiErrorCase{
+					name: fmt.Sprintf("%s, %s fails with %d %s", c.name, request, apiErr.status, code),
+					api: &failingAPI{
+						fakeAPI: &fakeAPI{
+							t: t,
+							volumes: map[int]*schema.Volume{
+								1: {ID: 1, Name: "pvc-1", Size: 10},
+								2: {ID: 2, Name: "pvc-2", Size: 10, Server: &attached},
+							},
+							servers: map[int]*schema.Server{1: {ID: 1}},
+						},
+						method: method,
+						path:   path,
+						status: apiErr.status,
+						code:   apiErr.code,
+					},
+					call: c.call,
+				})
+			}
+		}
+	}
+
+	// the calls wait for the actions they start, the cases are run at the
+	// same time to wait only once
+	var wg sync.WaitGroup
+	for _, c := range cases {
+		wg.Add(1)
+		go func(c *apiErrorCase) {
+			defer wg.Done()
+
+			ts := httptest.NewServer(c.api)
+			defer ts.Close()
+
+			log := logrus.New()
+			log.Out = ioutil.Discard
+			client := hcloud.NewClient(hcloud.WithEndpoint(ts.URL))
+			d := &Driver{
+				location:     "fsn1",
+				hcloudClient: client,
+				volumes:      &client.Volume,
+				servers:      &client.Server,
+				actions:      &actionClient{client: client},
+				log:          log.WithField("test_enabled", true),
+			}
+
+			err := c.call(d)
+			if err == nil {
+				c.result = "OK"
+			} else if s, ok := status.FromError(err); ok {
+				c.result = fmt.Sprintf("%s: %s", s.Code(), s.Message())
+			} else {
+				c.result = fmt.Sprintf("not a status error: %s", err)
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	var got bytes.Buffer
+	for _, c := range cases {
+		fmt.Fprintf(&got, "%s: %s\n", c.name, c.result)
+	}
+
+	golden := filepath.Join("testdata", "api_errors.golden")
+	if *updateGolden {
+		if err := ioutil.WriteFile(golden, got.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotLines := bytes.Split(got.Bytes(), []byte("\n"))
+	wantLines := bytes.Split(want, []byte("\n"))
+	for i := 0; i < len(gotLines) || i < len(wantLines); i++ {
+		var g, w []byte
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if !bytes.Equal(g, w) {
+			t.Errorf("line %d of %s:\n got: %s\nwant: %s", i+1, golden, g, w)
+		}
+	}
+}
+
+// TestErrorIdentity checks the calls fail with the errors of the errors
+// package, which callers tell apart with drivererrors.Is
+func TestErrorIdentity(t *testing.T) {
+	attached := 1
+	full := []int{10, 11, 12, 13, 14}
+	capability := &csi.VolumeCapability{AccessMode: supportedAccessMode}
+
+	publish := func(volumeID, nodeID string) func(d *Driver) error {
+		return func(d *Driver) error {
+			_, err := d.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+				VolumeId:         volumeID,
+				NodeId:           nodeID,
+				VolumeCapability: capability,
+			})
+			return err
+		}
+	}
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		status int
+		code   hcloud.ErrorCode
+		call   func(d *Driver) error
+		want   *drivererrors.Error
+	}{
+		{
+			name: "volume not found",
+			call: publish("3", "1"),
+			want: drivererrors.ErrVolumeNotFound,
+		},
+		{
+			name: "server not found",
+			call: publish("1", "3"),
+			want: drivererrors.ErrServerNotFound,
+		},
+		{
+			name: "attached to another server",
+			call: publish("2", "2"),
+			want: drivererrors.ErrAttached,
+		},
+		{
+			name:   "attach limit",
+			method: "POST",
+			path:   "/volumes/1/actions/attach",
+			status: http.StatusUnprocessableEntity,
+			code:   errorCodeVolumeLimitExceeded,
+			call:   publish("1", "2"),
+			want:   drivererrors.ErrAttachLimit,
+		},
+		{
+			name:   "attach locked",
+			method: "POST",
+			path:   "/volumes/1/actions/attach",
+			status: http.StatusLocked,
+			code:   hcloud.ErrorCode("locked"),
+			call:   publish("1", "1"),
+			want:   drivererrors.ErrLocked,
+		},
+		{
+			name:   "delete protected",
+			method: "DELETE",
+			path:   "/volumes/1",
+			status: http.StatusForbidden,
+			code:   hcloud.ErrorCode("protected"),
+			call: func(d *Driver) error {
+				_, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "1"})
+				return err
+			},
+			want: drivererrors.ErrProtected,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			api := &failingAPI{
+				fakeAPI: &fakeAPI{
+					t: t,
+					volumes: map[int]*schema.Volume{
+						1: {ID: 1, Name: "pvc-1", Size: 10},
+						2: {ID: 2, Name: "pvc-2", Size: 10, Server: &attached},
+					},
+					servers: map[int]*schema.Server{
+						1: {ID: 1},
+						2: {ID: 2, Volumes: full},
+					},
+				},
+				method: c.method,
+				path:   c.path,
+				status: c.status,
+				code:   c.code,
+			}
+			ts := httptest.NewServer(api)
+			defer ts.Close()
+
+			log := logrus.New()
+			log.Out = ioutil.Discard
+			client := hcloud.NewClient(hcloud.WithEndpoint(ts.URL))
+			d := &Driver{
+				location:     "fsn1",
+				hcloudClient: client,
+				volumes:      &client.Volume,
+				servers:      &client.Server,
+				actions:      &actionClient{client: client},
+				log:          log.WithField("test_enabled", true),
+			}
+
+			err := c.call(d)
+			if !drivererrors.Is(err, c.want) {
+				t.Fatalf("expected %q, got %v", c.want, err)
+			}
+			if code := status.Code(err); code != c.want.Code() {
+				t.Errorf("expected code %s, got %s", c.want.Code(), code)
+			}
+		})
+	}
+}
+
+// TestAttachErrorOnFullServer checks only the attach limit error of the API
+// is reported as ErrAttachLimit, not every attach error of a server with
+// many volumes
+func TestAttachErrorOnFullServer(t *testing.T) {
+	full := []int{10, 11, 12, 13, 14}
+
+	for _, code := range []hcloud.ErrorCode{hcloud.ErrorCodeInvalidInput, hcloud.ErrorCodeServiceError, hcloud.ErrorCode("locked")} {
+		t.Run(string(code), func(t *testing.T) {
+			api := &failingAPI{
+				fakeAPI: &fakeAPI{
+					t:       t,
+					volumes: map[int]*schema.Volume{1: {ID: 1, Name: "pvc-1", Size: 10}},
+					servers: map[int]*schema.Server{2: {ID: 2, Volumes: full}},
+				},
+				method: "POST",
+				path:   "/volumes/1/actions/attach",
+				status: http.StatusUnprocessableEntity,
+				code:   code,
+			}
+			ts := httptest.NewServer(api)
+			defer ts.Close()
+
+			log := logrus.New()
+			log.Out = ioutil.Discard
+			client := hcloud.NewClient(hcloud.WithEndpoint(ts.URL))
+			d := &Driver{
+				location:     "fsn1",
+				hcloudClient: client,
+				volumes:      &client.Volume,
+				servers:      &client.Server,
+				actions:      &actionClient{client: client},
+				log:          log.WithField("test_enabled", true),
+			}
+
+			_, err := d.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+				VolumeId:         "1",
+				NodeId:           "2",
+				VolumeCapability: &csi.VolumeCapability{AccessMode: supportedAccessMode},
+			})
+			if err == nil {
+				t.Fatal("expected the attach to fail")
+			}
+			if drivererrors.Is(err, drivererrors.ErrAttachLimit) || status.Code(err) == codes.ResourceExhausted {
+				t.Errorf("expected no attach limit error, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import "sync"
+
+// formatCache remembers the devices NodeStageVolume found formatted, so
+// retried stage calls don't probe them with blkid again, which can take a
+// while on loaded nodes. Only formatted devices are remembered, a device
+// found unformatted is formatted right away. Formatting or resizing the
+// filesystem of a device forgets it. The zero value is usable.
+type formatCache struct {
+	mu      sync.Mutex
+	devices map[string]bool
+}
+
+// add remembers that the device is formatted
+func (c *formatCache) add(device string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.devices == nil {
+		c.devices = map[string]bool{}
+	}
+	c.devices[device] = true
+}
+
+// formatted returns whether the device is known to be formatted
+func (c *formatCache) formatted(device string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.devices[device]
+}
+
+// forget removes the device from the cache
+func (c *formatCache) forget(device string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.devices, device)
+}
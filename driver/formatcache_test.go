@@ -0,0 +1,41 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import "testing"
+
+func TestFormatCache(t *testing.T) {
+	var c formatCache
+	device := "/dev/disk/by-id/scsi-0HC_Volume_1"
+
+	if c.formatted(device) {
+		t.Fatal("empty cache returned a formatted device")
+	}
+
+	c.add(device)
+	if !c.formatted(device) {
+		t.Error("formatted() = false for a device found formatted")
+	}
+	if c.formatted("/dev/disk/by-id/scsi-0HC_Volume_2") {
+		t.Error("formatted() = true for another device")
+	}
+
+	c.forget(device)
+	if c.formatted(device) {
+		t.Error("formatted() = true for a forgotten device")
+	}
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import "context"
+
+// defaultMaxConcurrentFormats is the number of filesystems formatted at the
+// same time if NewDriverParams.MaxConcurrentFormats isn't set
+const defaultMaxConcurrentFormats = 2
+
+// formatLimiter bounds the number of filesystems formatted at the same time.
+// Formatting a large volume writes a lot of metadata, so staging many new
+// volumes at once could saturate the IO of the server and starve the
+// workloads already running on it. A nil formatLimiter doesn't limit.
+type formatLimiter chan struct{}
+
+// newFormatLimiter returns a formatLimiter for the given number of
+// concurrent formats, which is unlimited if it's negative
+func newFormatLimiter(max int) formatLimiter {
+	if max < 0 {
+		return nil
+	}
+	if max == 0 {
+		max = defaultMaxConcurrentFormats
+	}
+	return make(formatLimiter, max)
+}
+
+// acquire waits until another filesystem may be formatted or ctx is done
+func (l formatLimiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees the slot taken by acquire
+func (l formatLimiter) release() {
+	if l == nil {
+		return
+	}
+	<-l
+}
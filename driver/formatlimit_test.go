@@ -0,0 +1,53 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFormatLimiter(t *testing.T) {
+	l := newFormatLimiter(1)
+	if err := l.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the slot is taken, the second format waits until ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.acquire(ctx); err == nil {
+		t.Fatal("acquire() succeeded while all slots are taken")
+	}
+
+	l.release()
+	if err := l.acquire(context.Background()); err != nil {
+		t.Errorf("acquire() after release(): %s", err)
+	}
+
+	if n := cap(newFormatLimiter(0)); n != defaultMaxConcurrentFormats {
+		t.Errorf("newFormatLimiter(0) has %d slots, want %d", n, defaultMaxConcurrentFormats)
+	}
+
+	unlimited := newFormatLimiter(-1)
+	for i := 0; i < 10; i++ {
+		if err := unlimited.acquire(ctx); err != nil {
+			t.Fatalf("unlimited acquire() failed: %s", err)
+		}
+	}
+}
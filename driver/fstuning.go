@@ -0,0 +1,140 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"strconv"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// paramReservedBlocksPercent is the StorageClass parameter setting the
+	// percentage of the blocks of ext filesystems reserved for root, 5 by
+	// default. Nobody writes to the volumes as root on the node, so the
+	// reserved blocks are wasted.
+	paramReservedBlocksPercent = "reservedBlocksPercent"
+
+	// paramInodeRatio is the StorageClass parameter setting the bytes per
+	// inode of ext filesystems. Volumes holding few large files need less
+	// inodes than the default of 16384.
+	paramInodeRatio = "inodeRatio"
+
+	// maxReservedBlocksPercent is the largest percentage mkfs.ext4 accepts
+	maxReservedBlocksPercent = 50
+
+	// minInodeRatio and maxInodeRatio are the bytes per inode mkfs.ext4
+	// accepts
+	minInodeRatio = 1024
+	maxInodeRatio = 64 * 1024 * 1024
+)
+
+// fsTuningParams are the StorageClass parameters tuning the filesystem. They
+// are passed to the node plugin as volume attributes.
+var fsTuningParams = []string{paramReservedBlocksPercent, paramInodeRatio}
+
+// validateFsTuningParams returns INVALID_ARGUMENT if the filesystem tuning
+// parameters are invalid or the volumes aren't formatted with ext4
+func validateFsTuningParams(params map[string]string, caps []*csi.VolumeCapability) error {
+	if v, ok := params[paramReservedBlocksPercent]; ok {
+		percent, err := strconv.ParseFloat(v, 64)
+		if err != nil || percent < 0 || percent > maxReservedBlocksPercent {
+			return status.Errorf(codes.InvalidArgument, "%s must be a percentage between 0 and %d, got %q", paramReservedBlocksPercent, maxReservedBlocksPercent, v)
+		}
+	}
+
+	if v, ok := params[paramInodeRatio]; ok {
+		ratio, err := strconv.Atoi(v)
+		if err != nil || ratio < minInodeRatio || ratio > maxInodeRatio {
+			return status.Errorf(codes.InvalidArgument, "%s must be between %d and %d bytes, got %q", paramInodeRatio, minInodeRatio, maxInodeRatio, v)
+		}
+	}
+
+	if len(fsTuningAttributes(params)) == 0 {
+		return nil
+	}
+
+	for _, c := range caps {
+		if mnt := c.GetMount(); mnt != nil && !extFsType(mnt.FsType) {
+			return status.Errorf(codes.InvalidArgument, "%s and %s require an ext filesystem, got %q", paramReservedBlocksPercent, paramInodeRatio, mnt.FsType)
+		}
+	}
+	return nil
+}
+
+// fsTuningAttributes returns the volume attributes of the filesystem tuning
+// parameters, nil if none are set
+func fsTuningAttributes(params map[string]string) map[string]string {
+	var attributes map[string]string
+	for _, key := range fsTuningParams {
+		if v, ok := params[key]; ok {
+			if attributes == nil {
+				attributes = map[string]string{}
+			}
+			attributes[key] = v
+		}
+	}
+	return attributes
+}
+
+// volumeAttributes returns the attributes of a new volume: the address of
+// its NFS export and the filesystem tuning parameters
+func (d *Driver) volumeAttributes(ctx context.Context, vol *hcloud.Volume, params map[string]string) (map[string]string, error) {
+	attributes, err := d.nfsAttributes(ctx, vol)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range fsTuningAttributes(params) {
+		if attributes == nil {
+			attributes = map[string]string{}
+		}
+		attributes[k] = v
+	}
+	return attributes, nil
+}
+
+// mkfsOptions returns the options of mkfs tuning a new filesystem of the
+// given type as set in the volume attributes
+func mkfsOptions(fsType string, attributes map[string]string) []string {
+	if !extFsType(fsType) {
+		return nil
+	}
+
+	var options []string
+	if v, ok := attributes[paramReservedBlocksPercent]; ok {
+		options = append(options, "-m", v)
+	}
+	if v, ok := attributes[paramInodeRatio]; ok {
+		options = append(options, "-i", v)
+	}
+	return options
+}
+
+// extFsType returns true for the ext filesystems, the default if fsType is
+// empty
+func extFsType(fsType string) bool {
+	switch fsType {
+	case "", "ext2", "ext3", "ext4":
+		return true
+	}
+	return false
+}
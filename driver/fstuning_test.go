@@ -0,0 +1,128 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidateFsTuningParams(t *testing.T) {
+	mount := func(fsType string) []*csi.VolumeCapability {
+		return []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{FsType: fsType},
+			},
+		}}
+	}
+
+	cases := []struct {
+		params map[string]string
+		caps   []*csi.VolumeCapability
+		valid  bool
+	}{
+		{map[string]string{}, mount("xfs"), true},
+		{map[string]string{paramReservedBlocksPercent: "0"}, mount(""), true},
+		{map[string]string{paramReservedBlocksPercent: "0.5", paramInodeRatio: "65536"}, mount("ext4"), true},
+		{map[string]string{paramReservedBlocksPercent: "51"}, mount("ext4"), false},
+		{map[string]string{paramReservedBlocksPercent: "-1"}, mount("ext4"), false},
+		{map[string]string{paramReservedBlocksPercent: "none"}, mount("ext4"), false},
+		{map[string]string{paramInodeRatio: "512"}, mount("ext4"), false},
+		{map[string]string{paramInodeRatio: "1M"}, mount("ext4"), false},
+		{map[string]string{paramInodeRatio: "65536"}, mount("xfs"), false},
+	}
+
+	for _, c := range cases {
+		err := validateFsTuningParams(c.params, c.caps)
+		if c.valid && err != nil {
+			t.Errorf("expected %v to be valid, got %v", c.params, err)
+		}
+		if !c.valid && status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected %v to be invalid, got %v", c.params, err)
+		}
+	}
+}
+
+func TestMkfsOptions(t *testing.T) {
+	attributes := map[string]string{
+		paramReservedBlocksPercent: "0",
+		paramInodeRatio:            "65536",
+		attrNFSServer:              "",
+	}
+
+	if got, want := mkfsOptions("ext4", attributes), []string{"-m", "0", "-i", "65536"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := mkfsOptions("xfs", attributes); got != nil {
+		t.Errorf("expected no options for xfs, got %v", got)
+	}
+	if got := mkfsOptions("ext4", nil); got != nil {
+		t.Errorf("expected no options without attributes, got %v", got)
+	}
+}
+
+func TestNodeStageVolumeFsTuning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hcloud-csi-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	mounter := &fakeMounter{}
+	d := &Driver{
+		volumes: &fakeVolumes{volumes: map[int]*hcloud.Volume{
+			1: {ID: 1, Name: "test", LinuxDevice: os.DevNull},
+		}},
+		mounter:       mounter,
+		formatLimiter: newFormatLimiter(1),
+		log:           log.WithField("test", t.Name()),
+	}
+
+	_, err = d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "1",
+		StagingTargetPath: filepath.Join(dir, "staging"),
+		VolumeAttributes:  map[string]string{paramReservedBlocksPercent: "1"},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := mounter.options[os.DevNull], []string{"-m", "1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the volume to be formatted with %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,237 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The fuzz targets run their seeds with go test, run them with e.g.
+//
+//	go test -run '^$' -fuzz FuzzCreateVolume ./driver
+//
+// to search for malformed requests the validation doesn't catch.
+
+// errFuzzCreate is returned by fuzzVolumes.Create, requests that get this
+// far passed the validation
+var errFuzzCreate = errors.New("volume not created by fuzz test")
+
+// fuzzVolumes records the volume CreateVolume tries to create and doesn't
+// find any existing volumes
+type fuzzVolumes struct {
+	VolumeService
+	created *hcloud.VolumeCreateOpts
+}
+
+func (f *fuzzVolumes) GetByName(ctx context.Context, name string) (*hcloud.Volume, *hcloud.Response, error) {
+	return nil, nil, nil
+}
+
+func (f *fuzzVolumes) List(ctx context.Context, opts hcloud.VolumeListOpts) ([]*hcloud.Volume, *hcloud.Response, error) {
+	return nil, &hcloud.Response{Meta: hcloud.Meta{Pagination: &hcloud.Pagination{}}}, nil
+}
+
+func (f *fuzzVolumes) Create(ctx context.Context, opts hcloud.VolumeCreateOpts) (hcloud.VolumeCreateResult, *hcloud.Response, error) {
+	f.created = &opts
+	return hcloud.VolumeCreateResult{}, nil, errFuzzCreate
+}
+
+func FuzzExtractStorage(f *testing.F) {
+	f.Add(int64(0), int64(0))
+	f.Add(int64(10*GB), int64(0))
+	f.Add(int64(10*GB), int64(10*GB))
+	f.Add(int64(10*GB+1), int64(0))
+	f.Add(int64(10*GB+1), int64(10*GB+1))
+	f.Add(int64(-1), int64(0))
+	f.Add(int64(1<<63-1), int64(0))
+
+	f.Fuzz(func(t *testing.T, required, limit int64) {
+		size, err := extractStorage(&csi.CapacityRange{RequiredBytes: required, LimitBytes: limit})
+		if err != nil {
+			return
+		}
+
+		if size <= 0 || size%GB != 0 {
+			t.Fatalf("expected a size in whole GB, got %d", size)
+		}
+		if size < required {
+			t.Fatalf("size %d is smaller than the required %d bytes", size, required)
+		}
+		if limit != 0 && size > limit {
+			t.Fatalf("size %d exceeds the limit of %d bytes", size, limit)
+		}
+	})
+}
+
+func FuzzCreateVolume(f *testing.F) {
+	singleNodeWriter := int32(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+	f.Add("pvc-1", int64(10*GB), int64(0), singleNodeWriter, false, false, "ext4", "", "")
+	f.Add("pvc-1", int64(10*GB+1), int64(0), singleNodeWriter, false, false, "", paramStorageClass, "fast")
+	f.Add("pvc-1", int64(10*GB), int64(10*GB), singleNodeWriter, false, true, "", "", "")
+	f.Add("pvc-1", int64(GB), int64(GB), int32(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER), true, false, "", paramMaxVolumes, "-1")
+	f.Add("pvc-1", int64(0), int64(0), int32(-1), false, false, "xfs", paramWipeOnDelete, "maybe")
+	f.Add("", int64(-1), int64(-1), int32(0), true, false, "", paramLocation, "nbg1")
+
+	f.Fuzz(func(t *testing.T, name string, required, limit int64, mode int32, block, empty bool, fsType, key, value string) {
+		volumes := &fuzzVolumes{}
+		d := &Driver{
+			location: "fsn1",
+			volumes:  volumes,
+			log:      logrus.New().WithField("test_enabled", true),
+		}
+		d.log.Logger.Out = ioutil.Discard
+
+		capability := &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{FsType: fsType},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_Mode(mode),
+			},
+		}
+		if block {
+			capability.AccessType = &csi.VolumeCapability_Block{
+				Block: &csi.VolumeCapability_BlockVolume{},
+			}
+		}
+		capabilities := []*csi.VolumeCapability{capability}
+		if empty {
+			capabilities = append(capabilities, &csi.VolumeCapability{})
+		}
+
+		_, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: required, LimitBytes: limit},
+			VolumeCapabilities: capabilities,
+			Parameters:         map[string]string{key: value},
+		})
+		if _, ok := status.FromError(err); !ok {
+			t.Fatalf("expected a gRPC status error, got %v", err)
+		}
+
+		opts := volumes.created
+		if opts == nil {
+			if err == nil {
+				t.Fatal("expected an error if no volume was created")
+			}
+			return
+		}
+
+		if empty || capability.AccessMode.Mode != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
+			t.Fatalf("volume %+v was created for unsupported capabilities", opts)
+		}
+		if opts.Name != name {
+			t.Fatalf("expected volume name %q, got %q", name, opts.Name)
+		}
+		size := int64(opts.Size) * GB
+		if size < minVolumeSizeInGB || size < required || (limit != 0 && size > limit) {
+			t.Fatalf("volume of %d GB created for required %d and limit %d bytes", opts.Size, required, limit)
+		}
+	})
+}
+
+func FuzzNodePublishVolume(f *testing.F) {
+	f.Add("1", "staging", "target", false, "ext4", "noatime", false)
+	f.Add("1", "staging", "a/b/../../../escaped", false, "", "", true)
+	f.Add("1", "", "target", true, "", "", false)
+	f.Add("", "staging", "/..", false, "xfs", "", false)
+	f.Add("1", "staging", "target\x00", false, "", "", false)
+
+	dir, err := ioutil.TempDir("", "hcloud-csi-fuzz")
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f.Fuzz(func(t *testing.T, volumeID, staging, target string, block bool, fsType, flag string, readonly bool) {
+		mounter := &fakeMounter{}
+		d := &Driver{
+			mounter: mounter,
+			log:     logrus.New().WithField("test_enabled", true),
+		}
+		d.log.Logger.Out = ioutil.Discard
+
+		// the paths are kept in dir unless they contain "..", which must
+		// be rejected
+		if staging != "" {
+			staging = dir + "/" + staging
+		}
+		if target != "" {
+			target = dir + "/" + target
+		}
+		if err := mounter.Format(context.Background(), "/dev/sdb", "ext4"); err != nil {
+			t.Fatal(err)
+		}
+		_ = mounter.Mount(context.Background(), "/dev/sdb", staging, "ext4")
+
+		capability := &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{FsType: fsType, MountFlags: []string{flag}},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		}
+		if block {
+			capability.AccessType = &csi.VolumeCapability_Block{
+				Block: &csi.VolumeCapability_BlockVolume{},
+			}
+		}
+
+		_, err := d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          volumeID,
+			StagingTargetPath: staging,
+			TargetPath:        target,
+			VolumeCapability:  capability,
+			Readonly:          readonly,
+		})
+		if _, ok := status.FromError(err); !ok {
+			t.Fatalf("expected a gRPC status error, got %v", err)
+		}
+		if err != nil {
+			if status.Code(err) != codes.InvalidArgument && status.Code(err) != codes.Internal {
+				t.Fatalf("unexpected error %v", err)
+			}
+			return
+		}
+
+		if volumeID == "" || block {
+			t.Fatalf("expected the request to be rejected, volume ID %q, block %t", volumeID, block)
+		}
+		if rel, err := filepath.Rel(dir, target); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			t.Fatalf("target %q was mounted outside of %s", target, dir)
+		}
+		if mounter.mounts[target] != staging {
+			t.Fatalf("expected %q to be bind mounted to %q, got %q", staging, target, mounter.mounts[target])
+		}
+	})
+}
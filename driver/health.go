@@ -0,0 +1,191 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// This file implements the standard gRPC health checking protocol
+// (grpc.health.v1.Health) as described in
+// https://github.com/grpc/grpc/blob/master/doc/health-checking.md
+//
+// The vendored gRPC version doesn't ship the generated health package, so the
+// messages and the service description are defined by hand. They are wire
+// compatible with grpc/health/v1/health.proto.
+
+// healthServingStatus is the serving status of a service.
+type healthServingStatus int32
+
+const (
+	healthStatusUnknown        healthServingStatus = 0
+	healthStatusServing        healthServingStatus = 1
+	healthStatusNotServing     healthServingStatus = 2
+	healthStatusServiceUnknown healthServingStatus = 3
+
+	// healthWatchInterval defines how often the status is re-evaluated for
+	// streaming Watch calls
+	healthWatchInterval = time.Second
+)
+
+// healthServices are the services the health checks can be requested for.
+// The empty string stands for the overall health of the server.
+var healthServices = map[string]bool{
+	"":                  true,
+	"csi.v0.Identity":   true,
+	"csi.v0.Controller": true,
+	"csi.v0.Node":       true,
+}
+
+type healthCheckRequest struct {
+	Service string `protobuf:"bytes,1,opt,name=service" json:"service,omitempty"`
+}
+
+func (m *healthCheckRequest) Reset()         { *m = healthCheckRequest{} }
+func (m *healthCheckRequest) String() string { return proto.CompactTextString(m) }
+func (*healthCheckRequest) ProtoMessage()    {}
+
+type healthCheckResponse struct {
+	Status healthServingStatus `protobuf:"varint,1,opt,name=status" json:"status,omitempty"`
+}
+
+func (m *healthCheckResponse) Reset()         { *m = healthCheckResponse{} }
+func (m *healthCheckResponse) String() string { return proto.CompactTextString(m) }
+func (*healthCheckResponse) ProtoMessage()    {}
+
+// healthServer is the server API for the grpc.health.v1.Health service
+type healthServer interface {
+	Check(context.Context, *healthCheckRequest) (*healthCheckResponse, error)
+	Watch(*healthCheckRequest, grpc.ServerStream) error
+}
+
+var healthServiceDesc = grpc.ServiceDesc{
+	ServiceName: "grpc.health.v1.Health",
+	HandlerType: (*healthServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Check",
+			Handler:    healthCheckHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       healthWatchHandler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "grpc/health/v1/health.proto",
+}
+
+// registerHealthServer registers the health service of the driver on the
+// given gRPC server.
+func registerHealthServer(s *grpc.Server, d *Driver) {
+	s.RegisterService(&healthServiceDesc, &driverHealthServer{d: d})
+}
+
+func healthCheckHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(healthCheckRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(healthServer).Check(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpc.health.v1.Health/Check",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(healthServer).Check(ctx, req.(*healthCheckRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func healthWatchHandler(srv interface{}, stream grpc.ServerStream) error {
+	in := new(healthCheckRequest)
+	if err := stream.RecvMsg(in); err != nil {
+		return err
+	}
+	return srv.(healthServer).Watch(in, stream)
+}
+
+// driverHealthServer reports the readiness of the driver via the gRPC health
+// checking protocol.
+type driverHealthServer struct {
+	d *Driver
+}
+
+// servingStatus returns the current serving status of the given service
+func (h *driverHealthServer) servingStatus(service string) healthServingStatus {
+	if !healthServices[service] ||
+		(service == "csi.v0.Controller" && !h.d.servesController()) ||
+		(service == "csi.v0.Node" && !h.d.servesNode()) {
+		return healthStatusServiceUnknown
+	}
+
+	if len(h.d.prober.degraded()) > 0 {
+		return healthStatusNotServing
+	}
+
+	h.d.readyMu.Lock()
+	defer h.d.readyMu.Unlock()
+
+	if h.d.ready {
+		return healthStatusServing
+	}
+	return healthStatusNotServing
+}
+
+// Check returns the current serving status of the requested service
+func (h *driverHealthServer) Check(ctx context.Context, req *healthCheckRequest) (*healthCheckResponse, error) {
+	st := h.servingStatus(req.Service)
+	if st == healthStatusServiceUnknown {
+		return nil, status.Errorf(codes.NotFound, "unknown service %q", req.Service)
+	}
+
+	return &healthCheckResponse{Status: st}, nil
+}
+
+// Watch streams the serving status of the requested service. A new message is
+// sent whenever the status changes.
+func (h *driverHealthServer) Watch(req *healthCheckRequest, stream grpc.ServerStream) error {
+	ticker := time.NewTicker(healthWatchInterval)
+	defer ticker.Stop()
+
+	last := healthStatusUnknown
+	for {
+		if st := h.servingStatus(req.Service); st != last {
+			if err := stream.SendMsg(&healthCheckResponse{Status: st}); err != nil {
+				return err
+			}
+			last = st
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// watchStream records the messages sent by Watch and cancels its context
+// after the first one
+type watchStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	cancel context.CancelFunc
+	sent   []healthServingStatus
+}
+
+func (s *watchStream) Context() context.Context { return s.ctx }
+
+func (s *watchStream) SendMsg(m interface{}) error {
+	s.sent = append(s.sent, m.(*healthCheckResponse).Status)
+	s.cancel()
+	return nil
+}
+
+func TestHealth(t *testing.T) {
+	cases := []struct {
+		name    string
+		mode    string
+		ready   bool
+		service string
+		want    healthServingStatus
+	}{
+		{"not ready", ModeAll, false, "", healthStatusNotServing},
+		{"ready", ModeAll, true, "csi.v0.Controller", healthStatusServing},
+		{"unknown service", ModeAll, true, "csi.v1.Controller", healthStatusServiceUnknown},
+		{"service not served", ModeNode, true, "csi.v0.Controller", healthStatusServiceUnknown},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := &driverHealthServer{d: &Driver{mode: c.mode, ready: c.ready}}
+			req := &healthCheckRequest{Service: c.service}
+
+			resp, err := h.Check(context.Background(), req)
+			if c.want == healthStatusServiceUnknown {
+				if status.Code(err) != codes.NotFound {
+					t.Errorf("expected Check to return NotFound, got %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("expected no error from Check, got %s", err)
+			} else if resp.Status != c.want {
+				t.Errorf("expected Check to return %d, got %d", c.want, resp.Status)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			stream := &watchStream{ctx: ctx, cancel: cancel}
+			if err := h.Watch(req, stream); err != context.Canceled {
+				t.Errorf("expected Watch to end with the stream, got %v", err)
+			}
+			if len(stream.sent) != 1 || stream.sent[0] != c.want {
+				t.Errorf("expected Watch to send %d, got %v", c.want, stream.sent)
+			}
+		})
+	}
+}
@@ -18,10 +18,13 @@ package driver
 
 import (
 	"context"
+	"strings"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
 	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // GetPluginInfo returns metadata of the plugin
@@ -39,16 +42,12 @@ func (d *Driver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoReques
 }
 
 // GetPluginCapabilities returns available capabilities of the plugin
+//
+// TODO: Nomad and Docker Swarm (cluster volumes) only speak CSI v1. Update the
+// CSI spec to support them, see the README.
 func (d *Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
 	resp := &csi.GetPluginCapabilitiesResponse{
 		Capabilities: []*csi.PluginCapability{
-			{
-				Type: &csi.PluginCapability_Service_{
-					Service: &csi.PluginCapability_Service{
-						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
-					},
-				},
-			},
 			{
 				Type: &csi.PluginCapability_Service_{
 					Service: &csi.PluginCapability_Service{
@@ -59,6 +58,16 @@ func (d *Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCa
 		},
 	}
 
+	if d.servesController() {
+		resp.Capabilities = append(resp.Capabilities, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+				},
+			},
+		})
+	}
+
 	d.log.WithFields(logrus.Fields{
 		"response": resp,
 		"method":   "get_plugin_capabilities",
@@ -66,9 +75,16 @@ func (d *Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCa
 	return resp, nil
 }
 
-// Probe returns the health and readiness of the plugin
+// Probe returns the health and readiness of the plugin. If dependencies of the
+// plugin are missing, i.e. the API token is invalid, it fails with
+// FailedPrecondition and the problems as details.
 func (d *Driver) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
 	d.log.WithField("method", "probe").Info("probe called")
+
+	if problems := d.prober.degraded(); len(problems) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "plugin is degraded: %s", strings.Join(problems, "; "))
+	}
+
 	d.readyMu.Lock()
 	defer d.readyMu.Unlock()
 
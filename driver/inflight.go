@@ -0,0 +1,52 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import "sync"
+
+// inFlight tracks the operations that are in progress by key. The CO retries
+// calls that time out while the first call is still running, the retries are
+// rejected instead of starting the operation twice. Operations with other
+// keys don't have to wait. The zero value is usable.
+type inFlight struct {
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+// start marks the operation as in progress. It returns false if it's in
+// progress already.
+func (f *inFlight) start(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.keys == nil {
+		f.keys = map[string]bool{}
+	}
+	if f.keys[key] {
+		return false
+	}
+	f.keys[key] = true
+	return true
+}
+
+// finish marks the operation as done
+func (f *inFlight) finish(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.keys, key)
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	journalStage     = "stage"
+	journalUnstage   = "unstage"
+	journalPublish   = "publish"
+	journalUnpublish = "unpublish"
+
+	journalSuffix = ".json"
+)
+
+// journalEntry is the intent of a node operation that's in progress
+type journalEntry struct {
+	Op       string    `json:"op"`
+	VolumeID string    `json:"volumeId"`
+	Target   string    `json:"target"`
+	Started  time.Time `json:"started"`
+
+	// CreatedDir is set if the target directory didn't exist before the
+	// operation, it's removed if the operation is rolled back
+	CreatedDir bool `json:"createdDir"`
+
+	// file is the name of the file of the entry in the journal directory
+	file string
+}
+
+// nodeJournal records the staging and publishing operations of the node
+// plugin in a directory, one file per operation. Entries are removed once
+// the operation returns, so the entries left after a crash of the plugin are
+// the operations it has to finish or roll back. A nil journal records
+// nothing.
+type nodeJournal struct {
+	dir string
+	log *logrus.Entry
+
+	// seq numbers the entries, so identical operations running at the same
+	// time get files of their own
+	seq uint64
+}
+
+// newNodeJournal returns a new nodeJournal storing its entries in dir
+func newNodeJournal(d *Driver, dir string) (*nodeJournal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create journal directory: %s", err)
+	}
+
+	return &nodeJournal{
+		dir: dir,
+		log: d.log.WithField("component", "node_journal"),
+	}, nil
+}
+
+// begin records the intent of the operation on the target. The returned func
+// removes the entry again and must be called once the operation returns.
+func (j *nodeJournal) begin(op, volumeID, target string) (func(), error) {
+	if j == nil {
+		return func() {}, nil
+	}
+
+	_, err := os.Stat(target)
+	entry := journalEntry{
+		Op:         op,
+		VolumeID:   volumeID,
+		Target:     target,
+		Started:    time.Now().UTC(),
+		CreatedDir: os.IsNotExist(err),
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	// write to a temporary file first, so a crash never leaves a partial
+	// entry behind
+	path := filepath.Join(j.dir, j.file(op, target, entry.Started))
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return nil, fmt.Errorf("could not write journal entry: %s", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return nil, fmt.Errorf("could not write journal entry: %s", err)
+	}
+
+	return func() {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			j.log.WithError(err).WithField("target", target).Warn("could not remove journal entry")
+		}
+	}, nil
+}
+
+// entries returns the entries of the journal, in no particular order
+func (j *nodeJournal) entries() ([]journalEntry, error) {
+	files, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []journalEntry
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), journalSuffix) {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(j.dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var entry journalEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			j.log.WithError(err).WithField("file", f.Name()).Warn("skipping invalid journal entry")
+			continue
+		}
+		entry.file = f.Name()
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// file returns the name of a new file for the entry of the operation on the
+// target. The start time and the sequence number keep the names unique, also
+// across restarts of the plugin.
+func (j *nodeJournal) file(op, target string, started time.Time) string {
+	sum := sha256.Sum256([]byte(target))
+	seq := atomic.AddUint64(&j.seq, 1)
+	return fmt.Sprintf("%s-%s-%d-%d%s", op, hex.EncodeToString(sum[:8]), started.UnixNano(), seq, journalSuffix)
+}
+
+// recoverJournal finishes or rolls back the operations that were in progress
+// when the plugin stopped. Unstaging and unpublishing is finished by
+// unmounting the target. Staging and publishing is rolled back if the target
+// isn't mounted yet, by removing the target directory if it was created by
+// the operation. A target that is mounted already is left alone, the CO
+// repeats the call and finds the volume mounted.
+func (d *Driver) recoverJournal(ctx context.Context) error {
+	entries, err := d.journal.entries()
+	if err != nil {
+		return fmt.Errorf("could not read journal: %s", err)
+	}
+
+	for _, e := range entries {
+		ll := d.journal.log.WithFields(logrus.Fields{
+			"op":        e.Op,
+			"volume_id": e.VolumeID,
+			"target":    e.Target,
+			"started":   e.Started,
+		})
+
+		if err := d.recoverJournalEntry(ctx, e, ll); err != nil {
+			// keep the entry, the next start tries again
+			ll.WithError(err).Error("could not recover interrupted operation")
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(d.journal.dir, e.file)); err != nil && !os.IsNotExist(err) {
+			ll.WithError(err).Warn("could not remove journal entry")
+		}
+	}
+
+	return nil
+}
+
+func (d *Driver) recoverJournalEntry(ctx context.Context, e journalEntry, ll *logrus.Entry) error {
+	mounted, err := d.mounter.IsMounted(ctx, e.Target)
+	if err != nil {
+		return err
+	}
+
+	switch e.Op {
+	case journalUnstage, journalUnpublish:
+		if mounted {
+			ll.Info("finishing interrupted unmount")
+			return d.mounter.Unmount(ctx, e.Target)
+		}
+	case journalStage, journalPublish:
+		if mounted {
+			ll.Info("interrupted operation mounted the target already")
+			return nil
+		}
+		if e.CreatedDir {
+			ll.Info("removing target directory of interrupted operation")
+			if err := os.Remove(e.Target); err != nil && !os.IsNotExist(err) {
+				// not empty, something else uses the directory
+				ll.WithError(err).Warn("could not remove target directory")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// journalMounter reports the targets in mounted as mounted
+type journalMounter struct {
+	fakeMounter
+	mounted map[string]bool
+}
+
+func (m *journalMounter) IsMounted(ctx context.Context, target string) (bool, error) {
+	return m.mounted[target], nil
+}
+
+func (m *journalMounter) Unmount(ctx context.Context, target string) error {
+	delete(m.mounted, target)
+	return nil
+}
+
+func TestNodeJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hcloud-csi-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mounter := &journalMounter{mounted: map[string]bool{}}
+	d := &Driver{
+		log:     logrus.New().WithField("test_enabled", true),
+		mounter: mounter,
+	}
+	d.journal, err = newNodeJournal(d, filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	existing := filepath.Join(dir, "existing")
+	if err := os.Mkdir(existing, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	done, err := d.journal.begin(journalPublish, "1", existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done()
+
+	entries, err := d.journal.entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected no entries after the operation returned, got %v", entries)
+	}
+
+	// interrupted operations, the target of the second one was created by
+	// it, the third one still has to unmount its target
+	created := filepath.Join(dir, "created")
+	unpublished := filepath.Join(dir, "unpublished")
+	mounter.mounted[unpublished] = true
+	if _, err := d.journal.begin(journalStage, "1", existing); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.journal.begin(journalStage, "2", created); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.journal.begin(journalUnpublish, "3", unpublished); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(created, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.recoverJournal(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(existing); err != nil {
+		t.Errorf("existing target directory was removed: %s", err)
+	}
+	if _, err := os.Stat(created); !os.IsNotExist(err) {
+		t.Errorf("created target directory wasn't removed: %v", err)
+	}
+	if mounter.mounted[unpublished] {
+		t.Error("interrupted unpublish wasn't finished")
+	}
+
+	entries, err = d.journal.entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected no entries after recovery, got %v", entries)
+	}
+}
+
+// TestConcurrentJournalOps checks identical operations running at the same
+// time don't share their entry, run it with -race
+func TestConcurrentJournalOps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hcloud-csi-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := &Driver{log: logrus.New().WithField("test_enabled", true)}
+	d.journal, err = newNodeJournal(d, filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(dir, "target")
+	const ops = 8
+	dones := make([]func(), ops)
+	var wg sync.WaitGroup
+	for i := 0; i < ops; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			done, err := d.journal.begin(journalPublish, "1", target)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			dones[i] = done
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	// the operations returning first must not remove the entries of the
+	// ones still running
+	for i, done := range dones {
+		entries, err := d.journal.entries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != ops-i {
+			t.Fatalf("expected %d entries with %d operations returned, got %d", ops-i, i, len(entries))
+		}
+		done()
+	}
+
+	entries, err := d.journal.entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected no entries after the operations returned, got %v", entries)
+	}
+}
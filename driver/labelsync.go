@@ -0,0 +1,178 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// labelSyncInterval defines how often the labels of the volumes are
+	// mirrored to their PVs
+	labelSyncInterval = 5 * time.Minute
+
+	// annVolumeLabelPrefix is the prefix of the PV annotations mirroring the
+	// labels of their volume
+	annVolumeLabelPrefix = "volume-label.de.apricote.hcloud.csi/"
+
+	// maxAnnotationNameLength is the maximum length of the name part of an
+	// annotation key
+	maxAnnotationNameLength = 63
+)
+
+// labelSyncer mirrors the labels of the volumes, i.e. set by billing or
+// inventory tooling, to annotations of their PVs, so they're visible
+// without access to the project. The labels the driver manages itself
+// aren't mirrored.
+type labelSyncer struct {
+	d   *Driver
+	log *logrus.Entry
+}
+
+// newLabelSyncer returns a new labelSyncer for the given driver
+func newLabelSyncer(d *Driver) *labelSyncer {
+	return &labelSyncer{
+		d:   d,
+		log: d.log.WithField("component", "label_syncer"),
+	}
+}
+
+// run mirrors the labels until stopCh is closed
+func (l *labelSyncer) run(stopCh <-chan struct{}) {
+	l.log.Info("label syncer started")
+
+	for {
+		timer := time.NewTimer(jittered(labelSyncInterval))
+		select {
+		case <-stopCh:
+			timer.Stop()
+			l.log.Info("label syncer stopped")
+			return
+		case <-timer.C:
+			if err := l.sync(context.Background()); err != nil {
+				l.log.WithError(err).Error("could not sync volume labels")
+			}
+		}
+	}
+}
+
+// sync updates the annotations of the PVs of this driver whose volume labels
+// changed
+func (l *labelSyncer) sync(ctx context.Context) error {
+	pvs, err := l.d.kubeClient.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list persistent volumes: %s", err)
+	}
+
+	// the labels set outside of the driver can be on any volume, i.e. on
+	// statically provisioned ones as well
+	labels := map[string]map[string]string{}
+	err = l.d.eachVolume(ctx, "", func(vol *hcloud.Volume) bool {
+		labels[strconv.Itoa(vol.ID)] = vol.Labels
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("could not list volumes: %s", err)
+	}
+
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName {
+			continue
+		}
+
+		// deleted volumes are reported by the lost volume detector
+		volumeLabels, ok := labels[pv.Spec.CSI.VolumeHandle]
+		if !ok {
+			continue
+		}
+
+		annotations, changed := syncedAnnotations(pv.Annotations, labelAnnotations(volumeLabels))
+		if !changed {
+			continue
+		}
+
+		ll := l.log.WithFields(logrus.Fields{
+			"pv_name":   pv.Name,
+			"volume_id": pv.Spec.CSI.VolumeHandle,
+		})
+
+		pv = pv.DeepCopy()
+		pv.Annotations = annotations
+		if _, err := l.d.kubeClient.CoreV1().PersistentVolumes().Update(pv); err != nil {
+			// retried with the next sync
+			ll.WithError(err).Error("could not update annotations of persistent volume")
+			continue
+		}
+		ll.Info("volume labels synced to persistent volume")
+	}
+
+	return nil
+}
+
+// labelAnnotations returns the PV annotations mirroring the given volume
+// labels. The prefix of prefixed label keys is separated by an underscore,
+// i.e. example.com/team becomes volume-label.de.apricote.hcloud.csi/example.com_team.
+// Labels that can't be mirrored, because the name of the annotation would be
+// too long, are left out.
+func labelAnnotations(labels map[string]string) map[string]string {
+	annotations := map[string]string{}
+	for k, v := range labels {
+		if managedLabels[k] {
+			continue
+		}
+
+		name := strings.Replace(k, "/", "_", 1)
+		if len(name) > maxAnnotationNameLength {
+			continue
+		}
+		annotations[annVolumeLabelPrefix+name] = v
+	}
+	return annotations
+}
+
+// syncedAnnotations returns the annotations with the mirrored labels
+// replaced by the given ones, and whether they changed
+func syncedAnnotations(current, mirrored map[string]string) (map[string]string, bool) {
+	annotations := map[string]string{}
+	changed := false
+	for k, v := range current {
+		if !strings.HasPrefix(k, annVolumeLabelPrefix) {
+			annotations[k] = v
+			continue
+		}
+		if _, ok := mirrored[k]; !ok {
+			changed = true
+		}
+	}
+
+	for k, v := range mirrored {
+		if cur, ok := current[k]; !ok || cur != v {
+			changed = true
+		}
+		annotations[k] = v
+	}
+	return annotations, changed
+}
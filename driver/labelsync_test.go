@@ -0,0 +1,75 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLabelAnnotations(t *testing.T) {
+	got := labelAnnotations(map[string]string{
+		"createdBy":             createdByHCloud,
+		labelPVCName:            "data",
+		"cost-center":           "1234",
+		"example.com/team":      "storage",
+		strings.Repeat("a", 64): "too long",
+	})
+
+	want := map[string]string{
+		annVolumeLabelPrefix + "cost-center":      "1234",
+		annVolumeLabelPrefix + "example.com_team": "storage",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSyncedAnnotations(t *testing.T) {
+	current := map[string]string{
+		"pv.kubernetes.io/provisioned-by":    driverName,
+		annVolumeLabelPrefix + "cost-center": "1234",
+		annVolumeLabelPrefix + "owner":       "alice",
+	}
+
+	// unchanged
+	if _, changed := syncedAnnotations(current, map[string]string{
+		annVolumeLabelPrefix + "cost-center": "1234",
+		annVolumeLabelPrefix + "owner":       "alice",
+	}); changed {
+		t.Error("expected the annotations to be unchanged")
+	}
+
+	// a label was changed, one was removed and one was added
+	got, changed := syncedAnnotations(current, map[string]string{
+		annVolumeLabelPrefix + "cost-center": "5678",
+		annVolumeLabelPrefix + "env":         "",
+	})
+	if !changed {
+		t.Error("expected the annotations to be changed")
+	}
+
+	want := map[string]string{
+		"pv.kubernetes.io/provisioned-by":    driverName,
+		annVolumeLabelPrefix + "cost-center": "5678",
+		annVolumeLabelPrefix + "env":         "",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
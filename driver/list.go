@@ -0,0 +1,94 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// volumesPerPage is the maximum page size of the API
+const volumesPerPage = 50
+
+// eachVolume calls fn for every volume matching the label selector, page by
+// page, until fn returns false. The background loops filter by label and
+// don't keep all volumes of the project in memory, so their API load stays
+// flat as projects grow to thousands of volumes.
+func (d *Driver) eachVolume(ctx context.Context, selector string, fn func(*hcloud.Volume) bool) error {
+	opts := hcloud.VolumeListOpts{
+		ListOpts: hcloud.ListOpts{
+			Page:          1,
+			PerPage:       volumesPerPage,
+			LabelSelector: selector,
+		},
+	}
+
+	for {
+		vols, resp, err := d.volumes.List(ctx, opts)
+		if err != nil {
+			return err
+		}
+
+		for _, vol := range vols {
+			if !fn(vol) {
+				return nil
+			}
+		}
+
+		if resp.Meta.Pagination == nil || resp.Meta.Pagination.NextPage == 0 {
+			return nil
+		}
+		opts.Page = resp.Meta.Pagination.NextPage
+	}
+}
+
+// volumePages calls fn for the volumes matching the label selector on up to
+// pages pages, starting at the given page. It returns the page to continue
+// with on the next call, 1 once the last page was scanned, so a background
+// loop can spread a scan of a large project over several runs.
+func (d *Driver) volumePages(ctx context.Context, selector string, page, pages int, fn func(*hcloud.Volume)) (int, error) {
+	if page < 1 {
+		page = 1
+	}
+
+	opts := hcloud.VolumeListOpts{
+		ListOpts: hcloud.ListOpts{
+			PerPage:       volumesPerPage,
+			LabelSelector: selector,
+		},
+	}
+
+	for i := 0; i < pages; i++ {
+		opts.Page = page
+		vols, resp, err := d.volumes.List(ctx, opts)
+		if err != nil {
+			return page, err
+		}
+
+		for _, vol := range vols {
+			fn(vol)
+		}
+
+		if resp.Meta.Pagination == nil || resp.Meta.Pagination.NextPage == 0 {
+			return 1, nil
+		}
+		page = resp.Meta.Pagination.NextPage
+	}
+
+	return page, nil
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+)
+
+func TestEachVolume(t *testing.T) {
+	var selectors []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		selectors = append(selectors, q.Get("label_selector"))
+		if q.Get("per_page") != strconv.Itoa(volumesPerPage) {
+			t.Errorf("expected pages of %d volumes, got %q", volumesPerPage, q.Get("per_page"))
+		}
+
+		// three pages with two volumes each
+		page, _ := strconv.Atoi(q.Get("page"))
+		resp := struct {
+			schema.VolumeListResponse
+			Meta schema.Meta `json:"meta"`
+		}{}
+		resp.Volumes = []schema.Volume{{ID: 2*page - 1}, {ID: 2 * page}}
+		resp.Meta.Pagination = &schema.MetaPagination{Page: page, LastPage: 3}
+		if page < 3 {
+			resp.Meta.Pagination.NextPage = page + 1
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer ts.Close()
+
+	client := hcloud.NewClient(hcloud.WithEndpoint(ts.URL))
+	d := &Driver{volumes: &client.Volume}
+
+	var ids []int
+	err := d.eachVolume(context.Background(), "createdBy=test", func(vol *hcloud.Volume) bool {
+		ids = append(ids, vol.ID)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 6 || ids[5] != 6 {
+		t.Errorf("expected the volumes of all pages, got %v", ids)
+	}
+	if selectors[0] != "createdBy=test" {
+		t.Errorf("expected the label selector to be passed, got %q", selectors[0])
+	}
+
+	// stops early, the last page isn't fetched
+	selectors = nil
+	err = d.eachVolume(context.Background(), "", func(vol *hcloud.Volume) bool {
+		return vol.ID < 3
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selectors) != 2 {
+		t.Errorf("expected 2 requests, got %d", len(selectors))
+	}
+}
+
+func TestVolumePages(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// five pages with one volume each
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		resp := struct {
+			schema.VolumeListResponse
+			Meta schema.Meta `json:"meta"`
+		}{}
+		resp.Volumes = []schema.Volume{{ID: page}}
+		resp.Meta.Pagination = &schema.MetaPagination{Page: page, LastPage: 5}
+		if page < 5 {
+			resp.Meta.Pagination.NextPage = page + 1
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer ts.Close()
+
+	client := hcloud.NewClient(hcloud.WithEndpoint(ts.URL))
+	d := &Driver{volumes: &client.Volume}
+
+	// two runs of two pages, then the last page and back to the start
+	var ids []int
+	page := 0
+	for _, next := range []int{3, 5, 1, 3} {
+		var err error
+		page, err = d.volumePages(context.Background(), "", page, 2, func(vol *hcloud.Volume) {
+			ids = append(ids, vol.ID)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page != next {
+			t.Fatalf("expected to continue at page %d, got %d", next, page)
+		}
+	}
+	if len(ids) != 7 || ids[4] != 5 || ids[5] != 1 {
+		t.Errorf("expected every page once per pass, got %v", ids)
+	}
+}
+
+func TestCountVolumes(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if per := r.URL.Query().Get("per_page"); per != "1" {
+			t.Errorf("expected a page of one volume, got %q", per)
+		}
+
+		resp := struct {
+			schema.VolumeListResponse
+			Meta schema.Meta `json:"meta"`
+		}{}
+		resp.Volumes = []schema.Volume{{ID: 1}}
+		resp.Meta.Pagination = &schema.MetaPagination{Page: 1, NextPage: 2, LastPage: 120, TotalEntries: 120}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer ts.Close()
+
+	client := hcloud.NewClient(hcloud.WithEndpoint(ts.URL))
+	d := &Driver{volumes: &client.Volume}
+
+	count, err := d.countVolumes(context.Background(), "createdBy=test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 120 {
+		t.Errorf("expected the total of the pagination, got %d", count)
+	}
+	if requests != 1 {
+		t.Errorf("expected a single request, got %d", requests)
+	}
+}
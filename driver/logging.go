@@ -0,0 +1,84 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"io/ioutil"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LogLevel is the severity of a log entry passed to a LogSink
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+// LogSink receives the log entries of the driver, so it can log with another
+// library than logrus, e.g. slog, zap or logr. See WithLogSink.
+type LogSink interface {
+	// Log writes an entry. The fields contain the error of the entry, if
+	// any, as "error". They must not be modified or kept after Log returns.
+	Log(level LogLevel, msg string, fields map[string]interface{})
+}
+
+// newSinkLogger returns a logrus logger that passes its entries to the sink
+// instead of writing them, the driver keeps logging with logrus internally
+func newSinkLogger(sink LogSink) *logrus.Entry {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	log.Formatter = discardFormatter{}
+	log.Level = logrus.DebugLevel
+	log.Hooks.Add(sinkHook{sink})
+	return logrus.NewEntry(log)
+}
+
+// sinkHook passes the entries of a logrus logger to a LogSink
+type sinkHook struct {
+	sink LogSink
+}
+
+func (h sinkHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h sinkHook) Fire(entry *logrus.Entry) error {
+	level := LogLevelError
+	switch entry.Level {
+	case logrus.DebugLevel:
+		level = LogLevelDebug
+	case logrus.InfoLevel:
+		level = LogLevelInfo
+	case logrus.WarnLevel:
+		level = LogLevelWarn
+	}
+
+	h.sink.Log(level, entry.Message, entry.Data)
+	return nil
+}
+
+// discardFormatter skips formatting the entries of loggers writing to a
+// LogSink
+type discardFormatter struct{}
+
+func (discardFormatter) Format(*logrus.Entry) ([]byte, error) {
+	return nil, nil
+}
@@ -0,0 +1,54 @@
+//go:build go1.21
+// +build go1.21
+
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogSink(t *testing.T) {
+	var out bytes.Buffer
+	handler := slog.NewTextHandler(&out, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	log := newSinkLogger(SlogSink(slog.New(handler)))
+
+	log.WithField("volume_id", "1").WithField("location", "fsn1").Info("volume is staged")
+	log.WithError(errors.New("mkfs failed")).Error("formatting failed")
+
+	expected := []string{
+		`level=INFO msg="volume is staged" location=fsn1 volume_id=1`,
+		`level=ERROR msg="formatting failed" error="mkfs failed"`,
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected the lines\n%s\ngot\n%s", strings.Join(expected, "\n"), out.String())
+	}
+}
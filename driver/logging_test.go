@@ -0,0 +1,63 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type logEntry struct {
+	level  LogLevel
+	msg    string
+	fields map[string]interface{}
+}
+
+// recordingSink records the entries passed to it
+type recordingSink struct {
+	entries []logEntry
+}
+
+func (r *recordingSink) Log(level LogLevel, msg string, fields map[string]interface{}) {
+	copied := map[string]interface{}{}
+	for key, value := range fields {
+		copied[key] = value
+	}
+	r.entries = append(r.entries, logEntry{level, msg, copied})
+}
+
+func TestLogSink(t *testing.T) {
+	sink := &recordingSink{}
+	log := newSinkLogger(sink).WithField("location", "fsn1")
+
+	err := errors.New("mkfs failed")
+	log.Debug("probing device")
+	log.WithField("volume_id", "1").Info("volume is staged")
+	log.Warn("device is slow")
+	log.WithError(err).Error("formatting failed")
+
+	expected := []logEntry{
+		{LogLevelDebug, "probing device", map[string]interface{}{"location": "fsn1"}},
+		{LogLevelInfo, "volume is staged", map[string]interface{}{"location": "fsn1", "volume_id": "1"}},
+		{LogLevelWarn, "device is slow", map[string]interface{}{"location": "fsn1"}},
+		{LogLevelError, "formatting failed", map[string]interface{}{"location": "fsn1", "error": err}},
+	}
+	if !reflect.DeepEqual(sink.entries, expected) {
+		t.Errorf("expected the entries\n%v\ngot\n%v", expected, sink.entries)
+	}
+}
@@ -0,0 +1,370 @@
+//go:build loopback
+// +build loopback
+
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The tests in this file run the mounter against loop devices. They're only
+// built with the loopback tag and need root, see `make test-loopback`.
+
+// loopbackFsTypes are the filesystems the tests are run with, the ones
+// without mkfs tool are skipped
+var loopbackFsTypes = []string{"ext4", "xfs"}
+
+// newLoopbackDir returns a directory for mounts, it's a shared mount like
+// the kubelet directory, which IsMounted checks for. The returned function
+// unmounts and removes it.
+func newLoopbackDir(t *testing.T) (string, func()) {
+	if os.Geteuid() != 0 {
+		t.Skip("the loopback tests must be run as root")
+	}
+	if _, err := exec.LookPath("losetup"); err != nil {
+		t.Skip("losetup is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "hcloud-csi-loopback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(t, "mount", "--bind", dir, dir)
+	run(t, "mount", "--make-shared", dir)
+
+	return dir, func() {
+		run(t, "umount", "--recursive", dir)
+		os.RemoveAll(dir)
+	}
+}
+
+// newLoopDevice returns a loop device of the given size backed by a file in
+// dir. The device is resized with the file, see growLoopDevice. The returned
+// function detaches the device.
+func newLoopDevice(t *testing.T, dir string, size string) (device, file string, detach func()) {
+	file = filepath.Join(dir, "disk-"+size)
+	run(t, "truncate", "-s", size, file)
+	device = strings.TrimSpace(run(t, "losetup", "--find", "--show", file))
+
+	return device, file, func() {
+		run(t, "losetup", "--detach", device)
+	}
+}
+
+// growLoopDevice grows the loop device like a resized volume
+func growLoopDevice(t *testing.T, device, file, size string) {
+	run(t, "truncate", "-s", size, file)
+	run(t, "losetup", "--set-capacity", device)
+}
+
+func skipWithoutMkfs(t *testing.T, fsType string) {
+	if _, err := exec.LookPath("mkfs." + fsType); err != nil {
+		t.Skipf("mkfs.%s is not installed", fsType)
+	}
+}
+
+func run(t *testing.T, name string, args ...string) string {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s %s failed: %s: %s", name, strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+func newLoopbackMounter() *mounter {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	return newMounter(log.WithField("test_enabled", true))
+}
+
+func TestLoopbackFormatAndMount(t *testing.T) {
+	ctx := context.Background()
+	for _, fsType := range loopbackFsTypes {
+		t.Run(fsType, func(t *testing.T) {
+			skipWithoutMkfs(t, fsType)
+			dir, cleanup := newLoopbackDir(t)
+			defer cleanup()
+			device, _, detach := newLoopDevice(t, dir, "512M")
+			defer detach()
+			m := newLoopbackMounter()
+
+			formatted, err := m.IsFormatted(ctx, device)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if formatted {
+				t.Fatal("empty device is reported as formatted")
+			}
+
+			if err := m.Format(ctx, device, fsType); err != nil {
+				t.Fatal(err)
+			}
+			formatted, err = m.IsFormatted(ctx, device)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !formatted {
+				t.Fatal("device is not reported as formatted")
+			}
+
+			// mount and publish it like NodeStageVolume and NodePublishVolume
+			staging := filepath.Join(dir, "staging")
+			target := filepath.Join(dir, "target")
+			if err := m.Mount(ctx, device, staging, fsType, "noatime"); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(staging, "data"), []byte("loopback"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Mount(ctx, staging, target, fsType, "bind", "ro"); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, path := range []string{staging, target} {
+				mounted, err := m.IsMounted(ctx, path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !mounted {
+					t.Fatalf("%s is not reported as mounted", path)
+				}
+			}
+
+			options := run(t, "findmnt", "-n", "-o", "OPTIONS", "-M", staging)
+			if !strings.Contains(options, "noatime") {
+				t.Errorf("expected %s to be mounted with noatime, got %s", staging, options)
+			}
+
+			data, err := ioutil.ReadFile(filepath.Join(target, "data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "loopback" {
+				t.Errorf("expected the data of the staging path in the target, got %q", data)
+			}
+			if err := ioutil.WriteFile(filepath.Join(target, "data"), nil, 0644); err == nil {
+				t.Error("read only target is writable")
+			}
+
+			mountTarget, mountFsType, err := deviceMount(device)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mountTarget != staging && mountTarget != target || mountFsType != fsType {
+				t.Errorf("expected the device to be mounted with %s, got %s mounted to %q", fsType, mountFsType, mountTarget)
+			}
+
+			for _, path := range []string{target, staging} {
+				if err := m.Unmount(ctx, path); err != nil {
+					t.Fatal(err)
+				}
+				mounted, err := m.IsMounted(ctx, path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if mounted {
+					t.Fatalf("%s is still reported as mounted", path)
+				}
+			}
+
+			// formatting must not be repeated once the device is unmounted
+			formatted, err = m.IsFormatted(ctx, device)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !formatted {
+				t.Fatal("device is not reported as formatted after unmounting it")
+			}
+		})
+	}
+}
+
+func TestLoopbackMountFailures(t *testing.T) {
+	ctx := context.Background()
+	dir, cleanup := newLoopbackDir(t)
+	defer cleanup()
+	device, _, detach := newLoopDevice(t, dir, "64M")
+	defer detach()
+	m := newLoopbackMounter()
+
+	if err := m.Mount(ctx, device, filepath.Join(dir, "unformatted"), "ext4"); err == nil {
+		t.Error("expected mounting an unformatted device to fail")
+	}
+
+	if err := m.Format(ctx, device, "ext4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mount(ctx, device, filepath.Join(dir, "invalid"), "ext4", "no-such-option"); err == nil {
+		t.Error("expected mounting with an invalid option to fail")
+	}
+	if err := m.Unmount(ctx, filepath.Join(dir, "invalid")); err == nil {
+		t.Error("expected unmounting a path that isn't mounted to fail")
+	}
+
+	// the mounter insists on shared mounts, private ones wouldn't propagate
+	// to the containers
+	private, err := ioutil.TempDir("", "hcloud-csi-private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(private)
+	if err := m.Mount(ctx, device, private, "ext4"); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Unmount(ctx, private)
+	run(t, "mount", "--make-private", private)
+
+	if _, err := m.IsMounted(ctx, private); err == nil {
+		t.Error("expected a private mount to be reported")
+	}
+}
+
+func TestLoopbackFormatCancelled(t *testing.T) {
+	skipWithoutMkfs(t, "ext4")
+	dir, cleanup := newLoopbackDir(t)
+	defer cleanup()
+	device, _, detach := newLoopDevice(t, dir, "64M")
+	defer detach()
+	m := newLoopbackMounter()
+
+	// the signatures of an interrupted mkfs look like a formatted device,
+	// a cancelled format must wipe them
+	if err := m.Format(context.Background(), device, "ext4"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.Format(ctx, device, "ext4"); err == nil {
+		t.Fatal("expected a cancelled format to fail")
+	}
+
+	formatted, err := m.IsFormatted(context.Background(), device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if formatted {
+		t.Error("device is reported as formatted after cancelling the format")
+	}
+}
+
+func TestLoopbackFormatTuning(t *testing.T) {
+	skipWithoutMkfs(t, "ext4")
+	dir, cleanup := newLoopbackDir(t)
+	defer cleanup()
+	device, _, detach := newLoopDevice(t, dir, "64M")
+	defer detach()
+	m := newLoopbackMounter()
+
+	options := mkfsOptions("ext4", map[string]string{
+		paramReservedBlocksPercent: "0",
+		paramInodeRatio:            "65536",
+	})
+	if err := m.Format(context.Background(), device, "ext4", options...); err != nil {
+		t.Fatal(err)
+	}
+
+	info := run(t, "tune2fs", "-l", device)
+	if !strings.Contains(info, "Reserved block count:     0\n") {
+		t.Errorf("expected no reserved blocks, got:\n%s", info)
+	}
+	// one inode per 64KiB of the 64MiB device
+	if !strings.Contains(info, "Inode count:              1024\n") {
+		t.Errorf("expected 1024 inodes, got:\n%s", info)
+	}
+}
+
+func TestLoopbackResizeFilesystem(t *testing.T) {
+	ctx := context.Background()
+	for _, fsType := range loopbackFsTypes {
+		t.Run(fsType, func(t *testing.T) {
+			skipWithoutMkfs(t, fsType)
+			dir, cleanup := newLoopbackDir(t)
+			defer cleanup()
+			if !hasCapability(t, capSysResource) {
+				t.Skip("online resizing requires CAP_SYS_RESOURCE")
+			}
+			device, file, detach := newLoopDevice(t, dir, "512M")
+			defer detach()
+			m := newLoopbackMounter()
+
+			target := filepath.Join(dir, "staging")
+			if err := m.Format(ctx, device, fsType); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Mount(ctx, device, target, fsType); err != nil {
+				t.Fatal(err)
+			}
+			defer m.Unmount(ctx, target)
+
+			before := filesystemSize(t, target)
+			growLoopDevice(t, device, file, "1G")
+			if err := resizeFilesystem(device, target, fsType); err != nil {
+				t.Fatal(err)
+			}
+
+			// the filesystem overhead is below 10%
+			after := filesystemSize(t, target)
+			if after <= before || after < 900<<20 {
+				t.Errorf("expected the filesystem to grow to 1G, it grew from %d to %d bytes", before, after)
+			}
+		})
+	}
+}
+
+// capSysResource is the number of the CAP_SYS_RESOURCE capability
+const capSysResource = 24
+
+// hasCapability returns true if the effective capabilities of the test
+// include the given one, containers often drop some of them
+func hasCapability(t *testing.T, capability uint) bool {
+	status, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range strings.Split(string(status), "\n") {
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return caps&(1<<capability) != 0
+	}
+	return false
+}
+
+func filesystemSize(t *testing.T, path string) uint64 {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		t.Fatal(err)
+	}
+	return stat.Blocks * uint64(stat.Bsize)
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// lostVolumeCheckInterval defines how often PVs are checked for deleted
+	// volumes
+	lostVolumeCheckInterval = 5 * time.Minute
+
+	// annVolumeLost is added to PVs whose volume was deleted outside of the
+	// plugin. It contains the time the deletion was noticed.
+	annVolumeLost = "de.apricote.hcloud.csi/volume-lost"
+
+	// eventReasonVolumeLost is the reason of the events emitted for PVs whose
+	// volume was deleted outside of the plugin
+	eventReasonVolumeLost = "VolumeLost"
+)
+
+// lostVolumeDetector notices when the volumes of PVs are deleted outside of
+// the plugin, i.e. in the Cloud Console or via the API. The PVs are marked
+// with annVolumeLost and a warning event is emitted for them and their PVCs,
+// so the loss shows up in `kubectl describe`. CSI v0.3 has no volume
+// conditions to report it with.
+type lostVolumeDetector struct {
+	d   *Driver
+	log *logrus.Entry
+}
+
+// newLostVolumeDetector returns a new lostVolumeDetector for the given driver
+func newLostVolumeDetector(d *Driver) *lostVolumeDetector {
+	return &lostVolumeDetector{
+		d:   d,
+		log: d.log.WithField("component", "lost_volume_detector"),
+	}
+}
+
+// run checks the PVs until stopCh is closed
+func (l *lostVolumeDetector) run(stopCh <-chan struct{}) {
+	l.log.Info("lost volume detector started")
+
+	for {
+		timer := time.NewTimer(jittered(lostVolumeCheckInterval))
+		select {
+		case <-stopCh:
+			timer.Stop()
+			l.log.Info("lost volume detector stopped")
+			return
+		case <-timer.C:
+			if err := l.check(context.Background()); err != nil {
+				l.log.WithError(err).Error("could not check for lost volumes")
+			}
+		}
+	}
+}
+
+// check marks the PVs of this driver whose volume doesn't exist anymore
+func (l *lostVolumeDetector) check(ctx context.Context) error {
+	// listed before the volumes, so PVs of volumes created in the meantime
+	// aren't marked
+	pvs, err := l.d.kubeClient.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list persistent volumes: %s", err)
+	}
+
+	// only the volumes labeled by the driver are listed, the PVs of other
+	// volumes (i.e. statically provisioned ones) are checked one by one
+	exists := map[string]bool{}
+	err = l.d.eachVolume(ctx, "createdBy="+createdByHCloud, func(vol *hcloud.Volume) bool {
+		exists[strconv.Itoa(vol.ID)] = true
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("could not list volumes: %s", err)
+	}
+
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName || exists[pv.Spec.CSI.VolumeHandle] {
+			continue
+		}
+
+		// the volumes of released PVs are deleted by DeleteVolume, or
+		// deliberately by the user with the Retain policy
+		if pv.DeletionTimestamp != nil || pv.Status.Phase == corev1.VolumeReleased || pv.Annotations[annVolumeLost] != "" {
+			continue
+		}
+
+		lost, err := l.volumeMissing(ctx, pv.Spec.CSI.VolumeHandle)
+		if err != nil {
+			l.log.WithError(err).WithField("pv_name", pv.Name).Error("could not get volume of persistent volume")
+			continue
+		}
+		if !lost {
+			continue
+		}
+
+		if err := l.markLost(pv); err != nil {
+			l.log.WithError(err).WithField("pv_name", pv.Name).Error("could not mark persistent volume as lost")
+		}
+	}
+
+	return nil
+}
+
+// volumeMissing returns true if the volume with the given ID doesn't exist
+func (l *lostVolumeDetector) volumeMissing(ctx context.Context, volumeID string) (bool, error) {
+	id, err := strconv.Atoi(volumeID)
+	if err != nil {
+		return true, nil
+	}
+
+	vol, _, err := l.d.volumes.GetByID(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	return vol == nil, nil
+}
+
+// markLost annotates the PV and emits the events for it and its PVC
+func (l *lostVolumeDetector) markLost(pv *corev1.PersistentVolume) error {
+	ll := l.log.WithFields(logrus.Fields{
+		"pv_name":   pv.Name,
+		"volume_id": pv.Spec.CSI.VolumeHandle,
+	})
+	ll.Warn("volume of persistent volume was deleted outside of the plugin")
+
+	pv = pv.DeepCopy()
+	if pv.Annotations == nil {
+		pv.Annotations = map[string]string{}
+	}
+	pv.Annotations[annVolumeLost] = time.Now().UTC().Format(time.RFC3339)
+
+	if _, err := l.d.kubeClient.CoreV1().PersistentVolumes().Update(pv); err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("volume %s was deleted outside of %s, the data is lost. If the volume was recreated from a backup, bind the claim to it with `hcloud-csi-driver repair`", pv.Spec.CSI.VolumeHandle, driverName)
+
+	// events of cluster scoped objects are stored in the default namespace
+	refs := []corev1.ObjectReference{{
+		Kind:       "PersistentVolume",
+		APIVersion: "v1",
+		Namespace:  metav1.NamespaceDefault,
+		Name:       pv.Name,
+		UID:        pv.UID,
+	}}
+	if ref := pv.Spec.ClaimRef; ref != nil {
+		refs = append(refs, corev1.ObjectReference{
+			Kind:       "PersistentVolumeClaim",
+			APIVersion: "v1",
+			Namespace:  ref.Namespace,
+			Name:       ref.Name,
+			UID:        ref.UID,
+		})
+	}
+
+	for _, ref := range refs {
+		if err := l.d.warningEvent(ref, eventReasonVolumeLost, message); err != nil {
+			ll.WithError(err).WithField("object", ref.Kind+"/"+ref.Name).Warn("could not create event")
+		}
+	}
+
+	return nil
+}
+
+// warningEvent creates a warning event for the given object
+func (d *Driver) warningEvent(ref corev1.ObjectReference, reason, message string) error {
+	now := metav1.Now()
+	_, err := d.kubeClient.CoreV1().Events(ref.Namespace).Create(&corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: ref.Name + ".",
+			Namespace:    ref.Namespace,
+		},
+		InvolvedObject: ref,
+		Reason:         reason,
+		Message:        message,
+		Type:           corev1.EventTypeWarning,
+		Source:         corev1.EventSource{Component: driverName},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	})
+	return err
+}
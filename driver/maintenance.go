@@ -0,0 +1,51 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"os"
+
+	drivererrors "github.com/apricote/hcloud-csi-driver/driver/errors"
+)
+
+// maintenanceMessage is returned by the calls rejected in maintenance mode
+const maintenanceMessage = "the plugin is in maintenance mode, no new volumes are provisioned"
+
+// inMaintenance returns true if the plugin is in maintenance mode. It's
+// enabled with the Maintenance parameter or, without a restart, by creating
+// the MaintenanceFile. In maintenance mode no volumes are created or grown,
+// the existing volumes can still be attached, detached and mounted.
+func (d *Driver) inMaintenance() bool {
+	if d.maintenance {
+		return true
+	}
+
+	if d.maintenanceFile == "" {
+		return false
+	}
+
+	_, err := os.Stat(d.maintenanceFile)
+	return err == nil
+}
+
+// checkMaintenance returns UNAVAILABLE if the plugin is in maintenance mode
+func (d *Driver) checkMaintenance() error {
+	if d.inMaintenance() {
+		return drivererrors.Errorf(drivererrors.ErrMaintenance, maintenanceMessage)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"testing"
+
+	drivererrors "github.com/apricote/hcloud-csi-driver/driver/errors"
+)
+
+func TestCreateVolumeInMaintenance(t *testing.T) {
+	d, _, stop := newConcurrencyDriver(t)
+	defer stop()
+
+	id, err := createVolume(d, "pvc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.maintenance = true
+
+	// retries for the existing volume are answered
+	retried, err := createVolume(d, "pvc-1")
+	if err != nil {
+		t.Fatalf("expected the existing volume to be returned, got %v", err)
+	}
+	if retried != id {
+		t.Errorf("expected volume %s, got %s", id, retried)
+	}
+
+	if _, err := createVolume(d, "pvc-2"); !drivererrors.Is(err, drivererrors.ErrMaintenance) {
+		t.Errorf("expected %q for a new volume, got %v", drivererrors.ErrMaintenance, err)
+	}
+}
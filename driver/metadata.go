@@ -0,0 +1,155 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultMetadataURL is the metadata service of Hetzner Cloud servers
+	DefaultMetadataURL = "http://169.254.169.254/hetzner/v1/metadata"
+
+	// metadataTimeout limits every request to the metadata service. Its
+	// address doesn't answer on dedicated servers.
+	metadataTimeout = 3 * time.Second
+)
+
+// MetadataClient is the part of the metadata service of Hetzner Cloud servers
+// the driver uses to find the server it runs on. It's implemented by the
+// client returned by NewMetadataClient.
+type MetadataClient interface {
+	// InstanceID returns the ID of the server
+	InstanceID(ctx context.Context) (int, error)
+	// AvailabilityZone returns the datacenter of the server, e.g. fsn1-dc14
+	AvailabilityZone(ctx context.Context) (string, error)
+}
+
+// NewMetadataClient returns a client of the metadata service at url, usually
+// DefaultMetadataURL
+func NewMetadataClient(url string) MetadataClient {
+	return &metadataClient{
+		url:    strings.TrimSuffix(url, "/"),
+		client: &http.Client{Timeout: metadataTimeout},
+	}
+}
+
+type metadataClient struct {
+	url    string
+	client *http.Client
+}
+
+func (m *metadataClient) InstanceID(ctx context.Context) (int, error) {
+	value, err := m.get(ctx, "instance-id")
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid instance-id %q in the metadata", value)
+	}
+	return id, nil
+}
+
+func (m *metadataClient) AvailabilityZone(ctx context.Context) (string, error) {
+	return m.get(ctx, "availability-zone")
+}
+
+// get returns the metadata value at path
+func (m *metadataClient) get(ctx context.Context, path string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, m.url+"/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := m.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("metadata service is unreachable: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("reading the %s metadata failed: %s", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata service answered %s for %s", resp.Status, path)
+	}
+
+	value := strings.TrimSpace(string(body))
+	if value == "" {
+		return "", fmt.Errorf("%s is missing in the metadata", path)
+	}
+	return value, nil
+}
+
+// nodeServer is the Hetzner Cloud server the plugin runs on
+type nodeServer struct {
+	id         int
+	location   string
+	datacenter string
+}
+
+// lookupNodeServer returns the server the plugin runs on, nil if there's no
+// server with the hostname (i.e. on dedicated servers). If metadata is set,
+// the server is taken from the metadata service without calling the API. The
+// server is looked up by hostname if the metadata service fails, its error is
+// returned as metadataErr.
+func lookupNodeServer(ctx context.Context, metadata MetadataClient, servers ServerService, hostname string) (server *nodeServer, metadataErr error, err error) {
+	if metadata != nil {
+		server, metadataErr = metadataNodeServer(ctx, metadata)
+		if metadataErr == nil {
+			return server, nil, nil
+		}
+	}
+
+	s, _, err := servers.GetByName(ctx, hostname)
+	if err != nil || s == nil {
+		return nil, metadataErr, err
+	}
+
+	return &nodeServer{
+		id:         s.ID,
+		location:   s.Datacenter.Location.Name,
+		datacenter: s.Datacenter.Name,
+	}, metadataErr, nil
+}
+
+func metadataNodeServer(ctx context.Context, metadata MetadataClient) (*nodeServer, error) {
+	id, err := metadata.InstanceID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	datacenter, err := metadata.AvailabilityZone(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &nodeServer{
+		id:         id,
+		location:   datacenterLocation(datacenter),
+		datacenter: datacenter,
+	}, nil
+}
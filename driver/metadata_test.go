@@ -0,0 +1,228 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeMetadata is a metadata service answering with the values by path,
+// missing paths are answered with 404. Every answer is delayed by delay.
+type fakeMetadata struct {
+	values map[string]string
+	delay  time.Duration
+}
+
+func (f *fakeMetadata) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-time.After(f.delay):
+	case <-r.Context().Done():
+		return
+	}
+
+	value, ok := f.values[strings.TrimPrefix(r.URL.Path, "/hetzner/v1/metadata/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprint(w, value)
+}
+
+// newFakeMetadata starts the metadata service and returns a client for it,
+// its requests time out after 100ms. The returned function stops the service.
+func newFakeMetadata(f *fakeMetadata) (MetadataClient, func()) {
+	ts := httptest.NewServer(f)
+
+	return &metadataClient{
+		url:    ts.URL + "/hetzner/v1/metadata",
+		client: &http.Client{Timeout: 100 * time.Millisecond},
+	}, ts.Close
+}
+
+// fakeServers returns the servers by name, the other methods of the
+// ServerService aren't implemented
+type fakeServers struct {
+	ServerService
+	servers map[string]*hcloud.Server
+	calls   int
+}
+
+func (f *fakeServers) GetByName(ctx context.Context, name string) (*hcloud.Server, *hcloud.Response, error) {
+	f.calls++
+	return f.servers[name], nil, nil
+}
+
+func TestLookupNodeServer(t *testing.T) {
+	apiServer := &hcloud.Server{
+		ID: 2,
+		Datacenter: &hcloud.Datacenter{
+			Name:     "nbg1-dc3",
+			Location: &hcloud.Location{Name: "nbg1"},
+		},
+	}
+	fromAPI := &nodeServer{id: 2, location: "nbg1", datacenter: "nbg1-dc3"}
+
+	tests := []struct {
+		name        string
+		metadata    *fakeMetadata // no metadata client if nil
+		hostname    string
+		expected    *nodeServer
+		metadataErr bool
+		apiCalls    int
+	}{
+		{
+			name: "fsn1",
+			metadata: &fakeMetadata{values: map[string]string{
+				"instance-id": "1", "availability-zone": "fsn1-dc14",
+			}},
+			hostname: "node",
+			expected: &nodeServer{id: 1, location: "fsn1", datacenter: "fsn1-dc14"},
+		},
+		{
+			name: "hel1",
+			metadata: &fakeMetadata{values: map[string]string{
+				"instance-id": "3\n", "availability-zone": "hel1-dc2\n",
+			}},
+			hostname: "node",
+			expected: &nodeServer{id: 3, location: "hel1", datacenter: "hel1-dc2"},
+		},
+		{
+			name:     "no metadata service",
+			hostname: "node",
+			expected: fromAPI,
+			apiCalls: 1,
+		},
+		{
+			name: "missing metadata",
+			metadata: &fakeMetadata{values: map[string]string{
+				"instance-id": "1",
+			}},
+			hostname:    "node",
+			expected:    fromAPI,
+			metadataErr: true,
+			apiCalls:    1,
+		},
+		{
+			name: "invalid instance id",
+			metadata: &fakeMetadata{values: map[string]string{
+				"instance-id": "i-123", "availability-zone": "fsn1-dc14",
+			}},
+			hostname:    "node",
+			expected:    fromAPI,
+			metadataErr: true,
+			apiCalls:    1,
+		},
+		{
+			name: "slow metadata service",
+			metadata: &fakeMetadata{
+				values: map[string]string{"instance-id": "1", "availability-zone": "fsn1-dc14"},
+				delay:  time.Second,
+			},
+			hostname:    "node",
+			expected:    fromAPI,
+			metadataErr: true,
+			apiCalls:    1,
+		},
+		{
+			name:        "dedicated server",
+			metadata:    &fakeMetadata{},
+			hostname:    "dedicated",
+			metadataErr: true,
+			apiCalls:    1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var metadata MetadataClient
+			if test.metadata != nil {
+				var stop func()
+				metadata, stop = newFakeMetadata(test.metadata)
+				defer stop()
+			}
+			servers := &fakeServers{servers: map[string]*hcloud.Server{"node": apiServer}}
+
+			server, metadataErr, err := lookupNodeServer(context.Background(), metadata, servers, test.hostname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(server, test.expected) {
+				t.Errorf("expected server %+v, got %+v", test.expected, server)
+			}
+			if (metadataErr != nil) != test.metadataErr {
+				t.Errorf("unexpected metadata error %v", metadataErr)
+			}
+			if servers.calls != test.apiCalls {
+				t.Errorf("expected %d API calls, got %d", test.apiCalls, servers.calls)
+			}
+		})
+	}
+}
+
+func TestNodeGetInfoMetadata(t *testing.T) {
+	for _, datacenter := range []string{"fsn1-dc14", "nbg1-dc3", "hel1-dc2", "ash-dc1"} {
+		t.Run(datacenter, func(t *testing.T) {
+			metadata, stop := newFakeMetadata(&fakeMetadata{values: map[string]string{
+				"instance-id": "42", "availability-zone": datacenter,
+			}})
+			defer stop()
+
+			server, _, err := lookupNodeServer(context.Background(), metadata, &fakeServers{}, "node")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			log := logrus.New()
+			log.Out = ioutil.Discard
+			d := &Driver{
+				nodeID:              "42",
+				location:            server.location,
+				datacenter:          server.datacenter,
+				topologyGranularity: TopologyGranularityDatacenter,
+				networkZones:        fakeNetworkZones,
+				log:                 log.WithField("test_enabled", true),
+			}
+
+			resp, err := d.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			location := datacenterLocation(datacenter)
+			expected := map[string]string{
+				topologyLocation:    location,
+				topologyNetworkZone: fakeNetworkZones[location],
+				topologyDatacenter:  datacenter,
+			}
+			if !reflect.DeepEqual(resp.AccessibleTopology.Segments, expected) {
+				t.Errorf("expected topology %v, got %v", expected, resp.AccessibleTopology.Segments)
+			}
+		})
+	}
+}
@@ -0,0 +1,356 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// labelMigratedFrom is added to migrated volumes and contains the id of
+	// the original volume
+	labelMigratedFrom = "migratedFrom"
+
+	// migratePollInterval defines how often the progress of a migration is
+	// checked
+	migratePollInterval = 5 * time.Second
+
+	// claimDeleteTimeout defines how long to wait for a PVC to be deleted
+	claimDeleteTimeout = 2 * time.Minute
+)
+
+// MigrateParams defines the parameters of MigrateVolume
+type MigrateParams struct {
+	ToolParams
+
+	// PersistentVolume is the name of the PV to migrate
+	PersistentVolume string
+	// Location is the name of the location the volume is moved to
+	Location string
+}
+
+// MigrateVolume moves the volume of a PV to another location. The data is
+// copied to a new volume via a temporary backup. Afterwards the PV is
+// replaced by one referencing the new volume, and the PVC is recreated and
+// bound to it. The original volume and PV are kept (the PV as Released with
+// the Retain policy) and can be deleted once the migration is verified.
+//
+// All pods using the PVC must be stopped before, so the volume is detached.
+func MigrateVolume(p MigrateParams) error {
+	d, err := newToolDriver(p.ToolParams)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	ll := d.log.WithFields(logrus.Fields{
+		"pv_name":  p.PersistentVolume,
+		"location": p.Location,
+		"method":   "migrate_volume",
+	})
+
+	pv, pvc, vol, err := d.boundVolume(ctx, p.PersistentVolume)
+	if err != nil {
+		return err
+	}
+
+	if vol.Location.Name == p.Location {
+		return fmt.Errorf("volume %d is in location %q already", vol.ID, p.Location)
+	}
+
+	location, _, err := d.hcloudClient.Location.GetByName(ctx, p.Location)
+	if err != nil {
+		return err
+	}
+	if location == nil {
+		return fmt.Errorf("location %q not found", p.Location)
+	}
+
+	datacenters, err := d.locationDatacenters(ctx, p.Location)
+	if err != nil {
+		return err
+	}
+	zone, err := d.networkZone(ctx, p.Location)
+	if err != nil {
+		return err
+	}
+
+	ll = ll.WithField("volume_id", vol.ID)
+	progress := d.progress.start(operationMigrate, pv.Name, ll)
+	defer progress.finish()
+
+	progress.phase("backing up volume", 0)
+	backupID := fmt.Sprintf("migrate-%d-%s", vol.ID, time.Now().UTC().Format("20060102150405"))
+	m, err := d.backupAndWait(ctx, backupID, vol)
+	if err != nil {
+		return err
+	}
+
+	labels := map[string]string{}
+	for k, v := range vol.Labels {
+		labels[k] = v
+	}
+	labels[labelMigratedFrom] = strconv.Itoa(vol.ID)
+
+	progress.phase("creating target volume", 0)
+	target, err := d.createToolVolume(ctx, hcloud.VolumeCreateOpts{
+		Name:     fmt.Sprintf("%s-%s", vol.Name, p.Location),
+		Size:     vol.Size,
+		Location: location,
+		Labels:   labels,
+	})
+	if err != nil {
+		return err
+	}
+
+	ll = ll.WithField("target_volume_id", target.ID)
+
+	progress.phase("restoring backup to target volume", 0)
+	if err := d.mover.Restore(ctx, target, m); err != nil {
+		return fmt.Errorf("restoring backup %q to volume %d failed: %s", backupID, target.ID, err)
+	}
+
+	progress.phase("replacing persistent volume", 0)
+	newPV, err := d.replaceVolume(pv, pvc, fmt.Sprintf("%s-%s", pv.Name, p.Location), func(pv *corev1.PersistentVolume) {
+		pv.Spec.CSI.VolumeHandle = strconv.Itoa(target.ID)
+		setLocationAffinity(pv, p.Location, zone, datacenters)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := d.deleteBackup(ctx, backupID); err != nil {
+		ll.WithError(err).Warn("could not delete temporary backup")
+	}
+
+	ll.WithField("new_pv_name", newPV.Name).Info("volume migrated, the original volume and persistent volume are retained")
+	return nil
+}
+
+// boundVolume returns the PV with the given name, the PVC bound to it and the
+// backing volume. The volume must be detached.
+func (d *Driver) boundVolume(ctx context.Context, name string) (*corev1.PersistentVolume, *corev1.PersistentVolumeClaim, *hcloud.Volume, error) {
+	pv, err := d.kubeClient.CoreV1().PersistentVolumes().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("could not get persistent volume %q: %s", name, err)
+	}
+
+	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName {
+		return nil, nil, nil, fmt.Errorf("persistent volume %q is not provisioned by %s", name, driverName)
+	}
+
+	ref := pv.Spec.ClaimRef
+	if ref == nil || pv.Status.Phase != corev1.VolumeBound {
+		return nil, nil, nil, fmt.Errorf("persistent volume %q is not bound", name)
+	}
+
+	pvc, err := d.kubeClient.CoreV1().PersistentVolumeClaims(ref.Namespace).Get(ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("could not get persistent volume claim %s/%s: %s", ref.Namespace, ref.Name, err)
+	}
+
+	volumeID, err := strconv.Atoi(pv.Spec.CSI.VolumeHandle)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid volume handle %q", pv.Spec.CSI.VolumeHandle)
+	}
+
+	vol, _, err := d.volumes.GetByID(ctx, volumeID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if vol == nil {
+		return nil, nil, nil, fmt.Errorf("volume %d of persistent volume %q not found", volumeID, name)
+	}
+
+	if vol.Server != nil {
+		return nil, nil, nil, fmt.Errorf("volume %d is attached to server %d, stop all pods using %s/%s first",
+			vol.ID, vol.Server.ID, pvc.Namespace, pvc.Name)
+	}
+
+	return pv, pvc, vol, nil
+}
+
+// backupAndWait creates a backup of the volume and waits until it's ready
+func (d *Driver) backupAndWait(ctx context.Context, id string, vol *hcloud.Volume) (*backupManifest, error) {
+	if _, err := d.createBackup(ctx, id, strconv.Itoa(vol.ID), nil); err != nil {
+		return nil, err
+	}
+
+	ticker := time.NewTicker(migratePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+
+		if d.backupRunning(id) {
+			continue
+		}
+
+		m, err := d.getBackup(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if m == nil {
+			return nil, fmt.Errorf("backup %q disappeared", id)
+		}
+
+		switch m.Status {
+		case backupStatusReady:
+			return m, nil
+		case backupStatusFailed:
+			return nil, fmt.Errorf("backup %q failed: %s", id, m.Error)
+		}
+	}
+}
+
+// createToolVolume creates a volume and waits until it's created
+func (d *Driver) createToolVolume(ctx context.Context, opts hcloud.VolumeCreateOpts) (*hcloud.Volume, error) {
+	res, _, err := d.volumes.Create(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not create volume %q: %s", opts.Name, err)
+	}
+
+	if res.Action != nil {
+		if err := d.waitAction(ctx, res.Volume.ID, res.Action.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	// reload the volume to get its device path and location
+	vol, _, err := d.volumes.GetByID(ctx, res.Volume.ID)
+	if err != nil {
+		return nil, err
+	}
+	if vol == nil {
+		return nil, fmt.Errorf("volume %d disappeared", res.Volume.ID)
+	}
+
+	return vol, nil
+}
+
+// replaceVolume binds the PVC to a copy of the PV with the given name. The
+// volume source of the copy is changed by mutate. PVs and PVCs are mostly
+// immutable, so the PVC is deleted and recreated. The original PV is kept
+// with the Retain policy, so its volume isn't deleted.
+func (d *Driver) replaceVolume(pv *corev1.PersistentVolume, pvc *corev1.PersistentVolumeClaim, name string, mutate func(*corev1.PersistentVolume)) (*corev1.PersistentVolume, error) {
+	pvs := d.kubeClient.CoreV1().PersistentVolumes()
+	pvcs := d.kubeClient.CoreV1().PersistentVolumeClaims(pvc.Namespace)
+
+	newPV := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Labels:      pv.Labels,
+			Annotations: pv.Annotations,
+		},
+		Spec: *pv.Spec.DeepCopy(),
+	}
+	newPV.Spec.ClaimRef = &corev1.ObjectReference{
+		Kind:       "PersistentVolumeClaim",
+		APIVersion: "v1",
+		Namespace:  pvc.Namespace,
+		Name:       pvc.Name,
+	}
+	mutate(newPV)
+
+	retained := pv.DeepCopy()
+	retained.Spec.PersistentVolumeReclaimPolicy = corev1.PersistentVolumeReclaimRetain
+	if _, err := pvs.Update(retained); err != nil {
+		return nil, fmt.Errorf("could not retain persistent volume %q: %s", pv.Name, err)
+	}
+
+	newPV, err := pvs.Create(newPV)
+	if err != nil {
+		return nil, fmt.Errorf("could not create persistent volume %q: %s", name, err)
+	}
+
+	if err := pvcs.Delete(pvc.Name, &metav1.DeleteOptions{}); err != nil {
+		return nil, fmt.Errorf("could not delete persistent volume claim %s/%s: %s", pvc.Namespace, pvc.Name, err)
+	}
+
+	deadline := time.Now().Add(claimDeleteTimeout)
+	for {
+		_, err := pvcs.Get(pvc.Name, metav1.GetOptions{})
+		if kubeerrors.IsNotFound(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timeout occured waiting for persistent volume claim %s/%s to be deleted", pvc.Namespace, pvc.Name)
+		}
+		time.Sleep(time.Second)
+	}
+
+	annotations := map[string]string{}
+	for k, v := range pvc.Annotations {
+		annotations[k] = v
+	}
+	// set by the binder, describe the binding to the original PV
+	delete(annotations, "pv.kubernetes.io/bind-completed")
+	delete(annotations, "pv.kubernetes.io/bound-by-controller")
+
+	newPVC := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pvc.Name,
+			Namespace:   pvc.Namespace,
+			Labels:      pvc.Labels,
+			Annotations: annotations,
+		},
+		Spec: *pvc.Spec.DeepCopy(),
+	}
+	newPVC.Spec.VolumeName = newPV.Name
+
+	if _, err := pvcs.Create(newPVC); err != nil {
+		return nil, fmt.Errorf("could not recreate persistent volume claim %s/%s: %s", pvc.Namespace, pvc.Name, err)
+	}
+
+	return newPV, nil
+}
+
+// setLocationAffinity changes the location in the node affinity of the PV.
+// Datacenter and network zone requirements are replaced by the given
+// datacenters and network zone of the location.
+func setLocationAffinity(pv *corev1.PersistentVolume, location, zone string, datacenters []string) {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return
+	}
+
+	for i := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		term := &pv.Spec.NodeAffinity.Required.NodeSelectorTerms[i]
+		for j := range term.MatchExpressions {
+			switch term.MatchExpressions[j].Key {
+			case topologyLocation:
+				term.MatchExpressions[j].Values = []string{location}
+			case topologyDatacenter:
+				term.MatchExpressions[j].Values = datacenters
+			case topologyNetworkZone:
+				term.MatchExpressions[j].Values = []string{zone}
+			}
+		}
+	}
+}
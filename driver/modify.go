@@ -0,0 +1,134 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+// managedLabels are the labels the driver relies on to find and count its
+// volumes, they can't be modified. The autoscale and wipe labels can.
+var managedLabels = map[string]bool{
+	"createdBy":       true,
+	labelStorageClass: true,
+	labelPVCName:      true,
+	labelPVCNamespace: true,
+	labelPool:         true,
+	labelPoolFsType:   true,
+	labelNFSExport:    true,
+}
+
+// ModifyParams defines the parameters of ModifyVolume
+type ModifyParams struct {
+	ToolParams
+
+	// PersistentVolume is the name of the PV to modify
+	PersistentVolume string
+	// Labels are set on the volume, RemoveLabels are removed from it
+	Labels       map[string]string
+	RemoveLabels []string
+	// DeleteProtection enables or disables the delete protection of the
+	// volume, it's left as is if nil
+	DeleteProtection *bool
+}
+
+// ModifyVolume changes the mutable attributes of the volume of a bound PV,
+// its labels and its delete protection, without recreating it. The CSI spec
+// we implement doesn't support ControllerModifyVolume, so the attributes
+// can't be changed with VolumeAttributesClasses.
+func ModifyVolume(p ModifyParams) error {
+	d, err := newAPIToolDriver(p.ToolParams)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	_, _, vol, err := d.boundVolume(ctx, p.PersistentVolume)
+	if err != nil {
+		return err
+	}
+
+	ll := d.log.WithFields(logrus.Fields{
+		"pv_name":   p.PersistentVolume,
+		"volume_id": vol.ID,
+		"method":    "modify_volume",
+	})
+
+	labels, changed, err := modifiedLabels(vol.Labels, p.Labels, p.RemoveLabels)
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		ll.WithField("labels", labels).Info("updating labels")
+		if _, _, err := d.volumes.Update(ctx, vol, hcloud.VolumeUpdateOpts{Labels: labels}); err != nil {
+			return fmt.Errorf("could not update labels of volume %d: %s", vol.ID, err)
+		}
+	}
+
+	if p.DeleteProtection != nil && *p.DeleteProtection != vol.Protection.Delete {
+		ll.WithField("delete_protection", *p.DeleteProtection).Info("changing delete protection")
+		action, _, err := d.volumes.ChangeProtection(ctx, vol, hcloud.VolumeChangeProtectionOpts{
+			Delete: p.DeleteProtection,
+		})
+		if err != nil {
+			return fmt.Errorf("could not change protection of volume %d: %s", vol.ID, err)
+		}
+		if err := d.waitAction(ctx, vol.ID, action.ID); err != nil {
+			return err
+		}
+	}
+
+	ll.Info("volume is modified")
+	return nil
+}
+
+// modifiedLabels returns the labels with set applied and remove removed, and
+// whether they differ from the given labels
+func modifiedLabels(labels, set map[string]string, remove []string) (map[string]string, bool, error) {
+	modified := map[string]string{}
+	for k, v := range labels {
+		modified[k] = v
+	}
+
+	changed := false
+	for k, v := range set {
+		if managedLabels[k] {
+			return nil, false, fmt.Errorf("label %q is managed by the driver", k)
+		}
+		if old, ok := modified[k]; !ok || old != v {
+			modified[k] = v
+			changed = true
+		}
+	}
+
+	for _, k := range remove {
+		if managedLabels[k] {
+			return nil, false, fmt.Errorf("label %q is managed by the driver", k)
+		}
+		if _, ok := modified[k]; ok {
+			delete(modified, k)
+			changed = true
+		}
+	}
+
+	return modified, changed, nil
+}
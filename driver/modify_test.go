@@ -0,0 +1,57 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestModifiedLabels(t *testing.T) {
+	labels := map[string]string{
+		"createdBy":       createdByHCloud,
+		labelAutoscaleMax: "100",
+		labelWipeOnDelete: "true",
+	}
+
+	got, changed, err := modifiedLabels(labels, map[string]string{labelAutoscaleMax: "200", "team": "data"}, []string{labelWipeOnDelete, "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"createdBy":       createdByHCloud,
+		labelAutoscaleMax: "200",
+		"team":            "data",
+	}
+	if !changed || !reflect.DeepEqual(got, want) {
+		t.Errorf("modifiedLabels() = %v, %t, want %v, true", got, changed, want)
+	}
+	if labels[labelAutoscaleMax] != "100" {
+		t.Error("modifiedLabels() changed the given labels")
+	}
+
+	if _, changed, _ := modifiedLabels(labels, map[string]string{labelAutoscaleMax: "100"}, nil); changed {
+		t.Error("modifiedLabels() reported unchanged labels as changed")
+	}
+
+	if _, _, err := modifiedLabels(labels, map[string]string{labelStorageClass: "fast"}, nil); err == nil {
+		t.Error("modifiedLabels() allowed changing a managed label")
+	}
+	if _, _, err := modifiedLabels(labels, nil, []string{"createdBy"}); err == nil {
+		t.Error("modifiedLabels() allowed removing a managed label")
+	}
+}
@@ -17,12 +17,14 @@ limitations under the License.
 package driver
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"strings"
+	"syscall"
 
 	"github.com/sirupsen/logrus"
 )
@@ -38,25 +40,29 @@ type fileSystem struct {
 	Options     string `json:"options"`
 }
 
-// Mounter is responsible for formatting and mounting volumes
+// Mounter is responsible for formatting and mounting volumes. The commands
+// of the methods are killed once ctx is done, i.e. when the deadline of the
+// call passes.
 type Mounter interface {
-	// Format formats the source with the given filesystem type
-	Format(source, fsType string) error
+	// Format formats the source with the given filesystem type, options are
+	// passed to mkfs. If it's cancelled, the partially created filesystem is
+	// wiped, so the source isn't reported as formatted.
+	Format(ctx context.Context, source, fsType string, options ...string) error
 
 	// Mount mounts source to target with the given fstype and options.
-	Mount(source, target, fsType string, options ...string) error
+	Mount(ctx context.Context, source, target, fsType string, options ...string) error
 
 	// Unmount unmounts the given target
-	Unmount(target string) error
+	Unmount(ctx context.Context, target string) error
 
 	// IsFormatted checks whether the source device is formatted or not. It
 	// returns true if the source device is already formatted.
-	IsFormatted(source string) (bool, error)
+	IsFormatted(ctx context.Context, source string) (bool, error)
 
 	// IsMounted checks whether the target path is a correct mount (i.e:
 	// propagated). It returns true if it's mounted. An error is returned in
 	// case of system errors or if it's mounted incorrectly.
-	IsMounted(target string) (bool, error)
+	IsMounted(ctx context.Context, target string) (bool, error)
 }
 
 // TODO(arslan): this is Linux only for now. Refactor this into a package with
@@ -73,7 +79,7 @@ func newMounter(log *logrus.Entry) *mounter {
 	}
 }
 
-func (m *mounter) Format(source, fsType string) error {
+func (m *mounter) Format(ctx context.Context, source, fsType string, opts ...string) error {
 	mkfsCmd := fmt.Sprintf("mkfs.%s", fsType)
 
 	_, err := exec.LookPath(mkfsCmd)
@@ -94,17 +100,26 @@ func (m *mounter) Format(source, fsType string) error {
 		return errors.New("source is not specified for formatting the volume")
 	}
 
-	mkfsArgs = append(mkfsArgs, source)
 	if fsType == "ext4" || fsType == "ext3" {
-		mkfsArgs = []string{"-F", source}
+		mkfsArgs = append(mkfsArgs, "-F")
 	}
+	mkfsArgs = append(mkfsArgs, opts...)
+	mkfsArgs = append(mkfsArgs, source)
 
 	m.log.WithFields(logrus.Fields{
 		"cmd":  mkfsCmd,
 		"args": mkfsArgs,
 	}).Info("executing format command")
 
-	out, err := exec.Command(mkfsCmd, mkfsArgs...).CombinedOutput()
+	out, err := exec.CommandContext(ctx, mkfsCmd, mkfsArgs...).CombinedOutput()
+	if err != nil && ctx.Err() != nil {
+		// mkfs was killed, the signatures it has written already would
+		// make the device look formatted
+		if out, err := exec.Command("wipefs", "--all", source).CombinedOutput(); err != nil {
+			m.log.WithField("output", string(out)).WithError(err).Error("wiping the partial filesystem failed")
+		}
+		return fmt.Errorf("formatting disk was cancelled: %s", ctx.Err())
+	}
 	if err != nil {
 		return fmt.Errorf("formatting disk failed: %v cmd: '%s %s' output: %q",
 			err, mkfsCmd, strings.Join(mkfsArgs, " "), string(out))
@@ -113,7 +128,7 @@ func (m *mounter) Format(source, fsType string) error {
 	return nil
 }
 
-func (m *mounter) Mount(source, target, fsType string, opts ...string) error {
+func (m *mounter) Mount(ctx context.Context, source, target, fsType string, opts ...string) error {
 	mountCmd := "mount"
 	mountArgs := []string{}
 
@@ -149,7 +164,7 @@ func (m *mounter) Mount(source, target, fsType string, opts ...string) error {
 		"args": mountArgs,
 	}).Info("executing mount command")
 
-	out, err := exec.Command(mountCmd, mountArgs...).CombinedOutput()
+	out, err := exec.CommandContext(ctx, mountCmd, mountArgs...).CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("mounting failed: %v cmd: '%s %s' output: %q",
 			err, mountCmd, strings.Join(mountArgs, " "), string(out))
@@ -158,7 +173,7 @@ func (m *mounter) Mount(source, target, fsType string, opts ...string) error {
 	return nil
 }
 
-func (m *mounter) Unmount(target string) error {
+func (m *mounter) Unmount(ctx context.Context, target string) error {
 	umountCmd := "umount"
 	if target == "" {
 		return errors.New("target is not specified for unmounting the volume")
@@ -171,7 +186,7 @@ func (m *mounter) Unmount(target string) error {
 		"args": umountArgs,
 	}).Info("executing umount command")
 
-	out, err := exec.Command(umountCmd, umountArgs...).CombinedOutput()
+	out, err := exec.CommandContext(ctx, umountCmd, umountArgs...).CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("unmounting failed: %v cmd: '%s %s' output: %q",
 			err, umountCmd, target, string(out))
@@ -180,7 +195,7 @@ func (m *mounter) Unmount(target string) error {
 	return nil
 }
 
-func (m *mounter) IsFormatted(source string) (bool, error) {
+func (m *mounter) IsFormatted(ctx context.Context, source string) (bool, error) {
 	if source == "" {
 		return false, errors.New("source is not specified")
 	}
@@ -201,7 +216,12 @@ func (m *mounter) IsFormatted(source string) (bool, error) {
 		"args": blkidArgs,
 	}).Info("checking if source is formatted")
 
-	out, err := exec.Command(blkidCmd, blkidArgs...).CombinedOutput()
+	out, err := exec.CommandContext(ctx, blkidCmd, blkidArgs...).CombinedOutput()
+	if exitStatus(err) == 2 {
+		// blkid exits with 2 if it couldn't identify the content of the
+		// device, i.e. it isn't formatted
+		return false, nil
+	}
 	if err != nil {
 		return false, fmt.Errorf("checking formatting failed: %v cmd: %q output: %q",
 			err, blkidCmd, string(out))
@@ -214,7 +234,7 @@ func (m *mounter) IsFormatted(source string) (bool, error) {
 	return true, nil
 }
 
-func (m *mounter) IsMounted(target string) (bool, error) {
+func (m *mounter) IsMounted(ctx context.Context, target string) (bool, error) {
 	if target == "" {
 		return false, errors.New("target is not specified for checking the mount")
 	}
@@ -235,7 +255,7 @@ func (m *mounter) IsMounted(target string) (bool, error) {
 		"args": findmntArgs,
 	}).Info("checking if target is mounted")
 
-	out, err := exec.Command(findmntCmd, findmntArgs...).CombinedOutput()
+	out, err := exec.CommandContext(ctx, findmntCmd, findmntArgs...).CombinedOutput()
 	if err != nil {
 		// findmnt exits with non zero exit status if it couldn't find anything
 		if strings.TrimSpace(string(out)) == "" {
@@ -272,3 +292,17 @@ func (m *mounter) IsMounted(target string) (bool, error) {
 
 	return targetFound, nil
 }
+
+// exitStatus returns the exit status of the command that failed with err, or
+// -1 if it didn't exit with a status
+func exitStatus(err error) int {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return -1
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return -1
+	}
+	return status.ExitStatus()
+}
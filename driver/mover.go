@@ -0,0 +1,542 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	drivererrors "github.com/apricote/hcloud-csi-driver/driver/errors"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DataMoverLocal copies data on the server the controller plugin is
+	// running on
+	DataMoverLocal = "local"
+
+	// DataMoverPod copies data in short-lived helper pods
+	DataMoverPod = "pod"
+
+	// MoverBackup, MoverRestore and MoverPopulate are the directions a
+	// helper can copy data in, MoverWipe zeroes the device, MoverBench
+	// measures its performance and MoverProbe returns its filesystem
+	MoverBackup   = "backup"
+	MoverRestore  = "restore"
+	MoverPopulate = "populate"
+	MoverWipe     = "wipe"
+	MoverBench    = "bench"
+	MoverProbe    = "probe"
+)
+
+// dataMover copies data between volumes and the backup store
+type dataMover interface {
+	// Check returns an error if the data of the volume can't be copied in
+	// its current state
+	Check(vol *hcloud.Volume) error
+
+	// Backup uploads the content of the volume to the given backup. It
+	// continues with the first chunk that's not stored yet and updates the
+	// manifest accordingly.
+	Backup(ctx context.Context, vol *hcloud.Volume, m *backupManifest) error
+
+	// Restore writes the content of the given backup to the volume
+	Restore(ctx context.Context, vol *hcloud.Volume, m *backupManifest) error
+
+	// Populate writes the image downloaded from source to the volume
+	Populate(ctx context.Context, vol *hcloud.Volume, source string) error
+
+	// Wipe overwrites the content of the volume with zeros
+	Wipe(ctx context.Context, vol *hcloud.Volume) error
+}
+
+// localMover copies data on the server the driver is running on. Detached
+// volumes are attached to it while they're copied.
+type localMover struct {
+	d *Driver
+}
+
+func (l *localMover) Check(vol *hcloud.Volume) error {
+	if vol.Server != nil && strconv.Itoa(vol.Server.ID) != l.d.nodeID {
+		return fmt.Errorf("volume is attached to server %d, it must be detached to be copied", vol.Server.ID)
+	}
+	if vol.Location != nil && vol.Location.Name != l.d.location {
+		return fmt.Errorf("volume is in location %q, only volumes in %q can be copied locally", vol.Location.Name, l.d.location)
+	}
+	return nil
+}
+
+func (l *localMover) Backup(ctx context.Context, vol *hcloud.Volume, m *backupManifest) error {
+	device, release, err := l.d.acquireDevice(ctx, vol)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	ll := l.d.log.WithField("backup_id", m.ID)
+	progress := l.d.progress.start(operationBackup, m.ID, ll)
+	defer progress.finish()
+
+	return copyToStore(ctx, l.d.backups, device, m, ll, progress)
+}
+
+func (l *localMover) Restore(ctx context.Context, vol *hcloud.Volume, m *backupManifest) error {
+	if vol.Server != nil {
+		return fmt.Errorf("volume %d must be detached to be restored", vol.ID)
+	}
+
+	device, release, err := l.d.acquireDevice(ctx, vol)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	ll := l.d.log.WithFields(logrus.Fields{
+		"backup_id": m.ID,
+		"volume_id": vol.ID,
+	})
+	progress := l.d.progress.start(operationRestore, strconv.Itoa(vol.ID), ll)
+	defer progress.finish()
+
+	return copyFromStore(ctx, l.d.backups, device, m, ll, progress)
+}
+
+func (l *localMover) Populate(ctx context.Context, vol *hcloud.Volume, source string) error {
+	if vol.Server != nil {
+		return fmt.Errorf("volume %d must be detached to be populated", vol.ID)
+	}
+
+	device, release, err := l.d.acquireDevice(ctx, vol)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return populateDevice(ctx, device, source, l.d.log.WithField("volume_id", vol.ID))
+}
+
+func (l *localMover) Wipe(ctx context.Context, vol *hcloud.Volume) error {
+	if vol.Server != nil {
+		return fmt.Errorf("volume %d must be detached to be wiped", vol.ID)
+	}
+
+	device, release, err := l.d.acquireDevice(ctx, vol)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return wipeDevice(ctx, device, l.d.log.WithField("volume_id", vol.ID))
+}
+
+// MoverParams defines the parameters of RunMover
+type MoverParams struct {
+	// Direction is MoverBackup, MoverRestore, MoverPopulate, MoverWipe,
+	// MoverBench or MoverProbe
+	Direction string
+	BackupID  string
+	Device    string
+	// Source is the URL of the image for MoverPopulate
+	Source string
+	// BenchFsType, BenchFileSize and BenchDuration configure MoverBench, see
+	// BenchParams
+	BenchFsType   string
+	BenchFileSize int64
+	BenchDuration time.Duration
+
+	BackupURL             string
+	BackupAccessKeyID     string
+	BackupSecretAccessKey string
+	BackupRegion          string
+	BackupEncryptionKey   string
+}
+
+// RunMover copies the data between the given device and backup. It's run by
+// the helper pods of the pod data mover.
+func RunMover(p MoverParams) error {
+	ll := logrus.New().WithFields(logrus.Fields{
+		"backup_id": p.BackupID,
+		"device":    p.Device,
+		"direction": p.Direction,
+	})
+
+	ctx := context.Background()
+
+	if p.Direction == MoverPopulate {
+		if err := waitForDevice(ctx, p.Device); err != nil {
+			return err
+		}
+		return populateDevice(ctx, p.Device, p.Source, ll)
+	}
+
+	if p.Direction == MoverWipe {
+		if err := waitForDevice(ctx, p.Device); err != nil {
+			return err
+		}
+		return wipeDevice(ctx, p.Device, ll)
+	}
+
+	if p.Direction == MoverProbe {
+		if err := waitForDevice(ctx, p.Device); err != nil {
+			return err
+		}
+		return probeDevice(ctx, p.Device)
+	}
+
+	if p.Direction == MoverBench {
+		if err := waitForDevice(ctx, p.Device); err != nil {
+			return err
+		}
+
+		results, err := benchDevice(ctx, p.Device, p.BenchFsType, benchConfig{
+			FileSize: p.BenchFileSize,
+			Duration: p.BenchDuration,
+		}, ll)
+		if err != nil {
+			return err
+		}
+
+		// returned to the tool as termination message of the helper pod
+		out, err := json.Marshal(results)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(moverResultPath, out, 0644)
+	}
+
+	store, err := newObjectStore(p.BackupURL, p.BackupAccessKeyID, p.BackupSecretAccessKey, p.BackupRegion)
+	if err != nil {
+		return err
+	}
+
+	store, err = encryptStore(store, p.BackupEncryptionKey)
+	if err != nil {
+		return err
+	}
+
+	m, err := getManifest(ctx, store, p.BackupID)
+	if err != nil {
+		return err
+	}
+
+	if m == nil {
+		return fmt.Errorf("backup %q not found", p.BackupID)
+	}
+
+	if err := waitForDevice(ctx, p.Device); err != nil {
+		return err
+	}
+
+	// the progress is only logged, the pod mover follows the manifest
+	var tracker progressTracker
+	progress := tracker.start(p.Direction, p.BackupID, ll)
+	defer progress.finish()
+
+	switch p.Direction {
+	case MoverBackup:
+		return copyToStore(ctx, store, p.Device, m, ll, progress)
+	case MoverRestore:
+		return copyFromStore(ctx, store, p.Device, m, ll, progress)
+	default:
+		return fmt.Errorf("unknown data mover direction %q, must be %q, %q, %q, %q, %q or %q", p.Direction, MoverBackup, MoverRestore, MoverPopulate, MoverWipe, MoverBench, MoverProbe)
+	}
+}
+
+// copyToStore uploads the content of device as chunks of the given backup,
+// starting with the first chunk that's not stored yet. The manifest is stored
+// and the progress is reported after every chunk.
+func copyToStore(ctx context.Context, store objectStore, device string, m *backupManifest, ll *logrus.Entry, progress *progressReporter) error {
+	// the stored chunks of an interrupted backup must use the same key
+	if err := checkEncryption(m, store); err != nil {
+		return err
+	}
+
+	f, err := os.Open(device)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	progress.phase("uploading", m.SizeBytes)
+	progress.update(m.copiedBytes(m.Chunks))
+
+	total := m.totalChunks()
+	for i := m.Chunks; i < total; i++ {
+		if _, err := f.Seek(int64(i)*m.ChunkSize, io.SeekStart); err != nil {
+			return fmt.Errorf("seeking device %q failed: %s", device, err)
+		}
+
+		stored, err := putChunk(ctx, store, m.chunkKey(i), io.LimitReader(f, m.ChunkSize))
+		if err != nil {
+			return err
+		}
+
+		m.Chunks = i + 1
+		m.StoredBytes += stored
+		if err := putManifest(ctx, store, m); err != nil {
+			return err
+		}
+
+		ll.WithFields(logrus.Fields{
+			"chunks":       m.Chunks,
+			"total_chunks": total,
+		}).Debug("chunk uploaded")
+		progress.update(m.copiedBytes(m.Chunks))
+	}
+
+	return nil
+}
+
+// putChunk stores the compressed content of r under the given key. It
+// returns the number of stored bytes.
+func putChunk(ctx context.Context, store objectStore, key string, r io.Reader) (int64, error) {
+	pr, pw := io.Pipe()
+	counter := &countingReader{r: pr}
+
+	go func() {
+		gz, err := gzip.NewWriterLevel(pw, gzip.BestSpeed)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		if _, err := io.Copy(gz, r); err != nil {
+			pw.CloseWithError(fmt.Errorf("reading device failed: %s", err))
+			return
+		}
+
+		pw.CloseWithError(gz.Close())
+	}()
+
+	err := store.Put(ctx, key, counter)
+	// unblock the writer in case uploading failed
+	pr.CloseWithError(err)
+	if err != nil {
+		return 0, err
+	}
+
+	return counter.n, nil
+}
+
+// copyFromStore writes all chunks of the given backup to device and reports
+// the progress after every chunk
+func copyFromStore(ctx context.Context, store objectStore, device string, m *backupManifest, ll *logrus.Entry, progress *progressReporter) error {
+	if m.Format != backupFormatChunkedGzip {
+		return fmt.Errorf("backup %q has the unsupported format %q", m.ID, m.Format)
+	}
+
+	if m.Status != backupStatusReady {
+		return fmt.Errorf("backup %q is not ready, its status is %q", m.ID, m.Status)
+	}
+
+	if err := checkEncryption(m, store); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(device, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	progress.phase("restoring", m.SizeBytes)
+
+	total := m.totalChunks()
+	for i := 0; i < total; i++ {
+		if _, err := f.Seek(int64(i)*m.ChunkSize, io.SeekStart); err != nil {
+			return fmt.Errorf("seeking device %q failed: %s", device, err)
+		}
+
+		if err := getChunk(ctx, store, m.chunkKey(i), f); err != nil {
+			return err
+		}
+
+		ll.WithFields(logrus.Fields{
+			"chunks":       i + 1,
+			"total_chunks": total,
+		}).Debug("chunk restored")
+		progress.update(m.copiedBytes(i + 1))
+	}
+
+	return f.Sync()
+}
+
+// getChunk writes the uncompressed content of the given key to w
+func getChunk(ctx context.Context, store objectStore, key string, w io.Writer) error {
+	r, err := store.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("reading chunk %q failed: %s", key, err)
+	}
+	defer r.Close()
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("reading chunk %q failed: %s", key, err)
+	}
+	defer gz.Close()
+
+	if _, err := io.Copy(w, gz); err != nil {
+		return fmt.Errorf("writing chunk %q failed: %s", key, err)
+	}
+	return nil
+}
+
+// acquireDevice makes the block device of the volume available on the server
+// the driver is running on. If the volume is detached, it's attached and the
+// returned release function detaches it again.
+func (d *Driver) acquireDevice(ctx context.Context, vol *hcloud.Volume) (string, func(), error) {
+	serverID, err := strconv.Atoi(d.nodeID)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid node id %q: %s", d.nodeID, err)
+	}
+
+	if vol.Server != nil {
+		if vol.Server.ID != serverID {
+			return "", nil, fmt.Errorf("volume %d is attached to server %d, it must be detached or attached to server %d",
+				vol.ID, vol.Server.ID, serverID)
+		}
+
+		d.log.WithFields(logrus.Fields{
+			"volume_id": vol.ID,
+			"server_id": serverID,
+		}).Warn("volume is attached to this server already, the content might change while it's read")
+		return vol.LinuxDevice, func() {}, waitForDevice(ctx, vol.LinuxDevice)
+	}
+
+	// volumes can only be attached to servers in their location
+	if vol.Location == nil || vol.Location.Name != d.location {
+		location := "unknown"
+		if vol.Location != nil {
+			location = vol.Location.Name
+		}
+		return "", nil, fmt.Errorf("volume %d is in location %s, it can't be attached to server %d in %s",
+			vol.ID, location, serverID, d.location)
+	}
+
+	release, err := d.attachVolume(ctx, vol, serverID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := waitForDevice(ctx, vol.LinuxDevice); err != nil {
+		release()
+		return "", nil, err
+	}
+
+	return vol.LinuxDevice, release, nil
+}
+
+// attachVolume attaches the detached volume to the given server to copy its
+// data. The returned release function detaches it again. The attach and the
+// detach wait for the other operations of the server in serverQueue, like the
+// ones of the CO.
+func (d *Driver) attachVolume(ctx context.Context, vol *hcloud.Volume, serverID int) (func(), error) {
+	ll := d.log.WithFields(logrus.Fields{
+		"volume_id": vol.ID,
+		"server_id": serverID,
+	})
+
+	if ok, retryAt := d.attachBackoff.allow(vol.ID, time.Now()); !ok {
+		return nil, fmt.Errorf("attaching volume %d failed repeatedly, the next attempt is at %s",
+			vol.ID, retryAt.Format(time.RFC3339))
+	}
+
+	releaseServer, err := d.serverQueue.acquire(ctx, serverID, false)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for the other operations of server %d: %s", serverID, err)
+	}
+
+	ll.Info("attaching volume to copy its data")
+	action, _, err := d.volumes.Attach(ctx, vol, &hcloud.Server{ID: serverID})
+	if err != nil {
+		releaseServer()
+		d.attachFailed(vol.ID, ll)
+		if hcloud.IsError(err, errorCodeVolumeLimitExceeded) {
+			return nil, drivererrors.Errorf(drivererrors.ErrAttachLimit, "volume %d could not be attached to server %d: %s", vol.ID, serverID, err)
+		}
+		return nil, fmt.Errorf("volume %d could not be attached to server %d: %s", vol.ID, serverID, err)
+	}
+
+	if action != nil {
+		err = d.waitAction(ctx, vol.ID, action.ID)
+	}
+	releaseServer()
+
+	release := func() {
+		ll.Info("detaching volume")
+		d.attachCache.forget(vol.ID)
+
+		ctx := context.Background()
+		releaseServer, err := d.serverQueue.acquire(ctx, serverID, true)
+		if err != nil {
+			ll.WithError(err).Error("detaching volume failed")
+			return
+		}
+		defer releaseServer()
+
+		action, _, err := d.volumes.Detach(ctx, vol)
+		if err != nil {
+			ll.WithError(err).Error("detaching volume failed")
+			return
+		}
+		if action == nil {
+			return
+		}
+
+		if err := d.waitAction(ctx, vol.ID, action.ID); err != nil {
+			ll.WithError(err).Error("detaching volume failed")
+		}
+	}
+
+	if err != nil {
+		d.attachFailed(vol.ID, ll)
+		release()
+		return nil, err
+	}
+
+	d.attachBackoff.succeeded(vol.ID)
+	return release, nil
+}
+
+// attachFailed records a failed attach of the volume in attachBackoff
+func (d *Driver) attachFailed(volumeID int, ll *logrus.Entry) {
+	failures := d.attachBackoff.failed(volumeID, time.Now())
+	if failures == attachCircuitFailures {
+		ll.WithField("failures", failures).
+			Errorf("attaching volume failed repeatedly, not attaching it again for %s", attachCircuitOpen)
+	}
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
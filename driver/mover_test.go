@@ -0,0 +1,229 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCopyChunks(t *testing.T) {
+	data := make([]byte, 10*1024+123)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	src := tempDevice(t, data)
+	defer os.Remove(src)
+
+	store := newMemStore()
+	m := &backupManifest{
+		ID:        "test",
+		SizeBytes: int64(len(data)),
+		Format:    backupFormatChunkedGzip,
+		Status:    backupStatusUploading,
+		ChunkSize: 1024,
+	}
+
+	// simulate an interrupted backup, that stored the first chunks already
+	m.Chunks = 3
+	for i := 0; i < m.Chunks; i++ {
+		if _, err := putChunk(context.Background(), store, m.chunkKey(i), bytes.NewReader(data[i*1024:(i+1)*1024])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ll := logrus.New().WithField("test", t.Name())
+	var tracker progressTracker
+	progress := tracker.start(operationBackup, m.ID, ll)
+	if err := copyToStore(context.Background(), store, src, m, ll, progress); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := tracker.operations()
+	if len(ops) != 1 || ops[0].Phase != "uploading" || ops[0].Done != m.SizeBytes || ops[0].Total != m.SizeBytes {
+		t.Errorf("expected the upload of all %d bytes to be reported, got %+v", m.SizeBytes, ops)
+	}
+	progress.finish()
+
+	if m.Chunks != 11 {
+		t.Fatalf("got %d chunks, want 11", m.Chunks)
+	}
+
+	stored, err := getManifest(context.Background(), store, m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Chunks != m.Chunks {
+		t.Fatalf("stored manifest has %d chunks, want %d", stored.Chunks, m.Chunks)
+	}
+
+	dst := tempDevice(t, make([]byte, len(data)))
+	defer os.Remove(dst)
+
+	m.Status = backupStatusReady
+	if err := copyFromStore(context.Background(), store, dst, m, ll, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored, data) {
+		t.Fatal("restored data differs from the original")
+	}
+}
+
+func tempDevice(t *testing.T, data []byte) string {
+	f, err := ioutil.TempFile("", "hcloud-csi-device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+// memStore is an in-memory objectStore
+type memStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newMemStore() *memStore {
+	return &memStore{objects: map[string][]byte{}}
+}
+
+func (s *memStore) Put(ctx context.Context, key string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = data
+	return nil
+}
+
+func (s *memStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, errObjectNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *memStore) List(ctx context.Context, prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := map[string]bool{}
+	var names []string
+	for key := range s.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		rest := strings.TrimPrefix(key, prefix)
+		i := strings.Index(rest, "/")
+		if i < 0 || seen[rest[:i]] {
+			continue
+		}
+		seen[rest[:i]] = true
+		names = append(names, rest[:i])
+	}
+	return names, nil
+}
+
+// nilActionVolumes returns no actions for attaches and detaches, like API
+// wrappers that wait for them already
+type nilActionVolumes struct {
+	VolumeService
+}
+
+func (n *nilActionVolumes) Attach(ctx context.Context, volume *hcloud.Volume, server *hcloud.Server) (*hcloud.Action, *hcloud.Response, error) {
+	_, resp, err := n.VolumeService.Attach(ctx, volume, server)
+	return nil, resp, err
+}
+
+func (n *nilActionVolumes) Detach(ctx context.Context, volume *hcloud.Volume) (*hcloud.Action, *hcloud.Response, error) {
+	_, resp, err := n.VolumeService.Detach(ctx, volume)
+	return nil, resp, err
+}
+
+func TestAttachVolumeWithoutAction(t *testing.T) {
+	d, api, stop := newConcurrencyDriver(t)
+	defer stop()
+	d.volumes = &nilActionVolumes{VolumeService: d.volumes}
+
+	volumeID, err := createVolume(d, "pvc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := strconv.Atoi(volumeID)
+
+	release, err := d.attachVolume(context.Background(), &hcloud.Volume{ID: id}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server := attachedServer(api, volumeID); server != 1 {
+		t.Fatalf("expected the volume to be attached to server 1, got %d", server)
+	}
+
+	release()
+	if server := attachedServer(api, volumeID); server != 0 {
+		t.Fatalf("expected the volume to be detached, got server %d", server)
+	}
+}
+
+func TestAcquireDeviceInOtherLocation(t *testing.T) {
+	d := &Driver{
+		nodeID:   "1",
+		location: "fsn1",
+		log:      logrus.New().WithField("test", t.Name()),
+	}
+
+	// the volume is rejected before the API is called
+	vol := &hcloud.Volume{ID: 1, Location: &hcloud.Location{Name: "nbg1"}}
+	if _, _, err := d.acquireDevice(context.Background(), vol); err == nil || !strings.Contains(err.Error(), "nbg1") {
+		t.Errorf("expected the volume in nbg1 to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,336 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// attrNFSServer is the volume attribute with the address of the NFS
+	// export of a ReadWriteMany volume. Volumes with the attribute aren't
+	// attached to the nodes, the export is mounted instead.
+	attrNFSServer = "nfsServer"
+
+	// labelNFSExport marks the volumes backing an NFS export
+	labelNFSExport = "nfsExport"
+
+	// nfsPort is the port of the NFS servers
+	nfsPort = 2049
+
+	// nfsExportPath is the path the volume is mounted to in the NFS server.
+	// The server image must export it as the NFSv4 root.
+	nfsExportPath = "/export"
+)
+
+// nfsExporter exports volumes via NFS, so they can be used by pods on many
+// nodes at the same time. Each export is an NFS server deployment using the
+// volume through a PV of this driver, plus a service the nodes mount.
+type nfsExporter struct {
+	d *Driver
+
+	image     string
+	namespace string
+}
+
+// nfsCapabilities returns true if the capabilities require an NFS export
+// and are supported by it. Only mounted volumes can be exported.
+func nfsCapabilities(caps []*csi.VolumeCapability) bool {
+	multiNode := false
+	for _, cap := range caps {
+		if cap.GetMount() == nil || cap.AccessMode == nil {
+			return false
+		}
+
+		switch cap.AccessMode.Mode {
+		case csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+			csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+			multiNode = true
+		case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:
+		default:
+			return false
+		}
+	}
+	return multiNode
+}
+
+// nfsAttributes exports the volume if it backs an NFS export and returns the
+// volume attributes the nodes mount the export with. It returns nil for other
+// volumes.
+func (d *Driver) nfsAttributes(ctx context.Context, vol *hcloud.Volume) (map[string]string, error) {
+	if d.nfs == nil || vol.Labels[labelNFSExport] == "" {
+		return nil, nil
+	}
+
+	server, err := d.nfs.export(ctx, vol)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return map[string]string{
+		attrNFSServer: server,
+	}, nil
+}
+
+// exportName returns the name of the Kubernetes objects of the export
+func exportName(volumeID int) string {
+	return fmt.Sprintf("hcloud-nfs-%d", volumeID)
+}
+
+// export creates the NFS export of the volume and returns the address of the
+// server. The function is idempotent.
+func (n *nfsExporter) export(ctx context.Context, vol *hcloud.Volume) (string, error) {
+	if vol.Location == nil {
+		return "", fmt.Errorf("location of volume %d is unknown", vol.ID)
+	}
+
+	name := exportName(vol.ID)
+	size := resource.MustParse(fmt.Sprintf("%dGi", vol.Size))
+	storageClass := ""
+	labels := map[string]string{
+		"app": name,
+	}
+
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			Capacity: corev1.ResourceList{
+				corev1.ResourceStorage: size,
+			},
+			AccessModes:                   []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					Driver:       driverName,
+					VolumeHandle: strconv.Itoa(vol.ID),
+					FSType:       "ext4",
+				},
+			},
+			ClaimRef: &corev1.ObjectReference{
+				Kind:       "PersistentVolumeClaim",
+				APIVersion: "v1",
+				Namespace:  n.namespace,
+				Name:       name,
+			},
+			NodeAffinity: locationAffinity(vol.Location.Name),
+		},
+	}
+	if _, err := n.d.kubeClient.CoreV1().PersistentVolumes().Create(pv); err != nil && !kubeerrors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("could not create persistent volume %q: %s", name, err)
+	}
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: n.namespace,
+			Labels:    labels,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			StorageClassName: &storageClass,
+			VolumeName:       name,
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: size,
+				},
+			},
+		},
+	}
+	if _, err := n.d.kubeClient.CoreV1().PersistentVolumeClaims(n.namespace).Create(pvc); err != nil && !kubeerrors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("could not create persistent volume claim %s/%s: %s", n.namespace, name, err)
+	}
+
+	if _, err := n.d.kubeClient.AppsV1().Deployments(n.namespace).Create(n.deployment(name, labels)); err != nil && !kubeerrors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("could not create deployment %s/%s: %s", n.namespace, name, err)
+	}
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: n.namespace,
+			Labels:    labels,
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: labels,
+			Ports: []corev1.ServicePort{
+				{
+					Name:     "nfs",
+					Protocol: corev1.ProtocolTCP,
+					Port:     nfsPort,
+				},
+			},
+		},
+	}
+	created, err := n.d.kubeClient.CoreV1().Services(n.namespace).Create(svc)
+	if kubeerrors.IsAlreadyExists(err) {
+		created, err = n.d.kubeClient.CoreV1().Services(n.namespace).Get(name, metav1.GetOptions{})
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not create service %s/%s: %s", n.namespace, name, err)
+	}
+
+	// the nodes mount the export from the host network, which can't resolve
+	// cluster DNS names
+	return created.Spec.ClusterIP, nil
+}
+
+// deployment returns the NFS server deployment of the export with the given
+// name
+func (n *nfsExporter) deployment(name string, labels map[string]string) *appsv1.Deployment {
+	replicas := int32(1)
+	privileged := true
+
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: n.namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			// the volume can only be attached to one node at a time
+			Strategy: appsv1.DeploymentStrategy{
+				Type: appsv1.RecreateDeploymentStrategyType,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:  "nfs-server",
+							Image: n.image,
+							Ports: []corev1.ContainerPort{
+								{
+									Name:          "nfs",
+									Protocol:      corev1.ProtocolTCP,
+									ContainerPort: nfsPort,
+								},
+							},
+							SecurityContext: &corev1.SecurityContext{
+								Privileged: &privileged,
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "export",
+									MountPath: nfsExportPath,
+								},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "export",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: name,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// unexport deletes the NFS export of the volume. Deleting an export that
+// doesn't exist is not an error. The volume is detached asynchronously once
+// the server is stopped.
+func (n *nfsExporter) unexport(volumeID int) error {
+	name := exportName(volumeID)
+	foreground := metav1.DeletePropagationForeground
+	opts := &metav1.DeleteOptions{PropagationPolicy: &foreground}
+
+	deletes := []struct {
+		kind   string
+		delete func(string, *metav1.DeleteOptions) error
+	}{
+		{"service", n.d.kubeClient.CoreV1().Services(n.namespace).Delete},
+		{"deployment", n.d.kubeClient.AppsV1().Deployments(n.namespace).Delete},
+		{"persistent volume claim", n.d.kubeClient.CoreV1().PersistentVolumeClaims(n.namespace).Delete},
+		{"persistent volume", n.d.kubeClient.CoreV1().PersistentVolumes().Delete},
+	}
+
+	for _, del := range deletes {
+		if err := del.delete(name, opts); err != nil && !kubeerrors.IsNotFound(err) {
+			return fmt.Errorf("could not delete %s %q: %s", del.kind, name, err)
+		}
+	}
+	return nil
+}
+
+// nodeStageNFS mounts the NFS export of a volume to the staging path
+func (d *Driver) nodeStageNFS(ctx context.Context, req *csi.NodeStageVolumeRequest, server string) (*csi.NodeStageVolumeResponse, error) {
+	source := fmt.Sprintf("%s:/", server)
+	target := req.StagingTargetPath
+
+	var options []string
+	if mnt := req.VolumeCapability.GetMount(); mnt != nil {
+		options = mnt.MountFlags
+	}
+
+	ll := d.log.WithFields(logrus.Fields{
+		"volume_id":           req.VolumeId,
+		"staging_target_path": target,
+		"source":              source,
+		"mount_options":       options,
+		"method":              "node_stage_volume",
+	})
+
+	mounted, err := d.mounter.IsMounted(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+
+	if mounted {
+		ll.Info("nfs export is already mounted to the target path")
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	if err := ensureDir(target, d.stagingDirMode); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	ll.Info("mounting the nfs export for staging")
+	if err := d.mounter.Mount(ctx, source, target, "nfs4", options...); err != nil {
+		// the server might not be ready yet
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	return &csi.NodeStageVolumeResponse{}, nil
+}
@@ -27,8 +27,12 @@ package driver
 import (
 	"context"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 
+	drivererrors "github.com/apricote/hcloud-csi-driver/driver/errors"
 	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc/codes"
@@ -59,25 +63,73 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Staging Target Path must be provided")
 	}
 
+	if !validPath(req.StagingTargetPath) {
+		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Staging Target Path must be absolute and must not contain \"..\"")
+	}
+
 	if req.VolumeCapability == nil {
 		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Volume Capability must be provided")
 	}
 
+	if req.VolumeCapability.GetMount() == nil {
+		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Volume Capability must be a mount capability, raw block volumes are not supported")
+	}
+
+	// answer retries for volumes staged by the plugin without probing the
+	// device again. The mount is checked, it might have been removed on the
+	// host since.
+	if d.nodeVolumes.isStaged(req.VolumeId, req.StagingTargetPath) {
+		ll := d.log.WithFields(logrus.Fields{
+			"volume_id":           req.VolumeId,
+			"staging_target_path": req.StagingTargetPath,
+			"method":              "node_stage_volume",
+		})
+
+		mounted, err := d.mounter.IsMounted(ctx, req.StagingTargetPath)
+		if err != nil {
+			return nil, err
+		}
+		if mounted {
+			ll.Info("volume is already staged")
+			return &csi.NodeStageVolumeResponse{}, nil
+		}
+
+		ll.Warn("staging target path was unmounted outside of the plugin, staging the volume again")
+		d.nodeVolumes.unstage(req.VolumeId)
+	}
+
+	done, err := d.journal.begin(journalStage, req.VolumeId, req.StagingTargetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer done()
+
+	if server := req.VolumeAttributes[attrNFSServer]; server != "" {
+		return d.nodeStageNFS(ctx, req, server)
+	}
+
+	if d.dedicated {
+		return nil, status.Error(codes.FailedPrecondition, "NodeStageVolume volumes can't be attached to nodes that aren't Hetzner Cloud servers")
+	}
+
 	var volumeID int
-	volumeID, err := strconv.Atoi(req.VolumeId)
+	volumeID, err = strconv.Atoi(req.VolumeId)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "NodeStageVolume Volume ID can not be converted to integer")
 	}
 
-	vol, resp, err := d.hcloudClient.Volume.GetByID(ctx, volumeID)
+	vol, resp, err := d.volumes.GetByID(ctx, volumeID)
 	if err != nil {
 		if resp != nil && resp.StatusCode == http.StatusNotFound {
-			return nil, status.Errorf(codes.NotFound, "volume %q not found", req.VolumeId)
+			return nil, drivererrors.Errorf(drivererrors.ErrVolumeNotFound, "volume %q not found", req.VolumeId)
 		}
 		// TODO: replace with actual error handling
-		return nil, status.Errorf(codes.NotFound, "volume %q not found", req.VolumeId)
+		return nil, drivererrors.Errorf(drivererrors.ErrVolumeNotFound, "volume %q not found", req.VolumeId)
 		// return nil, err
 	}
+	if vol == nil {
+		return nil, drivererrors.Errorf(drivererrors.ErrVolumeNotFound, "volume %q not found, it was deleted", req.VolumeId)
+	}
 
 	source := vol.LinuxDevice
 	target := req.StagingTargetPath
@@ -101,21 +153,41 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 		"method":              "node_stage_volume",
 	})
 
+	// the volume was just attached, udev might not have created the device
+	// link yet
+	if err := waitForDevice(ctx, source); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
 	_, ok := req.VolumeAttributes[annNoFormatVolume]
 	if !ok {
-		formatted, err := d.mounter.IsFormatted(source)
-		if err != nil {
-			return nil, err
+		formatted := d.formatCache.formatted(source)
+		if !formatted {
+			formatted, err = d.mounter.IsFormatted(ctx, source)
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		if !formatted {
+			ll.Info("waiting for other volumes to be formatted")
+			if err := d.formatLimiter.acquire(ctx); err != nil {
+				return nil, status.Errorf(codes.DeadlineExceeded, "waiting to format the volume: %s", err)
+			}
+
 			ll.Info("formatting the volume for staging")
-			if err := d.mounter.Format(source, fsType); err != nil {
+			err := d.mounter.Format(ctx, source, fsType, mkfsOptions(fsType, req.VolumeAttributes)...)
+			d.formatLimiter.release()
+			if err != nil && ctx.Err() != nil {
+				return nil, status.Errorf(codes.DeadlineExceeded, "formatting the volume: %s", err)
+			}
+			if err != nil {
 				return nil, status.Error(codes.Internal, err.Error())
 			}
 		} else {
 			ll.Info("source device is already formatted")
 		}
+		d.formatCache.add(source)
 
 	} else {
 		ll.Info("skipping formatting the source device")
@@ -123,18 +195,23 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 
 	ll.Info("mounting the volume for staging")
 
-	mounted, err := d.mounter.IsMounted(target)
+	mounted, err := d.mounter.IsMounted(ctx, target)
 	if err != nil {
 		return nil, err
 	}
 
 	if !mounted {
-		if err := d.mounter.Mount(source, target, fsType, options...); err != nil {
+		if err := ensureDir(target, d.stagingDirMode); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		if err := d.mounter.Mount(ctx, source, target, fsType, options...); err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	} else {
 		ll.Info("source device is already mounted to the target path")
 	}
+	d.nodeVolumes.stage(req.VolumeId, source, fsType, target)
 
 	ll.Info("formatting and mounting stage volume is finished")
 	return &csi.NodeStageVolumeResponse{}, nil
@@ -157,20 +234,27 @@ func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolu
 	})
 	ll.Info("node unstage volume called")
 
-	mounted, err := d.mounter.IsMounted(req.StagingTargetPath)
+	done, err := d.journal.begin(journalUnstage, req.VolumeId, req.StagingTargetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer done()
+
+	mounted, err := d.mounter.IsMounted(ctx, req.StagingTargetPath)
 	if err != nil {
 		return nil, err
 	}
 
 	if mounted {
 		ll.Info("unmounting the staging target path")
-		err := d.mounter.Unmount(req.StagingTargetPath)
+		err := d.mounter.Unmount(ctx, req.StagingTargetPath)
 		if err != nil {
 			return nil, err
 		}
 	} else {
 		ll.Info("staging target path is already unmounted")
 	}
+	d.nodeVolumes.unstage(req.VolumeId)
 
 	ll.Info("unmounting stage volume is finished")
 	return &csi.NodeUnstageVolumeResponse{}, nil
@@ -187,14 +271,56 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Staging Target Path must be provided")
 	}
 
+	if !validPath(req.StagingTargetPath) {
+		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Staging Target Path must be absolute and must not contain \"..\"")
+	}
+
 	if req.TargetPath == "" {
 		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Target Path must be provided")
 	}
 
+	if !validPath(req.TargetPath) {
+		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Target Path must be absolute and must not contain \"..\"")
+	}
+
+	if filepath.Clean(req.TargetPath) == filepath.Clean(req.StagingTargetPath) {
+		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Target Path must differ from the Staging Target Path")
+	}
+
 	if req.VolumeCapability == nil {
 		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Volume Capability must be provided")
 	}
 
+	if req.VolumeCapability.GetMount() == nil {
+		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Volume Capability must be a mount capability, raw block volumes are not supported")
+	}
+
+	if d.nodeVolumes.isPublished(req.VolumeId, req.TargetPath) {
+		ll := d.log.WithFields(logrus.Fields{
+			"volume_id": req.VolumeId,
+			"target":    req.TargetPath,
+			"method":    "node_publish_volume",
+		})
+
+		mounted, err := d.mounter.IsMounted(ctx, req.TargetPath)
+		if err != nil {
+			return nil, err
+		}
+		if mounted {
+			ll.Info("volume is already published")
+			return &csi.NodePublishVolumeResponse{}, nil
+		}
+
+		ll.Warn("target path was unmounted outside of the plugin, publishing the volume again")
+		d.nodeVolumes.unpublish(req.VolumeId, req.TargetPath)
+	}
+
+	done, err := d.journal.begin(journalPublish, req.VolumeId, req.TargetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer done()
+
 	source := req.StagingTargetPath
 	target := req.TargetPath
 
@@ -222,19 +348,24 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 		"method":        "node_publish_volume",
 	})
 
-	mounted, err := d.mounter.IsMounted(target)
+	mounted, err := d.mounter.IsMounted(ctx, target)
 	if err != nil {
 		return nil, err
 	}
 
 	if !mounted {
 		ll.Info("mounting the volume")
-		if err := d.mounter.Mount(source, target, fsType, options...); err != nil {
+		if err := ensureDir(target, d.publishDirMode); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		if err := d.mounter.Mount(ctx, source, target, fsType, options...); err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	} else {
 		ll.Info("volume is already mounted")
 	}
+	d.nodeVolumes.publish(req.VolumeId, target)
 
 	ll.Info("bind mounting the volume is finished")
 	return &csi.NodePublishVolumeResponse{}, nil
@@ -257,20 +388,27 @@ func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublish
 	})
 	ll.Info("node unpublish volume called")
 
-	mounted, err := d.mounter.IsMounted(req.TargetPath)
+	done, err := d.journal.begin(journalUnpublish, req.VolumeId, req.TargetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer done()
+
+	mounted, err := d.mounter.IsMounted(ctx, req.TargetPath)
 	if err != nil {
 		return nil, err
 	}
 
 	if mounted {
 		ll.Info("unmounting the target path")
-		err := d.mounter.Unmount(req.TargetPath)
+		err := d.mounter.Unmount(ctx, req.TargetPath)
 		if err != nil {
 			return nil, err
 		}
 	} else {
 		ll.Info("target path is already unmounted")
 	}
+	d.nodeVolumes.unpublish(req.VolumeId, req.TargetPath)
 
 	ll.Info("unmounting volume is finished")
 	return &csi.NodeUnpublishVolumeResponse{}, nil
@@ -313,15 +451,53 @@ func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabi
 // NodeGetInfo returns the supported capabilities of the node server
 func (d *Driver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
 	d.log.WithField("method", "node_get_info").Info("node get info called")
-	return &csi.NodeGetInfoResponse{
-		NodeId:            d.nodeID,
-		MaxVolumesPerNode: maxVolumesPerNode,
 
-		// make sure that the driver works on this particular location only
-		AccessibleTopology: &csi.Topology{
-			Segments: map[string]string{
-				"location": d.location,
-			},
-		},
+	if d.dedicated {
+		// a MaxVolumesPerNode of zero means unlimited, so the node reports no
+		// topology segments instead. As every volume is bound to its
+		// location, no volume is ever scheduled to this node.
+		return &csi.NodeGetInfoResponse{
+			NodeId: d.nodeID,
+		}, nil
+	}
+
+	// make sure that the driver works on this particular location only
+	topology, err := d.nodeTopology(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	return &csi.NodeGetInfoResponse{
+		NodeId:             d.nodeID,
+		MaxVolumesPerNode:  maxVolumesPerNode,
+		AccessibleTopology: topology,
 	}, nil
 }
+
+// validPath returns true if path is absolute and has no ".." elements. The
+// plugin creates the directories of the paths it's given, relative paths
+// would be resolved against its working directory.
+func validPath(path string) bool {
+	if !filepath.IsAbs(path) {
+		return false
+	}
+
+	for _, elem := range strings.Split(path, "/") {
+		if elem == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// ensureDir creates the target directory with the given permissions. The
+// permissions are set explicitly on the directory, so they are neither subject
+// to the umask of the process, nor to the defaults of an already existing
+// directory. It must only be called before the target is mounted.
+func ensureDir(target string, mode os.FileMode) error {
+	if err := os.MkdirAll(target, mode); err != nil {
+		return err
+	}
+
+	return os.Chmod(target, mode)
+}
@@ -0,0 +1,241 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeVolumes returns the volumes in volumes, the other methods of the
+// VolumeService aren't implemented
+type fakeVolumes struct {
+	VolumeService
+	volumes map[int]*hcloud.Volume
+}
+
+func (f *fakeVolumes) GetByID(ctx context.Context, id int) (*hcloud.Volume, *hcloud.Response, error) {
+	return f.volumes[id], nil, nil
+}
+
+func TestNodeMountOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hcloud-csi-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mounter := &fakeMounter{}
+	d := &Driver{
+		volumes: &fakeVolumes{volumes: map[int]*hcloud.Volume{
+			1: {ID: 1, Name: "test", LinuxDevice: os.DevNull},
+		}},
+		mounter: mounter,
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+	staging := filepath.Join(dir, "staging")
+	target := filepath.Join(dir, "target")
+
+	stage := func() error {
+		_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "1",
+			StagingTargetPath: staging,
+			VolumeCapability:  capability,
+		})
+		return err
+	}
+	publish := func() error {
+		_, err := d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          "1",
+			StagingTargetPath: staging,
+			TargetPath:        target,
+			VolumeCapability:  capability,
+		})
+		return err
+	}
+	unstage := func() error {
+		_, err := d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+			VolumeId:          "1",
+			StagingTargetPath: staging,
+		})
+		return err
+	}
+
+	if err := publish(); status.Code(err) != codes.Internal {
+		t.Fatalf("expected publishing before staging to fail, got %v", err)
+	}
+
+	mounter.errors = map[string]error{"Format": errors.New("mkfs failed")}
+	if err := stage(); status.Code(err) != codes.Internal {
+		t.Fatalf("expected the format error, got %v", err)
+	}
+	if mounted, _ := mounter.IsMounted(context.Background(), staging); mounted {
+		t.Fatal("staging path was mounted although formatting failed")
+	}
+
+	mounter.errors = nil
+	if err := stage(); err != nil {
+		t.Fatal(err)
+	}
+	if mounter.formatted[os.DevNull] != "ext4" {
+		t.Errorf("expected the device to be formatted with ext4, got %q", mounter.formatted[os.DevNull])
+	}
+	if err := publish(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := unstage(); err == nil {
+		t.Fatal("expected unstaging a published volume to fail")
+	}
+
+	_, err = d.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "1",
+		TargetPath: target,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unstage(); err != nil {
+		t.Fatal(err)
+	}
+	if len(mounter.mounts) != 0 {
+		t.Errorf("expected no mounts left, got %v", mounter.mounts)
+	}
+}
+
+// slowMounter formats until the context is done
+type slowMounter struct {
+	*fakeMounter
+}
+
+func (s *slowMounter) Format(ctx context.Context, source string, fsType string, options ...string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestNodeStageVolumeDeadline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hcloud-csi-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mounter := &fakeMounter{}
+	d := &Driver{
+		volumes: &fakeVolumes{volumes: map[int]*hcloud.Volume{
+			1: {ID: 1, Name: "test", LinuxDevice: os.DevNull},
+		}},
+		mounter:       &slowMounter{mounter},
+		formatLimiter: newFormatLimiter(1),
+		log:           logrus.New().WithField("test_enabled", true),
+	}
+
+	stage := func(ctx context.Context) error {
+		_, err := d.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          "1",
+			StagingTargetPath: filepath.Join(dir, "staging"),
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		})
+		return err
+	}
+
+	// the format is cancelled once the deadline of the call passes, a
+	// retry gets to format again
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err := stage(ctx)
+		cancel()
+		if status.Code(err) != codes.DeadlineExceeded {
+			t.Fatalf("expected DEADLINE_EXCEEDED, got %v", err)
+		}
+	}
+	if len(mounter.mounts) != 0 {
+		t.Errorf("expected no mounts, got %v", mounter.mounts)
+	}
+}
+
+func TestEnsureDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hcloud-csi-ensuredir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a restrictive umask must not change the mode of the created directories
+	defer syscall.Umask(syscall.Umask(0077))
+
+	existing := filepath.Join(dir, "existing")
+	if err := os.Mkdir(existing, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		target string
+		mode   os.FileMode
+	}{
+		{"new", filepath.Join(dir, "new"), 0755},
+		{"new with parents", filepath.Join(dir, "parent", "new"), 0750},
+		{"existing with other permissions", existing, 0755},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := ensureDir(c.target, c.mode); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(c.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !info.IsDir() {
+				t.Fatalf("expected %s to be a directory", c.target)
+			}
+			if mode := info.Mode().Perm(); mode != c.mode {
+				t.Errorf("expected mode %v, got %v", c.mode, mode)
+			}
+		})
+	}
+}
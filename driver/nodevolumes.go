@@ -0,0 +1,117 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import "sync"
+
+// nodeVolumes remembers the volumes staged and published by the node plugin,
+// so repeated calls for the same volume and the autoscaler don't have to
+// probe the devices again. Repeated calls still check the mount of the path,
+// it might have been removed on the host. It's filled as the volumes are
+// mounted and unmounted, so it's empty after a restart and the node plugin
+// falls back to checking the mounts. The zero value is usable.
+type nodeVolumes struct {
+	mu      sync.Mutex
+	volumes map[string]*nodeVolume
+}
+
+type nodeVolume struct {
+	device      string
+	fsType      string
+	stagingPath string
+
+	// published are the target paths the volume is published to
+	published map[string]bool
+}
+
+// stage remembers that the device of the volume is mounted to the staging
+// path
+func (n *nodeVolumes) stage(volumeID, device, fsType, stagingPath string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.volumes == nil {
+		n.volumes = map[string]*nodeVolume{}
+	}
+	n.volumes[volumeID] = &nodeVolume{
+		device:      device,
+		fsType:      fsType,
+		stagingPath: stagingPath,
+		published:   map[string]bool{},
+	}
+}
+
+// unstage forgets the volume
+func (n *nodeVolumes) unstage(volumeID string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.volumes, volumeID)
+}
+
+// isStaged returns whether the volume is known to be staged to the path
+func (n *nodeVolumes) isStaged(volumeID, stagingPath string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	v, ok := n.volumes[volumeID]
+	return ok && v.stagingPath == stagingPath
+}
+
+// publish remembers that the staged volume is published to the target path
+func (n *nodeVolumes) publish(volumeID, target string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if v, ok := n.volumes[volumeID]; ok {
+		v.published[target] = true
+	}
+}
+
+// unpublish forgets that the volume is published to the target path
+func (n *nodeVolumes) unpublish(volumeID, target string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if v, ok := n.volumes[volumeID]; ok {
+		delete(v.published, target)
+	}
+}
+
+// isPublished returns whether the volume is known to be published to the
+// target path
+func (n *nodeVolumes) isPublished(volumeID, target string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	v, ok := n.volumes[volumeID]
+	return ok && v.published[target]
+}
+
+// mount returns the staging path and filesystem of the volume staged from
+// the given device
+func (n *nodeVolumes) mount(device string) (string, string, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, v := range n.volumes {
+		if v.device == device {
+			return v.stagingPath, v.fsType, true
+		}
+	}
+	return "", "", false
+}
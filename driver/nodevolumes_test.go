@@ -0,0 +1,64 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import "testing"
+
+func TestNodeVolumes(t *testing.T) {
+	var n nodeVolumes
+
+	if n.isStaged("1", "/staging/1") {
+		t.Fatal("empty cache returned a staged volume")
+	}
+
+	// publishing requires the volume to be staged first
+	n.publish("1", "/target/1")
+	if n.isPublished("1", "/target/1") {
+		t.Error("isPublished() returned true for a volume that isn't staged")
+	}
+
+	n.stage("1", "/dev/disk/by-id/scsi-0HC_Volume_1", "ext4", "/staging/1")
+	if !n.isStaged("1", "/staging/1") {
+		t.Error("isStaged() = false for a staged volume")
+	}
+	if n.isStaged("1", "/staging/other") {
+		t.Error("isStaged() = true for another staging path")
+	}
+
+	target, fsType, ok := n.mount("/dev/disk/by-id/scsi-0HC_Volume_1")
+	if !ok || target != "/staging/1" || fsType != "ext4" {
+		t.Errorf("mount() = %q, %q, %t, want the staging path", target, fsType, ok)
+	}
+
+	n.publish("1", "/target/1")
+	if !n.isPublished("1", "/target/1") {
+		t.Error("isPublished() = false for a published volume")
+	}
+
+	n.unpublish("1", "/target/1")
+	if n.isPublished("1", "/target/1") {
+		t.Error("isPublished() = true after unpublishing")
+	}
+
+	n.unstage("1")
+	if n.isStaged("1", "/staging/1") {
+		t.Error("isStaged() = true after unstaging")
+	}
+	if _, _, ok := n.mount("/dev/disk/by-id/scsi-0HC_Volume_1"); ok {
+		t.Error("mount() returned an unstaged volume")
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Option configures the Driver returned by NewDriver
+type Option func(*driverOptions)
+
+// driverOptions are the settings of NewDriver. The clients, the mounter and
+// the logger are created from the params unless they're given.
+type driverOptions struct {
+	params NewDriverParams
+
+	// fields are set by the options setting single fields of the params.
+	// They're applied after WithParams, regardless of their position.
+	fields []func(*NewDriverParams)
+
+	hcloudClient *hcloud.Client
+	kubeClient   kubernetes.Interface
+	mounter      Mounter
+	log          *logrus.Entry
+}
+
+// WithParams sets the endpoint, the credentials and the features of the
+// driver, as given by the flags of the plugin. The options setting single
+// fields, like WithEndpoint, override them wherever they're passed.
+func WithParams(p NewDriverParams) Option {
+	return func(o *driverOptions) {
+		o.params = p
+	}
+}
+
+// WithEndpoint sets the endpoint the driver serves CSI on, e.g.
+// unix:///csi/csi.sock
+func WithEndpoint(endpoint string) Option {
+	return func(o *driverOptions) {
+		o.fields = append(o.fields, func(p *NewDriverParams) {
+			p.Endpoint = endpoint
+		})
+	}
+}
+
+// WithMode sets the CSI services the driver serves, ModeAll by default
+func WithMode(mode string) Option {
+	return func(o *driverOptions) {
+		o.fields = append(o.fields, func(p *NewDriverParams) {
+			p.Mode = mode
+		})
+	}
+}
+
+// WithHostname sets the name of the server the driver runs on, the hostname
+// of the machine by default
+func WithHostname(hostname string) Option {
+	return func(o *driverOptions) {
+		o.fields = append(o.fields, func(p *NewDriverParams) {
+			p.Hostname = hostname
+		})
+	}
+}
+
+// WithMetadata sets the metadata service the node plugin looks up its
+// server in
+func WithMetadata(metadata MetadataClient) Option {
+	return func(o *driverOptions) {
+		o.fields = append(o.fields, func(p *NewDriverParams) {
+			p.Metadata = metadata
+		})
+	}
+}
+
+// WithHCloudClient sets the client of the Hetzner Cloud API. The token and
+// the URL of the params are ignored then.
+func WithHCloudClient(client *hcloud.Client) Option {
+	return func(o *driverOptions) {
+		o.hcloudClient = client
+	}
+}
+
+// WithKubeClient sets the client of the Kubernetes API used by the background
+// controllers. The kubeconfig of the params is ignored then.
+func WithKubeClient(client kubernetes.Interface) Option {
+	return func(o *driverOptions) {
+		o.kubeClient = client
+	}
+}
+
+// WithMounter sets the mounter of the node plugin
+func WithMounter(mounter Mounter) Option {
+	return func(o *driverOptions) {
+		o.mounter = mounter
+	}
+}
+
+// WithLogger sets the logger of the driver, the location and the hostname
+// are added to its fields
+func WithLogger(log *logrus.Entry) Option {
+	return func(o *driverOptions) {
+		o.log = log
+	}
+}
+
+// WithLogSink makes the driver pass its log entries to sink instead of
+// writing them with logrus
+func WithLogSink(sink LogSink) Option {
+	return func(o *driverOptions) {
+		o.log = newSinkLogger(sink)
+	}
+}
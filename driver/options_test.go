@@ -0,0 +1,155 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+func TestNewDriverOptions(t *testing.T) {
+	metadata, stop := newFakeMetadata(&fakeMetadata{values: map[string]string{
+		"instance-id": "1", "availability-zone": "fsn1-dc14",
+	}})
+	defer stop()
+	// the server is taken from the metadata, the API is never called
+	client := hcloud.NewClient(hcloud.WithEndpoint("http://127.0.0.1:1"))
+	mounter := &fakeMounter{}
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	d, err := NewDriver(
+		WithParams(NewDriverParams{
+			Endpoint: "unix:///params/csi.sock",
+			Mode:     ModeAll,
+			GRPCGzip: true,
+		}),
+		WithEndpoint("unix:///csi/csi.sock"),
+		WithMode(ModeNode),
+		WithHostname("node"),
+		WithMetadata(metadata),
+		WithHCloudClient(client),
+		WithMounter(mounter),
+		WithLogger(log.WithField("embedded", true)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.endpoint != "unix:///csi/csi.sock" || d.mode != ModeNode {
+		t.Errorf("expected the endpoint and mode of the options, got %q and %q", d.endpoint, d.mode)
+	}
+	if !d.grpcGzip {
+		t.Error("expected the features of the params")
+	}
+	if d.nodeID != "1" || d.location != "fsn1" || d.datacenter != "fsn1-dc14" {
+		t.Errorf("expected server 1 in fsn1-dc14, got server %s in %s", d.nodeID, d.datacenter)
+	}
+	if d.hcloudClient != client || d.mounter != mounter {
+		t.Error("expected the client and mounter of the options")
+	}
+	if d.log.Data["embedded"] != true || d.log.Data["location"] != "fsn1" {
+		t.Errorf("expected the logger of the options with the location, got the fields %v", d.log.Data)
+	}
+}
+
+func TestNewDriverOptionOrder(t *testing.T) {
+	params := NewDriverParams{Endpoint: "unix:///params/csi.sock", Mode: ModeAll, GRPCGzip: true}
+	cases := []struct {
+		name string
+		opts []Option
+	}{
+		{"params first", []Option{WithParams(params), WithEndpoint("unix:///csi/csi.sock"), WithMode(ModeNode)}},
+		{"params last", []Option{WithEndpoint("unix:///csi/csi.sock"), WithMode(ModeNode), WithParams(params)}},
+		{"params between", []Option{WithEndpoint("unix:///csi/csi.sock"), WithParams(params), WithMode(ModeNode)}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			metadata, stop := newFakeMetadata(&fakeMetadata{values: map[string]string{
+				"instance-id": "1", "availability-zone": "fsn1-dc14",
+			}})
+			defer stop()
+			log := logrus.New()
+			log.Out = ioutil.Discard
+
+			d, err := NewDriver(append(c.opts,
+				WithHostname("node"),
+				WithMetadata(metadata),
+				WithHCloudClient(hcloud.NewClient(hcloud.WithEndpoint("http://127.0.0.1:1"))),
+				WithMounter(&fakeMounter{}),
+				WithLogger(log.WithField("test", t.Name())),
+			)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if d.endpoint != "unix:///csi/csi.sock" || d.mode != ModeNode {
+				t.Errorf("expected the endpoint and mode of the options, got %q and %q", d.endpoint, d.mode)
+			}
+			if !d.grpcGzip {
+				t.Error("expected the features of the params")
+			}
+		})
+	}
+}
+
+func TestNewDriverInvalidOptions(t *testing.T) {
+	_, err := NewDriver(WithMode("storage"), WithHostname("node"))
+	if err == nil {
+		t.Error("expected an unknown mode to be rejected")
+	}
+}
+
+// blockingMetadata blocks until the lookup is canceled
+type blockingMetadata struct {
+	canceled chan struct{}
+}
+
+func (m *blockingMetadata) InstanceID(ctx context.Context) (int, error) {
+	<-ctx.Done()
+	close(m.canceled)
+	return 0, ctx.Err()
+}
+
+func (m *blockingMetadata) AvailabilityZone(ctx context.Context) (string, error) {
+	return "", ctx.Err()
+}
+
+func TestNewDriverCancelsLookup(t *testing.T) {
+	metadata := &blockingMetadata{canceled: make(chan struct{})}
+	_, err := NewDriver(
+		WithParams(NewDriverParams{BackupSchedule: true}),
+		WithHostname("node"),
+		WithMetadata(metadata),
+		WithHCloudClient(hcloud.NewClient(hcloud.WithEndpoint("http://127.0.0.1:1"))),
+	)
+	if err == nil {
+		t.Fatal("expected scheduled backups without a backup store to be rejected")
+	}
+
+	select {
+	case <-metadata.canceled:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the server lookup to be canceled")
+	}
+}
@@ -0,0 +1,384 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// moverPodPollInterval defines how often the status of a helper pod is
+	// checked
+	moverPodPollInterval = 5 * time.Second
+
+	// moverSecretAccessKeyID and moverSecretAccessKey are the keys of the
+	// backup store credentials in the data mover secret,
+	// moverSecretEncryptionKey is the key of the optional encryption key
+	moverSecretAccessKeyID   = "backup-access-key-id"
+	moverSecretAccessKey     = "backup-secret-access-key"
+	moverSecretEncryptionKey = "backup-encryption-key"
+
+	// moverResultPath is the termination message path of the helpers. It's
+	// not below /dev, which is mounted from the host.
+	moverResultPath = "/var/run/hcloud-csi-mover/result"
+)
+
+// podMover copies data in short-lived helper pods. The helper runs on the
+// node the volume is attached to, so volumes in use can be backed up as well.
+// Detached volumes are attached to a node in their location. The
+// controller plugin itself doesn't need access to the block devices.
+type podMover struct {
+	d *Driver
+
+	// image is the image of the helper, it must contain this driver
+	image     string
+	namespace string
+	// secret contains the credentials of the backup store
+	secret string
+
+	backupURL    string
+	backupRegion string
+}
+
+func (p *podMover) Check(vol *hcloud.Volume) error {
+	return nil
+}
+
+func (p *podMover) Backup(ctx context.Context, vol *hcloud.Volume, m *backupManifest) error {
+	progress := p.d.progress.start(operationBackup, m.ID, p.d.log.WithField("backup_id", m.ID))
+	defer progress.finish()
+
+	progress.phase("uploading in helper pod", m.SizeBytes)
+	done := make(chan struct{})
+	go p.followBackup(ctx, m.ID, progress, done)
+
+	_, err := p.run(ctx, vol, MoverBackup, "--mover-backup-id="+m.ID)
+	close(done)
+	if err != nil {
+		return err
+	}
+
+	// the helper updated the manifest after every chunk
+	stored, err := p.d.getBackup(ctx, m.ID)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		return fmt.Errorf("manifest of backup %q disappeared", m.ID)
+	}
+
+	m.Chunks = stored.Chunks
+	m.StoredBytes = stored.StoredBytes
+	if m.Chunks != m.totalChunks() {
+		return fmt.Errorf("data mover finished after %d of %d chunks", m.Chunks, m.totalChunks())
+	}
+	return nil
+}
+
+func (p *podMover) Restore(ctx context.Context, vol *hcloud.Volume, m *backupManifest) error {
+	if vol.Server != nil {
+		return fmt.Errorf("volume %d must be detached to be restored", vol.ID)
+	}
+
+	// the helper doesn't store the progress of restores, it's only logged
+	// by the helper itself
+	progress := p.d.progress.start(operationRestore, strconv.Itoa(vol.ID), p.d.log.WithFields(logrus.Fields{
+		"backup_id": m.ID,
+		"volume_id": vol.ID,
+	}))
+	defer progress.finish()
+	progress.phase("restoring in helper pod", 0)
+
+	_, err := p.run(ctx, vol, MoverRestore, "--mover-backup-id="+m.ID)
+	return err
+}
+
+// followBackup reports the chunks the helper stored in the manifest of the
+// backup until done is closed
+func (p *podMover) followBackup(ctx context.Context, id string, progress *progressReporter, done <-chan struct{}) {
+	ticker := time.NewTicker(moverPodPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		stored, err := p.d.getBackup(ctx, id)
+		if err != nil || stored == nil {
+			continue
+		}
+		progress.update(stored.copiedBytes(stored.Chunks))
+	}
+}
+
+func (p *podMover) Populate(ctx context.Context, vol *hcloud.Volume, source string) error {
+	if vol.Server != nil {
+		return fmt.Errorf("volume %d must be detached to be populated", vol.ID)
+	}
+
+	_, err := p.run(ctx, vol, MoverPopulate, "--mover-source="+source)
+	return err
+}
+
+func (p *podMover) Wipe(ctx context.Context, vol *hcloud.Volume) error {
+	if vol.Server != nil {
+		return fmt.Errorf("volume %d must be detached to be wiped", vol.ID)
+	}
+
+	_, err := p.run(ctx, vol, MoverWipe)
+	return err
+}
+
+// run copies the data of the volume in a helper pod and waits until it's
+// finished. args are passed to the helper in addition to the common ones. It
+// returns the termination message of the helper.
+func (p *podMover) run(ctx context.Context, vol *hcloud.Volume, direction string, args ...string) (string, error) {
+	node, release, err := p.prepare(ctx, vol)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	pods := p.d.kubeClient.CoreV1().Pods(p.namespace)
+
+	pod, err := pods.Create(p.pod(node, vol, direction, args))
+	if err != nil {
+		return "", fmt.Errorf("could not create data mover pod: %s", err)
+	}
+
+	ll := p.d.log.WithFields(logrus.Fields{
+		"pod_name":      pod.Name,
+		"pod_namespace": pod.Namespace,
+		"node":          node,
+		"volume_id":     vol.ID,
+		"direction":     direction,
+	})
+	ll.Info("data mover pod created")
+
+	defer func() {
+		if err := pods.Delete(pod.Name, &metav1.DeleteOptions{}); err != nil {
+			ll.WithError(err).Error("could not delete data mover pod")
+		}
+	}()
+
+	ticker := time.NewTicker(moverPodPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-ticker.C:
+		}
+
+		pod, err = pods.Get(pod.Name, metav1.GetOptions{})
+		if err != nil {
+			ll.WithError(err).Warn("could not get data mover pod")
+			continue
+		}
+
+		switch pod.Status.Phase {
+		case corev1.PodSucceeded:
+			ll.Info("data mover pod finished")
+			return podTerminationMessage(pod), nil
+		case corev1.PodFailed:
+			return "", fmt.Errorf("data mover pod %s/%s failed: %s", pod.Namespace, pod.Name, podTerminationMessage(pod))
+		}
+	}
+}
+
+// prepare returns the node the helper pod runs on. Detached volumes are
+// attached to the node of the driver, or to another node in the location of
+// the volume if the driver runs elsewhere. The returned release function
+// detaches them again.
+func (p *podMover) prepare(ctx context.Context, vol *hcloud.Volume) (string, func(), error) {
+	if vol.Server == nil {
+		node, serverID := p.d.hostname, 0
+		if p.d.nodeID != "" && vol.Location != nil && vol.Location.Name == p.d.location {
+			var err error
+			serverID, err = strconv.Atoi(p.d.nodeID)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid node id %q: %s", p.d.nodeID, err)
+			}
+		} else {
+			server, err := p.d.nodeInLocation(ctx, vol.Location)
+			if err != nil {
+				return "", nil, err
+			}
+			node, serverID = server.Name, server.ID
+		}
+
+		release, err := p.d.attachVolume(ctx, vol, serverID)
+		if err != nil {
+			return "", nil, err
+		}
+		return node, release, nil
+	}
+
+	// node names are the names of the servers, see NewDriver
+	server, _, err := p.d.servers.GetByID(ctx, vol.Server.ID)
+	if err != nil {
+		return "", nil, err
+	}
+	if server == nil {
+		return "", nil, fmt.Errorf("server %d of volume %d not found", vol.Server.ID, vol.ID)
+	}
+
+	return server.Name, func() {}, nil
+}
+
+// nodeInLocation returns the server of a ready node in the given location
+func (d *Driver) nodeInLocation(ctx context.Context, location *hcloud.Location) (*hcloud.Server, error) {
+	if location == nil {
+		return nil, fmt.Errorf("location of the volume is unknown")
+	}
+
+	nodes, err := d.kubeClient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list nodes: %s", err)
+	}
+
+	for _, node := range nodes.Items {
+		if !nodeReady(&node) {
+			continue
+		}
+
+		server, _, err := d.servers.GetByName(ctx, node.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		if server != nil && server.Datacenter.Location.Name == location.Name {
+			return server, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no ready node in location %q", location.Name)
+}
+
+// nodeReady returns true if the node is ready
+func nodeReady(node *corev1.Node) bool {
+	for _, c := range node.Status.Conditions {
+		if c.Type == corev1.NodeReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// pod returns the helper pod copying the data of the volume on the given node
+func (p *podMover) pod(node string, vol *hcloud.Volume, direction string, args []string) *corev1.Pod {
+	privileged := true
+	optional := true
+
+	secretEnv := func(name, key string) corev1.EnvVar {
+		return corev1.EnvVar{
+			Name: name,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: p.secret},
+					Key:                  key,
+					Optional:             &optional,
+				},
+			},
+		}
+	}
+
+	var env []corev1.EnvVar
+	if p.secret != "" {
+		env = []corev1.EnvVar{
+			secretEnv("BACKUP_ACCESS_KEY_ID", moverSecretAccessKeyID),
+			secretEnv("BACKUP_SECRET_ACCESS_KEY", moverSecretAccessKey),
+			secretEnv("BACKUP_ENCRYPTION_KEY", moverSecretEncryptionKey),
+		}
+	}
+
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "hcloud-csi-mover-",
+			Namespace:    p.namespace,
+			Labels: map[string]string{
+				"app":       "hcloud-csi-mover",
+				"volume-id": strconv.Itoa(vol.ID),
+				"direction": direction,
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:      node,
+			RestartPolicy: corev1.RestartPolicyNever,
+			Tolerations: []corev1.Toleration{
+				{Operator: corev1.TolerationOpExists},
+			},
+			Containers: []corev1.Container{
+				{
+					Name:  "mover",
+					Image: p.image,
+					Args: append([]string{
+						"--mover=" + direction,
+						"--mover-device=" + vol.LinuxDevice,
+						"--backup-url=" + p.backupURL,
+						"--backup-region=" + p.backupRegion,
+					}, args...),
+					Env: env,
+					SecurityContext: &corev1.SecurityContext{
+						Privileged: &privileged,
+					},
+					TerminationMessagePath:   moverResultPath,
+					TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+					VolumeMounts: []corev1.VolumeMount{
+						{Name: "dev", MountPath: "/dev"},
+					},
+				},
+			},
+			Volumes: []corev1.Volume{
+				{
+					Name: "dev",
+					VolumeSource: corev1.VolumeSource{
+						HostPath: &corev1.HostPathVolumeSource{Path: "/dev"},
+					},
+				},
+			},
+		},
+	}
+}
+
+// podTerminationMessage returns the termination message of the first
+// terminated container of the pod
+func podTerminationMessage(pod *corev1.Pod) string {
+	for _, cs := range pod.Status.ContainerStatuses {
+		if t := cs.State.Terminated; t != nil {
+			if t.Message != "" {
+				return t.Message
+			}
+			return fmt.Sprintf("exit code %d", t.ExitCode)
+		}
+	}
+	return pod.Status.Message
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"path"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// paramAllowedNamespaces and paramDeniedNamespaces are the StorageClass
+	// parameters that restrict the namespaces that may provision volumes
+	// with the class. They're comma separated lists of namespaces, which may
+	// contain shell patterns like `team-*`.
+	paramAllowedNamespaces = "allowedNamespaces"
+	paramDeniedNamespaces  = "deniedNamespaces"
+)
+
+// checkNamespacePolicy checks whether the namespace of the PVC may provision
+// volumes with the StorageClass parameters. It requires the
+// external-provisioner to pass the PVC metadata (--extra-create-metadata),
+// volumes are not provisioned for unknown namespaces if a policy is set.
+func checkNamespacePolicy(params map[string]string) error {
+	allowed, denied := params[paramAllowedNamespaces], params[paramDeniedNamespaces]
+	if allowed == "" && denied == "" {
+		return nil
+	}
+
+	namespace := params[paramPVCNamespace]
+	if namespace == "" {
+		return status.Error(codes.FailedPrecondition,
+			"namespace policy can not be enforced, PVC metadata is not passed by the provisioner")
+	}
+
+	if denied != "" {
+		match, err := matchNamespace(denied, namespace)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "parameter %q is invalid: %s", paramDeniedNamespaces, err)
+		}
+		if match {
+			return status.Errorf(codes.PermissionDenied, "namespace %q may not provision volumes of this storage class", namespace)
+		}
+	}
+
+	if allowed != "" {
+		match, err := matchNamespace(allowed, namespace)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "parameter %q is invalid: %s", paramAllowedNamespaces, err)
+		}
+		if !match {
+			return status.Errorf(codes.PermissionDenied, "namespace %q may not provision volumes of this storage class", namespace)
+		}
+	}
+
+	return nil
+}
+
+// matchNamespace returns true if the namespace matches one of the comma
+// separated patterns
+func matchNamespace(patterns, namespace string) (bool, error) {
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+
+		match, err := path.Match(pattern, namespace)
+		if err != nil {
+			return false, err
+		}
+		if match {
+			return true, nil
+		}
+	}
+	return false, nil
+}
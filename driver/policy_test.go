@@ -0,0 +1,61 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheckNamespacePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed string
+		denied  string
+		ns      string
+		code    codes.Code
+	}{
+		{name: "no policy", ns: "", code: codes.OK},
+		{name: "allowed", allowed: "default, team-*", ns: "team-a", code: codes.OK},
+		{name: "not allowed", allowed: "default,team-*", ns: "kube-system", code: codes.PermissionDenied},
+		{name: "denied", denied: "kube-*", ns: "kube-public", code: codes.PermissionDenied},
+		{name: "not denied", denied: "kube-*", ns: "default", code: codes.OK},
+		{name: "denied wins", allowed: "team-*", denied: "team-b", ns: "team-b", code: codes.PermissionDenied},
+		{name: "unknown namespace", allowed: "default", ns: "", code: codes.FailedPrecondition},
+		{name: "invalid pattern", allowed: "team-[", ns: "default", code: codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		params := map[string]string{}
+		if tt.allowed != "" {
+			params[paramAllowedNamespaces] = tt.allowed
+		}
+		if tt.denied != "" {
+			params[paramDeniedNamespaces] = tt.denied
+		}
+		if tt.ns != "" {
+			params[paramPVCNamespace] = tt.ns
+		}
+
+		err := checkNamespacePolicy(params)
+		if code := status.Code(err); code != tt.code {
+			t.Errorf("%s: got code %s (%v), want %s", tt.name, code, err, tt.code)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// labelPool marks the volumes of the pool that are not claimed yet. It's
+	// poolPending until the volume is ready, then poolAvailable.
+	labelPool     = "pool"
+	poolPending   = "pending"
+	poolAvailable = "available"
+
+	// labelPoolFsType is the filesystem pool volumes are formatted with
+	labelPoolFsType = "poolFsType"
+
+	// poolVolumePrefix is the name prefix of unclaimed pool volumes
+	poolVolumePrefix = "pool-"
+
+	// volumePoolInterval defines how often the pool is refilled
+	volumePoolInterval = time.Minute
+)
+
+// volumePool keeps a number of unattached volumes per size ready, so
+// CreateVolume can claim one instead of waiting for a new volume. Claiming
+// renames the volume and replaces its labels. If fsType is set, the pool
+// volumes are formatted in advance (on the server of the controller plugin)
+// and only claimed for requests with that filesystem.
+type volumePool struct {
+	d *Driver
+	// sizes maps the volume size in GB to the number of volumes to keep
+	sizes  map[int]int
+	fsType string
+	log    *logrus.Entry
+
+	// claimMus serialize the claims per size, so a volume is only claimed
+	// once. Claims of other sizes don't have to wait.
+	claimMus map[int]*sync.Mutex
+
+	// refillCh triggers a refill after a volume was claimed
+	refillCh chan struct{}
+}
+
+// newVolumePool returns a new volumePool for the given driver
+func newVolumePool(d *Driver, sizes map[int]int, fsType string) *volumePool {
+	claimMus := map[int]*sync.Mutex{}
+	for size := range sizes {
+		claimMus[size] = &sync.Mutex{}
+	}
+
+	return &volumePool{
+		d:        d,
+		sizes:    sizes,
+		fsType:   fsType,
+		log:      d.log.WithField("component", "volume_pool"),
+		claimMus: claimMus,
+		refillCh: make(chan struct{}, 1),
+	}
+}
+
+// run refills the pool until stopCh is closed
+func (p *volumePool) run(stopCh <-chan struct{}) {
+	p.log.WithFields(logrus.Fields{
+		"sizes":   p.sizes,
+		"fs_type": p.fsType,
+	}).Info("volume pool started")
+
+	ticker := time.NewTicker(volumePoolInterval)
+	defer ticker.Stop()
+
+	for {
+		p.refill(context.Background())
+
+		select {
+		case <-stopCh:
+			p.log.Info("volume pool stopped")
+			return
+		case <-ticker.C:
+		case <-p.refillCh:
+		}
+	}
+}
+
+// refill creates the missing pool volumes. Pending volumes left over from an
+// interrupted refill are deleted.
+func (p *volumePool) refill(ctx context.Context) {
+	if p.d.inMaintenance() {
+		p.log.Info("skipping refill in maintenance mode")
+		return
+	}
+
+	available := map[int]int{}
+	var leftovers []*hcloud.Volume
+	err := p.d.eachVolume(ctx, labelPool, func(vol *hcloud.Volume) bool {
+		if vol.Location == nil || vol.Location.Name != p.d.location {
+			return true
+		}
+
+		switch vol.Labels[labelPool] {
+		case poolAvailable:
+			available[vol.Size]++
+		case poolPending:
+			if vol.Server == nil {
+				leftovers = append(leftovers, vol)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		p.log.WithError(err).Error("could not list pool volumes")
+		return
+	}
+
+	// deleted after listing, so no page is skipped
+	for _, vol := range leftovers {
+		p.log.WithField("volume_id", vol.ID).Warn("deleting leftover pending pool volume")
+		if _, err := p.d.volumes.Delete(ctx, vol); err != nil {
+			p.log.WithError(err).Error("could not delete pending pool volume")
+		}
+	}
+
+	for size, count := range p.sizes {
+		for i := available[size]; i < count; i++ {
+			if err := p.create(ctx, size); err != nil {
+				p.log.WithError(err).WithField("size_giga_bytes", size).Error("could not create pool volume")
+				return
+			}
+		}
+	}
+}
+
+// create adds a new volume of the given size to the pool
+func (p *volumePool) create(ctx context.Context, size int) error {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+
+	labels := map[string]string{
+		"createdBy": createdByHCloud,
+		labelPool:   poolPending,
+	}
+
+	res, _, err := p.d.volumes.Create(ctx, hcloud.VolumeCreateOpts{
+		Name:     poolVolumePrefix + hex.EncodeToString(suffix),
+		Size:     size,
+		Location: &hcloud.Location{Name: p.d.location},
+		Labels:   labels,
+	})
+	if err != nil {
+		return err
+	}
+	vol := res.Volume
+
+	ll := p.log.WithFields(logrus.Fields{
+		"volume_id":       vol.ID,
+		"size_giga_bytes": size,
+	})
+
+	if res.Action != nil {
+		if err := p.d.waitAction(ctx, vol.ID, res.Action.ID); err != nil {
+			return err
+		}
+	}
+
+	if p.fsType != "" {
+		vol, _, err = p.d.volumes.GetByID(ctx, vol.ID)
+		if err != nil {
+			return err
+		}
+		if vol == nil {
+			return fmt.Errorf("pool volume %d disappeared", res.Volume.ID)
+		}
+
+		if err := p.format(ctx, vol); err != nil {
+			// deleted as leftover with the next refill
+			return fmt.Errorf("formatting pool volume %d failed: %s", vol.ID, err)
+		}
+		labels[labelPoolFsType] = p.fsType
+	}
+
+	labels[labelPool] = poolAvailable
+	if _, _, err := p.d.volumes.Update(ctx, vol, hcloud.VolumeUpdateOpts{Labels: labels}); err != nil {
+		return err
+	}
+
+	ll.Info("pool volume created")
+	return nil
+}
+
+// format formats the volume with the filesystem of the pool
+func (p *volumePool) format(ctx context.Context, vol *hcloud.Volume) error {
+	device, release, err := p.d.acquireDevice(ctx, vol)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := p.d.formatLimiter.acquire(ctx); err != nil {
+		return err
+	}
+	defer p.d.formatLimiter.release()
+
+	p.d.formatCache.forget(device)
+	return p.d.mounter.Format(ctx, device, p.fsType)
+}
+
+// claim renames an available pool volume with the given size to name and
+// replaces its labels. It returns nil if no suitable volume is available.
+func (p *volumePool) claim(ctx context.Context, name string, size int, caps []*csi.VolumeCapability, labels map[string]string) (*hcloud.Volume, error) {
+	if p.sizes[size] == 0 || !p.fsTypeMatches(caps) {
+		return nil, nil
+	}
+
+	p.claimMus[size].Lock()
+	defer p.claimMus[size].Unlock()
+
+	var vol *hcloud.Volume
+	err := p.d.eachVolume(ctx, labelPool+"="+poolAvailable, func(v *hcloud.Volume) bool {
+		if v.Size != size || v.Server != nil || v.Location == nil || v.Location.Name != p.d.location {
+			return true
+		}
+		vol = v
+		return false
+	})
+	if err != nil || vol == nil {
+		return nil, err
+	}
+
+	claimed, _, err := p.d.volumes.Update(ctx, vol, hcloud.VolumeUpdateOpts{
+		Name:   name,
+		Labels: labels,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case p.refillCh <- struct{}{}:
+	default:
+	}
+
+	return claimed, nil
+}
+
+// fsTypeMatches returns true if the pool volumes can be used for the given
+// capabilities
+func (p *volumePool) fsTypeMatches(caps []*csi.VolumeCapability) bool {
+	if p.fsType == "" {
+		return true
+	}
+
+	for _, c := range caps {
+		mnt := c.GetMount()
+		if mnt == nil {
+			// raw block volumes must not contain a filesystem
+			return false
+		}
+
+		fsType := "ext4"
+		if mnt.FsType != "" {
+			fsType = mnt.FsType
+		}
+		if fsType != p.fsType {
+			return false
+		}
+	}
+	return true
+}
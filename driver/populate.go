@@ -0,0 +1,263 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	drivererrors "github.com/apricote/hcloud-csi-driver/driver/errors"
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// New volumes can be pre-filled with a raw disk image (i.e: an ext4 image of
+// a database seed) that's downloaded from a HTTP(S) URL, such as a presigned
+// S3 URL. Images ending with .gz are decompressed. The source is either set
+// for all volumes of a StorageClass (paramPopulateFrom) or per PVC via the
+// annPopulateFrom annotation.
+//
+// Volumes created from a snapshot are populated the same way, by restoring
+// the backup of the snapshot.
+//
+// CreateVolume returns ABORTED until the volume is populated, so the PVC is
+// only bound once the data is complete.
+//
+// TODO: support OCI artifacts as source
+
+const (
+	// paramPopulateFrom is the StorageClass parameter with the URL of the
+	// image the new volumes are populated from
+	paramPopulateFrom = "populateFrom"
+
+	// annPopulateFrom is the PVC annotation with the URL of the image the
+	// volume is populated from. It overrides paramPopulateFrom and requires
+	// --extra-create-metadata and the volume populator to be enabled.
+	annPopulateFrom = "de.apricote.hcloud.csi/populate-from"
+
+	// labelPopulated is "false" on volumes that are not yet populated
+	labelPopulated = "populated"
+
+	// snapshotSourcePrefix marks populate sources that are snapshots
+	snapshotSourcePrefix = "snapshot:"
+)
+
+// populateSource returns the source the volume requested by req is populated
+// from or an empty string if it's not populated. The source is either an URL,
+// or the id of a snapshot prefixed by snapshotSourcePrefix.
+func (d *Driver) populateSource(ctx context.Context, req *csi.CreateVolumeRequest, size int64) (string, error) {
+	if snapshot := req.VolumeContentSource.GetSnapshot(); snapshot != nil {
+		return d.snapshotSource(ctx, snapshot.Id, size)
+	}
+
+	params := req.Parameters
+	source := params[paramPopulateFrom]
+
+	name, namespace := params[paramPVCName], params[paramPVCNamespace]
+	if d.populator && name != "" && namespace != "" {
+		pvc, err := d.kubeClient.CoreV1().PersistentVolumeClaims(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return "", status.Errorf(codes.Internal, "could not get persistent volume claim %s/%s: %s", namespace, name, err)
+		}
+
+		if s, ok := pvc.Annotations[annPopulateFrom]; ok {
+			source = s
+		}
+	}
+
+	if source == "" {
+		return "", nil
+	}
+
+	u, err := url.Parse(source)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", status.Errorf(codes.InvalidArgument, "volume can only be populated from a http or https URL, got %q", source)
+	}
+
+	return source, nil
+}
+
+// snapshotSource checks that a volume of the given size can be restored from
+// the snapshot and returns the populate source for it
+func (d *Driver) snapshotSource(ctx context.Context, id string, size int64) (string, error) {
+	if d.backups == nil {
+		return "", status.Error(codes.InvalidArgument, "snapshots are not supported, no backup store is configured")
+	}
+
+	if !backupIDRegexp.MatchString(id) {
+		return "", drivererrors.Errorf(drivererrors.ErrSnapshotNotFound, "snapshot %q not found", id)
+	}
+
+	m, err := d.getBackup(ctx, id)
+	if err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+
+	if m == nil {
+		return "", drivererrors.Errorf(drivererrors.ErrSnapshotNotFound, "snapshot %q not found", id)
+	}
+
+	if m.Status != backupStatusReady {
+		return "", status.Errorf(codes.Unavailable, "snapshot %q is not ready, its status is %q", id, m.Status)
+	}
+
+	if m.SizeBytes > size {
+		return "", status.Errorf(codes.OutOfRange, "requested size %d is smaller than the size %d of snapshot %q", size, m.SizeBytes, id)
+	}
+
+	return snapshotSourcePrefix + id, nil
+}
+
+// checkPopulated returns nil if the volume is populated. Otherwise it starts
+// populating the volume from source, unless it's running already, and
+// returns ABORTED.
+func (d *Driver) checkPopulated(vol *hcloud.Volume, source string) error {
+	if vol.Labels[labelPopulated] != "false" {
+		return nil
+	}
+
+	d.populateMu.Lock()
+	defer d.populateMu.Unlock()
+
+	if !d.populateJobs[vol.ID] {
+		d.populateJobs[vol.ID] = true
+		go d.populate(vol, source)
+	}
+
+	return drivererrors.Errorf(drivererrors.ErrInProgress, "volume %d is being populated", vol.ID)
+}
+
+// populate copies the content of source to the volume and marks it as
+// populated
+func (d *Driver) populate(vol *hcloud.Volume, source string) {
+	defer func() {
+		d.populateMu.Lock()
+		delete(d.populateJobs, vol.ID)
+		d.populateMu.Unlock()
+	}()
+
+	ll := d.log.WithFields(logrus.Fields{
+		"volume_id": vol.ID,
+		"source":    redactURL(source),
+		"method":    "populate",
+	})
+
+	ctx := context.Background()
+
+	ll.Info("populating volume")
+	if err := d.populateFrom(ctx, vol, source); err != nil {
+		// retried with the next CreateVolume call
+		ll.WithError(err).Error("populating volume failed")
+		return
+	}
+
+	labels := map[string]string{}
+	for k, v := range vol.Labels {
+		labels[k] = v
+	}
+	delete(labels, labelPopulated)
+
+	if _, _, err := d.volumes.Update(ctx, vol, hcloud.VolumeUpdateOpts{Labels: labels}); err != nil {
+		ll.WithError(err).Error("marking volume as populated failed")
+		return
+	}
+
+	ll.Info("volume populated")
+}
+
+// populateFrom copies the data of source to the volume
+func (d *Driver) populateFrom(ctx context.Context, vol *hcloud.Volume, source string) error {
+	if !strings.HasPrefix(source, snapshotSourcePrefix) {
+		return d.mover.Populate(ctx, vol, source)
+	}
+
+	id := strings.TrimPrefix(source, snapshotSourcePrefix)
+	m, err := d.getBackup(ctx, id)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return fmt.Errorf("snapshot %q not found", id)
+	}
+
+	return d.mover.Restore(ctx, vol, m)
+}
+
+// populateDevice writes the image downloaded from source to device
+func populateDevice(ctx context.Context, device, source string, ll *logrus.Entry) error {
+	req, err := http.NewRequest("GET", source, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading %s failed with status %d", redactURL(source), resp.StatusCode)
+	}
+
+	var r io.Reader = resp.Body
+	if strings.HasSuffix(req.URL.Path, ".gz") {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("decompressing %s failed: %s", redactURL(source), err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	f, err := os.OpenFile(device, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return fmt.Errorf("writing device %q failed after %d bytes: %s", device, n, err)
+	}
+
+	ll.WithField("bytes", n).Info("image written")
+	return f.Sync()
+}
+
+// redactURL removes the query (i.e: the signature of presigned URLs) and
+// credentials from the URL so it can be logged
+func redactURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "<invalid url>"
+	}
+
+	u.User = nil
+	u.RawQuery = ""
+	return u.String()
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// probeInterval defines how often the dependencies of the plugin are
+	// checked
+	probeInterval = 30 * time.Second
+
+	// probeTimeout is the time the Hetzner Cloud API has to respond to the
+	// check
+	probeTimeout = 10 * time.Second
+)
+
+// nodeTools are the executables the node plugin needs to stage and publish
+// volumes
+var nodeTools = []string{"mount", "umount", "findmnt", "blkid", "mkfs.ext4"}
+
+// healthProber periodically checks the dependencies of the plugin, so Probe
+// and the health service report a degraded plugin instead of individual
+// calls failing. A nil prober reports no problems.
+type healthProber struct {
+	d   *Driver
+	log *logrus.Entry
+
+	mu       sync.Mutex // protects problems
+	problems []string
+}
+
+// newHealthProber returns a new healthProber
+func newHealthProber(d *Driver) *healthProber {
+	return &healthProber{
+		d:   d,
+		log: d.log.WithField("component", "health_prober"),
+	}
+}
+
+// run checks the dependencies until stopCh is closed
+func (p *healthProber) run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+
+	for {
+		p.check()
+
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// check runs all checks and records the problems found
+func (p *healthProber) check() {
+	var problems []string
+
+	// dedicated nodes don't need the API to mount NFS exports
+	if p.d.servesController() || !p.d.dedicated {
+		if problem := p.checkAPI(); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	if p.d.servesNode() {
+		for _, tool := range nodeTools {
+			if _, err := exec.LookPath(tool); err != nil {
+				problems = append(problems, fmt.Sprintf("%q executable not found in $PATH", tool))
+			}
+		}
+	}
+
+	p.mu.Lock()
+	changed := fmt.Sprint(p.problems) != fmt.Sprint(problems)
+	p.problems = problems
+	p.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if len(problems) > 0 {
+		p.log.WithField("problems", problems).Error("plugin is degraded")
+	} else {
+		p.log.Info("plugin recovered")
+	}
+}
+
+// checkAPI returns the problem with the Hetzner Cloud API, if any. On
+// Hetzner Cloud servers, the server of the node is fetched, so the topology
+// looked up at startup is revalidated with the same request.
+func (p *healthProber) checkAPI() string {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	var err error
+	var server *hcloud.Server
+	serverID, convErr := strconv.Atoi(p.d.nodeID)
+	checkServer := p.d.servesNode() && !p.d.dedicated && convErr == nil
+	if checkServer {
+		server, _, err = p.d.servers.GetByID(ctx, serverID)
+	} else {
+		_, err = p.d.hcloudClient.Location.All(ctx)
+	}
+
+	switch {
+	case err == nil:
+	case hcloud.IsError(err, hcloud.ErrorCode("unauthorized")):
+		return "Hetzner Cloud API token is invalid"
+	default:
+		return fmt.Sprintf("Hetzner Cloud API is unreachable: %s", err)
+	}
+
+	if checkServer {
+		return p.checkTopology(server)
+	}
+	return ""
+}
+
+// checkTopology returns a problem if the server of the node doesn't match the
+// topology looked up at startup anymore, i.e. because it was deleted and
+// recreated with the same name in another location. NodeGetInfo keeps
+// reporting the topology of the startup until the plugin is restarted.
+func (p *healthProber) checkTopology(server *hcloud.Server) string {
+	if server == nil {
+		return fmt.Sprintf("server %s of the node doesn't exist anymore", p.d.nodeID)
+	}
+
+	if server.Datacenter == nil || server.Datacenter.Location == nil {
+		return ""
+	}
+
+	if server.Datacenter.Location.Name != p.d.location || server.Datacenter.Name != p.d.datacenter {
+		return fmt.Sprintf("server of the node moved to datacenter %q since the plugin started in %q, restart the plugin",
+			server.Datacenter.Name, p.d.datacenter)
+	}
+	return ""
+}
+
+// degraded returns the problems found by the last check
+func (p *healthProber) degraded() []string {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.problems
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+func TestCheckTopology(t *testing.T) {
+	p := &healthProber{d: &Driver{nodeID: "1", location: "fsn1", datacenter: "fsn1-dc14"}}
+
+	server := func(dc, location string) *hcloud.Server {
+		return &hcloud.Server{ID: 1, Datacenter: &hcloud.Datacenter{Name: dc, Location: &hcloud.Location{Name: location}}}
+	}
+
+	if problem := p.checkTopology(server("fsn1-dc14", "fsn1")); problem != "" {
+		t.Errorf("unchanged server reported: %s", problem)
+	}
+	if problem := p.checkTopology(server("nbg1-dc3", "nbg1")); problem == "" {
+		t.Error("server in another location not reported")
+	}
+	if problem := p.checkTopology(server("fsn1-dc8", "fsn1")); problem == "" {
+		t.Error("server in another datacenter not reported")
+	}
+	if problem := p.checkTopology(nil); problem == "" {
+		t.Error("deleted server not reported")
+	}
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// progressLogInterval is the minimum time between two progress log
+	// entries of an operation
+	progressLogInterval = 30 * time.Second
+
+	// progressStallTimeout is the time after which an operation without
+	// progress is reported as stalled
+	progressStallTimeout = 10 * time.Minute
+)
+
+// The kinds of the operations whose progress is tracked
+const (
+	operationBackup      = "backup"
+	operationRestore     = "restore"
+	operationMigrate     = "migrate"
+	operationMoveProject = "move-project"
+)
+
+// operationProgress is the progress of a long-running operation, e.g. the
+// upload of a backup
+type operationProgress struct {
+	Kind  string `json:"kind"`
+	ID    string `json:"id"`
+	Phase string `json:"phase"`
+
+	// Done and Total are the bytes of the phase that are copied and that
+	// have to be copied. Total is zero for phases without byte progress.
+	Done  int64 `json:"doneBytes"`
+	Total int64 `json:"totalBytes"`
+
+	Started      time.Time `json:"started"`
+	PhaseStarted time.Time `json:"phaseStarted"`
+	// Updated is the time of the last progress, i.e. the last copied chunk
+	Updated time.Time `json:"updated"`
+	// Stalled is set if there was no progress for progressStallTimeout
+	Stalled bool `json:"stalled"`
+
+	// resumed is the number of bytes that were copied before the phase was
+	// resumed, -1 until the first update. They're left out of the rate.
+	resumed int64
+}
+
+// Ratio returns the copied part of the bytes of the phase, zero for phases
+// without byte progress
+func (p *operationProgress) Ratio() float64 {
+	if p.Total <= 0 {
+		return 0
+	}
+	return float64(p.Done) / float64(p.Total)
+}
+
+// progressTracker tracks the progress of the long-running operations of a
+// driver, so the admin endpoint can tell slow ones from stuck ones. The zero
+// value is usable.
+type progressTracker struct {
+	mu  sync.Mutex
+	ops map[*progressReporter]*operationProgress
+}
+
+// start starts tracking an operation. The returned reporter logs its
+// progress to ll, finish must be called once it's done.
+func (t *progressTracker) start(kind, id string, ll *logrus.Entry) *progressReporter {
+	now := time.Now()
+	r := &progressReporter{
+		t:  t,
+		ll: ll.WithFields(logrus.Fields{"operation": kind, "operation_id": id}),
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ops == nil {
+		t.ops = map[*progressReporter]*operationProgress{}
+	}
+	t.ops[r] = &operationProgress{
+		Kind:    kind,
+		ID:      id,
+		Started: now,
+		Updated: now,
+	}
+	return r
+}
+
+// operations returns the operations in progress, the oldest first
+func (t *progressTracker) operations() []operationProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	ops := make([]operationProgress, 0, len(t.ops))
+	for _, p := range t.ops {
+		op := *p
+		op.Stalled = now.Sub(op.Updated) > progressStallTimeout
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Started.Before(ops[j].Started) })
+	return ops
+}
+
+// progressReporter reports the progress of an operation. A nil reporter
+// reports nothing.
+type progressReporter struct {
+	t  *progressTracker
+	ll *logrus.Entry
+
+	// lastLog is the time the progress was last logged
+	lastLog time.Time
+}
+
+// phase starts the next phase of the operation, total is the number of bytes
+// it copies or zero
+func (r *progressReporter) phase(name string, total int64) {
+	if r == nil {
+		return
+	}
+
+	now := time.Now()
+	r.t.mu.Lock()
+	p := r.t.ops[r]
+	p.Phase = name
+	p.PhaseStarted = now
+	p.Done = 0
+	p.Total = total
+	p.Updated = now
+	p.resumed = -1
+	r.t.mu.Unlock()
+
+	r.lastLog = now
+	r.ll.WithFields(logrus.Fields{
+		"phase":       name,
+		"total_bytes": total,
+	}).Info("operation phase started")
+}
+
+// update sets the bytes of the phase that are copied. The first update of a
+// resumed phase sets the bytes copied before. The progress is logged every
+// progressLogInterval and once the phase is complete.
+func (r *progressReporter) update(done int64) {
+	if r == nil {
+		return
+	}
+
+	now := time.Now()
+	r.t.mu.Lock()
+	p, ok := r.t.ops[r]
+	if !ok {
+		// updated after finish, e.g. by a poller
+		r.t.mu.Unlock()
+		return
+	}
+	if p.resumed < 0 {
+		p.resumed = done
+	}
+	p.Done = done
+	p.Updated = now
+	progress := *p
+	r.t.mu.Unlock()
+
+	if now.Sub(r.lastLog) < progressLogInterval && progress.Done < progress.Total {
+		return
+	}
+	r.lastLog = now
+
+	fields := logrus.Fields{
+		"phase":       progress.Phase,
+		"percent":     int(progress.Ratio() * 100),
+		"done_bytes":  progress.Done,
+		"total_bytes": progress.Total,
+	}
+	if elapsed := now.Sub(progress.PhaseStarted).Seconds(); elapsed > 0 && progress.Done > progress.resumed {
+		rate := float64(progress.Done-progress.resumed) / elapsed
+		remaining := time.Duration(float64(progress.Total-progress.Done) / rate * float64(time.Second))
+		fields["bytes_per_second"] = int64(rate)
+		fields["eta"] = remaining.Round(time.Second).String()
+	}
+	r.ll.WithFields(fields).Info("operation progress")
+}
+
+// finish stops tracking the operation
+func (r *progressReporter) finish() {
+	if r == nil {
+		return
+	}
+
+	r.t.mu.Lock()
+	defer r.t.mu.Unlock()
+	delete(r.t.ops, r)
+}
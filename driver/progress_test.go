@@ -0,0 +1,92 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestProgressTracker(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	ll := log.WithField("test", t.Name())
+
+	var tracker progressTracker
+	backup := tracker.start(operationBackup, "b1", ll)
+	migrate := tracker.start(operationMigrate, "pv-1", ll)
+
+	backup.phase("uploading", 1000)
+	backup.update(200)
+	backup.update(500)
+	migrate.phase("creating target volume", 0)
+
+	ops := tracker.operations()
+	if len(ops) != 2 {
+		t.Fatalf("expected 2 operations, got %+v", ops)
+	}
+	if ops[0].Kind != operationBackup || ops[0].Phase != "uploading" || ops[0].Done != 500 || ops[0].Ratio() != 0.5 {
+		t.Errorf("unexpected backup progress %+v", ops[0])
+	}
+	if ops[1].Kind != operationMigrate || ops[1].Ratio() != 0 {
+		t.Errorf("unexpected migration progress %+v", ops[1])
+	}
+
+	// the resumed bytes aren't copied in this phase
+	if ops[0].resumed != 200 {
+		t.Errorf("expected 200 resumed bytes, got %d", ops[0].resumed)
+	}
+
+	backup.finish()
+	// updates of a poller after the operation finished are ignored
+	backup.update(1000)
+
+	ops = tracker.operations()
+	if len(ops) != 1 || ops[0].ID != "pv-1" {
+		t.Errorf("expected only the migration, got %+v", ops)
+	}
+
+	var nilReporter *progressReporter
+	nilReporter.phase("uploading", 1)
+	nilReporter.update(1)
+	nilReporter.finish()
+}
+
+func TestProgressStalled(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	var tracker progressTracker
+	r := tracker.start(operationRestore, "1", log.WithField("test", t.Name()))
+	r.phase("restoring", 1000)
+
+	tracker.mu.Lock()
+	tracker.ops[r].Updated = time.Now().Add(-progressStallTimeout - time.Minute)
+	tracker.mu.Unlock()
+
+	if ops := tracker.operations(); len(ops) != 1 || !ops[0].Stalled {
+		t.Errorf("expected the restore to be stalled, got %+v", ops)
+	}
+
+	r.update(100)
+	if ops := tracker.operations(); len(ops) != 1 || ops[0].Stalled {
+		t.Errorf("expected the restore to make progress, got %+v", ops)
+	}
+}
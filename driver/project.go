@@ -0,0 +1,153 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// labelMovedFrom is added to volumes moved from another project and contains
+// the id of the original volume
+const labelMovedFrom = "movedFrom"
+
+// MoveProjectParams defines the parameters of MoveVolumeToProject
+type MoveProjectParams struct {
+	ToolParams
+
+	// PersistentVolume is the name of the PV to move
+	PersistentVolume string
+	// TargetToken is the access token of the project the volume is moved to
+	TargetToken string
+	// BackupID optionally selects an existing backup of the volume to
+	// restore, instead of creating a new one. It's required if the cluster
+	// has no nodes in the source project anymore.
+	BackupID string
+}
+
+// MoveVolumeToProject moves the data of the volume of a PV to a new volume in
+// another project, in the same location. Like MigrateVolume, the data is
+// copied via a backup, the PV is replaced by one referencing the new volume
+// and the PVC is recreated. The original volume and PV are retained.
+//
+// The helper pods copying the data run on nodes in the respective project,
+// the source volume must be detached. Afterwards the plugin must be run with
+// the token of the target project.
+func MoveVolumeToProject(p MoveProjectParams) error {
+	src, err := newToolDriver(p.ToolParams)
+	if err != nil {
+		return err
+	}
+
+	dstParams := p.ToolParams
+	dstParams.Token = p.TargetToken
+	dst, err := newToolDriver(dstParams)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	ll := src.log.WithFields(logrus.Fields{
+		"pv_name": p.PersistentVolume,
+		"method":  "move_volume_to_project",
+	})
+
+	pv, pvc, vol, err := src.boundVolume(ctx, p.PersistentVolume)
+	if err != nil {
+		return err
+	}
+
+	ll = ll.WithField("volume_id", vol.ID)
+	progress := src.progress.start(operationMoveProject, pv.Name, ll)
+	defer progress.finish()
+
+	var m *backupManifest
+	if p.BackupID != "" {
+		m, err = src.getBackup(ctx, p.BackupID)
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			return fmt.Errorf("backup %q not found", p.BackupID)
+		}
+		if m.SourceVolumeID != strconv.Itoa(vol.ID) || m.Status != backupStatusReady {
+			return fmt.Errorf("backup %q is not a ready backup of volume %d", p.BackupID, vol.ID)
+		}
+	} else {
+		progress.phase("backing up volume", 0)
+		id := fmt.Sprintf("move-%d-%s", vol.ID, time.Now().UTC().Format("20060102150405"))
+		m, err = src.backupAndWait(ctx, id, vol)
+		if err != nil {
+			return err
+		}
+	}
+
+	existing, _, err := dst.volumes.GetByName(ctx, vol.Name)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("volume %q exists already in the target project", vol.Name)
+	}
+
+	labels := map[string]string{}
+	for k, v := range vol.Labels {
+		labels[k] = v
+	}
+	labels[labelMovedFrom] = strconv.Itoa(vol.ID)
+
+	progress.phase("creating volume in target project", 0)
+	target, err := dst.createToolVolume(ctx, hcloud.VolumeCreateOpts{
+		Name:     vol.Name,
+		Size:     vol.Size,
+		Location: vol.Location,
+		Labels:   labels,
+	})
+	if err != nil {
+		return err
+	}
+
+	ll = ll.WithField("target_volume_id", target.ID)
+
+	progress.phase("restoring backup to target volume", 0)
+	if err := dst.mover.Restore(ctx, target, m); err != nil {
+		return fmt.Errorf("restoring backup %q to volume %d failed: %s", m.ID, target.ID, err)
+	}
+
+	progress.phase("replacing persistent volume", 0)
+	newPV, err := dst.replaceVolume(pv, pvc, fmt.Sprintf("%s-%d", pv.Name, target.ID), func(pv *corev1.PersistentVolume) {
+		pv.Spec.CSI.VolumeHandle = strconv.Itoa(target.ID)
+	})
+	if err != nil {
+		return err
+	}
+
+	if p.BackupID == "" {
+		if err := src.deleteBackup(ctx, m.ID); err != nil {
+			ll.WithError(err).Warn("could not delete temporary backup")
+		}
+	}
+
+	ll.WithField("new_pv_name", newPV.Name).Info("volume moved, the original volume and persistent volume are retained")
+	return nil
+}
@@ -0,0 +1,241 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	drivererrors "github.com/apricote/hcloud-csi-driver/driver/errors"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// paramStorageClass is the StorageClass parameter that identifies the
+	// volumes provisioned by the class. It's stored as a label on the volume.
+	paramStorageClass = "storageClass"
+
+	// paramMaxVolumes is the StorageClass parameter that limits the number of
+	// volumes owned by the class (as identified by paramStorageClass).
+	paramMaxVolumes = "maxVolumes"
+
+	// paramMaxVolumesPerNamespace is the StorageClass parameter that limits
+	// the number of volumes a single namespace may own. It requires the
+	// external-provisioner to pass the PVC metadata (--extra-create-metadata).
+	paramMaxVolumesPerNamespace = "maxVolumesPerNamespace"
+
+	// parameters passed through by the external-provisioner if
+	// --extra-create-metadata is enabled
+	paramPVCName      = "csi.storage.k8s.io/pvc/name"
+	paramPVCNamespace = "csi.storage.k8s.io/pvc/namespace"
+
+	// labels added to the volumes to attribute them to their owners
+	labelStorageClass = "storageClass"
+	labelPVCName      = "pvcName"
+	labelPVCNamespace = "pvcNamespace"
+
+	// labelClusterID identifies the volumes of a cluster in projects shared
+	// by several clusters, see NewDriverParams.ClusterID
+	labelClusterID = "clusterID"
+)
+
+var (
+	// labelNameRegexp defines the valid label values and names of label
+	// keys of the hcloud API: at most 63 alphanumerics, '-', '_' and '.',
+	// beginning and ending with an alphanumeric
+	labelNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9_.-]{0,61}[a-zA-Z0-9])?$`)
+
+	// labelPrefixRegexp defines the valid prefixes of label keys, DNS
+	// subdomains
+	labelPrefixRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*$`)
+)
+
+// maxLabelPrefixLength is the maximum length of the prefix of a label key
+const maxLabelPrefixLength = 253
+
+// volumeLabels returns the labels for a new volume created with the given
+// parameters by the cluster with the given id, if any. Values that can't be
+// stored as a label are left out, e.g. PVC names longer than 63 characters.
+// If the volume limits or the autoscaling depend on such a value, it returns
+// INVALID_ARGUMENT naming the parameter instead.
+func volumeLabels(params map[string]string, clusterID string) (map[string]string, error) {
+	labels := map[string]string{
+		"createdBy": createdByHCloud,
+	}
+	if clusterID != "" {
+		labels[labelClusterID] = clusterID
+	}
+
+	perNamespace := params[paramMaxVolumesPerNamespace] != ""
+	type copiedParam struct {
+		param, label string
+		required     bool
+	}
+	copied := []copiedParam{
+		{paramStorageClass, labelStorageClass, perNamespace || params[paramMaxVolumes] != ""},
+		{paramPVCName, labelPVCName, false},
+		{paramPVCNamespace, labelPVCNamespace, perNamespace},
+	}
+	for _, key := range autoscaleLabels {
+		copied = append(copied, copiedParam{key, key, true})
+	}
+
+	for _, c := range copied {
+		v := params[c.param]
+		if v == "" {
+			continue
+		}
+		if err := validateLabel(c.label, v); err != nil {
+			if !c.required {
+				continue
+			}
+			return nil, status.Errorf(codes.InvalidArgument, "parameter %q can't be stored as volume label: %s", c.param, err)
+		}
+		labels[c.label] = v
+	}
+
+	if wipeEnabled(params) {
+		labels[labelWipeOnDelete] = "true"
+	}
+
+	return labels, nil
+}
+
+// validateLabel returns an error if the hcloud API rejects the label. Keys
+// are an optional DNS subdomain prefix followed by a slash and a name, the
+// name and the value are at most 63 alphanumerics, '-', '_' and '.'. The
+// value may be empty.
+func validateLabel(key, value string) error {
+	name := key
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		prefix := key[:i]
+		name = key[i+1:]
+		if len(prefix) > maxLabelPrefixLength || !labelPrefixRegexp.MatchString(prefix) {
+			return fmt.Errorf("prefix of label key %q must be a DNS subdomain of at most %d characters", key, maxLabelPrefixLength)
+		}
+	}
+	if !labelNameRegexp.MatchString(name) {
+		return fmt.Errorf("name of label key %q must be at most 63 alphanumerics, '-', '_' or '.', beginning and ending with an alphanumeric", key)
+	}
+
+	if value != "" && !labelNameRegexp.MatchString(value) {
+		return fmt.Errorf("value %q of label %q must be at most 63 alphanumerics, '-', '_' or '.', beginning and ending with an alphanumeric", value, key)
+	}
+	return nil
+}
+
+// checkQuota checks whether the volume count limits defined by the
+// StorageClass parameters allow creating another volume. Counting is based on
+// the labels of the existing volumes, concurrent requests might therefore
+// exceed the limit slightly.
+func (d *Driver) checkQuota(ctx context.Context, params map[string]string) error {
+	maxVolumes, err := parseLimit(params, paramMaxVolumes)
+	if err != nil {
+		return err
+	}
+
+	maxPerNamespace, err := parseLimit(params, paramMaxVolumesPerNamespace)
+	if err != nil {
+		return err
+	}
+
+	if maxVolumes == 0 && maxPerNamespace == 0 {
+		return nil
+	}
+
+	class := params[paramStorageClass]
+	if class == "" {
+		return status.Errorf(codes.InvalidArgument, "parameter %q is required to enforce volume limits", paramStorageClass)
+	}
+
+	selector := fmt.Sprintf("createdBy=%s,%s=%s", createdByHCloud, labelStorageClass, class)
+
+	if maxVolumes > 0 {
+		count, err := d.countVolumes(ctx, selector)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		if count >= maxVolumes {
+			return drivererrors.Errorf(drivererrors.ErrQuotaExceeded,
+				"storage class %q may own at most %d volumes, limit is reached", class, maxVolumes)
+		}
+	}
+
+	if maxPerNamespace > 0 {
+		namespace := params[paramPVCNamespace]
+		if namespace == "" {
+			d.log.WithField("storage_class", class).
+				Warn("namespace volume limit can not be enforced, PVC metadata is not passed by the provisioner")
+			return nil
+		}
+
+		count, err := d.countVolumes(ctx, fmt.Sprintf("%s,%s=%s", selector, labelPVCNamespace, namespace))
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		if count >= maxPerNamespace {
+			return drivererrors.Errorf(drivererrors.ErrQuotaExceeded,
+				"namespace %q may own at most %d volumes of storage class %q, limit is reached", namespace, maxPerNamespace, class)
+		}
+	}
+
+	return nil
+}
+
+// countVolumes returns the number of volumes matching the label selector.
+// The count is taken from the pagination of a single page with one volume,
+// instead of fetching and decoding all of them.
+func (d *Driver) countVolumes(ctx context.Context, selector string) (int, error) {
+	vols, resp, err := d.volumes.List(ctx, hcloud.VolumeListOpts{
+		ListOpts: hcloud.ListOpts{
+			PerPage:       1,
+			LabelSelector: selector,
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.Meta.Pagination == nil {
+		// without pagination all volumes are returned
+		return len(vols), nil
+	}
+	return resp.Meta.Pagination.TotalEntries, nil
+}
+
+// parseLimit parses the given limit parameter. It returns zero if the
+// parameter is not set.
+func parseLimit(params map[string]string, key string) (int, error) {
+	v, ok := params[key]
+	if !ok {
+		return 0, nil
+	}
+
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 1 {
+		return 0, status.Errorf(codes.InvalidArgument, "parameter %q must be a positive integer, got: %q", key, v)
+	}
+
+	return limit, nil
+}
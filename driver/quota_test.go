@@ -0,0 +1,128 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVolumeLabels(t *testing.T) {
+	cases := []struct {
+		name   string
+		params map[string]string
+		want   map[string]string
+		param  string // named in the INVALID_ARGUMENT error, if any
+	}{
+		{
+			name:   "no parameters",
+			params: map[string]string{},
+			want:   map[string]string{"createdBy": createdByHCloud},
+		},
+		{
+			name: "valid",
+			params: map[string]string{
+				paramStorageClass: "fast-ssd",
+				paramPVCName:      "data.db_0",
+				paramPVCNamespace: "default",
+				labelAutoscaleMax: "100",
+			},
+			want: map[string]string{
+				"createdBy":       createdByHCloud,
+				labelStorageClass: "fast-ssd",
+				labelPVCName:      "data.db_0",
+				labelPVCNamespace: "default",
+				labelAutoscaleMax: "100",
+			},
+		},
+		{
+			name:   "too long",
+			params: map[string]string{paramPVCName: strings.Repeat("a", 64), paramPVCNamespace: "default"},
+			want:   map[string]string{"createdBy": createdByHCloud, labelPVCNamespace: "default"},
+		},
+		{
+			name:   "invalid character",
+			params: map[string]string{paramStorageClass: "fast ssd"},
+			want:   map[string]string{"createdBy": createdByHCloud},
+		},
+		{
+			name:   "invalid character with limit",
+			params: map[string]string{paramStorageClass: "fast ssd", paramMaxVolumes: "10"},
+			param:  paramStorageClass,
+		},
+		{
+			name:   "invalid namespace with namespace limit",
+			params: map[string]string{paramStorageClass: "fast", paramPVCNamespace: "team a", paramMaxVolumesPerNamespace: "10"},
+			param:  paramPVCNamespace,
+		},
+		{
+			name:   "not ending with an alphanumeric",
+			params: map[string]string{labelAutoscaleStep: "10-"},
+			param:  labelAutoscaleStep,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			labels, err := volumeLabels(c.params, "")
+			if c.param != "" {
+				if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), c.param) {
+					t.Errorf("expected INVALID_ARGUMENT naming %q, got %v", c.param, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(labels, c.want) {
+				t.Errorf("expected labels %v, got %v", c.want, labels)
+			}
+		})
+	}
+}
+
+func TestValidateLabel(t *testing.T) {
+	cases := []struct {
+		key, value string
+		valid      bool
+	}{
+		{"pvcName", "data", true},
+		{"pvcName", "", true},
+		{"example.com/team", "storage", true},
+		{"", "data", false},
+		{"-pvcName", "data", false},
+		{strings.Repeat("k", 64), "data", false},
+		{"Example.com/team", "storage", false},
+		{strings.Repeat("a", 254) + "/team", "storage", false},
+		{"pvcName", "data/db", false},
+		{"pvcName", "_data", false},
+	}
+
+	for _, c := range cases {
+		err := validateLabel(c.key, c.value)
+		if c.valid && err != nil {
+			t.Errorf("expected %q=%q to be valid, got %s", c.key, c.value, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("expected %q=%q to be invalid", c.key, c.value)
+		}
+	}
+}
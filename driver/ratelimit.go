@@ -0,0 +1,103 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"sync"
+	"time"
+
+	drivererrors "github.com/apricote/hcloud-csi-driver/driver/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// paramMaxProvisionRate is the StorageClass parameter that limits the number
+// of volumes the class (as identified by paramStorageClass) may provision per
+// minute
+const paramMaxProvisionRate = "maxProvisionRate"
+
+// provisionLimiter limits the provisioning rate per storage class with a token
+// bucket each. A bucket holds up to a minute worth of tokens, so short bursts
+// are allowed. The zero value is ready to use.
+type provisionLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// tokenBucket holds the tokens of a storage class at the time of the last
+// update
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token from the bucket of the class, if it has one. The bucket
+// is refilled with perMinute tokens per minute.
+func (l *provisionLimiter) allow(class string, perMinute int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.buckets == nil {
+		l.buckets = map[string]*tokenBucket{}
+	}
+
+	rate := float64(perMinute)
+	b, ok := l.buckets[class]
+	if !ok {
+		b = &tokenBucket{tokens: rate, last: now}
+		l.buckets[class] = b
+	}
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Minutes() * rate
+		b.last = now
+	}
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// checkProvisionRate checks whether the provisioning rate limit defined by the
+// StorageClass parameters allows creating another volume. The limit protects
+// the API rate limit and volume quota of the project from runaway clients.
+// It's tracked in memory, restarts of the controller reset it.
+func (d *Driver) checkProvisionRate(params map[string]string) error {
+	perMinute, err := parseLimit(params, paramMaxProvisionRate)
+	if err != nil {
+		return err
+	}
+	if perMinute == 0 {
+		return nil
+	}
+
+	class := params[paramStorageClass]
+	if class == "" {
+		return status.Errorf(codes.InvalidArgument, "parameter %q is required to enforce the provisioning rate", paramStorageClass)
+	}
+
+	if !d.provisionLimiter.allow(class, perMinute, time.Now()) {
+		return drivererrors.Errorf(drivererrors.ErrQuotaExceeded,
+			"storage class %q may provision at most %d volumes per minute, rate is exceeded", class, perMinute)
+	}
+	return nil
+}
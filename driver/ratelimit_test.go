@@ -0,0 +1,61 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProvisionLimiter(t *testing.T) {
+	var l provisionLimiter
+	now := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	// a full bucket allows a burst of one minute worth of volumes
+	for i := 0; i < 3; i++ {
+		if !l.allow("fast", 3, now) {
+			t.Fatalf("volume %d of the burst was not allowed", i)
+		}
+	}
+	if l.allow("fast", 3, now) {
+		t.Error("volume exceeding the burst was allowed")
+	}
+
+	// other classes have their own bucket
+	if !l.allow("slow", 1, now) {
+		t.Error("volume of another class was not allowed")
+	}
+
+	// a token is refilled every 20s
+	if l.allow("fast", 3, now.Add(19*time.Second)) {
+		t.Error("volume was allowed before a token was refilled")
+	}
+	if !l.allow("fast", 3, now.Add(20*time.Second)) {
+		t.Error("volume was not allowed after a token was refilled")
+	}
+
+	// the bucket doesn't hold more than a minute worth of tokens
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !l.allow("fast", 3, later) {
+			t.Fatalf("volume %d after an hour was not allowed", i)
+		}
+	}
+	if l.allow("fast", 3, later) {
+		t.Error("bucket held more than a minute worth of tokens")
+	}
+}
@@ -0,0 +1,367 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+// The tests in this file replay what the kubelet does after it or the node
+// restarts. The kubelet repeats NodeStageVolume and NodePublishVolume for all
+// pods on the node, so the calls must find what's left of the mounts and
+// restore the rest.
+
+// testNode is a node for the reboot tests. The formatted devices survive
+// restarts of the plugin and reboots, the mounts only survive restarts of
+// the plugin and the kubelet.
+type testNode struct {
+	t       *testing.T
+	dir     string
+	mounter *fakeMounter
+	volumes *fakeVolumes
+	d       *Driver
+
+	// formats and mounts count the calls of the mounter
+	formats, mounts int
+}
+
+// countingMounter counts the formats and mounts of the node
+type countingMounter struct {
+	*fakeMounter
+	node *testNode
+}
+
+func (c *countingMounter) Format(ctx context.Context, source string, fsType string, options ...string) error {
+	c.node.formats++
+	return c.fakeMounter.Format(ctx, source, fsType, options...)
+}
+
+func (c *countingMounter) Mount(ctx context.Context, source string, target string, fsType string, options ...string) error {
+	c.node.mounts++
+	return c.fakeMounter.Mount(ctx, source, target, fsType, options...)
+}
+
+// newTestNode returns a node with the volumes 1 to n attached, it must be
+// removed after the test
+func newTestNode(t *testing.T, n int) *testNode {
+	dir, err := ioutil.TempDir("", "hcloud-csi-reboot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &testNode{
+		t:       t,
+		dir:     dir,
+		mounter: &fakeMounter{},
+		volumes: &fakeVolumes{volumes: map[int]*hcloud.Volume{}},
+	}
+	for id := 1; id <= n; id++ {
+		device := filepath.Join(dir, "dev", "volume-"+strconv.Itoa(id))
+		if err := os.MkdirAll(filepath.Dir(device), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(device, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		node.volumes.volumes[id] = &hcloud.Volume{ID: id, Name: "pvc-" + strconv.Itoa(id), LinuxDevice: device}
+	}
+
+	node.restartPlugin()
+	return node
+}
+
+// remove removes the directory of the node
+func (n *testNode) remove() {
+	os.RemoveAll(n.dir)
+}
+
+// restartPlugin replaces the plugin by a new one, which starts without
+// knowing about the volumes of the node
+func (n *testNode) restartPlugin() {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	n.d = &Driver{
+		volumes: n.volumes,
+		mounter: &countingMounter{fakeMounter: n.mounter, node: n},
+		log:     log.WithField("test_enabled", true),
+	}
+
+	journal, err := newNodeJournal(n.d, filepath.Join(n.dir, "journal"))
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	n.d.journal = journal
+	if err := n.d.recoverJournal(context.Background()); err != nil {
+		n.t.Fatal(err)
+	}
+}
+
+// reboot loses all mounts and restarts the plugin. The volumes stay
+// attached to the server.
+func (n *testNode) reboot() {
+	n.mounter.mu.Lock()
+	n.mounter.mounts = map[string]string{}
+	n.mounter.mu.Unlock()
+
+	n.restartPlugin()
+}
+
+// unmount removes a mount outside of the plugin
+func (n *testNode) unmount(target string) {
+	if err := n.mounter.Unmount(context.Background(), target); err != nil {
+		n.t.Fatal(err)
+	}
+}
+
+func (n *testNode) stagingPath(volumeID int) string {
+	return filepath.Join(n.dir, "plugins", "pv", strconv.Itoa(volumeID), "globalmount")
+}
+
+func (n *testNode) targetPath(volumeID int, pod string) string {
+	return filepath.Join(n.dir, "pods", pod, "volumes", strconv.Itoa(volumeID), "mount")
+}
+
+var testNodeCapability = &csi.VolumeCapability{
+	AccessType: &csi.VolumeCapability_Mount{
+		Mount: &csi.VolumeCapability_MountVolume{},
+	},
+	AccessMode: &csi.VolumeCapability_AccessMode{
+		Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	},
+}
+
+func (n *testNode) stage(volumeID int) {
+	_, err := n.d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          strconv.Itoa(volumeID),
+		StagingTargetPath: n.stagingPath(volumeID),
+		VolumeCapability:  testNodeCapability,
+	})
+	if err != nil {
+		n.t.Fatalf("staging volume %d: %s", volumeID, err)
+	}
+}
+
+func (n *testNode) publish(volumeID int, pod string) {
+	_, err := n.d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          strconv.Itoa(volumeID),
+		StagingTargetPath: n.stagingPath(volumeID),
+		TargetPath:        n.targetPath(volumeID, pod),
+		VolumeCapability:  testNodeCapability,
+	})
+	if err != nil {
+		n.t.Fatalf("publishing volume %d to pod %s: %s", volumeID, pod, err)
+	}
+}
+
+func (n *testNode) unpublish(volumeID int, pod string) {
+	_, err := n.d.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   strconv.Itoa(volumeID),
+		TargetPath: n.targetPath(volumeID, pod),
+	})
+	if err != nil {
+		n.t.Fatalf("unpublishing volume %d from pod %s: %s", volumeID, pod, err)
+	}
+}
+
+func (n *testNode) unstage(volumeID int) {
+	_, err := n.d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          strconv.Itoa(volumeID),
+		StagingTargetPath: n.stagingPath(volumeID),
+	})
+	if err != nil {
+		n.t.Fatalf("unstaging volume %d: %s", volumeID, err)
+	}
+}
+
+// expectMounted fails the test unless the volume is staged and published to
+// the pods
+func (n *testNode) expectMounted(volumeID int, pods ...string) {
+	n.mounter.mu.Lock()
+	defer n.mounter.mu.Unlock()
+
+	staging := n.stagingPath(volumeID)
+	if device := n.mounter.mounts[staging]; device != n.volumes.volumes[volumeID].LinuxDevice {
+		n.t.Errorf("expected volume %d to be staged, got %q mounted to %s", volumeID, device, staging)
+	}
+	for _, pod := range pods {
+		target := n.targetPath(volumeID, pod)
+		if source := n.mounter.mounts[target]; source != staging {
+			n.t.Errorf("expected volume %d to be published to pod %s, got %q mounted to %s", volumeID, pod, source, target)
+		}
+	}
+}
+
+// expectCalls fails the test unless the mounter formatted and mounted as
+// often as expected since the last call
+func (n *testNode) expectCalls(formats, mounts int) {
+	if n.formats != formats || n.mounts != mounts {
+		n.t.Errorf("expected %d formats and %d mounts, got %d and %d", formats, mounts, n.formats, n.mounts)
+	}
+	n.formats, n.mounts = 0, 0
+}
+
+// setUp stages the volumes 1 and 2, publishes volume 1 to the pods a and b
+// and volume 2 to pod c
+func (n *testNode) setUp() {
+	n.stage(1)
+	n.publish(1, "a")
+	n.publish(1, "b")
+	n.stage(2)
+	n.publish(2, "c")
+	n.expectCalls(2, 5)
+}
+
+// replay repeats the calls of the kubelet for the pods of setUp
+func (n *testNode) replay() {
+	n.stage(1)
+	n.publish(1, "a")
+	n.publish(1, "b")
+	n.stage(2)
+	n.publish(2, "c")
+}
+
+func TestKubeletRestart(t *testing.T) {
+	n := newTestNode(t, 2)
+	defer n.remove()
+	n.setUp()
+
+	n.replay()
+	n.expectCalls(0, 0)
+	n.expectMounted(1, "a", "b")
+	n.expectMounted(2, "c")
+}
+
+func TestPluginRestart(t *testing.T) {
+	n := newTestNode(t, 2)
+	defer n.remove()
+	n.setUp()
+
+	// the new plugin finds the mounts
+	n.restartPlugin()
+	n.replay()
+	n.expectCalls(0, 0)
+	n.expectMounted(1, "a", "b")
+	n.expectMounted(2, "c")
+}
+
+func TestNodeReboot(t *testing.T) {
+	n := newTestNode(t, 2)
+	defer n.remove()
+	n.setUp()
+
+	// the volumes are attached and formatted, only the mounts are restored
+	n.reboot()
+	n.replay()
+	n.expectCalls(0, 5)
+	n.expectMounted(1, "a", "b")
+	n.expectMounted(2, "c")
+
+	// the second replay finds everything mounted
+	n.replay()
+	n.expectCalls(0, 0)
+}
+
+func TestNodeRebootPodsGone(t *testing.T) {
+	n := newTestNode(t, 2)
+	defer n.remove()
+	n.setUp()
+
+	// the pods were deleted while the node was down, the kubelet cleans up
+	// the mounts that don't exist anymore
+	n.reboot()
+	n.unpublish(1, "a")
+	n.unpublish(1, "b")
+	n.unstage(1)
+
+	// the other pod comes up again
+	n.stage(2)
+	n.publish(2, "c")
+	n.unpublish(2, "c")
+	n.unstage(2)
+
+	n.mounter.mu.Lock()
+	defer n.mounter.mu.Unlock()
+	if len(n.mounter.mounts) != 0 {
+		t.Errorf("expected no mounts left, got %v", n.mounter.mounts)
+	}
+}
+
+func TestPublishLost(t *testing.T) {
+	n := newTestNode(t, 2)
+	defer n.remove()
+	n.setUp()
+
+	// the mounts of a pod are gone while the volume stays staged, the
+	// plugin must not trust its memory of the publish
+	n.unmount(n.targetPath(1, "a"))
+	n.replay()
+	n.expectCalls(0, 1)
+	n.expectMounted(1, "a", "b")
+	n.expectMounted(2, "c")
+}
+
+func TestStageLost(t *testing.T) {
+	n := newTestNode(t, 2)
+	defer n.remove()
+	n.setUp()
+
+	// all mounts of a volume are gone while the plugin keeps running, i.e.
+	// they were unmounted on the host
+	n.unmount(n.targetPath(2, "c"))
+	n.unmount(n.stagingPath(2))
+	n.replay()
+	n.expectCalls(0, 2)
+	n.expectMounted(1, "a", "b")
+	n.expectMounted(2, "c")
+}
+
+func TestNodeRebootDuringStage(t *testing.T) {
+	n := newTestNode(t, 1)
+	defer n.remove()
+
+	// the node goes down while volume 1 is staged, the journal entry is
+	// left behind
+	if _, err := n.d.journal.begin(journalStage, "1", n.stagingPath(1)); err != nil {
+		t.Fatal(err)
+	}
+	n.reboot()
+
+	entries, err := n.d.journal.entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected the interrupted stage to be recovered, got %v", entries)
+	}
+	if _, err := os.Stat(n.stagingPath(1)); !os.IsNotExist(err) {
+		t.Errorf("expected the staging path created by the interrupted stage to be removed, got %v", err)
+	}
+
+	n.stage(1)
+	n.publish(1, "a")
+	n.expectCalls(1, 2)
+	n.expectMounted(1, "a")
+}
@@ -0,0 +1,333 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	storagev1beta1 "k8s.io/api/storage/v1beta1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// nodeRecoveryInterval defines how often stale attachments are looked for
+const nodeRecoveryInterval = time.Minute
+
+// nodeRecoveryPages is the number of volume pages scanned per run. Large
+// projects are scanned over several runs, continuing where the last run
+// stopped, instead of listing all volumes every minute.
+const nodeRecoveryPages = 4
+
+// nodeRecovery cleans up the attachments left behind by replaced or rebuilt
+// nodes, so pods using the volumes can be scheduled again. Only the volumes
+// labeled with the id of the cluster are scanned, other clusters may share
+// the project:
+//
+//   - volumes attached to a server that doesn't exist anymore are detached
+//   - volumes of a PV of the cluster attached to a server without a node (the
+//     node was deleted) are detached
+//   - volumes attached to a server while they're only needed on other nodes
+//     (the node was recreated and the pods moved on) are detached
+//   - VolumeAttachments of deleted nodes are removed, the external-attacher
+//     can't detach them anymore
+type nodeRecovery struct {
+	d   *Driver
+	log *logrus.Entry
+
+	// page is the volume page the next run starts at
+	page int
+}
+
+// newNodeRecovery returns a new nodeRecovery for the given driver
+func newNodeRecovery(d *Driver) *nodeRecovery {
+	return &nodeRecovery{
+		d:   d,
+		log: d.log.WithField("component", "node_recovery"),
+	}
+}
+
+// run recovers stale attachments until stopCh is closed
+func (r *nodeRecovery) run(stopCh <-chan struct{}) {
+	r.log.Info("node recovery started")
+
+	for {
+		timer := time.NewTimer(jittered(nodeRecoveryInterval))
+		select {
+		case <-stopCh:
+			timer.Stop()
+			r.log.Info("node recovery stopped")
+			return
+		case <-timer.C:
+			if err := r.recover(context.Background()); err != nil {
+				r.log.WithError(err).Error("could not recover stale attachments")
+			}
+		}
+	}
+}
+
+// jittered returns the interval plus up to 20% jitter, so the loops of
+// several clusters in a project don't hit the API at the same time
+func jittered(interval time.Duration) time.Duration {
+	return interval + time.Duration(rand.Int63n(int64(interval/5)+1))
+}
+
+// recover detaches stale volumes and removes stale VolumeAttachments. Each
+// call scans the next nodeRecoveryPages pages of volumes.
+func (r *nodeRecovery) recover(ctx context.Context) error {
+	nodeList, err := r.d.kubeClient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list nodes: %s", err)
+	}
+
+	nodes := map[string]bool{}
+	for _, node := range nodeList.Items {
+		nodes[node.Name] = true
+	}
+
+	attachments, wanted, owned, err := r.d.volumeAttachments()
+	if err != nil {
+		return err
+	}
+
+	// pool volumes are attached while they're formatted, only the attached
+	// volumes are kept
+	var vols []*hcloud.Volume
+	selector := fmt.Sprintf("createdBy=%s,%s=%s,!%s", createdByHCloud, labelClusterID, r.d.clusterID, labelPool)
+	r.page, err = r.d.volumePages(ctx, selector, r.page, nodeRecoveryPages, func(vol *hcloud.Volume) {
+		if vol.Server != nil {
+			vols = append(vols, vol)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("could not list volumes: %s", err)
+	}
+
+	servers := map[int]*hcloud.Server{}
+	for _, vol := range vols {
+		if r.d.volumeBusy(vol.ID) {
+			continue
+		}
+
+		server, ok := servers[vol.Server.ID]
+		if !ok {
+			server, _, err = r.d.servers.GetByID(ctx, vol.Server.ID)
+			if err != nil {
+				return err
+			}
+			servers[vol.Server.ID] = server
+		}
+
+		// node names are the names of the servers, see NewDriver. A server
+		// without a node may be a node of another cluster, the volume is
+		// only detached if a PV of this cluster references it.
+		var reason string
+		switch {
+		case server == nil:
+			reason = "server doesn't exist anymore"
+		case !nodes[server.Name] && owned[vol.ID]:
+			reason = "node doesn't exist anymore"
+		case len(wanted[vol.ID]) > 0 && !wanted[vol.ID][server.Name]:
+			reason = "volume is only needed on other nodes"
+		default:
+			continue
+		}
+
+		if err := r.detach(ctx, vol, reason); err != nil {
+			r.log.WithError(err).WithField("volume_id", vol.ID).Error("could not detach stale volume")
+		}
+	}
+
+	for _, va := range attachments {
+		if nodes[va.Spec.NodeName] {
+			continue
+		}
+
+		if err := r.removeAttachment(va); err != nil {
+			r.log.WithError(err).WithField("volume_attachment", va.Name).Error("could not remove stale volume attachment")
+		}
+	}
+
+	return nil
+}
+
+// volumeAttachments returns the VolumeAttachments of the driver, the names
+// of the nodes each volume should be attached to and the ids of the volumes
+// referenced by a PV of the cluster
+func (d *Driver) volumeAttachments() ([]storagev1beta1.VolumeAttachment, map[int]map[string]bool, map[int]bool, error) {
+	vaList, err := d.kubeClient.StorageV1beta1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("could not list volume attachments: %s", err)
+	}
+
+	pvList, err := d.kubeClient.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("could not list persistent volumes: %s", err)
+	}
+
+	handles := map[string]string{}
+	owned := map[int]bool{}
+	for _, pv := range pvList.Items {
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == driverName {
+			handles[pv.Name] = pv.Spec.CSI.VolumeHandle
+			if id, err := strconv.Atoi(pv.Spec.CSI.VolumeHandle); err == nil {
+				owned[id] = true
+			}
+		}
+	}
+
+	var attachments []storagev1beta1.VolumeAttachment
+	wanted := map[int]map[string]bool{}
+	for _, va := range vaList.Items {
+		if va.Spec.Attacher != driverName {
+			continue
+		}
+		attachments = append(attachments, va)
+
+		// attachments being deleted don't need the volume anymore
+		if va.Spec.Source.PersistentVolumeName == nil || va.DeletionTimestamp != nil {
+			continue
+		}
+
+		volumeID, err := strconv.Atoi(handles[*va.Spec.Source.PersistentVolumeName])
+		if err != nil {
+			continue
+		}
+
+		if wanted[volumeID] == nil {
+			wanted[volumeID] = map[string]bool{}
+		}
+		wanted[volumeID][va.Spec.NodeName] = true
+	}
+
+	return attachments, wanted, owned, nil
+}
+
+// volumeBusy returns true if the driver attached the volume itself to copy or
+// wipe its data
+func (d *Driver) volumeBusy(volumeID int) bool {
+	if d.volumeBackupRunning(strconv.Itoa(volumeID)) {
+		return true
+	}
+
+	d.wipeMu.Lock()
+	wiping := d.wipeJobs[volumeID]
+	d.wipeMu.Unlock()
+	if wiping {
+		return true
+	}
+
+	d.populateMu.Lock()
+	defer d.populateMu.Unlock()
+	return d.populateJobs[volumeID]
+}
+
+// detach detaches the stale volume
+func (r *nodeRecovery) detach(ctx context.Context, vol *hcloud.Volume, reason string) error {
+	r.log.WithFields(logrus.Fields{
+		"volume_id": vol.ID,
+		"server_id": vol.Server.ID,
+		"reason":    reason,
+	}).Warn("detaching stale volume")
+
+	r.d.attachCache.forget(vol.ID)
+	action, _, err := r.d.volumes.Detach(ctx, vol)
+	if err != nil {
+		return err
+	}
+
+	return r.d.waitAction(ctx, vol.ID, action.ID)
+}
+
+// removeAttachment removes the finalizers of the stale VolumeAttachment and
+// deletes it
+func (r *nodeRecovery) removeAttachment(va storagev1beta1.VolumeAttachment) error {
+	r.log.WithFields(logrus.Fields{
+		"volume_attachment": va.Name,
+		"node_name":         va.Spec.NodeName,
+	}).Warn("removing stale volume attachment")
+
+	vas := r.d.kubeClient.StorageV1beta1().VolumeAttachments()
+	if len(va.Finalizers) > 0 {
+		va.Finalizers = nil
+		if _, err := vas.Update(&va); err != nil {
+			return err
+		}
+	}
+
+	if err := vas.Delete(va.Name, &metav1.DeleteOptions{}); err != nil && !kubeerrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// detachStaleAttachment detaches the volume from the server it's attached to,
+// if Kubernetes doesn't need it there anymore: no VolumeAttachment for the
+// volume exists for the node of the server. It's used by
+// ControllerPublishVolume, so volumes left attached to old nodes don't block
+// the pods on their new nodes. Errors are gRPC status errors.
+func (d *Driver) detachStaleAttachment(ctx context.Context, vol *hcloud.Volume) error {
+	ll := d.log.WithFields(logrus.Fields{
+		"volume_id": vol.ID,
+		"server_id": vol.Server.ID,
+		"method":    "detach_stale_attachment",
+	})
+
+	if vol.Labels[labelPool] != "" || d.volumeBusy(vol.ID) {
+		return status.Errorf(codes.FailedPrecondition,
+			"volume is attached to server(%d) by the plugin itself to copy its data, retry later", vol.Server.ID)
+	}
+
+	server, _, err := d.servers.GetByID(ctx, vol.Server.ID)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	if server != nil {
+		_, wanted, _, err := d.volumeAttachments()
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		// node names are the names of the servers, see NewDriver
+		if wanted[vol.ID][server.Name] {
+			return status.Errorf(codes.FailedPrecondition,
+				"volume is attached to server(%d), which is still used by node %q", server.ID, server.Name)
+		}
+	}
+
+	ll.Warn("detaching volume from stale attachment")
+	d.attachCache.forget(vol.ID)
+	action, _, err := d.volumes.Detach(ctx, vol)
+	if err != nil {
+		return status.Errorf(codes.Aborted, "volume %d could not be detached from server %d: %s", vol.ID, vol.Server.ID, err)
+	}
+
+	if err := d.waitAction(ctx, vol.ID, action.ID); err != nil {
+		return err
+	}
+
+	vol.Server = nil
+	return nil
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	storagev1beta1 "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// fakeKube serves the lists of nodes, PVs and VolumeAttachments the node
+// recovery reads
+type fakeKube struct {
+	nodes       []string
+	pvs         map[string]string // volume handles by PV name
+	attachments []storagev1beta1.VolumeAttachment
+}
+
+func (f *fakeKube) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var resp interface{}
+	switch r.URL.Path {
+	case "/api/v1/nodes":
+		list := &corev1.NodeList{TypeMeta: metav1.TypeMeta{Kind: "NodeList", APIVersion: "v1"}}
+		for _, name := range f.nodes {
+			list.Items = append(list.Items, corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}})
+		}
+		resp = list
+	case "/api/v1/persistentvolumes":
+		list := &corev1.PersistentVolumeList{TypeMeta: metav1.TypeMeta{Kind: "PersistentVolumeList", APIVersion: "v1"}}
+		for name, handle := range f.pvs {
+			pv := corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: name}}
+			pv.Spec.CSI = &corev1.CSIPersistentVolumeSource{Driver: driverName, VolumeHandle: handle}
+			list.Items = append(list.Items, pv)
+		}
+		resp = list
+	case "/apis/storage.k8s.io/v1beta1/volumeattachments":
+		resp = &storagev1beta1.VolumeAttachmentList{
+			TypeMeta: metav1.TypeMeta{Kind: "VolumeAttachmentList", APIVersion: "storage.k8s.io/v1beta1"},
+			Items:    f.attachments,
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func TestNodeRecovery(t *testing.T) {
+	attached := func(id, server int, cluster string) *schema.Volume {
+		return &schema.Volume{
+			ID:     id,
+			Size:   10,
+			Server: &server,
+			Labels: map[string]string{"createdBy": createdByHCloud, labelClusterID: cluster},
+		}
+	}
+
+	// server 1 is a node of the cluster, server 2 a node of another cluster
+	// and server 3 was deleted
+	api := &fakeAPI{
+		t: t,
+		volumes: map[int]*schema.Volume{
+			10: attached(10, 2, "a"), // PV of the cluster, its node was deleted
+			11: attached(11, 2, "a"), // no PV of the cluster
+			12: attached(12, 2, "b"), // volume of the other cluster
+			13: attached(13, 3, "b"),
+			14: attached(14, 3, "a"),
+			15: attached(15, 1, "a"),
+		},
+		servers: map[int]*schema.Server{
+			1: {ID: 1, Name: "node-1"},
+			2: {ID: 2, Name: "foreign-node"},
+		},
+	}
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	kube := httptest.NewServer(&fakeKube{
+		nodes: []string{"node-1"},
+		pvs:   map[string]string{"pvc-10": "10", "pvc-15": "15"},
+	})
+	defer kube.Close()
+
+	kubeClient, err := kubernetes.NewForConfig(&rest.Config{Host: kube.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	client := hcloud.NewClient(hcloud.WithEndpoint(ts.URL))
+	d := &Driver{
+		clusterID:  "a",
+		volumes:    &client.Volume,
+		servers:    &client.Server,
+		actions:    &actionClient{client: client},
+		kubeClient: kubeClient,
+		log:        log.WithField("test", t.Name()),
+	}
+
+	if err := newNodeRecovery(d).recover(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[int]bool{10: false, 11: true, 12: true, 13: true, 14: false, 15: true}
+	for id, stillAttached := range want {
+		if got := api.volumes[id].Server != nil; got != stillAttached {
+			t.Errorf("volume %d: expected attached to be %t, got %t", id, stillAttached, got)
+		}
+	}
+}
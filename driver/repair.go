@@ -0,0 +1,301 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// labelRepairedFrom is added to volumes a PV was repaired with and contains
+// the id of the volume the PV referenced before
+const labelRepairedFrom = "repairedFrom"
+
+// RepairParams defines the parameters of RepairVolume
+type RepairParams struct {
+	ToolParams
+
+	// PersistentVolume is the name of the PV whose volume was recreated
+	PersistentVolume string
+	// Volume is the id or name of the recreated volume. If it's empty, the
+	// volume is looked up by its labels.
+	Volume string
+	// CheckFilesystem checks in a data mover helper pod that the volume
+	// contains the filesystem of the PV
+	CheckFilesystem bool
+	// DryRun only validates that the PV can be repaired
+	DryRun bool
+}
+
+// RepairVolume binds the PVC of a PV whose volume was deleted to the volume
+// it was recreated as, e.g. restored from a backup outside of the plugin.
+// The recreated volume has a new id, and the volume handle of PVs can't be
+// changed, so the PV is replaced by one referencing the new volume and the
+// PVC is recreated. The volume is labeled like the volumes created by this
+// driver. The original PV is retained and can be deleted afterwards.
+//
+// Unless the volume is given, a volume labeled as restored from the old
+// volume (restoredFrom, see RestoreVolume) or with the name and namespace
+// of the PVC is used. The volume must be detached, at least as large as the
+// PV and not be referenced by another PV. All pods using the PVC must be
+// stopped before.
+func RepairVolume(p RepairParams) error {
+	if p.CheckFilesystem && p.DataMoverImage == "" {
+		return fmt.Errorf("a data mover image is required to check the filesystem")
+	}
+
+	d, err := newAPIToolDriver(p.ToolParams)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	ll := d.log.WithFields(logrus.Fields{
+		"pv_name": p.PersistentVolume,
+		"dry_run": p.DryRun,
+		"method":  "repair_volume",
+	})
+
+	pv, err := d.kubeClient.CoreV1().PersistentVolumes().Get(p.PersistentVolume, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("could not get persistent volume %q: %s", p.PersistentVolume, err)
+	}
+	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName {
+		return fmt.Errorf("persistent volume %q is not provisioned by %s", pv.Name, driverName)
+	}
+
+	oldID := pv.Spec.CSI.VolumeHandle
+	if id, err := strconv.Atoi(oldID); err == nil {
+		old, _, err := d.volumes.GetByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		if old != nil {
+			return fmt.Errorf("volume %d of persistent volume %q still exists, there's nothing to repair", old.ID, pv.Name)
+		}
+	}
+
+	ref := pv.Spec.ClaimRef
+	if ref == nil {
+		return fmt.Errorf("persistent volume %q has no claim", pv.Name)
+	}
+	pvc, err := d.kubeClient.CoreV1().PersistentVolumeClaims(ref.Namespace).Get(ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("could not get persistent volume claim %s/%s: %s", ref.Namespace, ref.Name, err)
+	}
+
+	handle := p.Volume
+	if handle == "" {
+		vol, err := d.recreatedVolume(ctx, oldID, pvc)
+		if err != nil {
+			return err
+		}
+		handle = strconv.Itoa(vol.ID)
+	}
+
+	// the volume must be attachable like an adopted one
+	vol, err := d.adoptableVolume(ctx, handle)
+	if err != nil {
+		return err
+	}
+
+	ll = ll.WithFields(logrus.Fields{
+		"old_volume_id": oldID,
+		"volume_id":     vol.ID,
+	})
+
+	if err := d.checkRepairVolume(pv, vol); err != nil {
+		return err
+	}
+
+	fsType := pv.Spec.CSI.FSType
+	if fsType == "" {
+		fsType = "ext4"
+	}
+	if p.CheckFilesystem {
+		ll.Info("checking filesystem of volume")
+		found, err := newToolPodMover(d, p.ToolParams).run(ctx, vol, MoverProbe)
+		if err != nil {
+			return fmt.Errorf("could not check filesystem of volume %d: %s", vol.ID, err)
+		}
+		found = strings.TrimSpace(found)
+		if found == "" {
+			return fmt.Errorf("volume %d has no filesystem, persistent volume %q expects %s", vol.ID, pv.Name, fsType)
+		}
+		if found != fsType {
+			return fmt.Errorf("volume %d contains %q, persistent volume %q expects %s", vol.ID, found, pv.Name, fsType)
+		}
+	}
+
+	var datacenters []string
+	var zone string
+	if location := pvLocation(pv); location != "" && location != vol.Location.Name {
+		datacenters, err = d.locationDatacenters(ctx, vol.Location.Name)
+		if err != nil {
+			return err
+		}
+		zone, err = d.networkZone(ctx, vol.Location.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.DryRun {
+		ll.Info("persistent volume can be repaired")
+		return nil
+	}
+
+	labels := map[string]string{}
+	for k, v := range vol.Labels {
+		labels[k] = v
+	}
+	labels["createdBy"] = createdByHCloud
+	labels[labelPVCName] = pvc.Name
+	labels[labelPVCNamespace] = pvc.Namespace
+	if pv.Spec.StorageClassName != "" {
+		labels[labelStorageClass] = pv.Spec.StorageClassName
+	}
+	labels[labelRepairedFrom] = oldID
+
+	ll.Info("labeling volume")
+	if _, _, err := d.volumes.Update(ctx, vol, hcloud.VolumeUpdateOpts{Labels: labels}); err != nil {
+		return fmt.Errorf("could not label volume %d: %s", vol.ID, err)
+	}
+
+	ll.Info("replacing persistent volume")
+	newPV, err := d.replaceVolume(pv, pvc, fmt.Sprintf("%s-%d", pv.Name, vol.ID), func(newPV *corev1.PersistentVolume) {
+		newPV.Spec.CSI.VolumeHandle = strconv.Itoa(vol.ID)
+
+		// the replaced PV stays marked as lost
+		annotations := map[string]string{}
+		for k, v := range pv.Annotations {
+			if k != annVolumeLost {
+				annotations[k] = v
+			}
+		}
+		newPV.Annotations = annotations
+
+		if datacenters != nil {
+			setLocationAffinity(newPV, vol.Location.Name, zone, datacenters)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	ll.WithField("new_pv_name", newPV.Name).Info("persistent volume repaired, the original persistent volume is retained")
+	return nil
+}
+
+// recreatedVolume returns the volume a deleted volume was recreated as: the
+// volume restored from it or, if there's none, the volume labeled with the
+// name and namespace of its PVC
+func (d *Driver) recreatedVolume(ctx context.Context, oldID string, pvc *corev1.PersistentVolumeClaim) (*hcloud.Volume, error) {
+	selectors := []string{
+		fmt.Sprintf("%s=%s", labelRestoredFrom, oldID),
+		fmt.Sprintf("%s=%s,%s=%s", labelPVCNamespace, pvc.Namespace, labelPVCName, pvc.Name),
+	}
+
+	for _, selector := range selectors {
+		var found []*hcloud.Volume
+		err := d.eachVolume(ctx, selector, func(vol *hcloud.Volume) bool {
+			if strconv.Itoa(vol.ID) != oldID {
+				found = append(found, vol)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		switch len(found) {
+		case 0:
+			continue
+		case 1:
+			return found[0], nil
+		default:
+			var ids []string
+			for _, vol := range found {
+				ids = append(ids, strconv.Itoa(vol.ID))
+			}
+			return nil, fmt.Errorf("volumes %s match %q, select one with --volume", strings.Join(ids, ", "), selector)
+		}
+	}
+
+	return nil, fmt.Errorf("no volume is labeled %s, select one with --volume", strings.Join(selectors, " or "))
+}
+
+// checkRepairVolume returns an error if the PV can't be repaired with the
+// given volume
+func (d *Driver) checkRepairVolume(pv *corev1.PersistentVolume, vol *hcloud.Volume) error {
+	capacity := pv.Spec.Capacity[corev1.ResourceStorage]
+	if int64(vol.Size)*GB < capacity.Value() {
+		return fmt.Errorf("volume %d (%dGB) is smaller than persistent volume %q (%s)", vol.ID, vol.Size, pv.Name, capacity.String())
+	}
+
+	pvs, err := d.kubeClient.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list persistent volumes: %s", err)
+	}
+	for _, other := range pvs.Items {
+		if other.Spec.CSI != nil && other.Spec.CSI.Driver == driverName && other.Spec.CSI.VolumeHandle == strconv.Itoa(vol.ID) {
+			return fmt.Errorf("volume %d is referenced by persistent volume %q already", vol.ID, other.Name)
+		}
+	}
+
+	return nil
+}
+
+// pvLocation returns the location in the node affinity of the PV, or an
+// empty string if it has none
+func pvLocation(pv *corev1.PersistentVolume) string {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return ""
+	}
+
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, req := range term.MatchExpressions {
+			if req.Key == topologyLocation && len(req.Values) > 0 {
+				return req.Values[0]
+			}
+		}
+	}
+	return ""
+}
+
+// probeDevice writes the filesystem type of the device to the result of the
+// data mover helper, or an empty result if it has none
+func probeDevice(ctx context.Context, device string) error {
+	out, err := exec.CommandContext(ctx, "blkid", "-o", "value", "-s", "TYPE", device).Output()
+	if err != nil {
+		// blkid exits with 2 if it couldn't identify the content
+		if exitStatus(err) != 2 {
+			return fmt.Errorf("blkid failed on %s: %s", device, err)
+		}
+	}
+
+	return ioutil.WriteFile(moverResultPath, out, 0644)
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRecreatedVolume(t *testing.T) {
+	// volumes by label selector
+	volumes := map[string][]schema.Volume{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp := struct {
+			schema.VolumeListResponse
+			Meta schema.Meta `json:"meta"`
+		}{}
+		resp.Volumes = volumes[r.URL.Query().Get("label_selector")]
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer ts.Close()
+
+	client := hcloud.NewClient(hcloud.WithEndpoint(ts.URL))
+	d := &Driver{volumes: &client.Volume}
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "default"}}
+
+	if _, err := d.recreatedVolume(context.Background(), "1", pvc); err == nil || !strings.Contains(err.Error(), "--volume") {
+		t.Errorf("expected no volume to be found, got %v", err)
+	}
+
+	// labeled with the PVC only
+	volumes["pvcNamespace=default,pvcName=data"] = []schema.Volume{{ID: 3}}
+	vol, err := d.recreatedVolume(context.Background(), "1", pvc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol.ID != 3 {
+		t.Errorf("expected volume 3, got %d", vol.ID)
+	}
+
+	// the restored volume is preferred
+	volumes["restoredFrom=1"] = []schema.Volume{{ID: 2}}
+	vol, err = d.recreatedVolume(context.Background(), "1", pvc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol.ID != 2 {
+		t.Errorf("expected volume 2, got %d", vol.ID)
+	}
+
+	// ambiguous
+	volumes["restoredFrom=1"] = []schema.Volume{{ID: 2}, {ID: 4}}
+	if _, err := d.recreatedVolume(context.Background(), "1", pvc); err == nil || !strings.Contains(err.Error(), "2, 4") {
+		t.Errorf("expected volumes 2 and 4 to be reported, got %v", err)
+	}
+}
+
+func TestPVLocation(t *testing.T) {
+	pv := &corev1.PersistentVolume{}
+	if got := pvLocation(pv); got != "" {
+		t.Errorf("expected no location, got %q", got)
+	}
+
+	pv.Spec.NodeAffinity = locationAffinity("fsn1")
+	if got := pvLocation(pv); got != "fsn1" {
+		t.Errorf("expected fsn1, got %q", got)
+	}
+}
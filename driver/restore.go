@@ -0,0 +1,241 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/ghodss/yaml"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// labelRestoredFrom is added to volumes restored by RestoreVolume and
+// contains the id of the volume the backup was created from
+const labelRestoredFrom = "restoredFrom"
+
+// RestoreParams defines the parameters of RestoreVolume
+type RestoreParams struct {
+	ToolParams
+
+	// BackupID is the id of the backup (or snapshot) to restore
+	BackupID string
+	// Name is the name of the new volume and PV, defaults to "restore-<backup id>"
+	Name string
+	// Location is the name of the location the volume is created in. It
+	// defaults to the location of the source volume, if it still exists.
+	Location string
+	// Size is the size of the new volume in GB, it defaults to the size of
+	// the backup
+	Size int
+	// FsType is the filesystem the PV is mounted with, defaults to ext4
+	FsType string
+	// StorageClass is the name of the storage class set in the PV
+	StorageClass string
+	// ClaimNamespace and ClaimName optionally pre-bind the PV to a PVC
+	ClaimNamespace string
+	ClaimName      string
+
+	// Output receives the manifest of the PV
+	Output io.Writer
+}
+
+// RestoreVolume restores a backup into a new volume and writes the manifest
+// of a PV referencing it to p.Output. It doesn't need the cluster or volume
+// the backup was created in, only the backup store, so it can recover
+// volumes in a new cluster. The PV isn't created, apply the manifest (along
+// with a PVC) once the driver runs in the cluster.
+//
+// The data is copied by the pod data mover, a ready node running this driver
+// must be in the location of the new volume.
+func RestoreVolume(p RestoreParams) error {
+	d, err := newToolDriver(p.ToolParams)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	ll := d.log.WithFields(logrus.Fields{
+		"backup_id": p.BackupID,
+		"method":    "restore_volume",
+	})
+
+	m, err := d.getBackup(ctx, p.BackupID)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return fmt.Errorf("backup %q not found", p.BackupID)
+	}
+	if m.Status != backupStatusReady {
+		return fmt.Errorf("backup %q is not ready, its status is %q", m.ID, m.Status)
+	}
+
+	location, err := d.restoreLocation(ctx, p.Location, m)
+	if err != nil {
+		return err
+	}
+
+	size := int((m.SizeBytes + GB - 1) / GB)
+	if p.Size != 0 {
+		if p.Size < size {
+			return fmt.Errorf("size %dGB is smaller than the backup (%dGB)", p.Size, size)
+		}
+		size = p.Size
+	}
+
+	name := p.Name
+	if name == "" {
+		name = fmt.Sprintf("restore-%s", m.ID)
+	}
+
+	existing, _, err := d.volumes.GetByName(ctx, name)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("volume %q exists already", name)
+	}
+
+	ll = ll.WithFields(logrus.Fields{
+		"volume_name":     name,
+		"volume_location": location.Name,
+		"size_gb":         size,
+	})
+
+	labels := map[string]string{
+		"createdBy":       createdByHCloud,
+		labelRestoredFrom: m.SourceVolumeID,
+	}
+	if p.ClaimName != "" {
+		labels[labelPVCName] = p.ClaimName
+		labels[labelPVCNamespace] = p.ClaimNamespace
+	}
+
+	ll.Info("creating volume")
+	vol, err := d.createToolVolume(ctx, hcloud.VolumeCreateOpts{
+		Name:     name,
+		Size:     size,
+		Location: location,
+		Labels:   labels,
+	})
+	if err != nil {
+		return err
+	}
+
+	ll = ll.WithField("volume_id", vol.ID)
+
+	ll.Info("restoring backup to volume")
+	if err := d.mover.Restore(ctx, vol, m); err != nil {
+		return fmt.Errorf("restoring backup %q to volume %d failed: %s", m.ID, vol.ID, err)
+	}
+
+	out, err := yaml.Marshal(restoredVolume(p, name, vol))
+	if err != nil {
+		return err
+	}
+	if _, err := p.Output.Write(out); err != nil {
+		return err
+	}
+
+	ll.Info("backup restored")
+	return nil
+}
+
+// restoreLocation returns the location a backup is restored to. Unless it's
+// given, it's the location of the source volume.
+func (d *Driver) restoreLocation(ctx context.Context, name string, m *backupManifest) (*hcloud.Location, error) {
+	if name == "" {
+		id, err := strconv.Atoi(m.SourceVolumeID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source volume id %q in backup %q", m.SourceVolumeID, m.ID)
+		}
+
+		src, _, err := d.volumes.GetByID(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if src == nil {
+			return nil, fmt.Errorf("source volume %d of backup %q doesn't exist anymore, a location must be given", id, m.ID)
+		}
+		return src.Location, nil
+	}
+
+	location, _, err := d.hcloudClient.Location.GetByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if location == nil {
+		return nil, fmt.Errorf("location %q not found", name)
+	}
+	return location, nil
+}
+
+// restoredVolume returns the PV of a restored volume. It's retained when the
+// PVC is deleted, as it's usually restored to recover from a disaster.
+func restoredVolume(p RestoreParams, name string, vol *hcloud.Volume) *corev1.PersistentVolume {
+	fsType := p.FsType
+	if fsType == "" {
+		fsType = "ext4"
+	}
+
+	pv := &corev1.PersistentVolume{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "PersistentVolume",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Annotations: map[string]string{
+				"pv.kubernetes.io/provisioned-by": driverName,
+			},
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			Capacity: corev1.ResourceList{
+				corev1.ResourceStorage: *resource.NewQuantity(int64(vol.Size)*GB, resource.BinarySI),
+			},
+			AccessModes:                   []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+			StorageClassName:              p.StorageClass,
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					Driver:       driverName,
+					VolumeHandle: strconv.Itoa(vol.ID),
+					FSType:       fsType,
+				},
+			},
+			NodeAffinity: locationAffinity(vol.Location.Name),
+		},
+	}
+
+	if p.ClaimName != "" {
+		pv.Spec.ClaimRef = &corev1.ObjectReference{
+			Kind:       "PersistentVolumeClaim",
+			APIVersion: "v1",
+			Namespace:  p.ClaimNamespace,
+			Name:       p.ClaimName,
+		}
+	}
+
+	return pv
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// paramRetainCount and paramRetainAge are the VolumeSnapshotClass
+	// parameters defining the retention of the snapshots, see
+	// backupRetention
+	paramRetainCount = "retainCount"
+	paramRetainAge   = "retainAge"
+
+	// annBackupRetainCount and annBackupRetainAge are the PVC annotations
+	// defining the retention of scheduled backups
+	annBackupRetainCount = "de.apricote.hcloud.csi/backup-retain-count"
+	annBackupRetainAge   = "de.apricote.hcloud.csi/backup-retain-age"
+
+	// backupPruneInterval defines how often backups are pruned
+	backupPruneInterval = time.Hour
+)
+
+// backupRetention defines when a backup is pruned: once MaxCount newer ready
+// backups of the same volume with a retention exist, or once it's older than
+// MaxAge. Backups without a retention are never pruned.
+type backupRetention struct {
+	MaxCount int `json:"maxCount,omitempty"`
+	// MaxAge is a duration like 12h, or a number of days like 30d
+	MaxAge string `json:"maxAge,omitempty"`
+}
+
+// parseRetention parses the given retention count and age. It returns nil if
+// both are empty. Errors are gRPC status errors.
+func parseRetention(count, age string) (*backupRetention, error) {
+	if count == "" && age == "" {
+		return nil, nil
+	}
+
+	r := &backupRetention{MaxAge: age}
+	if count != "" {
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 1 {
+			return nil, status.Errorf(codes.InvalidArgument, "retention count must be a positive number, got %q", count)
+		}
+		r.MaxCount = n
+	}
+
+	if age != "" {
+		if _, err := parseRetentionAge(age); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	return r, nil
+}
+
+// parseRetentionAge parses a duration. In addition to the units of
+// time.ParseDuration, whole days like 30d are supported.
+func parseRetentionAge(age string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if strings.HasSuffix(age, "d") {
+		var days int
+		days, err = strconv.Atoi(strings.TrimSuffix(age, "d"))
+		d = time.Duration(days) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(age)
+	}
+
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("retention age must be a positive duration like 12h or 30d, got %q", age)
+	}
+	return d, nil
+}
+
+// runBackupPruner prunes backups until stopCh is closed
+func (d *Driver) runBackupPruner(stopCh <-chan struct{}) {
+	ll := d.log.WithField("component", "backup_pruner")
+	ll.Info("backup pruner started")
+
+	ticker := time.NewTicker(backupPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.pruneBackups(context.Background(), time.Now()); err != nil {
+			ll.WithError(err).Error("could not prune backups")
+		}
+
+		select {
+		case <-stopCh:
+			ll.Info("backup pruner stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pruneBackups deletes the backups whose retention has expired at the given
+// time. Running uploads are never pruned.
+func (d *Driver) pruneBackups(ctx context.Context, now time.Time) error {
+	manifests, err := d.listBackups(ctx)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(manifests, func(i, j int) bool {
+		return manifests[i].CreatedAt.After(manifests[j].CreatedAt)
+	})
+
+	// number of newer ready backups with a retention per volume
+	newer := map[string]int{}
+	for _, m := range manifests {
+		if m.Retention == nil || m.Status == backupStatusUploading {
+			continue
+		}
+
+		expired := m.Retention.MaxCount > 0 && newer[m.SourceVolumeID] >= m.Retention.MaxCount
+		if m.Retention.MaxAge != "" {
+			maxAge, err := parseRetentionAge(m.Retention.MaxAge)
+			if err != nil {
+				d.log.WithError(err).WithField("backup_id", m.ID).Warn("invalid backup retention")
+				continue
+			}
+			expired = expired || now.Sub(m.CreatedAt) > maxAge
+		}
+
+		if !expired {
+			if m.Status == backupStatusReady {
+				newer[m.SourceVolumeID]++
+			}
+			continue
+		}
+
+		d.log.WithFields(logrus.Fields{
+			"backup_id":        m.ID,
+			"source_volume_id": m.SourceVolumeID,
+			"created_at":       m.CreatedAt,
+			"retention":        m.Retention,
+		}).Info("pruning backup")
+
+		if err := d.deleteBackup(ctx, m.ID); err != nil {
+			return fmt.Errorf("could not delete backup %q: %s", m.ID, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestPruneBackups(t *testing.T) {
+	now := time.Date(2018, 10, 1, 0, 0, 0, 0, time.UTC)
+	keepTwo := &backupRetention{MaxCount: 2}
+	weekly := &backupRetention{MaxAge: "7d"}
+
+	backups := []struct {
+		id        string
+		volume    string
+		age       time.Duration
+		status    string
+		retention *backupRetention
+	}{
+		{"a-1", "1", 1 * time.Hour, backupStatusUploading, keepTwo},
+		{"a-2", "1", 2 * time.Hour, backupStatusFailed, keepTwo},
+		{"a-3", "1", 3 * time.Hour, backupStatusReady, keepTwo},
+		{"a-4", "1", 4 * time.Hour, backupStatusReady, keepTwo},
+		{"a-5", "1", 5 * time.Hour, backupStatusReady, keepTwo},
+		{"a-6", "1", 6 * time.Hour, backupStatusReady, nil},
+		{"b-1", "2", 24 * time.Hour, backupStatusReady, weekly},
+		{"b-2", "2", 8 * 24 * time.Hour, backupStatusReady, weekly},
+	}
+
+	d := &Driver{
+		backups: newMemStore(),
+		log:     logrus.New().WithField("test", t.Name()),
+	}
+
+	for _, b := range backups {
+		m := &backupManifest{
+			ID:             b.id,
+			SourceVolumeID: b.volume,
+			CreatedAt:      now.Add(-b.age),
+			Status:         b.status,
+			ChunkSize:      backupChunkSize,
+			Retention:      b.retention,
+		}
+		if err := d.putBackup(context.Background(), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := d.pruneBackups(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+
+	manifests, err := d.listBackups(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, m := range manifests {
+		got = append(got, m.ID)
+	}
+	sort.Strings(got)
+
+	want := []string{"a-1", "a-2", "a-3", "a-4", "a-6", "b-1"}
+	if len(got) != len(want) {
+		t.Fatalf("remaining backups = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("remaining backups = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestParseRetention(t *testing.T) {
+	for _, tt := range []struct{ count, age string }{{"0", ""}, {"a", ""}, {"", "7"}, {"", "-1h"}, {"", "0d"}} {
+		if _, err := parseRetention(tt.count, tt.age); err == nil {
+			t.Errorf("parseRetention(%q, %q) succeeded, want error", tt.count, tt.age)
+		}
+	}
+
+	r, err := parseRetention("", "")
+	if err != nil || r != nil {
+		t.Errorf("parseRetention of empty values = %v, %v, want nil", r, err)
+	}
+}
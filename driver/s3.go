@@ -0,0 +1,408 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// s3MinPartSize is the minimum size of a part of a multipart upload
+	s3MinPartSize = 16 * MB
+
+	// s3MaxParts is the maximum number of parts of a multipart upload
+	s3MaxParts = 10000
+
+	s3TimeFormat = "20060102T150405Z"
+	s3DateFormat = "20060102"
+)
+
+// s3Store is a minimal client for S3 compatible object storages. It only
+// implements the operations that are needed for backups and uses path-style
+// requests and AWS Signature Version 4 for authentication.
+type s3Store struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+
+	// partSize is the size of a single part of multipart uploads. Objects
+	// that are smaller are uploaded with a single request.
+	partSize int64
+
+	client *http.Client
+}
+
+// newS3Store returns a new s3Store for the given bucket on the endpoint. All
+// keys are stored below the given prefix.
+func newS3Store(endpoint *url.URL, bucket, prefix, region, accessKey, secretKey string) *s3Store {
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return &s3Store{
+		endpoint:  endpoint,
+		bucket:    bucket,
+		prefix:    prefix,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		partSize:  s3MinPartSize,
+		client:    &http.Client{},
+	}
+}
+
+// Put uploads the content of r to the given key. The content is uploaded in
+// parts, so it doesn't have to be known in advance how large it is.
+func (s *s3Store) Put(ctx context.Context, key string, r io.Reader) error {
+	buf := make([]byte, s.partSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// small enough for a single request
+		_, _, err := s.do(ctx, "PUT", key, nil, buf[:n])
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	uploadID, err := s.createMultipartUpload(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	var parts []s3CompletedPart
+	for n > 0 {
+		if len(parts) == s3MaxParts {
+			s.abortMultipartUpload(key, uploadID)
+			return fmt.Errorf("object %q exceeds the maximum of %d parts", key, s3MaxParts)
+		}
+
+		query := url.Values{}
+		query.Set("partNumber", strconv.Itoa(len(parts)+1))
+		query.Set("uploadId", uploadID)
+
+		header, _, err := s.do(ctx, "PUT", key, query, buf[:n])
+		if err != nil {
+			s.abortMultipartUpload(key, uploadID)
+			return err
+		}
+
+		parts = append(parts, s3CompletedPart{
+			PartNumber: len(parts) + 1,
+			ETag:       header.Get("ETag"),
+		})
+
+		n, err = io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			s.abortMultipartUpload(key, uploadID)
+			return err
+		}
+	}
+
+	return s.completeMultipartUpload(ctx, key, uploadID, parts)
+}
+
+// Get returns the content of the object with the given key. It returns
+// errObjectNotFound if the object doesn't exist.
+func (s *s3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := s.newRequest(ctx, "GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errObjectNotFound
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, s3Error(req, resp)
+	}
+
+	return resp.Body, nil
+}
+
+// Delete deletes the object with the given key. Deleting an object that
+// doesn't exist is not an error.
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	_, _, err := s.do(ctx, "DELETE", key, nil, nil)
+	return err
+}
+
+// List returns the names of all common prefixes directly below the given
+// prefix, i.e: the "directories" stored under prefix.
+func (s *s3Store) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("delimiter", "/")
+	query.Set("prefix", s.prefix+prefix)
+
+	for {
+		_, body, err := s.do(ctx, "GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			CommonPrefixes []struct {
+				Prefix string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("couldn't decode list response: %s", err)
+		}
+
+		for _, p := range result.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, s.prefix+prefix), "/")
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return names, nil
+		}
+
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (s *s3Store) createMultipartUpload(ctx context.Context, key string) (string, error) {
+	query := url.Values{}
+	query.Set("uploads", "")
+
+	_, body, err := s.do(ctx, "POST", key, query, nil)
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("couldn't decode multipart upload response: %s", err)
+	}
+
+	return result.UploadID, nil
+}
+
+func (s *s3Store) completeMultipartUpload(ctx context.Context, key, uploadID string, parts []s3CompletedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{
+		Parts: parts,
+	})
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("uploadId", uploadID)
+
+	_, _, err = s.do(ctx, "POST", key, query, body)
+	return err
+}
+
+// abortMultipartUpload aborts the given upload. It's best effort only and
+// not bound to the context of the upload, which might be cancelled already.
+func (s *s3Store) abortMultipartUpload(key, uploadID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	query := url.Values{}
+	query.Set("uploadId", uploadID)
+
+	s.do(ctx, "DELETE", key, query, nil)
+}
+
+// do executes a signed request and returns the header and body of the
+// response if it was successful. Responses are expected to be small.
+func (s *s3Store) do(ctx context.Context, method, key string, query url.Values, body []byte) (http.Header, []byte, error) {
+	req, err := s.newRequest(ctx, method, key, query, body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound && method == "DELETE" {
+		return resp.Header, nil, nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, nil, s3Error(req, resp)
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return resp.Header, respBody, nil
+}
+
+// newRequest returns a new request for the given key, signed with AWS
+// Signature Version 4.
+func (s *s3Store) newRequest(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Request, error) {
+	u := *s.endpoint
+	u.Path = "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + s.prefix + key
+	}
+	u.RawPath = s3EncodePath(u.Path)
+	u.RawQuery = s3EncodeQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = int64(len(body))
+
+	payloadHash := sha256.Sum256(body)
+	s.sign(req, hex.EncodeToString(payloadHash[:]), time.Now().UTC())
+
+	return req, nil
+}
+
+// sign adds the AWS Signature Version 4 authorization header to the request
+func (s *s3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n",
+		req.URL.Host, payloadHash, now.Format(s3TimeFormat))
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EncodePath(req.URL.Path),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{now.Format(s3DateFormat), s.region, "s3", "aws4_request"}, "/")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format(s3TimeFormat),
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), now.Format(s3DateFormat))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3EncodeQuery encodes the query in the canonical form required by the
+// signature, i.e: sorted by key and with spaces encoded as %20.
+func s3EncodeQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3EncodePath encodes every segment of the path
+func s3EncodePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = s3Escape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3Escape escapes all characters except for the unreserved ones
+func s3Escape(s string) string {
+	var buf bytes.Buffer
+	for _, c := range []byte(s) {
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func s3Error(req *http.Request, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("%s %s failed with status %d: %s", req.Method, req.URL.Path, resp.StatusCode, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,326 @@
+//go:build scale
+// +build scale
+
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"runtime"
+	"runtime/metrics"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	scaleVolumes     = flag.Int("scale-volumes", 1000, "Number of volumes driven through a create, attach, detach and delete cycle")
+	scaleConcurrency = flag.Int("scale-concurrency", 100, "Number of cycles run at the same time")
+	scaleServers     = flag.Int("scale-servers", 20, "Number of servers the volumes are attached to")
+	scaleAPILatency  = flag.Duration("scale-api-latency", 20*time.Millisecond, "Latency added to every request of the fake API")
+)
+
+// TestScale drives the controller through many volume lifecycles against a
+// fake API and reports the throughput and lock contention of every call. It's
+// only built with the scale tag, see `make test-scale`.
+func TestScale(t *testing.T) {
+	api := newScaleAPI(*scaleAPILatency)
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	client := hcloud.NewClient(hcloud.WithEndpoint(ts.URL))
+	d := &Driver{
+		nodeID:       "1",
+		location:     "fsn1",
+		hcloudClient: client,
+		volumes:      &client.Volume,
+		servers:      &client.Server,
+		actions:      &actionClient{client: client},
+		log:          log.WithField("test_enabled", true),
+	}
+
+	steps := []struct {
+		name string
+		run  func(ctx context.Context, i int, volumeID string) (string, error)
+	}{
+		{"CreateVolume", func(ctx context.Context, i int, _ string) (string, error) {
+			resp, err := d.CreateVolume(ctx, &csi.CreateVolumeRequest{
+				Name:               fmt.Sprintf("scale-%d", i),
+				VolumeCapabilities: []*csi.VolumeCapability{{AccessMode: supportedAccessMode}},
+			})
+			if err != nil {
+				return "", err
+			}
+			return resp.Volume.Id, nil
+		}},
+		{"ControllerPublishVolume", func(ctx context.Context, i int, volumeID string) (string, error) {
+			_, err := d.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+				VolumeId:         volumeID,
+				NodeId:           strconv.Itoa(1 + i%*scaleServers),
+				VolumeCapability: &csi.VolumeCapability{AccessMode: supportedAccessMode},
+			})
+			return volumeID, err
+		}},
+		{"ControllerUnpublishVolume", func(ctx context.Context, i int, volumeID string) (string, error) {
+			_, err := d.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+				VolumeId: volumeID,
+				NodeId:   strconv.Itoa(1 + i%*scaleServers),
+			})
+			return volumeID, err
+		}},
+		{"DeleteVolume", func(ctx context.Context, _ int, volumeID string) (string, error) {
+			_, err := d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+			return volumeID, err
+		}},
+	}
+
+	latencies := make([][]time.Duration, len(steps))
+	for i := range latencies {
+		latencies[i] = make([]time.Duration, *scaleVolumes)
+	}
+
+	runtime.SetMutexProfileFraction(1)
+	waitBefore := mutexWait()
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	var errs []error
+	sem := make(chan struct{}, *scaleConcurrency)
+	for i := 0; i < *scaleVolumes; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			ctx := context.Background()
+			var volumeID string
+			for s, step := range steps {
+				began := time.Now()
+				id, err := step.run(ctx, i, volumeID)
+				latencies[s][i] = time.Since(began)
+				if err != nil {
+					errMu.Lock()
+					errs = append(errs, fmt.Errorf("%s of volume %d: %s", step.name, i, err))
+					errMu.Unlock()
+					return
+				}
+				volumeID = id
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	// includes the lock of the fake API, which is held only briefly
+	contention := mutexWait() - waitBefore
+
+	for _, err := range errs {
+		t.Error(err)
+	}
+
+	t.Logf("%d volume cycles in %s: %.1f cycles/s, %d API requests, %s waiting for locks",
+		*scaleVolumes, elapsed.Round(time.Millisecond), float64(*scaleVolumes)/elapsed.Seconds(),
+		api.requestCount(), contention.Round(time.Microsecond))
+	for s, step := range steps {
+		avg, p99 := latencyStats(latencies[s])
+		t.Logf("%-26s avg %10s  p99 %10s", step.name, avg.Round(time.Microsecond), p99.Round(time.Microsecond))
+	}
+
+	if n := api.volumeCount(); n != 0 {
+		t.Errorf("%d volumes are left after all cycles", n)
+	}
+}
+
+// mutexWait returns the total time goroutines were blocked on mutexes
+func mutexWait() time.Duration {
+	sample := []metrics.Sample{{Name: "/sync/mutex/wait/total:seconds"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindFloat64 {
+		return 0
+	}
+	return time.Duration(sample[0].Value.Float64() * float64(time.Second))
+}
+
+// latencyStats returns the average and the 99th percentile of the latencies
+func latencyStats(latencies []time.Duration) (time.Duration, time.Duration) {
+	sorted := append([]time.Duration{}, latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var sum time.Duration
+	for _, l := range sorted {
+		sum += l
+	}
+	return sum / time.Duration(len(sorted)), sorted[len(sorted)*99/100]
+}
+
+// scaleAPI is a fake API for TestScale. Unlike fakeAPI, it's safe for
+// concurrent use and implements attaching and detaching. All actions
+// succeed once they're polled.
+type scaleAPI struct {
+	latency time.Duration
+
+	mu       sync.Mutex
+	volumes  map[int]*schema.Volume
+	nextID   int
+	requests int
+}
+
+func newScaleAPI(latency time.Duration) *scaleAPI {
+	return &scaleAPI{latency: latency, volumes: map[int]*schema.Volume{}}
+}
+
+func (f *scaleAPI) requestCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+func (f *scaleAPI) volumeCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.volumes)
+}
+
+func (f *scaleAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(f.latency)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case parts[0] == "actions":
+		resp := &schema.ActionListResponse{}
+		ids := r.URL.Query()["id"]
+		if len(parts) == 2 {
+			ids = []string{parts[1]}
+		}
+		for _, v := range ids {
+			id, _ := strconv.Atoi(v)
+			resp.Actions = append(resp.Actions, schema.Action{ID: id, Status: string(hcloud.ActionStatusSuccess)})
+		}
+		if len(parts) == 2 {
+			f.write(w, &schema.ActionGetResponse{Action: resp.Actions[0]})
+			return
+		}
+		f.write(w, resp)
+
+	case parts[0] == "servers" && len(parts) == 2:
+		id, _ := strconv.Atoi(parts[1])
+		f.write(w, &schema.ServerGetResponse{Server: schema.Server{ID: id, Name: "server-" + parts[1]}})
+
+	case parts[0] == "volumes" && len(parts) == 1 && r.Method == "GET":
+		resp := &schema.VolumeListResponse{Volumes: []schema.Volume{}}
+		name := r.URL.Query().Get("name")
+		for _, vol := range f.volumes {
+			if name == "" || vol.Name == name {
+				resp.Volumes = append(resp.Volumes, *vol)
+			}
+		}
+		f.write(w, resp)
+
+	case parts[0] == "volumes" && len(parts) == 1 && r.Method == "POST":
+		var req schema.VolumeCreateRequest
+		json.NewDecoder(r.Body).Decode(&req)
+
+		f.nextID++
+		vol := &schema.Volume{
+			ID:          f.nextID,
+			Name:        req.Name,
+			Size:        req.Size,
+			LinuxDevice: "/dev/disk/by-id/scsi-0HC_Volume_" + strconv.Itoa(f.nextID),
+			Created:     time.Now().UTC(),
+		}
+		if req.Labels != nil {
+			vol.Labels = *req.Labels
+		}
+		f.volumes[vol.ID] = vol
+		f.write(w, &schema.VolumeCreateResponse{Volume: *vol, Action: f.action("create_volume")})
+
+	case parts[0] == "volumes" && len(parts) >= 2:
+		id, _ := strconv.Atoi(parts[1])
+		vol, ok := f.volumes[id]
+		if !ok {
+			f.writeStatus(w, http.StatusNotFound, &schema.ErrorResponse{Error: schema.Error{Code: string(hcloud.ErrorCodeNotFound), Message: "volume not found"}})
+			return
+		}
+
+		switch {
+		case len(parts) == 2 && r.Method == "GET":
+			f.write(w, &schema.VolumeGetResponse{Volume: *vol})
+		case len(parts) == 2 && r.Method == "DELETE":
+			delete(f.volumes, id)
+			w.WriteHeader(http.StatusNoContent)
+		case len(parts) == 3:
+			// the running actions, none are ever running
+			f.write(w, &schema.ActionListResponse{})
+		case path.Base(r.URL.Path) == "attach":
+			var req schema.VolumeActionAttachVolumeRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			vol.Server = &req.Server
+			f.write(w, &schema.VolumeActionAttachVolumeResponse{Action: *f.action("attach_volume")})
+		case path.Base(r.URL.Path) == "detach":
+			vol.Server = nil
+			f.write(w, &schema.VolumeActionDetachVolumeResponse{Action: *f.action("detach_volume")})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// action returns a new running action. It must be called with mu held.
+func (f *scaleAPI) action(command string) *schema.Action {
+	f.nextID++
+	return &schema.Action{ID: f.nextID, Command: command, Status: string(hcloud.ActionStatusRunning)}
+}
+
+func (f *scaleAPI) writeStatus(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (f *scaleAPI) write(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,250 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// annBackupSchedule is the PVC annotation containing the cron expression
+	// (in UTC) on which backups of the volume are created
+	annBackupSchedule = "de.apricote.hcloud.csi/backup-schedule"
+
+	// annBackupGroup is the PVC annotation with the name of a backup group.
+	// The backups of all PVCs of a namespace in the same group are started
+	// together, see createBackupGroup.
+	annBackupGroup = "de.apricote.hcloud.csi/backup-group"
+
+	// scheduledBackupPrefix is the prefix of the ids of scheduled backups
+	scheduledBackupPrefix = "scheduled-"
+
+	// defaultBackupScheduleConcurrency defines how many scheduled backups are
+	// uploaded at the same time if not configured otherwise
+	defaultBackupScheduleConcurrency = 1
+)
+
+// backupScheduler creates backups of all PVCs annotated with
+// annBackupSchedule. At most one backup per volume and concurrency backups in
+// total are uploaded at the same time. Backups that are due but can't be
+// started yet are kept pending and started as soon as possible.
+type backupScheduler struct {
+	d           *Driver
+	concurrency int
+	log         *logrus.Entry
+
+	// last is the last minute a PVC was checked, so every minute is
+	// handled exactly once
+	last time.Time
+
+	// pending are the backups that are due but couldn't be started yet,
+	// keyed by the volume id or the group
+	pending map[string]*pendingBackup
+}
+
+// pendingBackup is a due backup of a single volume or a group of volumes
+type pendingBackup struct {
+	// group is empty for single volumes
+	group string
+	// backups maps the backup ids to the source volume ids
+	backups map[string]string
+	// retention of the backups, taken from the first PVC of a group
+	retention *backupRetention
+}
+
+// newBackupScheduler returns a new backupScheduler for the given driver
+func newBackupScheduler(d *Driver, concurrency int) *backupScheduler {
+	if concurrency < 1 {
+		concurrency = defaultBackupScheduleConcurrency
+	}
+
+	return &backupScheduler{
+		d:           d,
+		concurrency: concurrency,
+		log:         d.log.WithField("component", "backup_scheduler"),
+		pending:     map[string]*pendingBackup{},
+	}
+}
+
+// run checks the schedules every minute until stopCh is closed
+func (s *backupScheduler) run(stopCh <-chan struct{}) {
+	s.log.WithField("concurrency", s.concurrency).Info("backup scheduler started")
+
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			s.log.Info("backup scheduler stopped")
+			return
+		case now := <-ticker.C:
+			minute := now.UTC().Truncate(time.Minute)
+			if !minute.After(s.last) {
+				continue
+			}
+			s.last = minute
+
+			s.schedule(minute)
+			s.startPending()
+		}
+	}
+}
+
+// schedule adds the backups of all PVCs whose schedule matches the given time
+// to the pending backups
+func (s *backupScheduler) schedule(t time.Time) {
+	pvcs, err := s.d.kubeClient.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		s.log.WithError(err).Error("could not list persistent volume claims")
+		return
+	}
+
+	// pending backups added for t, groups are completed below
+	added := map[string]bool{}
+
+	for _, pvc := range pvcs.Items {
+		expr, ok := pvc.Annotations[annBackupSchedule]
+		if !ok {
+			continue
+		}
+
+		ll := s.log.WithFields(logrus.Fields{
+			"pvc_name":      pvc.Name,
+			"pvc_namespace": pvc.Namespace,
+			"schedule":      expr,
+		})
+
+		sched, err := parseCron(expr)
+		if err != nil {
+			ll.WithError(err).Warn("invalid backup schedule")
+			continue
+		}
+
+		if !sched.matches(t) {
+			continue
+		}
+
+		if pvc.Spec.VolumeName == "" {
+			ll.Warn("persistent volume claim is not bound, skipping scheduled backup")
+			continue
+		}
+
+		pv, err := s.d.kubeClient.CoreV1().PersistentVolumes().Get(pvc.Spec.VolumeName, metav1.GetOptions{})
+		if err != nil {
+			ll.WithError(err).Error("could not get persistent volume")
+			continue
+		}
+
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName {
+			ll.Warn("persistent volume is not provisioned by this driver, skipping scheduled backup")
+			continue
+		}
+
+		volumeID := pv.Spec.CSI.VolumeHandle
+
+		retention, err := parseRetention(pvc.Annotations[annBackupRetainCount], pvc.Annotations[annBackupRetainAge])
+		if err != nil {
+			ll.WithError(err).Warn("invalid backup retention, skipping scheduled backup")
+			continue
+		}
+
+		key, group := volumeID, ""
+		if name := pvc.Annotations[annBackupGroup]; name != "" {
+			key = "group/" + pvc.Namespace + "/" + name
+			group = fmt.Sprintf("%s-%s-%s", pvc.Namespace, name, t.UTC().Format("200601021504"))
+		}
+
+		if _, ok := s.pending[key]; ok && !added[key] {
+			ll.WithField("volume_id", volumeID).Warn("previous scheduled backup is still pending, skipping")
+			continue
+		}
+
+		if !added[key] {
+			s.pending[key] = &pendingBackup{group: group, backups: map[string]string{}, retention: retention}
+			added[key] = true
+		}
+		s.pending[key].backups[scheduledBackupID(volumeID, t)] = volumeID
+	}
+}
+
+// startPending starts as many pending backups as the concurrency limits
+// allow. Groups are started at once, a group larger than the limit only if
+// no other backup is running.
+func (s *backupScheduler) startPending() {
+	for key, pb := range s.pending {
+		running := s.d.runningBackups()
+		if running >= s.concurrency {
+			return
+		}
+
+		if running > 0 && running+len(pb.backups) > s.concurrency {
+			continue
+		}
+
+		if s.volumesBusy(pb) {
+			continue
+		}
+
+		ll := s.log.WithFields(logrus.Fields{
+			"backups": pb.backups,
+			"group":   pb.group,
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		var err error
+		if pb.group == "" {
+			for id, volumeID := range pb.backups {
+				_, err = s.d.createBackup(ctx, id, volumeID, pb.retention)
+			}
+		} else {
+			err = s.d.createBackupGroup(ctx, pb.group, pb.backups, pb.retention)
+		}
+		cancel()
+
+		// failed backups are not retried, the next one is created on the
+		// next scheduled run
+		delete(s.pending, key)
+		if err != nil {
+			ll.WithError(err).Error("could not create scheduled backup")
+			continue
+		}
+
+		ll.Info("scheduled backup started")
+	}
+}
+
+// volumesBusy returns true if a backup of any volume of pb is running
+func (s *backupScheduler) volumesBusy(pb *pendingBackup) bool {
+	for _, volumeID := range pb.backups {
+		if s.d.volumeBackupRunning(volumeID) {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduledBackupID returns the id of the backup of the given volume
+// scheduled at t
+func scheduledBackupID(volumeID string, t time.Time) string {
+	return fmt.Sprintf("%s%s-%s", scheduledBackupPrefix, volumeID, t.UTC().Format("200601021504"))
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// serverQueueRetryAfter is the delay suggested to the callers rejected
+// because the queue of the server is full
+const serverQueueRetryAfter = 10 * time.Second
+
+// errServerQueueFull is returned by serverQueue.acquire if too many attaches
+// are waiting for the server already
+var errServerQueueFull = errors.New("too many operations are waiting for the server")
+
+// serverQueue runs the attaches and detaches of each server one after
+// another. The API locks a server while a volume is attached to or detached
+// from it, so concurrent operations would fail and be retried by the
+// attacher in no particular order. Waiting detaches go first: when a node is
+// drained, its volumes are released before new volumes are attached, and the
+// pods rescheduled to other nodes start sooner. The zero value is usable.
+type serverQueue struct {
+	// maxAttaches is the number of attaches that may wait for a server,
+	// unlimited if zero. Further attaches are rejected right away instead of
+	// timing out while they wait. Detaches are never rejected, they go first
+	// and free the server.
+	maxAttaches int
+
+	mu      sync.Mutex
+	servers map[int]*serverOps
+}
+
+// serverOps are the operations of a server. One of them is running while the
+// server is in serverQueue.servers, the others wait for their channel to be
+// closed.
+type serverOps struct {
+	detaches []chan struct{}
+	attaches []chan struct{}
+}
+
+// acquire waits until the server is free for another attach, or a detach if
+// detach is set. The returned function must be called once the operation is
+// finished. It returns errServerQueueFull if the attach isn't queued.
+func (q *serverQueue) acquire(ctx context.Context, serverID int, detach bool) (func(), error) {
+	q.mu.Lock()
+	if q.servers == nil {
+		q.servers = map[int]*serverOps{}
+	}
+
+	ops, busy := q.servers[serverID]
+	if !busy {
+		q.servers[serverID] = &serverOps{}
+		q.mu.Unlock()
+		return q.releaseFunc(serverID), nil
+	}
+
+	if !detach && q.maxAttaches > 0 && len(ops.attaches) >= q.maxAttaches {
+		q.mu.Unlock()
+		return nil, errServerQueueFull
+	}
+
+	ready := make(chan struct{})
+	if detach {
+		ops.detaches = append(ops.detaches, ready)
+	} else {
+		ops.attaches = append(ops.attaches, ready)
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-ready:
+		return q.releaseFunc(serverID), nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		waiting := ops.remove(ready)
+		q.mu.Unlock()
+
+		// the server was handed over right when ctx was done
+		if !waiting {
+			q.release(serverID)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// releaseFunc returns a function that releases the server once
+func (q *serverQueue) releaseFunc(serverID int) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { q.release(serverID) })
+	}
+}
+
+// release hands the server over to the next waiting operation, detaches
+// first
+func (q *serverQueue) release(serverID int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ops := q.servers[serverID]
+	var next chan struct{}
+	switch {
+	case len(ops.detaches) > 0:
+		next, ops.detaches = ops.detaches[0], ops.detaches[1:]
+	case len(ops.attaches) > 0:
+		next, ops.attaches = ops.attaches[0], ops.attaches[1:]
+	default:
+		delete(q.servers, serverID)
+		return
+	}
+	close(next)
+}
+
+// remove removes the waiting operation. It returns false if it isn't waiting
+// anymore.
+func (o *serverOps) remove(ready chan struct{}) bool {
+	for _, queue := range []*[]chan struct{}{&o.detaches, &o.attaches} {
+		for i, ch := range *queue {
+			if ch == ready {
+				*queue = append((*queue)[:i], (*queue)[i+1:]...)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serverQueueError returns the error for a failed serverQueue.acquire. If the
+// queue is full, the call fails with UNAVAILABLE and the retry-after trailer
+// suggests when to try again.
+func serverQueueError(ctx context.Context, serverID int, err error) error {
+	if err != errServerQueueFull {
+		return status.Errorf(codes.Aborted, "waiting for the other operations of server %d: %s", serverID, err)
+	}
+
+	retryAfter := strconv.Itoa(int(serverQueueRetryAfter / time.Second))
+	_ = grpc.SetTrailer(ctx, metadata.Pairs("retry-after", retryAfter))
+	return status.Errorf(codes.Unavailable, "%s %d, retry after %s seconds", err, serverID, retryAfter)
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestServerQueue(t *testing.T) {
+	var q serverQueue
+	ctx := context.Background()
+
+	release, err := q.acquire(ctx, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// other servers aren't blocked
+	other, err := q.acquire(ctx, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other()
+
+	order := make(chan string, 2)
+	queue := func(name string, detach bool) {
+		next, err := q.acquire(ctx, 1, detach)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		order <- name
+		next()
+	}
+
+	// the attach is queued first, the detach still runs before it
+	go queue("attach", false)
+	waitQueued(t, &q, 1, 1)
+	go queue("detach", true)
+	waitQueued(t, &q, 1, 2)
+
+	release()
+	if first, second := <-order, <-order; first != "detach" || second != "attach" {
+		t.Errorf("operations ran in order %s, %s, want the detach first", first, second)
+	}
+
+	// a waiting operation that gives up is removed from the queue
+	release, _ = q.acquire(ctx, 1, false)
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := q.acquire(timeout, 1, true); err == nil {
+		t.Error("acquire() succeeded while the server is busy")
+	}
+	release()
+	release()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.servers) != 0 {
+		t.Errorf("%d servers are left in the queue", len(q.servers))
+	}
+}
+
+// waitQueued waits until n operations are waiting for the server
+func waitQueued(t *testing.T, q *serverQueue, serverID, n int) {
+	for i := 0; i < 100; i++ {
+		q.mu.Lock()
+		ops := q.servers[serverID]
+		queued := len(ops.detaches) + len(ops.attaches)
+		q.mu.Unlock()
+
+		if queued == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("operations weren't queued")
+}
+
+func TestServerQueueFull(t *testing.T) {
+	q := serverQueue{maxAttaches: 1}
+	ctx := context.Background()
+
+	release, err := q.acquire(ctx, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queued := make(chan error, 2)
+	go func() {
+		next, err := q.acquire(ctx, 1, false)
+		if err == nil {
+			next()
+		}
+		queued <- err
+	}()
+	waitQueued(t, &q, 1, 1)
+
+	if _, err := q.acquire(ctx, 1, false); err != errServerQueueFull {
+		t.Errorf("acquire() = %v, want errServerQueueFull", err)
+	}
+
+	// detaches are queued anyway
+	go func() {
+		next, err := q.acquire(ctx, 1, true)
+		if err == nil {
+			next()
+		}
+		queued <- err
+	}()
+	waitQueued(t, &q, 1, 2)
+
+	release()
+	for i := 0; i < 2; i++ {
+		if err := <-queued; err != nil {
+			t.Error(err)
+		}
+	}
+
+	if code := status.Code(serverQueueError(ctx, 1, errServerQueueFull)); code != codes.Unavailable {
+		t.Errorf("full queue returned %s, want %s", code, codes.Unavailable)
+	}
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// VolumeService is the part of the volume API the driver uses. It's
+// implemented by hcloud.VolumeClient and can be replaced in tests, or
+// wrapped by layers that retry or cache requests.
+type VolumeService interface {
+	GetByID(ctx context.Context, id int) (*hcloud.Volume, *hcloud.Response, error)
+	GetByName(ctx context.Context, name string) (*hcloud.Volume, *hcloud.Response, error)
+	List(ctx context.Context, opts hcloud.VolumeListOpts) ([]*hcloud.Volume, *hcloud.Response, error)
+	Create(ctx context.Context, opts hcloud.VolumeCreateOpts) (hcloud.VolumeCreateResult, *hcloud.Response, error)
+	Delete(ctx context.Context, volume *hcloud.Volume) (*hcloud.Response, error)
+	Update(ctx context.Context, volume *hcloud.Volume, opts hcloud.VolumeUpdateOpts) (*hcloud.Volume, *hcloud.Response, error)
+	Attach(ctx context.Context, volume *hcloud.Volume, server *hcloud.Server) (*hcloud.Action, *hcloud.Response, error)
+	Detach(ctx context.Context, volume *hcloud.Volume) (*hcloud.Action, *hcloud.Response, error)
+	Resize(ctx context.Context, volume *hcloud.Volume, size int) (*hcloud.Action, *hcloud.Response, error)
+	ChangeProtection(ctx context.Context, volume *hcloud.Volume, opts hcloud.VolumeChangeProtectionOpts) (*hcloud.Action, *hcloud.Response, error)
+}
+
+// ServerService is the part of the server API the driver uses. It's
+// implemented by hcloud.ServerClient.
+type ServerService interface {
+	GetByID(ctx context.Context, id int) (*hcloud.Server, *hcloud.Response, error)
+	GetByName(ctx context.Context, name string) (*hcloud.Server, *hcloud.Response, error)
+}
+
+// ActionService is the part of the action API the driver uses. The API
+// client we use doesn't support filtering actions yet, so it's implemented
+// by actionClient.
+type ActionService interface {
+	// ListByID returns the actions with the given IDs
+	ListByID(ctx context.Context, ids []int) ([]*hcloud.Action, *hcloud.Response, error)
+	// ListForVolume returns the actions of the volume with the given status
+	ListForVolume(ctx context.Context, volumeID int, status hcloud.ActionStatus) ([]*hcloud.Action, *hcloud.Response, error)
+}
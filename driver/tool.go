@@ -0,0 +1,116 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ToolParams defines the common parameters of the operations run from the
+// command line instead of the plugin, such as MigrateVolume. They copy data
+// with the pod data mover, so they need access to the Kubernetes API.
+type ToolParams struct {
+	Token      string
+	URL        string
+	Kubeconfig string
+
+	BackupURL             string
+	BackupAccessKeyID     string
+	BackupSecretAccessKey string
+	BackupRegion          string
+	BackupEncryptionKey   string
+
+	DataMoverImage     string
+	DataMoverNamespace string
+	DataMoverSecret    string
+}
+
+// newToolDriver returns a driver for the operations run from the command
+// line. It doesn't run on a server of the project, so it has no node id.
+func newToolDriver(p ToolParams) (*Driver, error) {
+	if p.BackupURL == "" {
+		return nil, fmt.Errorf("a backup store is required to copy data")
+	}
+
+	if p.DataMoverImage == "" {
+		return nil, fmt.Errorf("a data mover image is required to copy data")
+	}
+
+	backups, err := newObjectStore(p.BackupURL, p.BackupAccessKeyID, p.BackupSecretAccessKey, p.BackupRegion)
+	if err != nil {
+		return nil, err
+	}
+
+	backups, err = encryptStore(backups, p.BackupEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := newAPIToolDriver(p)
+	if err != nil {
+		return nil, err
+	}
+
+	d.backups = backups
+	d.mover = newToolPodMover(d, p)
+
+	return d, nil
+}
+
+// newToolPodMover returns the pod data mover of a driver returned by
+// newToolDriver or newAPIToolDriver
+func newToolPodMover(d *Driver, p ToolParams) *podMover {
+	namespace := p.DataMoverNamespace
+	if namespace == "" {
+		namespace = "kube-system"
+	}
+
+	return &podMover{
+		d:            d,
+		image:        p.DataMoverImage,
+		namespace:    namespace,
+		secret:       p.DataMoverSecret,
+		backupURL:    p.BackupURL,
+		backupRegion: p.BackupRegion,
+	}
+}
+
+// newAPIToolDriver returns a driver for the operations run from the command
+// line that only use the Hetzner Cloud and Kubernetes APIs, such as
+// AdoptVolume. It can't copy data.
+func newAPIToolDriver(p ToolParams) (*Driver, error) {
+	kubeClient, err := newKubeClient(p.Kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	hcloudClient := newHCloudClient(p.Token, p.URL)
+	return &Driver{
+		hcloudClient: hcloudClient,
+		volumes:      &hcloudClient.Volume,
+		servers:      &hcloudClient.Server,
+		actions:      &actionClient{client: hcloudClient},
+		log: logrus.New().WithFields(logrus.Fields{
+			"version": version,
+		}),
+		backupJobs:   map[string]string{},
+		kubeClient:   kubeClient,
+		populateJobs: map[int]bool{},
+	}, nil
+}
@@ -0,0 +1,346 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// topologyLocation is the topology segment of the Hetzner Cloud location
+	topologyLocation = "location"
+
+	// topologyNetworkZone is the topology segment of the network zone the
+	// location belongs to, e.g. eu-central
+	topologyNetworkZone = "networkZone"
+
+	// topologyDatacenter is the topology segment of the datacenter, e.g.
+	// fsn1-dc14. It's only used with TopologyGranularityDatacenter.
+	topologyDatacenter = "datacenter"
+
+	// TopologyGranularityLocation and TopologyGranularityDatacenter define
+	// whether the topology of the nodes (and volumes) is expressed by their
+	// location or additionally by their datacenter. Volumes are accessible
+	// from all datacenters of their location.
+	TopologyGranularityLocation   = "location"
+	TopologyGranularityDatacenter = "datacenter"
+
+	// paramLocation is the StorageClass parameter that sets the location new
+	// volumes are created in
+	paramLocation = "location"
+)
+
+// topologySegments returns the topology segments of the given location
+func (d *Driver) topologySegments(ctx context.Context, location string) (map[string]string, error) {
+	zone, err := d.networkZone(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{
+		topologyLocation:    location,
+		topologyNetworkZone: zone,
+	}, nil
+}
+
+// datacenterLocation returns the location of the datacenter, as given by the
+// naming scheme of the datacenters (<location>-dc<number>)
+func datacenterLocation(datacenter string) string {
+	return strings.SplitN(datacenter, "-", 2)[0]
+}
+
+// topologyMatches returns true if the location satisfies all segments of the
+// given topology that are known to the driver
+func (d *Driver) topologyMatches(ctx context.Context, t *csi.Topology, location string) (bool, error) {
+	if t == nil {
+		return true, nil
+	}
+
+	if dc, ok := t.Segments[topologyDatacenter]; ok && datacenterLocation(dc) != location {
+		return false, nil
+	}
+
+	if want, ok := t.Segments[topologyLocation]; ok && want != location {
+		return false, nil
+	}
+
+	if want, ok := t.Segments[topologyNetworkZone]; ok {
+		zone, err := d.networkZone(ctx, location)
+		if err != nil {
+			return false, err
+		}
+		if zone != want {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// topologyMatchesAny returns true if the location satisfies at least one of
+// the given topologies, or if there are none
+func (d *Driver) topologyMatchesAny(ctx context.Context, topologies []*csi.Topology, location string) (bool, error) {
+	if len(topologies) == 0 {
+		return true, nil
+	}
+
+	for _, t := range topologies {
+		ok, err := d.topologyMatches(ctx, t, location)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// volumeLocation returns the location a new volume is created in. The
+// location parameter wins, otherwise the first preferred or requisite
+// topology that names a location or network zone is used. If neither is
+// given, the volume is created in the location of the driver. Errors are
+// gRPC status errors.
+func (d *Driver) volumeLocation(ctx context.Context, params map[string]string, req *csi.TopologyRequirement) (string, error) {
+	location := params[paramLocation]
+
+	if location == "" && req != nil {
+		topologies := append([]*csi.Topology{}, req.Preferred...)
+		for _, t := range append(topologies, req.Requisite...) {
+			var err error
+			if location, err = d.topologyLocation(ctx, t); err != nil {
+				return "", status.Error(codes.Internal, err.Error())
+			}
+			if location != "" {
+				break
+			}
+		}
+	}
+
+	if location == "" {
+		location = d.location
+	}
+
+	if req != nil {
+		ok, err := d.topologyMatchesAny(ctx, req.Requisite, location)
+		if err != nil {
+			return "", status.Error(codes.Internal, err.Error())
+		}
+		if !ok {
+			return "", status.Errorf(codes.ResourceExhausted, "volume can't be created in location %q, requisite topology: %v", location, req.Requisite)
+		}
+	}
+
+	return location, nil
+}
+
+// topologyLocation returns the location for the given topology. If only the
+// network zone is set, the location of the driver is preferred if it's in the
+// zone.
+func (d *Driver) topologyLocation(ctx context.Context, t *csi.Topology) (string, error) {
+	if location, ok := t.Segments[topologyLocation]; ok {
+		return location, nil
+	}
+
+	if dc, ok := t.Segments[topologyDatacenter]; ok {
+		return datacenterLocation(dc), nil
+	}
+
+	zone, ok := t.Segments[topologyNetworkZone]
+	if !ok {
+		return "", nil
+	}
+
+	zones, err := d.locationNetworkZones(ctx, d.location)
+	if err != nil {
+		return "", err
+	}
+
+	if zones[d.location] == zone {
+		return d.location, nil
+	}
+
+	var locations []string
+	for location, z := range zones {
+		if z == zone {
+			locations = append(locations, location)
+		}
+	}
+	if len(locations) == 0 {
+		return "", nil
+	}
+
+	sort.Strings(locations)
+	return locations[0], nil
+}
+
+// nodeTopology returns the topology of the node the driver is running on
+func (d *Driver) nodeTopology(ctx context.Context) (*csi.Topology, error) {
+	segments, err := d.topologySegments(ctx, d.location)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.topologyGranularity == TopologyGranularityDatacenter {
+		segments[topologyDatacenter] = d.datacenter
+	}
+	return &csi.Topology{Segments: segments}, nil
+}
+
+// volumeTopologies returns the topologies a volume in the given location is
+// accessible from. With TopologyGranularityDatacenter, that's one per
+// datacenter of the location.
+func (d *Driver) volumeTopologies(ctx context.Context, location string) ([]*csi.Topology, error) {
+	if d.topologyGranularity != TopologyGranularityDatacenter {
+		segments, err := d.topologySegments(ctx, location)
+		if err != nil {
+			return nil, err
+		}
+		return []*csi.Topology{{Segments: segments}}, nil
+	}
+
+	datacenters, err := d.locationDatacenters(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+
+	var topologies []*csi.Topology
+	for _, dc := range datacenters {
+		segments, err := d.topologySegments(ctx, location)
+		if err != nil {
+			return nil, err
+		}
+		segments[topologyDatacenter] = dc
+		topologies = append(topologies, &csi.Topology{Segments: segments})
+	}
+	return topologies, nil
+}
+
+// accessibleTopology returns the topologies the volume is accessible from,
+// as given by its location. If the volume has no location, i.e. it was just
+// created, the given location is used. NFS exports are mounted over the
+// network, so they're accessible from all nodes and have none.
+func (d *Driver) accessibleTopology(ctx context.Context, vol *hcloud.Volume, location string) ([]*csi.Topology, error) {
+	if vol.Labels[labelNFSExport] != "" {
+		return nil, nil
+	}
+	return d.volumeTopologies(ctx, volumeLocationName(vol, location))
+}
+
+// volumeLocationName returns the name of the location of the volume, or the
+// given location if it has none
+func volumeLocationName(vol *hcloud.Volume, location string) string {
+	if vol.Location != nil && vol.Location.Name != "" {
+		return vol.Location.Name
+	}
+	return location
+}
+
+// locationDatacenters returns the sorted names of the datacenters in the
+// given location. The datacenters are listed once, they don't change while
+// the plugin is running.
+func (d *Driver) locationDatacenters(ctx context.Context, location string) ([]string, error) {
+	d.datacentersMu.Lock()
+	defer d.datacentersMu.Unlock()
+
+	if d.datacenters == nil {
+		all, err := d.hcloudClient.Datacenter.All(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not list datacenters: %s", err)
+		}
+
+		byLocation := map[string][]string{}
+		for _, dc := range all {
+			if dc.Location != nil {
+				byLocation[dc.Location.Name] = append(byLocation[dc.Location.Name], dc.Name)
+			}
+		}
+		for _, names := range byLocation {
+			sort.Strings(names)
+		}
+		d.datacenters = byLocation
+	}
+
+	datacenters := d.datacenters[location]
+	if len(datacenters) == 0 {
+		return nil, fmt.Errorf("no datacenters found in location %q", location)
+	}
+	return datacenters, nil
+}
+
+// networkZone returns the network zone of the given location, e.g.
+// eu-central
+func (d *Driver) networkZone(ctx context.Context, location string) (string, error) {
+	zones, err := d.locationNetworkZones(ctx, location)
+	if err != nil {
+		return "", err
+	}
+
+	zone, ok := zones[location]
+	if !ok {
+		return "", fmt.Errorf("unknown location %q", location)
+	}
+	return zone, nil
+}
+
+// locationNetworkZones returns the network zones by location. The locations
+// are listed once, and again if the given location is missing, i.e. it was
+// added since. The returned map must not be changed.
+func (d *Driver) locationNetworkZones(ctx context.Context, location string) (map[string]string, error) {
+	d.networkZonesMu.Lock()
+	defer d.networkZonesMu.Unlock()
+
+	if _, ok := d.networkZones[location]; ok {
+		return d.networkZones, nil
+	}
+
+	zones, err := d.listNetworkZones(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list locations: %s", err)
+	}
+	d.networkZones = zones
+	return zones, nil
+}
+
+// listNetworkZones returns the network zones of all locations. The API client
+// we use doesn't expose the network zone of a location yet.
+func (d *Driver) listNetworkZones(ctx context.Context) (map[string]string, error) {
+	req, err := d.hcloudClient.NewRequest(ctx, "GET", "/locations?per_page=50", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var body struct {
+		Locations []struct {
+			Name        string `json:"name"`
+			NetworkZone string `json:"network_zone"`
+		} `json:"locations"`
+	}
+	if _, err := d.hcloudClient.Do(req, &body); err != nil {
+		return nil, err
+	}
+
+	zones := make(map[string]string, len(body.Locations))
+	for _, l := range body.Locations {
+		zones[l.Name] = l.NetworkZone
+	}
+	return zones, nil
+}
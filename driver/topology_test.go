@@ -0,0 +1,185 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newTopologyDriver returns a driver in fsn1 whose API serves the locations
+// of fakeNetworkZones. The returned counter is the number of requests.
+func newTopologyDriver(t *testing.T) (*Driver, *int32, func()) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path != "/locations" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fakeLocations(w)
+	}))
+
+	d := &Driver{
+		location:     "fsn1",
+		hcloudClient: hcloud.NewClient(hcloud.WithEndpoint(ts.URL)),
+	}
+	return d, &requests, ts.Close
+}
+
+func TestTopologyMatches(t *testing.T) {
+	d, _, stop := newTopologyDriver(t)
+	defer stop()
+
+	tests := []struct {
+		name     string
+		segments map[string]string
+		location string
+		want     bool
+	}{
+		{"no segments", nil, "fsn1", true},
+		{"location", map[string]string{topologyLocation: "fsn1"}, "fsn1", true},
+		{"other location", map[string]string{topologyLocation: "nbg1"}, "fsn1", false},
+		{"network zone", map[string]string{topologyNetworkZone: "eu-central"}, "fsn1", true},
+		{"other network zone", map[string]string{topologyNetworkZone: "us-east"}, "fsn1", false},
+		{"network zone of sin", map[string]string{topologyNetworkZone: "ap-southeast"}, "sin", true},
+		{"datacenter", map[string]string{topologyDatacenter: "fsn1-dc14"}, "fsn1", true},
+		{"other datacenter", map[string]string{topologyDatacenter: "nbg1-dc3"}, "fsn1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := d.topologyMatches(context.Background(), &csi.Topology{Segments: tt.segments}, tt.location)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("topologyMatches(%v, %q) = %t, want %t", tt.segments, tt.location, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTopologyLocation(t *testing.T) {
+	d, _, stop := newTopologyDriver(t)
+	defer stop()
+
+	tests := []struct {
+		name     string
+		segments map[string]string
+		want     string
+	}{
+		{"datacenter", map[string]string{topologyDatacenter: "hel1-dc2"}, "hel1"},
+		{"zone of the driver", map[string]string{topologyNetworkZone: "eu-central"}, "fsn1"},
+		{"other zone", map[string]string{topologyNetworkZone: "ap-southeast"}, "sin"},
+		{"unknown zone", map[string]string{topologyNetworkZone: "moon"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := d.topologyLocation(context.Background(), &csi.Topology{Segments: tt.segments})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("topologyLocation(%v) = %q, want %q", tt.segments, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTopologySegments(t *testing.T) {
+	d, requests, stop := newTopologyDriver(t)
+	defer stop()
+
+	for _, location := range []string{"fsn1", "sin", "ash"} {
+		got, err := d.topologySegments(context.Background(), location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{topologyLocation: location, topologyNetworkZone: fakeNetworkZones[location]}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("topologySegments(%q) = %v, want %v", location, got, want)
+		}
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("expected the locations to be listed once, got %d requests", n)
+	}
+
+	// unknown locations are listed again, they might have been added since
+	if _, err := d.topologySegments(context.Background(), "moon1"); err == nil {
+		t.Error("expected an error for an unknown location")
+	}
+	if n := atomic.LoadInt32(requests); n != 2 {
+		t.Errorf("expected the locations to be listed again, got %d requests", n)
+	}
+}
+
+func TestCreateVolumeExistingTopology(t *testing.T) {
+	d, _, stop := newConcurrencyDriver(t)
+	defer stop()
+
+	req := &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 10 * GB},
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessMode: supportedAccessMode}},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{{Segments: map[string]string{topologyLocation: "nbg1"}}},
+		},
+	}
+
+	created, err := d.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// retries get the response of the first call
+	retried, err := d.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(retried.Volume, created.Volume) {
+		t.Errorf("expected the retry to return %v, got %v", created.Volume, retried.Volume)
+	}
+	want := map[string]string{topologyLocation: "nbg1", topologyNetworkZone: "eu-central"}
+	if len(retried.Volume.AccessibleTopology) != 1 || !reflect.DeepEqual(retried.Volume.AccessibleTopology[0].Segments, want) {
+		t.Errorf("expected the topology %v, got %v", want, retried.Volume.AccessibleTopology)
+	}
+
+	// a volume of the same name in another location doesn't satisfy the
+	// request
+	req.AccessibilityRequirements.Requisite[0].Segments[topologyLocation] = "fsn1"
+	if _, err := d.CreateVolume(context.Background(), req); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("expected ALREADY_EXISTS for a requisite location, got %v", err)
+	}
+
+	req.AccessibilityRequirements = nil
+	req.Parameters = map[string]string{paramLocation: "hel1"}
+	if _, err := d.CreateVolume(context.Background(), req); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("expected ALREADY_EXISTS for the location parameter, got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+const (
+	// apiMaxIdleConnsPerHost is the number of idle connections kept open to
+	// the API. The default of 2 means that every burst of more than two
+	// concurrent calls opens new connections and pays for a TLS handshake.
+	apiMaxIdleConnsPerHost = 32
+
+	apiIdleConnTimeout     = 90 * time.Second
+	apiTLSHandshakeTimeout = 10 * time.Second
+)
+
+var tuneTransportOnce sync.Once
+
+// newHCloudClient returns a client for the Hetzner Cloud API at the given
+// endpoint.
+func newHCloudClient(token, endpoint string) *hcloud.Client {
+	tuneTransportOnce.Do(tuneTransport)
+
+	return hcloud.NewClient(
+		hcloud.WithToken(token),
+		hcloud.WithApplication("hcloud-csi-driver", version),
+		hcloud.WithEndpoint(endpoint))
+}
+
+// tuneTransport configures the connection pool of the default transport.
+// The vendored hcloud-go doesn't accept a custom http.Client, so its
+// requests always go through http.DefaultTransport. This has to happen
+// before the first request is sent.
+func tuneTransport() {
+	t, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return
+	}
+
+	t.ForceAttemptHTTP2 = true
+	t.MaxIdleConnsPerHost = apiMaxIdleConnsPerHost
+	if t.MaxIdleConns != 0 && t.MaxIdleConns < apiMaxIdleConnsPerHost {
+		t.MaxIdleConns = apiMaxIdleConnsPerHost
+	}
+	t.IdleConnTimeout = apiIdleConnTimeout
+	t.TLSHandshakeTimeout = apiTLSHandshakeTimeout
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// webdavStore stores objects on a WebDAV server, such as a Hetzner Storage
+// Box. Keys are mapped to paths below the base URL.
+type webdavStore struct {
+	base     *url.URL
+	username string
+	password string
+
+	client *http.Client
+}
+
+// newWebDAVStore returns a new webdavStore for the given base URL
+func newWebDAVStore(base *url.URL, username, password string) *webdavStore {
+	return &webdavStore{
+		base:     base,
+		username: username,
+		password: password,
+		client:   &http.Client{},
+	}
+}
+
+// Put uploads the content of r to the given key. Missing collections are
+// created.
+func (w *webdavStore) Put(ctx context.Context, key string, r io.Reader) error {
+	if err := w.mkcolAll(ctx, path.Dir(key)); err != nil {
+		return err
+	}
+
+	resp, err := w.do(ctx, "PUT", key, r, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return webdavError("PUT", key, resp)
+	}
+	return nil
+}
+
+// Get returns the content of the object with the given key. It returns
+// errObjectNotFound if the object doesn't exist.
+func (w *webdavStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := w.do(ctx, "GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errObjectNotFound
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, webdavError("GET", key, resp)
+	}
+
+	return resp.Body, nil
+}
+
+// Delete deletes the object or collection with the given key. Deleting an
+// object that doesn't exist is not an error.
+func (w *webdavStore) Delete(ctx context.Context, key string) error {
+	resp, err := w.do(ctx, "DELETE", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return webdavError("DELETE", key, resp)
+	}
+	return nil
+}
+
+// List returns the names of all collections directly below the given prefix
+func (w *webdavStore) List(ctx context.Context, prefix string) ([]string, error) {
+	resp, err := w.do(ctx, "PROPFIND", prefix, strings.NewReader(
+		`<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><resourcetype/></prop></propfind>`),
+		map[string]string{"Depth": "1", "Content-Type": "application/xml"})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, webdavError("PROPFIND", prefix, resp)
+	}
+
+	var result struct {
+		Responses []struct {
+			Href       string    `xml:"href"`
+			Collection *struct{} `xml:"propstat>prop>resourcetype>collection"`
+		} `xml:"response"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("couldn't decode PROPFIND response: %s", err)
+	}
+
+	self := strings.TrimSuffix(w.url(prefix).Path, "/")
+
+	var names []string
+	for _, r := range result.Responses {
+		if r.Collection == nil {
+			continue
+		}
+
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, fmt.Errorf("invalid href %q in PROPFIND response: %s", r.Href, err)
+		}
+
+		p := strings.TrimSuffix(href.Path, "/")
+		if p == self {
+			continue
+		}
+		names = append(names, path.Base(p))
+	}
+
+	return names, nil
+}
+
+// mkcolAll creates the collection with the given key and all its parents
+func (w *webdavStore) mkcolAll(ctx context.Context, key string) error {
+	if key == "." || key == "/" || key == "" {
+		return nil
+	}
+
+	if err := w.mkcolAll(ctx, path.Dir(key)); err != nil {
+		return err
+	}
+
+	resp, err := w.do(ctx, "MKCOL", key+"/", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// 405 is returned if the collection exists already
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+		return webdavError("MKCOL", key, resp)
+	}
+	return nil
+}
+
+func (w *webdavStore) url(key string) *url.URL {
+	u := *w.base
+	u.User = nil
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(key, "/")
+	return &u
+}
+
+func (w *webdavStore) do(ctx context.Context, method, key string, body io.Reader, header map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(method, w.url(key).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	if w.username != "" {
+		req.SetBasicAuth(w.username, w.password)
+	}
+
+	return w.client.Do(req)
+}
+
+func webdavError(method, key string, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("%s %s failed with status %d: %s", method, key, resp.StatusCode, strings.TrimSpace(string(body)))
+}
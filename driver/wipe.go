@@ -0,0 +1,174 @@
+/*
+Copyright 2018 Julian Tölle
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	drivererrors "github.com/apricote/hcloud-csi-driver/driver/errors"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// paramWipeOnDelete is the StorageClass parameter that enables wiping
+	// the volumes before they're deleted
+	paramWipeOnDelete = "wipeOnDelete"
+
+	// labelWipeOnDelete marks the volumes that are wiped before they're
+	// deleted
+	labelWipeOnDelete = "wipeOnDelete"
+)
+
+// validateWipeParams checks the wipe parameter of a StorageClass
+func validateWipeParams(params map[string]string) error {
+	v, ok := params[paramWipeOnDelete]
+	if !ok {
+		return nil
+	}
+	if _, err := strconv.ParseBool(v); err != nil {
+		return status.Errorf(codes.InvalidArgument, "%s must be true or false, got %q", paramWipeOnDelete, v)
+	}
+	return nil
+}
+
+// wipeEnabled returns true if the volumes created with the given parameters
+// are wiped before they're deleted
+func wipeEnabled(params map[string]string) bool {
+	wipe, _ := strconv.ParseBool(params[paramWipeOnDelete])
+	return wipe
+}
+
+// checkWiped returns nil if the volume can be deleted right away. If it must
+// be wiped first, it starts wiping it in the background, unless that's
+// running already, and returns ABORTED. The volume is deleted once it's
+// wiped, so the retried DeleteVolume call finds it deleted.
+func (d *Driver) checkWiped(ctx context.Context, volumeID int) error {
+	vol, _, err := d.volumes.GetByID(ctx, volumeID)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if vol == nil || vol.Labels[labelWipeOnDelete] != "true" {
+		return nil
+	}
+
+	if d.mover == nil {
+		return status.Errorf(codes.FailedPrecondition, "volume %d must be wiped before it's deleted, but no data mover is configured", vol.ID)
+	}
+
+	if err := d.mover.Check(vol); err != nil {
+		return status.Errorf(codes.FailedPrecondition, "volume %d can't be wiped: %s", vol.ID, err)
+	}
+
+	d.wipeMu.Lock()
+	defer d.wipeMu.Unlock()
+
+	if !d.wipeJobs[vol.ID] {
+		d.wipeJobs[vol.ID] = true
+		go d.wipe(vol)
+	}
+
+	return drivererrors.Errorf(drivererrors.ErrInProgress, "volume %d is being wiped", vol.ID)
+}
+
+// wipe overwrites the content of the volume and deletes it
+func (d *Driver) wipe(vol *hcloud.Volume) {
+	defer func() {
+		d.wipeMu.Lock()
+		delete(d.wipeJobs, vol.ID)
+		d.wipeMu.Unlock()
+	}()
+
+	ll := d.log.WithFields(logrus.Fields{
+		"volume_id": vol.ID,
+		"method":    "wipe",
+	})
+
+	ctx := context.Background()
+
+	ll.Info("wiping volume")
+	if err := d.mover.Wipe(ctx, vol); err != nil {
+		// retried with the next DeleteVolume call
+		ll.WithError(err).Error("wiping volume failed")
+		return
+	}
+
+	if _, err := d.volumes.Delete(ctx, vol); err != nil {
+		ll.WithError(err).Error("deleting wiped volume failed")
+		return
+	}
+
+	ll.Info("volume wiped and deleted")
+}
+
+// wipeDevice overwrites the content of device with zeros. It's zeroed by the
+// kernel with blkdiscard, which uses the discard or write zeroes support of
+// the device, and with a slow manual pass if that fails.
+func wipeDevice(ctx context.Context, device string, ll *logrus.Entry) error {
+	out, err := exec.CommandContext(ctx, "blkdiscard", "--zeroout", device).CombinedOutput()
+	if err == nil {
+		ll.Info("device zeroed with blkdiscard")
+		return nil
+	}
+
+	ll.WithError(err).WithField("output", strings.TrimSpace(string(out))).
+		Warn("blkdiscard failed, overwriting the device with zeros")
+
+	f, err := os.OpenFile(device, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	buf := make([]byte, MB)
+	var written int64
+	for written < size {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n := int64(len(buf))
+		if size-written < n {
+			n = size - written
+		}
+
+		m, err := f.Write(buf[:n])
+		written += int64(m)
+		if err != nil {
+			return fmt.Errorf("zeroing device %q failed after %d bytes: %s", device, written, err)
+		}
+	}
+
+	ll.WithField("bytes", written).Info("device zeroed")
+	return f.Sync()
+}
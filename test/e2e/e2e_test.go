@@ -0,0 +1,340 @@
+//go:build e2e
+// +build e2e
+
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+
+	"github.com/apricote/hcloud-csi-driver/driver"
+)
+
+const (
+	// e2eLabel marks the servers and SSH keys created by the tests, the
+	// volumes are created with the storage class e2eLabel. Everything with
+	// the label is deleted before and after the tests, so resources leaked
+	// by aborted runs don't pile up.
+	e2eLabel = "hcloud-csi-driver-e2e"
+
+	// mountPath is the path the volume is mounted to on the server
+	mountPath = "/mnt/e2e"
+)
+
+var (
+	client *hcloud.Client
+	server *hcloud.Server
+	// sshKeyFile is the private key to log in to server
+	sshKeyFile string
+)
+
+// TestMain creates a throwaway server. The tests only run if HCLOUD_TOKEN is
+// set, the token must belong to a project without production resources.
+func TestMain(m *testing.M) {
+	token := os.Getenv("HCLOUD_TOKEN")
+	if token == "" {
+		log.Println("HCLOUD_TOKEN isn't set, skipping the e2e tests")
+		os.Exit(0)
+	}
+	client = hcloud.NewClient(hcloud.WithToken(token))
+
+	dir, err := ioutil.TempDir("", "hcloud-csi-e2e")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if err := setup(dir); err != nil {
+		log.Println(err)
+		if err := cleanup(); err != nil {
+			log.Println(err)
+		}
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+
+	// run the tests, don't call any defer yet as it'll fail due `os.Exit()
+	exitStatus := m.Run()
+
+	if err := cleanup(); err != nil {
+		// don't call log.Fatalln() as we exit with `m.Run()`'s exit status
+		log.Println(err)
+	}
+	os.RemoveAll(dir)
+
+	os.Exit(exitStatus)
+}
+
+func TestVolumeLifecycle(t *testing.T) {
+	ctx := context.Background()
+
+	d, err := driver.NewDriver(
+		driver.WithParams(driver.NewDriverParams{
+			Token: os.Getenv("HCLOUD_TOKEN"),
+		}),
+		driver.WithEndpoint("unix://"+filepath.Join(filepath.Dir(sshKeyFile), "csi.sock")),
+		driver.WithHostname(server.Name),
+		driver.WithMode(driver.ModeController),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+
+	t.Log("Creating volume")
+	created, err := d.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               fmt.Sprintf("e2e-%d", time.Now().Unix()),
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 10 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{capability},
+		Parameters:         map[string]string{"storageClass": e2eLabel},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the volume is deleted by cleanup if a step fails
+	volumeID := created.Volume.Id
+
+	t.Log("Attaching volume")
+	_, err = d.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           strconv.Itoa(server.ID),
+		VolumeCapability: capability,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vol := getVolume(t, volumeID)
+	if vol.Server == nil || vol.Server.ID != server.ID {
+		t.Fatalf("volume isn't attached to server %d", server.ID)
+	}
+
+	t.Log("Formatting and mounting volume")
+	device := vol.LinuxDevice
+	run(t, fmt.Sprintf("for i in $(seq 30); do test -b %[1]s && break; sleep 1; done; mkfs.ext4 -F %[1]s", device))
+	run(t, fmt.Sprintf("mkdir -p %[2]s && mount %[1]s %[2]s && echo e2e > %[2]s/data && sync", device, mountPath))
+
+	t.Log("Resizing volume")
+	action, _, err := client.Volume.Resize(ctx, vol, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitAction(t, action)
+	run(t, "resize2fs "+device)
+
+	size := strings.TrimSpace(run(t, "df --output=size -BG "+mountPath+" | tail -1"))
+	if gb, _ := strconv.Atoi(strings.TrimSuffix(size, "G")); gb < 19 {
+		t.Errorf("expected the filesystem to be resized to 20G, got %s", size)
+	}
+	if data := strings.TrimSpace(run(t, "cat "+mountPath+"/data")); data != "e2e" {
+		t.Errorf("expected the data to survive the resize, got %q", data)
+	}
+	run(t, "umount "+mountPath)
+
+	t.Log("Detaching volume")
+	_, err = d.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: volumeID,
+		NodeId:   strconv.Itoa(server.ID),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol := getVolume(t, volumeID); vol.Server != nil {
+		t.Fatal("volume is still attached")
+	}
+
+	t.Log("Deleting volume")
+	_, err = d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, _ := strconv.Atoi(volumeID)
+	vol, _, err = client.Volume.GetByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol != nil {
+		t.Error("volume wasn't deleted")
+	}
+
+	t.Log("Finished!")
+}
+
+// setup removes leaked resources of earlier runs, then creates an SSH key
+// and the server the volumes are attached to
+func setup(dir string) error {
+	if err := cleanup(); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	labels := map[string]string{e2eLabel: "true"}
+
+	sshKeyFile = filepath.Join(dir, "id_ed25519")
+	out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", sshKeyFile).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("could not generate ssh key: %s: %s", err, out)
+	}
+	publicKey, err := ioutil.ReadFile(sshKeyFile + ".pub")
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("csi-e2e-%d", time.Now().Unix())
+	sshKey, _, err := client.SSHKey.Create(ctx, hcloud.SSHKeyCreateOpts{
+		Name:      name,
+		PublicKey: string(publicKey),
+		Labels:    labels,
+	})
+	if err != nil {
+		return fmt.Errorf("could not create ssh key: %s", err)
+	}
+
+	location := os.Getenv("HCLOUD_E2E_LOCATION")
+	if location == "" {
+		location = "fsn1"
+	}
+
+	log.Printf("Creating server %q in %s", name, location)
+	result, _, err := client.Server.Create(ctx, hcloud.ServerCreateOpts{
+		Name:       name,
+		ServerType: &hcloud.ServerType{Name: "cx11"},
+		Image:      &hcloud.Image{Name: "ubuntu-18.04"},
+		SSHKeys:    []*hcloud.SSHKey{sshKey},
+		Location:   &hcloud.Location{Name: location},
+		Labels:     labels,
+	})
+	if err != nil {
+		return fmt.Errorf("could not create server: %s", err)
+	}
+	server = result.Server
+
+	_, errCh := client.Action.WatchProgress(ctx, result.Action)
+	if err := <-errCh; err != nil {
+		return fmt.Errorf("could not create server: %s", err)
+	}
+
+	// the server takes a while to boot after the action finished
+	for i := 0; ; i++ {
+		if _, err := ssh("true"); err == nil {
+			return nil
+		} else if i == 30 {
+			return fmt.Errorf("could not connect to server: %s", err)
+		}
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// cleanup deletes all resources with the e2e label
+func cleanup() error {
+	ctx := context.Background()
+	opts := hcloud.ListOpts{LabelSelector: e2eLabel}
+
+	servers, err := client.Server.AllWithOpts(ctx, hcloud.ServerListOpts{ListOpts: opts})
+	if err != nil {
+		return err
+	}
+	for _, s := range servers {
+		log.Printf("Deleting server %q", s.Name)
+		if _, err := client.Server.Delete(ctx, s); err != nil {
+			return fmt.Errorf("could not delete server %d: %s", s.ID, err)
+		}
+	}
+
+	vols, err := client.Volume.AllWithOpts(ctx, hcloud.VolumeListOpts{
+		ListOpts: hcloud.ListOpts{LabelSelector: "storageClass=" + e2eLabel},
+	})
+	if err != nil {
+		return err
+	}
+	for _, vol := range vols {
+		log.Printf("Deleting volume %q", vol.Name)
+		if vol.Server != nil {
+			action, _, err := client.Volume.Detach(ctx, vol)
+			if err != nil {
+				return fmt.Errorf("could not detach volume %d: %s", vol.ID, err)
+			}
+			if _, errCh := client.Action.WatchProgress(ctx, action); <-errCh != nil {
+				return fmt.Errorf("could not detach volume %d", vol.ID)
+			}
+		}
+		if _, err := client.Volume.Delete(ctx, vol); err != nil {
+			return fmt.Errorf("could not delete volume %d: %s", vol.ID, err)
+		}
+	}
+
+	keys, err := client.SSHKey.AllWithOpts(ctx, hcloud.SSHKeyListOpts{ListOpts: opts})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, err := client.SSHKey.Delete(ctx, key); err != nil {
+			return fmt.Errorf("could not delete ssh key %d: %s", key.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// ssh runs the command on the server and returns its output
+func ssh(command string) (string, error) {
+	out, err := exec.Command("ssh",
+		"-i", sshKeyFile,
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "ConnectTimeout=10",
+		"root@"+server.PublicNet.IPv4.IP.String(),
+		command,
+	).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%q failed: %s: %s", command, err, out)
+	}
+	return string(out), nil
+}
+
+func run(t *testing.T, command string) string {
+	out, err := ssh(command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func getVolume(t *testing.T, volumeID string) *hcloud.Volume {
+	id, _ := strconv.Atoi(volumeID)
+	vol, _, err := client.Volume.GetByID(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol == nil {
+		t.Fatalf("volume %s doesn't exist", volumeID)
+	}
+	return vol
+}
+
+func waitAction(t *testing.T, action *hcloud.Action) {
+	_, errCh := client.Action.WatchProgress(context.Background(), action)
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}